@@ -0,0 +1,375 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	client "go-simple-embedding-database/client"
+	collection "go-simple-embedding-database/collection"
+	database "go-simple-embedding-database/database"
+	embedders "go-simple-embedding-database/embedders"
+	records "go-simple-embedding-database/records"
+	server "go-simple-embedding-database/server"
+	tenant "go-simple-embedding-database/tenant"
+)
+
+func mockEmbed(blob []byte) ([]float64, error) {
+	return []float64{1, 2, 3}, nil
+}
+
+// writeKeys writes a key file with a key for each grant list, returning the
+// keys' secrets by ID
+func writeKeys(t *testing.T, fileName string, grants map[string][]Grant) map[string]string {
+	t.Helper()
+	secrets := make(map[string]string)
+	keyFile := KeyFile{}
+	for id, keyGrants := range grants {
+		secret, key, err := GenerateKey(id, keyGrants)
+		if err != nil {
+			t.Fatalf("Could not generate key: %v", err)
+		}
+		secrets[id] = secret
+		keyFile.Keys = append(keyFile.Keys, key)
+	}
+	err := WriteKeyFile(fileName, keyFile)
+	if err != nil {
+		t.Fatalf("Could not write key file: %v", err)
+	}
+	return secrets
+}
+
+func TestKeys(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "keys.json")
+	secrets := writeKeys(t, fileName, map[string][]Grant{
+		"reader": {{Role: RoleRead, Collections: []string{"*"}}},
+		"writer": {{Role: RoleWrite, Collections: []string{"docs", "notes-*"}}},
+	})
+	data, _ := ReadKeyFile(fileName)
+	encoded, _ := json.Marshal(data)
+	for _, secret := range secrets {
+		if bytes.Contains(encoded, []byte(secret)) {
+			t.Errorf("The key file should only have hashes of keys")
+		}
+	}
+
+	store, err := OpenKeyStore(fileName, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Could not open key store: %v", err)
+	}
+	key, err := store.Authenticate(secrets["writer"])
+	if err != nil || key.Id != "writer" {
+		t.Fatalf("Expected the writer key, got %+v (%v)", key, err)
+	}
+	for _, test := range []struct {
+		role    Role
+		target  string
+		allowed bool
+	}{
+		{RoleWrite, "docs", true},
+		{RoleRead, "docs", true},
+		{RoleAdmin, "docs", false},
+		{RoleWrite, "notes-2024", true},
+		{RoleWrite, "other", false},
+		// a pattern only covers requests about every collection if it's *
+		{RoleRead, "*", false},
+	} {
+		if key.Allows(test.role, test.target) != test.allowed {
+			t.Errorf("Expected Allows(%s, %s) to be %v", test.role, test.target, test.allowed)
+		}
+	}
+	for _, secret := range []string{"", "sedb.writer.wrong", "sedb.nobody.x", "nonsense", secrets["writer"] + "x"} {
+		if _, err := store.Authenticate(secret); err == nil {
+			t.Errorf("Expected %q not to authenticate", secret)
+		}
+	}
+
+	// rewriting the file rotates keys without reopening the store
+	newSecrets := writeKeys(t, fileName, map[string][]Grant{"reader": {{Role: RoleRead, Collections: []string{"*"}}}})
+	time.Sleep(5 * time.Millisecond)
+	if _, err := store.Authenticate(secrets["writer"]); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected the revoked key to stop working, got %v", err)
+	}
+	if _, err := store.Authenticate(secrets["reader"]); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected the rotated key to stop working, got %v", err)
+	}
+	if _, err := store.Authenticate(newSecrets["reader"]); err != nil {
+		t.Errorf("Expected the new key to work, got %v", err)
+	}
+
+	// a broken file leaves the old keys in place
+	err = WriteKeyFile(fileName, KeyFile{Keys: []Key{{Id: "bad id"}}})
+	if err != nil {
+		t.Fatalf("Could not write key file: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := store.Authenticate(newSecrets["reader"]); err != nil {
+		t.Errorf("Expected the last good keys to keep working, got %v", err)
+	}
+	if store.Err() == nil {
+		t.Errorf("Expected the store to report the broken file")
+	}
+
+	secret, expired, _ := GenerateKey("expired", []Grant{{Role: RoleAdmin, Collections: []string{"*"}}})
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	WriteKeyFile(fileName, KeyFile{Keys: []Key{expired}})
+	store.Reload()
+	if _, err := store.Authenticate(secret); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected an expired key not to work, got %v", err)
+	}
+}
+
+// Keys are rotated while requests are being authenticated. A key that's in
+// every version of the file never stops working
+func TestConcurrentRotation(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "keys.json")
+	secret, stable, _ := GenerateKey("stable", []Grant{{Role: RoleRead, Collections: []string{"*"}}})
+	err := WriteKeyFile(fileName, KeyFile{Keys: []Key{stable}})
+	if err != nil {
+		t.Fatalf("Could not write key file: %v", err)
+	}
+	store, err := OpenKeyStore(fileName, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Could not open key store: %v", err)
+	}
+
+	done := make(chan struct{})
+	var wait sync.WaitGroup
+	failures := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				_, err := store.Authenticate(secret)
+				if err != nil {
+					failures <- err
+					return
+				}
+			}
+		}()
+	}
+	var rotated string
+	for i := 0; i < 20; i++ {
+		var key Key
+		rotated, key, _ = GenerateKey("rotated", []Grant{{Role: RoleWrite, Collections: []string{"docs"}}})
+		err := WriteKeyFile(fileName, KeyFile{Keys: []Key{stable, key}})
+		if err != nil {
+			t.Fatalf("Could not write key file: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	wait.Wait()
+	close(failures)
+	for err := range failures {
+		t.Errorf("Expected the stable key to keep working, got %v", err)
+	}
+	store.Reload()
+	if _, err := store.Authenticate(rotated); err != nil {
+		t.Errorf("Expected the last rotated key to work, got %v", err)
+	}
+}
+
+func makeTestDatabase(t *testing.T) *database.SimpleDataBase {
+	t.Helper()
+	embedders.EmbedderRegister["mock-embedder"] = mockEmbed
+	db := database.MakeDatabase()
+	for _, id := range []string{"docs", "private"} {
+		coll, _ := collection.MakeCollection(id, "mock-embedder")
+		db.AddCollection(coll)
+		record, _ := records.MakeRecord("mock-embedder", []byte("blob"), "a")
+		db.AddRecord(id, record)
+	}
+	return db
+}
+
+func TestHandler(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "keys.json")
+	secrets := writeKeys(t, fileName, map[string][]Grant{
+		"reader": {{Role: RoleRead, Collections: []string{"*"}}},
+		"writer": {{Role: RoleWrite, Collections: []string{"docs"}}, {Role: RoleRead, Collections: []string{"*"}}},
+		"admin":  {{Role: RoleAdmin, Collections: []string{"*"}}},
+	})
+	store, err := OpenKeyStore(fileName, 0)
+	if err != nil {
+		t.Fatalf("Could not open key store: %v", err)
+	}
+	audit := &bytes.Buffer{}
+	handler := MakeHandler(server.MakeServer(makeTestDatabase(t)), store, Options{Audit: MakeAuditLog(audit)})
+	for _, test := range []struct {
+		key    string
+		method string
+		target string
+		body   string
+		status int
+		code   string
+	}{
+		{"", "GET", "/collections", "", http.StatusUnauthorized, server.CodeUnauthenticated},
+		{"nonsense", "GET", "/collections", "", http.StatusUnauthorized, server.CodeUnauthenticated},
+		{"reader", "GET", "/collections", "", http.StatusOK, ""},
+		{"reader", "POST", "/collections/docs/query", `{"vector": [1, 2, 3]}`, http.StatusOK, ""},
+		{"reader", "DELETE", "/collections/docs/records/a", "", http.StatusForbidden, server.CodePermissionDenied},
+		{"writer", "PUT", "/collections/private/records/a", `{"id": "a", "embedderId": "mock-embedder", "embedding": [1, 2, 3]}`, http.StatusForbidden, server.CodePermissionDenied},
+		{"writer", "PUT", "/collections/docs/records/a", `{"id": "a", "embedderId": "mock-embedder", "embedding": [1, 2, 3]}`, http.StatusOK, ""},
+		{"writer", "POST", "/collections", `{"id": "notes", "embedderId": "mock-embedder"}`, http.StatusForbidden, server.CodePermissionDenied},
+		{"writer", "DELETE", "/collections/docs", "", http.StatusForbidden, server.CodePermissionDenied},
+		{"admin", "POST", "/collections", `{"id": "notes", "embedderId": "mock-embedder"}`, http.StatusCreated, ""},
+		{"admin", "DELETE", "/collections/docs/records/missing", "", http.StatusNotFound, server.CodeNotFound},
+	} {
+		r := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+		if secret, ok := secrets[test.key]; ok {
+			r.Header.Set("Authorization", "Bearer "+secret)
+		} else if test.key != "" {
+			r.Header.Set("X-API-Key", test.key)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		errorResponse := server.ErrorResponse{}
+		json.Unmarshal(recorder.Body.Bytes(), &errorResponse)
+		if recorder.Code != test.status || (test.code != "" && errorResponse.Error.Code != test.code) {
+			t.Errorf("%s %s %s: expected %d %s, got %d %s", test.key, test.method, test.target, test.status, test.code, recorder.Code, recorder.Body)
+		}
+	}
+
+	// every write is logged, reads aren't
+	expected := []AuditEntry{
+		{KeyId: "reader", Operation: "DELETE /collections/{id}/records/{recordId}", Targets: []string{"docs"}, RecordId: "a", Status: 403},
+		{KeyId: "writer", Operation: "PUT /collections/{id}/records/{recordId}", Targets: []string{"private"}, RecordId: "a", Status: 403},
+		{KeyId: "writer", Operation: "PUT /collections/{id}/records/{recordId}", Targets: []string{"docs"}, RecordId: "a", Status: 200, Allowed: true},
+		{KeyId: "writer", Operation: "POST /collections", Targets: []string{"notes"}, Status: 403},
+		{KeyId: "writer", Operation: "DELETE /collections/{id}", Targets: []string{"docs"}, Status: 403},
+		{KeyId: "admin", Operation: "POST /collections", Targets: []string{"notes"}, Status: 201, Allowed: true},
+		{KeyId: "admin", Operation: "DELETE /collections/{id}/records/{recordId}", Targets: []string{"docs"}, RecordId: "missing", Status: 404, Allowed: true},
+	}
+	entries := make([]AuditEntry, 0)
+	decoder := json.NewDecoder(audit)
+	for decoder.More() {
+		entry := AuditEntry{}
+		err := decoder.Decode(&entry)
+		if err != nil {
+			t.Fatalf("Could not decode audit entry: %v", err)
+		}
+		if entry.Time.IsZero() || entry.RemoteAddr == "" {
+			t.Errorf("Expected the entry to have a time and address, got %+v", entry)
+		}
+		entry.Time, entry.RemoteAddr = time.Time{}, ""
+		entries = append(entries, entry)
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected audit log\n%+v\ngot\n%+v", expected, entries)
+	}
+}
+
+func TestEscapedCollectionIds(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "keys.json")
+	secrets := writeKeys(t, fileName, map[string][]Grant{
+		"scoped": {{Role: RoleAdmin, Collections: []string{"a"}}},
+		"admin":  {{Role: RoleAdmin, Collections: []string{"*"}}},
+	})
+	store, err := OpenKeyStore(fileName, 0)
+	if err != nil {
+		t.Fatalf("Could not open key store: %v", err)
+	}
+	embedders.EmbedderRegister["mock-embedder"] = mockEmbed
+	db := database.MakeDatabase()
+	for _, id := range []string{"a", "a/secret"} {
+		coll, _ := collection.MakeCollection(id, "mock-embedder")
+		db.AddCollection(coll)
+	}
+	handler := MakeHandler(server.MakeServer(db), store, Options{})
+	// the server routes a%2Fsecret as the one collection a/secret, so that's
+	// what the key needs a grant on
+	for _, test := range []struct {
+		key    string
+		method string
+		target string
+		status int
+	}{
+		{"scoped", "GET", "/collections/a/records", http.StatusOK},
+		{"scoped", "GET", "/collections/a%2Fsecret/records", http.StatusForbidden},
+		{"scoped", "GET", "/collections/a%2Fsecret", http.StatusForbidden},
+		{"scoped", "DELETE", "/collections/a%2Fsecret", http.StatusForbidden},
+		{"admin", "GET", "/collections/a%2Fsecret/records", http.StatusOK},
+	} {
+		r := httptest.NewRequest(test.method, test.target, nil)
+		r.Header.Set("Authorization", "Bearer "+secrets[test.key])
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		if recorder.Code != test.status {
+			t.Errorf("%s %s %s: expected %d, got %d %s", test.key, test.method, test.target, test.status, recorder.Code, recorder.Body)
+		}
+	}
+	if _, err := db.GetCollection("a/secret"); err != nil {
+		t.Errorf("Expected a/secret to still be there: %v", err)
+	}
+	request := ClassifyServer(httptest.NewRequest("DELETE", "/collections/a%2Fsecret", nil))
+	if !reflect.DeepEqual(request.Targets, []string{"a/secret"}) {
+		t.Errorf("Expected the target to be a/secret, got %v", request.Targets)
+	}
+}
+
+func TestClassifyTenantServer(t *testing.T) {
+	for _, test := range []struct {
+		method    string
+		target    string
+		role      Role
+		operation string
+		targets   []string
+	}{
+		{"GET", "/tenants", RoleRead, "GET /tenants", []string{"*/*/*"}},
+		{"POST", "/tenants", RoleAdmin, "POST /tenants", []string{"*/*/*"}},
+		{"PUT", "/tenants/acme/quota", RoleAdmin, "PUT /tenants/acme/quota", []string{"*/*/*"}},
+		{"GET", "/tenants/acme/databases", RoleRead, "GET /tenants/{tenant}/databases", []string{"acme/*/*"}},
+		{"POST", "/tenants/acme/databases", RoleAdmin, "POST /tenants/{tenant}/databases", []string{"acme/*/*"}},
+		{"DELETE", "/tenants/acme/databases/prod", RoleAdmin, "DELETE /tenants/{tenant}/databases/{database}", []string{"acme/prod/*"}},
+		{"GET", "/tenants/acme/databases/prod/collections", RoleRead, "GET /tenants/{tenant}/databases/{database}/collections", []string{"acme/prod/*"}},
+		{"POST", "/tenants/acme/databases/prod/collections/docs/records", RoleWrite, "POST /tenants/{tenant}/databases/{database}/collections/{id}/records", []string{"acme/prod/docs"}},
+		{"GET", "/tenants/acme/databases/prod/changes?collection=a&collection=b", RoleRead, "GET /tenants/{tenant}/databases/{database}/changes", []string{"acme/prod/a", "acme/prod/b"}},
+	} {
+		request := ClassifyTenantServer(httptest.NewRequest(test.method, test.target, nil))
+		if request.Role != test.role || request.Operation != test.operation || !reflect.DeepEqual(request.Targets, test.targets) {
+			t.Errorf("%s %s: expected %s %s %v, got %+v", test.method, test.target, test.role, test.operation, test.targets, request)
+		}
+	}
+
+	// a grant on one tenant's databases doesn't reach another tenant's
+	fileName := filepath.Join(t.TempDir(), "keys.json")
+	secrets := writeKeys(t, fileName, map[string][]Grant{"acme": {{Role: RoleAdmin, Collections: []string{"acme/*/*"}}}})
+	store, _ := OpenKeyStore(fileName, 0)
+	registry := tenant.MakeRegistry()
+	defer registry.Close()
+	for _, name := range []string{"acme", "globex"} {
+		t, _ := registry.CreateTenant(name, database.Quota{})
+		t.CreateDatabase("prod")
+	}
+	httpServer := httptest.NewServer(MakeHandler(server.MakeTenantServer(registry), store, Options{Classify: ClassifyTenantServer}))
+	defer httpServer.Close()
+	embedders.EmbedderRegister["mock-embedder"] = mockEmbed
+	coll, _ := collection.MakeCollection("docs", "mock-embedder")
+	acme := client.MakeClient(httpServer.URL+"/tenants/acme/databases/prod", client.Options{APIKey: secrets["acme"]})
+	if err := acme.AddCollection(coll); err != nil {
+		t.Errorf("Expected acme's key to work on acme's database, got %v", err)
+	}
+	globex := client.MakeClient(httpServer.URL+"/tenants/globex/databases/prod", client.Options{APIKey: secrets["acme"]})
+	if err := globex.AddCollection(coll); client.ErrorCode(err) != server.CodePermissionDenied {
+		t.Errorf("Expected acme's key not to work on globex's database, got %v", err)
+	}
+	noKey := client.MakeClient(httpServer.URL+"/tenants/acme/databases/prod", client.Options{})
+	if _, err := noKey.GetCollection("docs"); client.ErrorCode(err) != server.CodeUnauthenticated {
+		t.Errorf("Expected a client without a key to be turned away, got %v", err)
+	}
+}
@@ -0,0 +1,313 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	server "go-simple-embedding-database/server"
+)
+
+// Request is what a request needs permission to do
+type Request struct {
+	Role Role
+	// the route, e.g. DELETE /collections/{id}
+	Operation string
+	// the collections it touches. Requests about more than one collection
+	// have a pattern here, like * for every collection, and need a grant
+	// that covers all of it
+	Targets  []string
+	RecordId string
+}
+
+// Classifier works out what a request needs permission to do
+type Classifier func(r *http.Request) Request
+
+type Options struct {
+	// Defaults to ClassifyServer
+	Classify Classifier
+	// Every write or admin request is logged here, allowed or not. Leave nil
+	// for no audit log
+	Audit *AuditLog
+}
+
+// Handler checks every request's API key before passing it on. Keys are
+// sent as Authorization: Bearer <key> or X-API-Key: <key>. Requests without
+// a valid key get a 401 with server.CodeUnauthenticated, and requests the
+// key isn't allowed to make get a 403 with server.CodePermissionDenied
+type Handler struct {
+	next     http.Handler
+	store    *KeyStore
+	classify Classifier
+	audit    *AuditLog
+}
+
+func MakeHandler(next http.Handler, store *KeyStore, options Options) *Handler {
+	if options.Classify == nil {
+		options.Classify = ClassifyServer
+	}
+	return &Handler{next: next, store: store, classify: options.Classify, audit: options.Audit}
+}
+
+type contextKey struct{}
+
+// KeyId returns the ID of the key a request was made with, for handlers
+// behind a Handler
+func KeyId(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(contextKey{}).(string)
+	return id, ok
+}
+
+func requestKey(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok {
+		return strings.TrimSpace(token)
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	request := handler.classify(r)
+	entry := AuditEntry{Operation: request.Operation, Targets: request.Targets, RecordId: request.RecordId, RemoteAddr: r.RemoteAddr}
+	audited := handler.audit != nil && request.Role >= RoleWrite
+
+	key, err := handler.store.Authenticate(requestKey(r))
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, server.CodeUnauthenticated, err.Error())
+		if audited {
+			entry.Status = http.StatusUnauthorized
+			handler.audit.Record(entry)
+		}
+		return
+	}
+	entry.KeyId = key.Id
+	for _, target := range request.Targets {
+		if !key.Allows(request.Role, target) {
+			writeError(w, http.StatusForbidden, server.CodePermissionDenied, "Key "+key.Id+" does not have "+request.Role.String()+" access to "+target)
+			if audited {
+				entry.Status = http.StatusForbidden
+				handler.audit.Record(entry)
+			}
+			return
+		}
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), contextKey{}, key.Id))
+	if !audited {
+		handler.next.ServeHTTP(w, r)
+		return
+	}
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	handler.next.ServeHTTP(recorder, r)
+	entry.Allowed = true
+	entry.Status = recorder.status
+	handler.audit.Record(entry)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(server.ErrorResponse{Error: server.ErrorBody{Code: code, Message: message}})
+}
+
+// statusRecorder remembers the status a handler sent, for the audit log
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written bool
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if !recorder.written {
+		recorder.status = status
+		recorder.written = true
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	recorder.written = true
+	return recorder.ResponseWriter.Write(data)
+}
+
+// Unwrap lets http.ResponseController get at the real ResponseWriter
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// AuditEntry is a line of the audit log. Allowed is false for requests
+// turned away for their key, with Status 401 or 403
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	KeyId      string    `json:"keyId,omitempty"`
+	Operation  string    `json:"operation"`
+	Targets    []string  `json:"targets"`
+	RecordId   string    `json:"recordId,omitempty"`
+	Status     int       `json:"status"`
+	Allowed    bool      `json:"allowed"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+}
+
+// AuditLog writes entries to a writer as JSON lines
+type AuditLog struct {
+	mutex   *sync.Mutex
+	encoder *json.Encoder
+}
+
+func MakeAuditLog(writer io.Writer) *AuditLog {
+	return &AuditLog{mutex: &sync.Mutex{}, encoder: json.NewEncoder(writer)}
+}
+
+// Record writes an entry, filling in its time if it's not set
+func (audit *AuditLog) Record(entry AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	return audit.encoder.Encode(entry)
+}
+
+// ClassifyServer classifies requests to a server.Server. Reads and queries
+// need read, writing records needs write, and creating or deleting
+// collections (or anything it doesn't know) needs admin. Listing
+// collections, changes without a collection filter and metrics need read
+// on *
+func ClassifyServer(r *http.Request) Request {
+	return classifyDatabase(r, splitPath(r), "")
+}
+
+// ClassifyTenantServer classifies requests to a server.TenantServer.
+// Targets are <tenant>/<database>/<collection>, so grants can be for
+// patterns like acme/prod/* or acme/*/docs. Within a database it works like
+// ClassifyServer. A tenant's own requests (listing or adding databases)
+// need a grant on <tenant>/*/*, deleting a database needs admin on
+// <tenant>/<database>/*, adding or deleting tenants or changing quotas
+// needs admin on everything, and metrics need read on everything
+func ClassifyTenantServer(r *http.Request) Request {
+	parts := splitPath(r)
+	everything := []string{"*/*/*"}
+	switch {
+	case len(parts) >= 5 && parts[0] == "tenants" && parts[2] == "databases":
+		request := classifyDatabase(r, parts[4:], parts[1]+"/"+parts[3]+"/")
+		request.Operation = strings.Replace(request.Operation, " ", " /tenants/{tenant}/databases/{database}", 1)
+		return request
+	case len(parts) == 1 && parts[0] == "tenants" && r.Method == http.MethodGet:
+		return Request{Role: RoleRead, Operation: "GET /tenants", Targets: everything}
+	case len(parts) == 1 && parts[0] == "metrics" && r.Method == http.MethodGet:
+		return Request{Role: RoleRead, Operation: "GET /metrics", Targets: everything}
+	case len(parts) == 2 && parts[0] == "tenants" && r.Method == http.MethodGet:
+		return Request{Role: RoleRead, Operation: "GET /tenants/{tenant}", Targets: []string{parts[1] + "/*/*"}}
+	case len(parts) == 3 && parts[0] == "tenants" && parts[2] == "databases" && r.Method == http.MethodGet:
+		return Request{Role: RoleRead, Operation: "GET /tenants/{tenant}/databases", Targets: []string{parts[1] + "/*/*"}}
+	case len(parts) == 3 && parts[0] == "tenants" && parts[2] == "databases" && r.Method == http.MethodPost:
+		return Request{Role: RoleAdmin, Operation: "POST /tenants/{tenant}/databases", Targets: []string{parts[1] + "/*/*"}}
+	case len(parts) == 4 && parts[0] == "tenants" && parts[2] == "databases" && r.Method == http.MethodDelete:
+		return Request{Role: RoleAdmin, Operation: "DELETE /tenants/{tenant}/databases/{database}", Targets: []string{parts[1] + "/" + parts[3] + "/*"}}
+	}
+	return Request{Role: RoleAdmin, Operation: r.Method + " " + r.URL.EscapedPath(), Targets: everything}
+}
+
+// splitPath splits the request's path into unescaped segments. It splits the
+// escaped path, like http.ServeMux does, so an ID with an escaped / in it
+// (a%2Fb) stays one segment instead of looking like two
+func splitPath(r *http.Request) []string {
+	parts := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	for i, part := range parts {
+		unescaped, err := url.PathUnescape(part)
+		if err == nil {
+			parts[i] = unescaped
+		}
+	}
+	return parts
+}
+
+// classifyDatabase classifies a request to a server.Server's API, given the
+// segments of its path, with prefix in front of every target
+func classifyDatabase(r *http.Request, parts []string, prefix string) Request {
+	everything := prefix + "*"
+	request := Request{Role: RoleAdmin, Operation: r.Method + " /" + strings.Join(parts, "/"), Targets: []string{everything}}
+	if parts[0] == "changes" && len(parts) == 1 && r.Method == http.MethodGet {
+		request.Role, request.Operation = RoleRead, "GET /changes"
+		if collections := r.URL.Query()["collection"]; len(collections) > 0 {
+			request.Targets = make([]string, len(collections))
+			for i, id := range collections {
+				request.Targets[i] = prefix + id
+			}
+		}
+		return request
+	}
+	if parts[0] == "metrics" && len(parts) == 1 && r.Method == http.MethodGet {
+		request.Role, request.Operation = RoleRead, "GET /metrics"
+		return request
+	}
+	if parts[0] != "collections" {
+		return request
+	}
+	switch len(parts) {
+	case 1:
+		request.Operation = r.Method + " /collections"
+		if r.Method == http.MethodGet {
+			request.Role = RoleRead
+		} else if r.Method == http.MethodPost {
+			request.Targets = []string{prefix + newCollectionId(r)}
+		}
+		return request
+	case 2:
+		request.Operation = r.Method + " /collections/{id}"
+		if r.Method == http.MethodGet {
+			request.Role = RoleRead
+		}
+	case 3:
+		request.Operation = r.Method + " /collections/{id}/" + parts[2]
+		if parts[2] == "records" && r.Method == http.MethodGet || parts[2] == "query" && r.Method == http.MethodPost {
+			request.Role = RoleRead
+		} else if parts[2] == "records" && r.Method == http.MethodPost {
+			request.Role = RoleWrite
+		}
+	case 4:
+		request.Operation = r.Method + " /collections/{id}/records/{recordId}"
+		request.RecordId = parts[3]
+		if r.Method == http.MethodGet {
+			request.Role = RoleRead
+		} else if r.Method == http.MethodPut || r.Method == http.MethodDelete {
+			request.Role = RoleWrite
+		}
+	default:
+		return request
+	}
+	request.Targets = []string{prefix + parts[1]}
+	return request
+}
+
+// the most of a request body newCollectionId will read
+const maxCollectionBody = 1 << 20
+
+// newCollectionId reads the ID of the collection a POST /collections is
+// adding, putting the body back for the server to read
+func newCollectionId(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCollectionBody))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil {
+		return ""
+	}
+	coll := struct {
+		Id string `json:"id"`
+	}{}
+	json.Unmarshal(body, &coll)
+	return coll.Id
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,347 @@
+// Package auth puts API-key authentication and per-collection authorization
+// in front of an http.Handler, such as a server.Server, and keeps an audit
+// log of every call that changes something.
+//
+// Keys look like sedb.<id>.<secret>. Only a SHA-256 hash of each key is kept,
+// in a JSON key file (see KeyFile) that's reloaded whenever it changes, so
+// keys can be added, rotated and revoked without a restart. Each key has
+// grants of a role (read, write or admin) on collections matching patterns
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Role is what a key can do. Each role can do everything the roles before
+// it can
+type Role int
+
+const (
+	// query and read records and collections
+	RoleRead Role = iota + 1
+	// add, upsert and delete records
+	RoleWrite
+	// create and delete collections, and anything else
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{RoleRead: "read", RoleWrite: "write", RoleAdmin: "admin"}
+
+func (role Role) String() string {
+	name, ok := roleNames[role]
+	if !ok {
+		return fmt.Sprintf("Role(%d)", int(role))
+	}
+	return name
+}
+
+func ParseRole(name string) (Role, error) {
+	for role, roleName := range roleNames {
+		if roleName == name {
+			return role, nil
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("Unknown role %q (expected read, write or admin)", name))
+}
+
+func (role Role) MarshalText() ([]byte, error) {
+	if _, ok := roleNames[role]; !ok {
+		return nil, errors.New(fmt.Sprintf("Unknown role %d", int(role)))
+	}
+	return []byte(role.String()), nil
+}
+
+func (role *Role) UnmarshalText(text []byte) error {
+	parsed, err := ParseRole(string(text))
+	if err != nil {
+		return err
+	}
+	*role = parsed
+	return nil
+}
+
+// Grant gives a role on every collection matching one of Collections.
+// Patterns are path.Match patterns, and * on its own matches everything
+type Grant struct {
+	Role        Role     `json:"role"`
+	Collections []string `json:"collections"`
+}
+
+// matches reports whether the pattern covers target. Targets are collection
+// IDs, or patterns themselves for requests about more than one collection
+// (see Request), and a * in a target is only covered by a * in the pattern
+func matches(pattern string, target string) bool {
+	if pattern == "*" {
+		return true
+	}
+	patternParts, targetParts := strings.Split(pattern, "/"), strings.Split(target, "/")
+	if len(patternParts) != len(targetParts) {
+		return false
+	}
+	for i, part := range targetParts {
+		if part == "*" {
+			if patternParts[i] != "*" {
+				return false
+			}
+			continue
+		}
+		ok, _ := path.Match(patternParts[i], part)
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Key is a key as it's kept in the key file
+type Key struct {
+	Id        string    `json:"id"`
+	Hash      string    `json:"hash"`
+	Grants    []Grant   `json:"grants"`
+	CreatedAt time.Time `json:"createdAt"`
+	// the key stops working at this time. The zero value means never
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+}
+
+// Allows reports whether the key has role (or better) on target
+func (key Key) Allows(role Role, target string) bool {
+	for _, grant := range key.Grants {
+		if grant.Role < role {
+			continue
+		}
+		for _, pattern := range grant.Collections {
+			if matches(pattern, target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (key Key) expired(now time.Time) bool {
+	return !key.ExpiresAt.IsZero() && !now.Before(key.ExpiresAt)
+}
+
+// KeyFile is the format of the key file
+type KeyFile struct {
+	Keys []Key `json:"keys"`
+}
+
+const keyPrefix = "sedb."
+
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+func checkId(id string) error {
+	if !idPattern.MatchString(id) {
+		return errors.New(fmt.Sprintf("Invalid key ID %q: IDs are 1-64 letters, digits, _ and -", id))
+	}
+	return nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// GenerateKey makes a new random key with the given ID and grants. The
+// returned secret is the only copy of the key itself; the Key only has its
+// hash
+func GenerateKey(id string, grants []Grant) (secret string, key Key, err error) {
+	err = checkId(id)
+	if err != nil {
+		return "", Key{}, err
+	}
+	random := make([]byte, 32)
+	_, err = rand.Read(random)
+	if err != nil {
+		return "", Key{}, err
+	}
+	secret = keyPrefix + id + "." + base64.RawURLEncoding.EncodeToString(random)
+	return secret, Key{Id: id, Hash: hashKey(secret), Grants: grants, CreatedAt: time.Now().UTC()}, nil
+}
+
+// keyId pulls the ID out of a key, so it can be looked up without trying
+// every hash
+func keyId(secret string) (string, bool) {
+	rest, ok := strings.CutPrefix(secret, keyPrefix)
+	if !ok {
+		return "", false
+	}
+	id, _, ok := strings.Cut(rest, ".")
+	return id, ok
+}
+
+func ReadKeyFile(fileName string) (KeyFile, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return KeyFile{}, err
+	}
+	keyFile := KeyFile{}
+	err = json.Unmarshal(data, &keyFile)
+	if err != nil {
+		return KeyFile{}, fmt.Errorf("Could not read key file %s: %w", fileName, err)
+	}
+	seen := make(map[string]bool)
+	for _, key := range keyFile.Keys {
+		err = checkId(key.Id)
+		if err != nil {
+			return KeyFile{}, err
+		}
+		if seen[key.Id] {
+			return KeyFile{}, errors.New(fmt.Sprintf("Key file %s has key %s twice", fileName, key.Id))
+		}
+		seen[key.Id] = true
+	}
+	return keyFile, nil
+}
+
+// WriteKeyFile writes the key file to a temporary file and renames it into
+// place, so a KeyStore never reads half of it
+func WriteKeyFile(fileName string, keyFile KeyFile) error {
+	data, err := json.MarshalIndent(keyFile, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(append(data, '\n'))
+	if err == nil {
+		err = tempFile.Chmod(0600)
+	}
+	closeErr := tempFile.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(tempFile.Name(), fileName)
+}
+
+var (
+	ErrNoKey      = errors.New("No API key was given")
+	ErrInvalidKey = errors.New("The API key is not valid")
+)
+
+// KeyStore checks keys against a key file, reloading it when it changes
+type KeyStore struct {
+	fileName string
+	// how often to check whether the file has changed
+	interval time.Duration
+
+	mutex *sync.Mutex
+	keys  map[string]Key
+	// the file the keys were loaded from
+	info      os.FileInfo
+	lastCheck time.Time
+	// the error from the last reload, if it failed. The keys from before it
+	// are kept
+	reloadErr error
+}
+
+// how often a KeyStore checks its file by default
+const defaultReloadInterval = time.Second
+
+// OpenKeyStore reads the key file. Changes to the file are picked up within
+// interval (a second if it's 0)
+func OpenKeyStore(fileName string, interval time.Duration) (*KeyStore, error) {
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	store := &KeyStore{fileName: fileName, interval: interval, mutex: &sync.Mutex{}}
+	err := store.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Reload reads the key file again. If it can't be read, the keys already
+// loaded stay in use
+func (store *KeyStore) Reload() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.reload()
+}
+
+// reload expects the caller to hold the lock
+func (store *KeyStore) reload() error {
+	store.lastCheck = time.Now()
+	info, err := os.Stat(store.fileName)
+	if err == nil {
+		var keyFile KeyFile
+		keyFile, err = ReadKeyFile(store.fileName)
+		if err == nil {
+			store.keys = make(map[string]Key, len(keyFile.Keys))
+			for _, key := range keyFile.Keys {
+				store.keys[key.Id] = key
+			}
+			store.info = info
+		}
+	}
+	store.reloadErr = err
+	return err
+}
+
+// refresh reloads the file if it's time to check and it has changed.
+// Expects the caller to hold the lock
+func (store *KeyStore) refresh() {
+	if time.Since(store.lastCheck) < store.interval {
+		return
+	}
+	store.lastCheck = time.Now()
+	info, err := os.Stat(store.fileName)
+	if err != nil {
+		store.reloadErr = err
+		return
+	}
+	// WriteKeyFile replaces the file, but it might have been edited in place
+	if !os.SameFile(info, store.info) || !info.ModTime().Equal(store.info.ModTime()) || info.Size() != store.info.Size() {
+		store.reload()
+	}
+}
+
+// Err is the error from the last time the key file was reloaded, or nil if
+// it was reloaded fine
+func (store *KeyStore) Err() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.reloadErr
+}
+
+// Authenticate returns the key secret belongs to, if it's a key in the file
+// that hasn't expired
+func (store *KeyStore) Authenticate(secret string) (Key, error) {
+	if secret == "" {
+		return Key{}, ErrNoKey
+	}
+	store.mutex.Lock()
+	store.refresh()
+	id, ok := keyId(secret)
+	key, found := store.keys[id]
+	store.mutex.Unlock()
+	if !ok || !found || key.expired(time.Now()) {
+		return Key{}, ErrInvalidKey
+	}
+	if subtle.ConstantTimeCompare([]byte(hashKey(secret)), []byte(key.Hash)) != 1 {
+		return Key{}, ErrInvalidKey
+	}
+	return key, nil
+}
@@ -0,0 +1,420 @@
+// Package client talks to a database served by the server package. Client
+// implements database.DataBase, so code written against the interface can
+// switch between an embedded SimpleDataBase and a remote one:
+//
+//	var db database.DataBase = database.MakeDatabase()
+//	var db database.DataBase = client.MakeClient("http://localhost:8080", client.Options{})
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	collection "go-simple-embedding-database/collection"
+	database "go-simple-embedding-database/database"
+	records "go-simple-embedding-database/records"
+	server "go-simple-embedding-database/server"
+	storage "go-simple-embedding-database/storage"
+)
+
+type Options struct {
+	// Used for every request. Leave nil to get a client with its own
+	// connection pool of MaxIdleConns connections
+	HTTPClient   *http.Client
+	MaxIdleConns int
+	// How many times an idempotent call is retried after a network error or a
+	// 502, 503 or 504. The wait before each retry starts at Backoff and
+	// doubles every time
+	Retries int
+	Backoff time.Duration
+	// The deadline for calls made without a context of their own. Negative
+	// means no deadline
+	Timeout time.Duration
+	// Sent with every request, for servers behind an auth.Handler
+	APIKey string
+}
+
+var DefaultOptions = Options{MaxIdleConns: 16, Retries: 2, Backoff: 100 * time.Millisecond, Timeout: 30 * time.Second}
+
+// Error is what the server sent back for a failed request. Code is one of
+// the server.Code constants
+type Error struct {
+	StatusCode int
+	Code       string
+	// names the error the server's error wrapped, if any. See
+	// server.ReasonError
+	Reason  string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+// Is makes errors.Is(err, collection.ErrRecordNotFound) and the like work on
+// errors from the server, as they do on the embedded database's. The target
+// has to be the error e's Reason names
+func (e *Error) Is(target error) bool {
+	return e.Reason != "" && server.ReasonError(e.Reason) == target
+}
+
+// ErrorCode returns the code of an *Error, or an empty string for any other
+// error
+func ErrorCode(err error) string {
+	clientErr := &Error{}
+	if errors.As(err, &clientErr) {
+		return clientErr.Code
+	}
+	return ""
+}
+
+type Client struct {
+	baseURL string
+	http    *http.Client
+	options Options
+}
+
+var _ database.DataBase = (*Client)(nil)
+
+// MakeClient makes a client for the server at baseURL. Zero fields in options
+// are taken from DefaultOptions; set Retries to a negative number to turn
+// retries off
+func MakeClient(baseURL string, options Options) *Client {
+	if options.MaxIdleConns == 0 {
+		options.MaxIdleConns = DefaultOptions.MaxIdleConns
+	}
+	if options.Retries == 0 {
+		options.Retries = DefaultOptions.Retries
+	}
+	if options.Retries < 0 {
+		options.Retries = 0
+	}
+	if options.Backoff == 0 {
+		options.Backoff = DefaultOptions.Backoff
+	}
+	if options.Timeout == 0 {
+		options.Timeout = DefaultOptions.Timeout
+	}
+	httpClient := options.HTTPClient
+	if httpClient == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConns = options.MaxIdleConns
+		transport.MaxIdleConnsPerHost = options.MaxIdleConns
+		httpClient = &http.Client{Transport: transport}
+	}
+	return &Client{baseURL: strings.TrimRight(baseURL, "/"), http: httpClient, options: options}
+}
+
+// Close drops the client's idle connections
+func (client *Client) Close() error {
+	client.http.CloseIdleConnections()
+	return nil
+}
+
+func (client *Client) context() (context.Context, context.CancelFunc) {
+	if client.options.Timeout > 0 {
+		return context.WithTimeout(context.Background(), client.options.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+func collectionPath(collectionId string, rest ...string) string {
+	path := "/collections/" + url.PathEscape(collectionId)
+	for _, part := range rest {
+		path += "/" + url.PathEscape(part)
+	}
+	return path
+}
+
+// call sends a request and decodes the response into out (if it isn't nil).
+// Idempotent calls are retried
+func (client *Client) call(ctx context.Context, method string, path string, query url.Values, idempotent bool, in any, out any) error {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+	target := client.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	return client.retry(ctx, idempotent, func(retried bool) (bool, error) {
+		return client.send(ctx, method, target, body, out)
+	})
+}
+
+// delete sends a DELETE, retried like any idempotent call. If an attempt
+// deleted the thing but its response was lost, the retry finds it gone, so
+// an error that Is gone on a retry counts as success
+func (client *Client) delete(ctx context.Context, path string, gone error) error {
+	target := client.baseURL + path
+	return client.retry(ctx, true, func(retried bool) (bool, error) {
+		retry, err := client.send(ctx, http.MethodDelete, target, nil, nil)
+		if retried && errors.Is(err, gone) {
+			return false, nil
+		}
+		return retry, err
+	})
+}
+
+// retry makes attempts until one succeeds or fails for good. Only
+// idempotent calls get more than one attempt
+func (client *Client) retry(ctx context.Context, idempotent bool, attempt func(retried bool) (bool, error)) error {
+	backoff := client.options.Backoff
+	for n := 0; ; n++ {
+		retry, err := attempt(n > 0)
+		if err == nil || !retry || !idempotent || n >= client.options.Retries {
+			return err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// send makes one attempt at a request and reports whether it's worth trying
+// again
+func (client *Client) send(ctx context.Context, method string, target string, body []byte, out any) (bool, error) {
+	request, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if client.options.APIKey != "" {
+		request.Header.Set("Authorization", "Bearer "+client.options.APIKey)
+	}
+	response, err := client.http.Do(request)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, err
+		}
+		netErr := net.Error(nil)
+		return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF), err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		// the body is read in full so the connection goes back in the pool
+		data, _ := io.ReadAll(response.Body)
+		errorResponse := server.ErrorResponse{}
+		err = json.Unmarshal(data, &errorResponse)
+		if err != nil || errorResponse.Error.Code == "" {
+			errorResponse.Error = server.ErrorBody{Code: server.CodeInternal, Message: strings.TrimSpace(fmt.Sprintf("%s: %s", response.Status, data))}
+		}
+		retry := response.StatusCode == http.StatusBadGateway || response.StatusCode == http.StatusServiceUnavailable || response.StatusCode == http.StatusGatewayTimeout
+		return retry, &Error{StatusCode: response.StatusCode, Code: errorResponse.Error.Code, Reason: errorResponse.Error.Reason, Message: errorResponse.Error.Message}
+	}
+	if out == nil {
+		io.Copy(io.Discard, response.Body)
+		return false, nil
+	}
+	err = json.NewDecoder(response.Body).Decode(out)
+	if err != nil {
+		return false, fmt.Errorf("Could not decode response from %s: %w", target, err)
+	}
+	io.Copy(io.Discard, response.Body)
+	return false, nil
+}
+
+// ListCollections returns every collection's info in ID order
+func (client *Client) ListCollections() ([]storage.CollectionInfo, error) {
+	ctx, cancel := client.context()
+	defer cancel()
+	return client.ListCollectionsContext(ctx)
+}
+
+func (client *Client) ListCollectionsContext(ctx context.Context) ([]storage.CollectionInfo, error) {
+	infos := make([]storage.CollectionInfo, 0)
+	err := client.call(ctx, http.MethodGet, "/collections", nil, true, nil, &infos)
+	return infos, err
+}
+
+// AddCollection sends the collection along with any records it has
+func (client *Client) AddCollection(coll *collection.Collection) error {
+	ctx, cancel := client.context()
+	defer cancel()
+	return client.AddCollectionContext(ctx, coll)
+}
+
+func (client *Client) AddCollectionContext(ctx context.Context, coll *collection.Collection) error {
+	if coll.Store != nil {
+		return errors.New(fmt.Sprintf("Cannot send collection %s: its records are in a store", coll.Id))
+	}
+	return client.call(ctx, http.MethodPost, "/collections", nil, false, coll, nil)
+}
+
+func (client *Client) DeleteCollection(collectionId string) error {
+	ctx, cancel := client.context()
+	defer cancel()
+	return client.DeleteCollectionContext(ctx, collectionId)
+}
+
+func (client *Client) DeleteCollectionContext(ctx context.Context, collectionId string) error {
+	return client.delete(ctx, collectionPath(collectionId), collection.ErrCollectionNotFound)
+}
+
+// GetCollection returns the collection without its records (Records is
+// empty). Use ListRecords to read them
+func (client *Client) GetCollection(collectionId string) (*collection.Collection, error) {
+	ctx, cancel := client.context()
+	defer cancel()
+	return client.GetCollectionContext(ctx, collectionId)
+}
+
+func (client *Client) GetCollectionContext(ctx context.Context, collectionId string) (*collection.Collection, error) {
+	info := storage.CollectionInfo{}
+	err := client.call(ctx, http.MethodGet, collectionPath(collectionId), nil, true, nil, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &collection.Collection{Id: info.Id, EmbedderId: info.EmbedderId, TTL: info.TTL, Records: make(map[string]records.Record)}, nil
+}
+
+// AddRecord and UpsertRecord update record with the times the server gave
+// it, the same as the embedded database does
+func (client *Client) AddRecord(collectionId string, record *records.Record) error {
+	ctx, cancel := client.context()
+	defer cancel()
+	return client.AddRecordContext(ctx, collectionId, record)
+}
+
+func (client *Client) AddRecordContext(ctx context.Context, collectionId string, record *records.Record) error {
+	stored := records.Record{}
+	err := client.call(ctx, http.MethodPost, collectionPath(collectionId, "records"), nil, false, record, &stored)
+	if err != nil {
+		return err
+	}
+	setTimes(record, stored)
+	return nil
+}
+
+func (client *Client) UpsertRecord(collectionId string, record *records.Record) error {
+	ctx, cancel := client.context()
+	defer cancel()
+	return client.UpsertRecordContext(ctx, collectionId, record)
+}
+
+func (client *Client) UpsertRecordContext(ctx context.Context, collectionId string, record *records.Record) error {
+	stored := records.Record{}
+	err := client.call(ctx, http.MethodPut, collectionPath(collectionId, "records", record.Id), nil, true, record, &stored)
+	if err != nil {
+		return err
+	}
+	setTimes(record, stored)
+	return nil
+}
+
+func setTimes(record *records.Record, stored records.Record) {
+	record.CreatedAt = stored.CreatedAt
+	record.UpdatedAt = stored.UpdatedAt
+	record.ExpiresAt = stored.ExpiresAt
+}
+
+func (client *Client) GetRecord(collectionId string, recordId string) (*records.Record, error) {
+	ctx, cancel := client.context()
+	defer cancel()
+	return client.GetRecordContext(ctx, collectionId, recordId)
+}
+
+func (client *Client) GetRecordContext(ctx context.Context, collectionId string, recordId string) (*records.Record, error) {
+	record := records.Record{}
+	err := client.call(ctx, http.MethodGet, collectionPath(collectionId, "records", recordId), nil, true, nil, &record)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (client *Client) DeleteRecord(collectionId string, recordId string) error {
+	ctx, cancel := client.context()
+	defer cancel()
+	return client.DeleteRecordContext(ctx, collectionId, recordId)
+}
+
+func (client *Client) DeleteRecordContext(ctx context.Context, collectionId string, recordId string) error {
+	return client.delete(ctx, collectionPath(collectionId, "records", recordId), collection.ErrRecordNotFound)
+}
+
+func (client *Client) ListRecords(collectionId string, options collection.ListOptions) (collection.RecordPage, error) {
+	ctx, cancel := client.context()
+	defer cancel()
+	return client.ListRecordsContext(ctx, collectionId, options)
+}
+
+func (client *Client) ListRecordsContext(ctx context.Context, collectionId string, options collection.ListOptions) (collection.RecordPage, error) {
+	page := collection.RecordPage{}
+	err := client.call(ctx, http.MethodGet, collectionPath(collectionId, "records"), server.ListQuery(options), true, nil, &page)
+	return page, err
+}
+
+func (client *Client) Query(collectionId string, query []byte, n_greatest int) (*[]records.Record, error) {
+	ctx, cancel := client.context()
+	defer cancel()
+	return client.QueryContext(ctx, collectionId, query, n_greatest)
+}
+
+func (client *Client) QueryContext(ctx context.Context, collectionId string, query []byte, n_greatest int) (*[]records.Record, error) {
+	results, err := client.QueryWithOptionsContext(ctx, collectionId, query, collection.QueryOptions{NGreatest: n_greatest})
+	if err != nil {
+		return nil, err
+	}
+	mostSimilarRecords := make([]records.Record, len(results))
+	for i, result := range results {
+		mostSimilarRecords[i] = result.Record
+	}
+	return &mostSimilarRecords, nil
+}
+
+// QueryWithOptions has the server embed the query with the collection's
+// embedder
+func (client *Client) QueryWithOptions(collectionId string, query []byte, options collection.QueryOptions) ([]collection.QueryResult, error) {
+	ctx, cancel := client.context()
+	defer cancel()
+	return client.QueryWithOptionsContext(ctx, collectionId, query, options)
+}
+
+func (client *Client) QueryWithOptionsContext(ctx context.Context, collectionId string, query []byte, options collection.QueryOptions) ([]collection.QueryResult, error) {
+	return client.query(ctx, collectionId, server.MakeQueryRequest(query, options))
+}
+
+func (client *Client) QueryVector(collectionId string, queryEmbedding []float64, options collection.QueryOptions) ([]collection.QueryResult, error) {
+	ctx, cancel := client.context()
+	defer cancel()
+	return client.QueryVectorContext(ctx, collectionId, queryEmbedding, options)
+}
+
+func (client *Client) QueryVectorContext(ctx context.Context, collectionId string, queryEmbedding []float64, options collection.QueryOptions) ([]collection.QueryResult, error) {
+	request := server.MakeQueryRequest(nil, options)
+	request.Vector = queryEmbedding
+	return client.query(ctx, collectionId, request)
+}
+
+// queries don't change anything, so they're retried even though they're
+// POSTs
+func (client *Client) query(ctx context.Context, collectionId string, request server.QueryRequest) ([]collection.QueryResult, error) {
+	results := make([]collection.QueryResult, 0)
+	err := client.call(ctx, http.MethodPost, collectionPath(collectionId, "query"), nil, true, request, &results)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,332 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	collection "go-simple-embedding-database/collection"
+	database "go-simple-embedding-database/database"
+	embedders "go-simple-embedding-database/embedders"
+	records "go-simple-embedding-database/records"
+	server "go-simple-embedding-database/server"
+)
+
+func mockEmbed(blob []byte) ([]float64, error) {
+	return []float64{float64(bytes.Count(blob, []byte("a"))), float64(bytes.Count(blob, []byte("b"))), 1}, nil
+}
+
+func makeTestClient(t *testing.T) (*Client, *database.SimpleDataBase) {
+	t.Helper()
+	embedders.EmbedderRegister["mock-embedder"] = mockEmbed
+	db := database.MakeDatabase()
+	httpServer := httptest.NewServer(server.MakeServer(db))
+	t.Cleanup(httpServer.Close)
+	client := MakeClient(httpServer.URL, Options{})
+	t.Cleanup(func() { client.Close() })
+	return client, db
+}
+
+// exercise runs the same calls against any DataBase and returns what came
+// back, so the embedded and remote databases can be compared
+func exercise(t *testing.T, db database.DataBase) []any {
+	t.Helper()
+	results := make([]any, 0)
+	coll, _ := collection.MakeCollection("docs", "mock-embedder")
+	err := db.AddCollection(coll)
+	if err != nil {
+		t.Fatalf("Could not add collection: %v", err)
+	}
+	for _, blob := range []string{"aaa", "bbb", "ab", "aab"} {
+		record, _ := records.MakeRecord("mock-embedder", []byte(blob), blob)
+		record.Metadata = map[string]string{"first": blob[:1]}
+		err = db.AddRecord("docs", record)
+		if err != nil {
+			t.Fatalf("Could not add record: %v", err)
+		}
+		if record.CreatedAt.IsZero() {
+			t.Errorf("Expected AddRecord to set CreatedAt")
+		}
+	}
+	upserted, _ := records.MakeRecord("mock-embedder", []byte("bba"), "ab")
+	err = db.UpsertRecord("docs", upserted)
+	if err != nil {
+		t.Fatalf("Could not upsert record: %v", err)
+	}
+	err = db.DeleteRecord("docs", "bbb")
+	if err != nil {
+		t.Fatalf("Could not delete record: %v", err)
+	}
+
+	record, err := db.GetRecord("docs", "aab")
+	if err != nil {
+		t.Fatalf("Could not get record: %v", err)
+	}
+	results = append(results, record.Id, record.Blob, record.Embedding, record.Metadata)
+	mostSimilar, err := db.Query("docs", []byte("aaaa"), 2)
+	if err != nil {
+		t.Fatalf("Could not query: %v", err)
+	}
+	for _, record := range *mostSimilar {
+		results = append(results, record.Id)
+	}
+	// 0 is no limit and negative is an error, embedded or not
+	everything, err := db.Query("docs", []byte("aaaa"), 0)
+	if err != nil {
+		t.Fatalf("Could not query: %v", err)
+	}
+	results = append(results, len(*everything))
+	_, err = db.Query("docs", []byte("aaaa"), -1)
+	results = append(results, errors.Is(err, collection.ErrInvalidOptions))
+	minSimilarity := 0.5
+	scored, err := db.QueryWithOptions("docs", []byte("b"), collection.QueryOptions{NGreatest: 3, MinSimilarity: &minSimilarity, Where: map[string]string{"first": "a"}})
+	if err != nil {
+		t.Fatalf("Could not query: %v", err)
+	}
+	for _, result := range scored {
+		results = append(results, result.Record.Id, result.Similarity)
+	}
+	page, err := db.ListRecords("docs", collection.ListOptions{Limit: 2, ExcludeEmbeddings: true})
+	if err != nil {
+		t.Fatalf("Could not list records: %v", err)
+	}
+	for _, record := range page.Records {
+		results = append(results, record.Id, record.Embedding)
+	}
+	page, err = db.ListRecords("docs", collection.ListOptions{Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatalf("Could not list records: %v", err)
+	}
+	for _, record := range page.Records {
+		results = append(results, record.Id)
+	}
+	got, err := db.GetCollection("docs")
+	if err != nil {
+		t.Fatalf("Could not get collection: %v", err)
+	}
+	results = append(results, got.Id, got.EmbedderId)
+
+	err = db.DeleteCollection("docs")
+	if err != nil {
+		t.Fatalf("Could not delete collection: %v", err)
+	}
+	_, err = db.GetCollection("docs")
+	results = append(results, err != nil)
+	return results
+}
+
+func TestClientMatchesEmbedded(t *testing.T) {
+	client, _ := makeTestClient(t)
+	embedders.EmbedderRegister["mock-embedder"] = mockEmbed
+	expected := exercise(t, database.MakeDatabase())
+	got := exercise(t, client)
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("Not equal (expected %v, got %v)", expected, got)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	client, _ := makeTestClient(t)
+	_, err := client.GetRecord("missing", "a")
+	if ErrorCode(err) != server.CodeNotFound {
+		t.Errorf("Expected a not_found error, got %v", err)
+	}
+	clientErr := &Error{}
+	if !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected an *Error with status 404, got %#v", err)
+	}
+	if !errors.Is(err, collection.ErrCollectionNotFound) || errors.Is(err, collection.ErrRecordNotFound) {
+		t.Errorf("Expected the error to be collection.ErrCollectionNotFound and only that, got %v", err)
+	}
+	coll, _ := collection.MakeCollection("docs", "mock-embedder")
+	client.AddCollection(coll)
+	_, err = client.GetRecord("docs", "a")
+	if !errors.Is(err, collection.ErrRecordNotFound) || errors.Is(err, collection.ErrCollectionNotFound) {
+		t.Errorf("Expected the error to be collection.ErrRecordNotFound and only that, got %v", err)
+	}
+	err = client.AddCollection(coll)
+	if ErrorCode(err) != server.CodeAlreadyExists || !errors.Is(err, collection.ErrCollectionExists) {
+		t.Errorf("Expected an already_exists error, got %v", err)
+	}
+	record := &records.Record{Id: "a", EmbedderId: "other-embedder", Embedding: []float64{1}}
+	err = client.AddRecord("docs", record)
+	if ErrorCode(err) != server.CodeInvalidArgument || !errors.Is(err, collection.ErrEmbedderMismatch) {
+		t.Errorf("Expected an invalid_argument error, got %v", err)
+	}
+	if errors.Is(err, collection.ErrCollectionExists) || errors.Is(err, database.ErrReadOnly) {
+		t.Errorf("Expected the error not to match other codes' errors, got %v", err)
+	}
+	// only the reason counts, not what the message says
+	err = &Error{Code: server.CodeNotFound, Reason: "record_not_found", Message: "Collection does not exist: a"}
+	if !errors.Is(err, collection.ErrRecordNotFound) || errors.Is(err, collection.ErrCollectionNotFound) {
+		t.Errorf("Expected the error to be matched by its reason, got %v", err)
+	}
+}
+
+// flaky fails the first failures requests with a 503, then hands the rest to
+// handler. The first lost requests are handled, but their responses are
+// swapped for a 503, as if they'd been lost on the way back
+type flaky struct {
+	failures atomic.Int32
+	lost     atomic.Int32
+	requests atomic.Int32
+	handler  http.Handler
+}
+
+func (f *flaky) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests.Add(1)
+	if f.failures.Add(-1) >= 0 {
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	if f.lost.Add(-1) >= 0 {
+		f.handler.ServeHTTP(httptest.NewRecorder(), r)
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	f.handler.ServeHTTP(w, r)
+}
+
+func TestClientRetries(t *testing.T) {
+	embedders.EmbedderRegister["mock-embedder"] = mockEmbed
+	db := database.MakeDatabase()
+	handler := &flaky{handler: server.MakeServer(db)}
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+	client := MakeClient(httpServer.URL, Options{Retries: 2, Backoff: time.Millisecond})
+
+	// adding isn't idempotent, so it isn't retried
+	handler.failures.Store(1)
+	coll, _ := collection.MakeCollection("docs", "mock-embedder")
+	err := client.AddCollection(coll)
+	if ErrorCode(err) != server.CodeInternal || handler.requests.Load() != 1 {
+		t.Errorf("Expected one failed request, got %d (%v)", handler.requests.Load(), err)
+	}
+	client.AddCollection(coll)
+
+	handler.requests.Store(0)
+	handler.failures.Store(2)
+	_, err = client.ListCollections()
+	if err != nil || handler.requests.Load() != 3 {
+		t.Errorf("Expected to succeed on the third try, got %d requests (%v)", handler.requests.Load(), err)
+	}
+
+	handler.requests.Store(0)
+	handler.failures.Store(3)
+	_, err = client.QueryVector("docs", []float64{1, 0, 1}, collection.QueryOptions{})
+	if err == nil || handler.requests.Load() != 3 {
+		t.Errorf("Expected to give up after 3 tries, got %d requests (%v)", handler.requests.Load(), err)
+	}
+
+	// a retried delete that finds the record gone was done by the first try
+	record, _ := records.MakeRecord("mock-embedder", []byte("a"), "a")
+	client.AddRecord("docs", record)
+	handler.requests.Store(0)
+	handler.lost.Store(1)
+	err = client.DeleteRecord("docs", "a")
+	if err != nil || handler.requests.Load() != 2 {
+		t.Errorf("Expected the retried delete to succeed, got %d requests (%v)", handler.requests.Load(), err)
+	}
+	handler.lost.Store(1)
+	err = client.DeleteCollection("docs")
+	if err != nil {
+		t.Errorf("Expected the retried collection delete to succeed, got %v", err)
+	}
+	// but not when it's something else that's missing, or nothing was retried
+	handler.failures.Store(1)
+	err = client.DeleteRecord("docs", "a")
+	if !errors.Is(err, collection.ErrCollectionNotFound) {
+		t.Errorf("Expected a retried delete from a missing collection to fail, got %v", err)
+	}
+	err = client.DeleteCollection("docs")
+	if !errors.Is(err, collection.ErrCollectionNotFound) {
+		t.Errorf("Expected deleting a missing collection to fail, got %v", err)
+	}
+}
+
+func TestClientDeadline(t *testing.T) {
+	release := make(chan struct{})
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer httpServer.Close()
+	defer close(release)
+	client := MakeClient(httpServer.URL, Options{Retries: -1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.GetRecordContext(ctx, "docs", "a")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to be exceeded, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("Expected the call to give up at the deadline, took %v", time.Since(start))
+	}
+
+	client = MakeClient(httpServer.URL, Options{Timeout: 20 * time.Millisecond})
+	_, err = client.ListCollections()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the client timeout to apply, got %v", err)
+	}
+}
+
+// One client shares its connection pool between goroutines
+func TestConcurrentCalls(t *testing.T) {
+	client, db := makeTestClient(t)
+	coll, _ := collection.MakeCollection("docs", "mock-embedder")
+	err := client.AddCollection(coll)
+	if err != nil {
+		t.Fatalf("Could not add collection: %v", err)
+	}
+
+	var wait sync.WaitGroup
+	errs := make(chan error, 8)
+	for writer := 0; writer < 4; writer++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for i := 0; i < 20; i++ {
+				record, _ := records.MakeRecord("mock-embedder", []byte(fmt.Sprintf("ab %d %d", writer, i)), fmt.Sprintf("record-%d-%d", writer, i))
+				err := client.UpsertRecord("docs", record)
+				if err == nil && i%2 == 1 {
+					err = client.DeleteRecord("docs", record.Id)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	for reader := 0; reader < 4; reader++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for i := 0; i < 20; i++ {
+				_, err := client.QueryWithOptions("docs", []byte("aab"), collection.QueryOptions{NGreatest: 3})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wait.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Concurrent call failed: %v", err)
+	}
+	count, err := db.Count("docs")
+	if err != nil || count != 40 {
+		t.Errorf("Expected 40 records after the concurrent writes, got %d (%v)", count, err)
+	}
+}
@@ -0,0 +1,1093 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	auth "go-simple-embedding-database/auth"
+	collection "go-simple-embedding-database/collection"
+	database "go-simple-embedding-database/database"
+	mcp "go-simple-embedding-database/mcp"
+	metrics "go-simple-embedding-database/metrics"
+	records "go-simple-embedding-database/records"
+	replication "go-simple-embedding-database/replication"
+	resp "go-simple-embedding-database/resp"
+	server "go-simple-embedding-database/server"
+	shell "go-simple-embedding-database/shell"
+	tenant "go-simple-embedding-database/tenant"
+
+	"golang.org/x/term"
+)
+
+// keyValues collects repeated -flag k=v arguments
+type keyValues map[string]string
+
+func (kv keyValues) String() string {
+	pairs := make([]string, 0, len(kv))
+	for key, value := range kv {
+		pairs = append(pairs, key+"="+value)
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (kv keyValues) Set(pair string) error {
+	key, value, ok := strings.Cut(pair, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected key=value, got %q", pair)
+	}
+	kv[key] = value
+	return nil
+}
+
+func parseVector(text string) ([]float64, error) {
+	fields := strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == ' ' || r == '[' || r == ']' })
+	vector := make([]float64, 0, len(fields))
+	for _, field := range fields {
+		value, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse vector %q: %w", text, err)
+		}
+		vector = append(vector, value)
+	}
+	if len(vector) == 0 {
+		return nil, fmt.Errorf("vector %q is empty", text)
+	}
+	return vector, nil
+}
+
+func isSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func checkFormat(format string) error {
+	if format != "table" && format != "json" {
+		return usageError("unknown format %q (expected table or json)", format)
+	}
+	return nil
+}
+
+func (c cli) writeJSON(value any) error {
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func (c cli) table() *tabwriter.Writer {
+	return tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+}
+
+// truncate keeps table rows on one line
+func truncate(blob []byte, length int) string {
+	text := strings.Join(strings.Fields(string(blob)), " ")
+	if len(text) > length {
+		return text[:length] + "..."
+	}
+	return text
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (c cli) collections(args []string) error {
+	if len(args) == 0 {
+		return usageError("collections needs a subcommand (list, create, delete)")
+	}
+	switch args[0] {
+	case "list":
+		flags := newFlagSet("collections list", c.stderr)
+		format := flags.String("format", "table", "output format (table or json)")
+		if err := parseFlags(flags, args[1:]); err != nil {
+			return err
+		}
+		if err := checkFormat(*format); err != nil {
+			return err
+		}
+		db, err := c.loadDatabase()
+		if err != nil {
+			return err
+		}
+		ids := sortedCollectionIds(db)
+		if *format == "json" {
+			return c.writeJSON(ids)
+		}
+		for _, id := range ids {
+			fmt.Fprintln(c.stdout, id)
+		}
+		return nil
+
+	case "create":
+		flags := newFlagSet("collections create", c.stderr)
+		ttl := flags.Duration("ttl", 0, "expire records this long after they're added")
+		if err := parseFlags(flags, args[1:]); err != nil {
+			return err
+		}
+		if err := expectArgs(flags, 2, 2); err != nil {
+			return err
+		}
+		db, err := c.loadDatabase()
+		if err != nil {
+			return err
+		}
+		coll, err := collection.MakeCollection(flags.Arg(0), flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		coll.TTL = *ttl
+		err = db.AddCollection(coll)
+		if err != nil {
+			return err
+		}
+		return c.saveDatabase(db)
+
+	case "delete":
+		flags := newFlagSet("collections delete", c.stderr)
+		if err := parseFlags(flags, args[1:]); err != nil {
+			return err
+		}
+		if err := expectArgs(flags, 1, 1); err != nil {
+			return err
+		}
+		db, err := c.loadDatabase()
+		if err != nil {
+			return err
+		}
+		err = db.DeleteCollection(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		return c.saveDatabase(db)
+
+	default:
+		return usageError("unknown collections subcommand %q", args[0])
+	}
+}
+
+func sortedCollectionIds(db *database.SimpleDataBase) []string {
+	ids := make([]string, 0)
+	for id := range db.GetCollections() {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func (c cli) records(args []string) error {
+	if len(args) == 0 {
+		return usageError("records needs a subcommand (add, get, delete, list)")
+	}
+	switch args[0] {
+	case "add":
+		return c.addRecord(args[1:])
+	case "get":
+		return c.getRecord(args[1:])
+	case "delete":
+		return c.deleteRecord(args[1:])
+	case "list":
+		return c.listRecords(args[1:])
+	default:
+		return usageError("unknown records subcommand %q", args[0])
+	}
+}
+
+func (c cli) addRecord(args []string) error {
+	flags := newFlagSet("records add", c.stderr)
+	id := flags.String("id", "", "record ID (defaults to the file name, required when reading stdin)")
+	file := flags.String("file", "", "read the blob from this file instead of stdin")
+	vector := flags.String("vector", "", "use this embedding instead of running the collection's embedder")
+	metadata := keyValues{}
+	flags.Var(metadata, "metadata", "metadata key=value (repeatable)")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 1); err != nil {
+		return err
+	}
+	collectionId := flags.Arg(0)
+
+	recordId := *id
+	var blob []byte
+	var err error
+	if *file != "" {
+		blob, err = os.ReadFile(*file)
+		if recordId == "" {
+			recordId = *file
+		}
+	} else {
+		blob, err = io.ReadAll(c.stdin)
+	}
+	if err != nil {
+		return err
+	}
+	if recordId == "" {
+		return usageError("records add needs -id when reading from stdin")
+	}
+
+	db, err := c.loadDatabase()
+	if err != nil {
+		return err
+	}
+	coll, err := db.GetCollection(collectionId)
+	if err != nil {
+		return err
+	}
+	var record *records.Record
+	if *vector != "" {
+		embedding, err := parseVector(*vector)
+		if err != nil {
+			return err
+		}
+		record = &records.Record{Embedding: embedding, EmbedderId: coll.EmbedderId, Blob: blob, Id: recordId}
+	} else {
+		record, err = records.MakeRecord(coll.EmbedderId, blob, recordId)
+		if err != nil {
+			return err
+		}
+	}
+	if len(metadata) > 0 {
+		record.Metadata = metadata
+	}
+	err = db.AddRecord(collectionId, record)
+	if err != nil {
+		return err
+	}
+	return c.saveDatabase(db)
+}
+
+func (c cli) getRecord(args []string) error {
+	flags := newFlagSet("records get", c.stderr)
+	format := flags.String("format", "table", "output format (table or json)")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 2, 2); err != nil {
+		return err
+	}
+	if err := checkFormat(*format); err != nil {
+		return err
+	}
+	db, err := c.loadDatabase()
+	if err != nil {
+		return err
+	}
+	record, err := db.GetRecord(flags.Arg(0), flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		return c.writeJSON(record)
+	}
+	table := c.table()
+	fmt.Fprintf(table, "id\t%s\n", record.Id)
+	fmt.Fprintf(table, "embedder\t%s\n", record.EmbedderId)
+	fmt.Fprintf(table, "dimensions\t%d\n", len(record.Embedding))
+	fmt.Fprintf(table, "created\t%s\n", formatTime(record.CreatedAt))
+	fmt.Fprintf(table, "updated\t%s\n", formatTime(record.UpdatedAt))
+	fmt.Fprintf(table, "expires\t%s\n", formatTime(record.ExpiresAt))
+	fmt.Fprintf(table, "metadata\t%s\n", keyValues(record.Metadata))
+	table.Flush()
+	fmt.Fprintf(c.stdout, "\n%s\n", string(record.Blob))
+	return nil
+}
+
+func (c cli) deleteRecord(args []string) error {
+	flags := newFlagSet("records delete", c.stderr)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 2, 2); err != nil {
+		return err
+	}
+	db, err := c.loadDatabase()
+	if err != nil {
+		return err
+	}
+	err = db.DeleteRecord(flags.Arg(0), flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	return c.saveDatabase(db)
+}
+
+func (c cli) listRecords(args []string) error {
+	flags := newFlagSet("records list", c.stderr)
+	limit := flags.Int("limit", 20, "records per page (0 for all)")
+	cursor := flags.String("cursor", "", "cursor from a previous page")
+	order := flags.String("order", "id", "order by id or insertion")
+	format := flags.String("format", "table", "output format (table or json)")
+	where := keyValues{}
+	flags.Var(where, "where", "only list records with metadata key=value (repeatable)")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 1); err != nil {
+		return err
+	}
+	if err := checkFormat(*format); err != nil {
+		return err
+	}
+	orderBy, err := collection.ParseListOrder(*order)
+	if err != nil {
+		return usageError("unknown order %q (expected id or insertion)", *order)
+	}
+	options := collection.ListOptions{OrderBy: orderBy, Cursor: *cursor, Limit: *limit, Where: where, ExcludeEmbeddings: true}
+
+	db, err := c.loadDatabase()
+	if err != nil {
+		return err
+	}
+	page, err := db.ListRecords(flags.Arg(0), options)
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		return c.writeJSON(page)
+	}
+	table := c.table()
+	fmt.Fprintln(table, "ID\tCREATED\tBLOB")
+	for _, record := range page.Records {
+		fmt.Fprintf(table, "%s\t%s\t%s\n", record.Id, formatTime(record.CreatedAt), truncate(record.Blob, 60))
+	}
+	table.Flush()
+	if page.NextCursor != "" {
+		fmt.Fprintf(c.stdout, "\nnext page: -cursor %s\n", page.NextCursor)
+	}
+	return nil
+}
+
+func (c cli) query(args []string) error {
+	flags := newFlagSet("query", c.stderr)
+	k := flags.Int("k", 5, "number of results (0 for all)")
+	text := flags.String("text", "", "query text")
+	vector := flags.String("vector", "", "query embedding, e.g. 0.1,0.2,0.3")
+	minSimilarity := flags.Float64("min-similarity", 0, "drop results less similar than this")
+	format := flags.String("format", "table", "output format (table or json)")
+	where := keyValues{}
+	flags.Var(where, "where", "only match records with metadata key=value (repeatable)")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 1); err != nil {
+		return err
+	}
+	if err := checkFormat(*format); err != nil {
+		return err
+	}
+	if *text != "" && *vector != "" {
+		return usageError("query takes -text or -vector, not both")
+	}
+	options := collection.QueryOptions{NGreatest: *k, Where: where}
+	if isSet(flags, "min-similarity") {
+		options.MinSimilarity = minSimilarity
+	}
+
+	db, err := c.loadDatabase()
+	if err != nil {
+		return err
+	}
+	var results []collection.QueryResult
+	if *vector != "" {
+		embedding, err := parseVector(*vector)
+		if err != nil {
+			return err
+		}
+		results, err = db.QueryVector(flags.Arg(0), embedding, options)
+		if err != nil {
+			return err
+		}
+	} else {
+		query := []byte(*text)
+		if *text == "" {
+			query, err = io.ReadAll(c.stdin)
+			if err != nil {
+				return err
+			}
+		}
+		results, err = db.QueryWithOptions(flags.Arg(0), query, options)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *format == "json" {
+		return c.writeJSON(results)
+	}
+	table := c.table()
+	fmt.Fprintln(table, "RANK\tID\tSIMILARITY\tBLOB")
+	for i, result := range results {
+		fmt.Fprintf(table, "%d\t%s\t%.4f\t%s\n", i+1, result.Record.Id, result.Similarity, truncate(result.Record.Blob, 60))
+	}
+	return table.Flush()
+}
+
+func (c cli) export(args []string) error {
+	flags := newFlagSet("export", c.stderr)
+	format := flags.String("format", "json", "json (the whole collection), jsonl or csv")
+	noEmbeddings := flags.Bool("no-embeddings", false, "leave embeddings out of jsonl and csv exports")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 2); err != nil {
+		return err
+	}
+	var rowFormat database.Format
+	if *format != "json" {
+		var err error
+		rowFormat, err = database.ParseFormat(*format)
+		if err != nil {
+			return usageError("%v", err)
+		}
+	}
+	db, err := c.loadDatabase()
+	if err != nil {
+		return err
+	}
+	out := c.stdout
+	if flags.NArg() == 2 {
+		file, err := os.Create(flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if *format != "json" {
+		_, err = db.ExportCollection(flags.Arg(0), out, database.ExportOptions{Format: rowFormat, ExcludeEmbeddings: *noEmbeddings})
+		return err
+	}
+	coll, err := db.GetCollection(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(out).Encode(coll)
+}
+
+func (c cli) importCollection(args []string) error {
+	flags := newFlagSet("import", c.stderr)
+	format := flags.String("format", "json", "json (a whole collection), jsonl or csv")
+	upsert := flags.Bool("upsert", false, "replace existing records when importing jsonl or csv")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if *format == "json" {
+		if err := expectArgs(flags, 1, 1); err != nil {
+			return err
+		}
+	} else if flags.NArg() != 2 {
+		return usageError("import -format %s takes a file and a collection ID", *format)
+	}
+	var rowFormat database.Format
+	if *format != "json" {
+		var err error
+		rowFormat, err = database.ParseFormat(*format)
+		if err != nil {
+			return usageError("%v", err)
+		}
+	}
+
+	var in io.Reader = c.stdin
+	if flags.Arg(0) != "-" {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	db, err := c.loadDatabase()
+	if err != nil {
+		return err
+	}
+
+	if *format != "json" {
+		report, err := db.ImportCollection(flags.Arg(1), in, database.ImportOptions{Format: rowFormat, Upsert: *upsert})
+		if err != nil {
+			return err
+		}
+		for _, lineErr := range report.Errors {
+			fmt.Fprintf(c.stderr, "%s: %v\n", flags.Arg(0), lineErr)
+		}
+		fmt.Fprintf(c.stdout, "imported %d records, %d errors\n", report.Imported, len(report.Errors))
+		if report.Imported > 0 {
+			err = c.saveDatabase(db)
+			if err != nil {
+				return err
+			}
+		}
+		if len(report.Errors) > 0 {
+			return fmt.Errorf("%d lines could not be imported", len(report.Errors))
+		}
+		return nil
+	}
+
+	coll := collection.Collection{}
+	err = json.NewDecoder(in).Decode(&coll)
+	if err != nil {
+		return fmt.Errorf("could not decode collection from %s: %w", flags.Arg(0), err)
+	}
+	if coll.Records == nil {
+		coll.Records = make(map[string]records.Record)
+	}
+	err = db.AddCollection(&coll)
+	if err != nil {
+		return err
+	}
+	return c.saveDatabase(db)
+}
+
+type collectionStats struct {
+	Id         string        `json:"id"`
+	EmbedderId string        `json:"embedderId"`
+	Records    int           `json:"records"`
+	Dimensions int           `json:"dimensions"`
+	BlobBytes  int           `json:"blobBytes"`
+	TTL        time.Duration `json:"ttl,omitempty"`
+}
+
+type databaseStats struct {
+	File        string            `json:"file"`
+	FileBytes   int64             `json:"fileBytes"`
+	Collections []collectionStats `json:"collections"`
+}
+
+func (c cli) stats(args []string) error {
+	flags := newFlagSet("stats", c.stderr)
+	format := flags.String("format", "table", "output format (table or json)")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if err := checkFormat(*format); err != nil {
+		return err
+	}
+	db, err := c.loadDatabase()
+	if err != nil {
+		return err
+	}
+
+	stats := databaseStats{File: c.dbPath, Collections: make([]collectionStats, 0)}
+	info, err := os.Stat(c.dbPath)
+	if err == nil {
+		stats.FileBytes = info.Size()
+	}
+	for _, id := range sortedCollectionIds(db) {
+		coll, err := db.GetCollection(id)
+		if err != nil {
+			return err
+		}
+		page, err := db.ListRecords(id, collection.ListOptions{})
+		if err != nil {
+			return err
+		}
+		collStats := collectionStats{Id: id, EmbedderId: coll.EmbedderId, Records: len(page.Records), TTL: coll.TTL}
+		for _, record := range page.Records {
+			collStats.Dimensions = len(record.Embedding)
+			collStats.BlobBytes += len(record.Blob)
+		}
+		stats.Collections = append(stats.Collections, collStats)
+	}
+
+	if *format == "json" {
+		return c.writeJSON(stats)
+	}
+	fmt.Fprintf(c.stdout, "%s (%d bytes)\n\n", stats.File, stats.FileBytes)
+	table := c.table()
+	fmt.Fprintln(table, "COLLECTION\tEMBEDDER\tRECORDS\tDIMENSIONS\tBLOB BYTES\tTTL")
+	for _, s := range stats.Collections {
+		ttl := "-"
+		if s.TTL > 0 {
+			ttl = s.TTL.String()
+		}
+		fmt.Fprintf(table, "%s\t%s\t%d\t%d\t%d\t%s\n", s.Id, s.EmbedderId, s.Records, s.Dimensions, s.BlobBytes, ttl)
+	}
+	return table.Flush()
+}
+
+func (c cli) pack(args []string) error {
+	flags := newFlagSet("pack", c.stderr)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 1); err != nil {
+		return err
+	}
+	db, err := c.loadDatabase()
+	if err != nil {
+		return err
+	}
+	return db.ToBinaryFile(flags.Arg(0))
+}
+
+// databaseMux serves a database's HTTP APIs: the server package's, the
+// Chroma API, metrics and, if the database has a change feed, replication.
+// The database's gauges go in metrics.Default, so there can only be one
+func databaseMux(db *database.SimpleDataBase) (*http.ServeMux, error) {
+	err := db.RegisterMetrics(metrics.Default)
+	if err != nil {
+		return nil, err
+	}
+	// the native API and the Chroma API don't overlap, so one server has both
+	chroma := server.MakeChromaServer(db, server.ChromaOptions{})
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/", chroma)
+	mux.Handle("/api/v1", chroma)
+	mux.Handle("/", server.MakeServer(db))
+	mux.Handle("/replication/", http.StripPrefix("/replication", replication.MakeLeader(db, replication.LeaderOptions{})))
+	mux.Handle("GET /metrics", metrics.Default)
+	return mux, nil
+}
+
+// makeHTTPServer makes a server for handler whose requests are all
+// cancelled on Shutdown. Shutdown doesn't cancel requests itself, so change
+// streams and replication logs, which only end when their request's context
+// does, would hold it up
+func makeHTTPServer(handler http.Handler) *http.Server {
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	httpServer := &http.Server{Handler: handler, BaseContext: func(net.Listener) context.Context { return requestCtx }}
+	httpServer.RegisterOnShutdown(cancelRequests)
+	return httpServer
+}
+
+func shutdown(httpServer *http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return httpServer.Shutdown(ctx)
+}
+
+// serve serves the database over HTTP, with both the server package's API
+// and the Chroma API, and optionally over RESP, until it gets an interrupt.
+// Then it saves the database (unless it was opened read-only)
+func (c cli) serve(args []string) error {
+	flags := newFlagSet("serve", c.stderr)
+	addr := flags.String("addr", "localhost:8080", "address to listen on")
+	respAddr := flags.String("resp", "", "address to serve the RESP (Redis) protocol on, off if empty")
+	tenantsDir := flags.String("tenants", "", "serve the tenants in this directory instead of -db")
+	keysFile := flags.String("keys", "", "require API keys from this key file (see keys)")
+	auditFile := flags.String("audit", "", "append an audit log of every change to this file, needs -keys")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 0, 0); err != nil {
+		return err
+	}
+	if *auditFile != "" && *keysFile == "" {
+		return usageError("-audit needs -keys")
+	}
+	if *keysFile != "" && *respAddr != "" {
+		return usageError("-resp can't be used with -keys, RESP clients don't send API keys")
+	}
+	if *tenantsDir != "" {
+		if *respAddr != "" {
+			return usageError("-resp can't be used with -tenants")
+		}
+		return c.serveTenants(*addr, *tenantsDir, *keysFile, *auditFile)
+	}
+	db, err := c.loadDatabase()
+	if err != nil {
+		return err
+	}
+	mux, err := databaseMux(db)
+	if err != nil {
+		return err
+	}
+	handler, closeAudit, err := authenticate(mux, *keysFile, *auditFile, auth.ClassifyServer)
+	if err != nil {
+		return err
+	}
+	defer closeAudit()
+	if !db.ReadOnly() {
+		db.EnableChangeFeed(database.ChangeFeedOptions{})
+	}
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	httpServer := makeHTTPServer(handler)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() {
+		served <- httpServer.Serve(listener)
+	}()
+	fmt.Fprintf(c.stderr, "serving %s on http://%s\n", c.dbPath, listener.Addr())
+
+	var respServer *resp.Server
+	respServed := make(chan error, 1)
+	if *respAddr != "" {
+		respListener, err := net.Listen("tcp", *respAddr)
+		if err != nil {
+			httpServer.Close()
+			return err
+		}
+		respServer = resp.MakeServer(db)
+		go func() {
+			respServed <- respServer.Serve(respListener)
+		}()
+		fmt.Fprintf(c.stderr, "serving %s over RESP on %s\n", c.dbPath, respListener.Addr())
+	}
+
+	select {
+	case err = <-served:
+		if respServer != nil {
+			respServer.Close()
+		}
+		return err
+	case err = <-respServed:
+		httpServer.Close()
+		return err
+	case <-ctx.Done():
+	}
+	if respServer != nil {
+		respServer.Close()
+	}
+	err = shutdown(httpServer)
+	if err != nil {
+		return err
+	}
+	if db.ReadOnly() {
+		return db.Close()
+	}
+	return c.saveDatabase(db)
+}
+
+// authenticate puts handler behind the API keys in keysFile, logging
+// changes to auditFile if it's set. With no keysFile it returns handler as
+// it is. The returned func closes the audit log
+func authenticate(handler http.Handler, keysFile string, auditFile string, classify auth.Classifier) (http.Handler, func() error, error) {
+	noAudit := func() error { return nil }
+	if keysFile == "" {
+		return handler, noAudit, nil
+	}
+	store, err := auth.OpenKeyStore(keysFile, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read keys: %w", err)
+	}
+	options := auth.Options{Classify: classify}
+	if auditFile == "" {
+		return auth.MakeHandler(handler, store, options), noAudit, nil
+	}
+	audit, err := os.OpenFile(auditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	options.Audit = auth.MakeAuditLog(audit)
+	return auth.MakeHandler(handler, store, options), audit.Close, nil
+}
+
+// serveTenants serves the tenant registry in dir over HTTP until it gets an
+// interrupt. Every change is written to the tenants' files as it happens, so
+// there's nothing to save afterwards
+func (c cli) serveTenants(addr string, dir string, keysFile string, auditFile string) error {
+	registry, err := tenant.OpenRegistry(dir)
+	if err != nil {
+		return err
+	}
+	defer registry.Close()
+	mux := http.NewServeMux()
+	mux.Handle("/", server.MakeTenantServer(registry))
+	mux.Handle("GET /metrics", metrics.Default)
+	handler, closeAudit, err := authenticate(mux, keysFile, auditFile, auth.ClassifyTenantServer)
+	if err != nil {
+		return err
+	}
+	defer closeAudit()
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	httpServer := makeHTTPServer(handler)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() {
+		served <- httpServer.Serve(listener)
+	}()
+	fmt.Fprintf(c.stderr, "serving tenants in %s on http://%s\n", dir, listener.Addr())
+
+	select {
+	case err = <-served:
+		return err
+	case <-ctx.Done():
+	}
+	err = shutdown(httpServer)
+	if err != nil {
+		return err
+	}
+	return registry.Close()
+}
+
+// follow keeps a replica of the database a leader's sedb serve is serving,
+// and serves it read-only the same way until it gets an interrupt. The
+// replica lives in memory, -db isn't used
+func (c cli) follow(args []string) error {
+	flags := newFlagSet("follow", c.stderr)
+	leaderURL := flags.String("leader", "", "URL of the leader's sedb serve, e.g. http://localhost:8080")
+	addr := flags.String("addr", "localhost:8081", "address to listen on")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 0, 0); err != nil {
+		return err
+	}
+	if *leaderURL == "" {
+		return usageError("follow needs -leader")
+	}
+	follower := replication.MakeFollower(strings.TrimSuffix(*leaderURL, "/")+"/replication", replication.FollowerOptions{OnError: func(err error) {
+		fmt.Fprintf(c.stderr, "replication: %v\n", err)
+	}})
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	mux, err := databaseMux(follower.Database())
+	if err != nil {
+		return err
+	}
+	mux.Handle("GET /replication/status", follower)
+	httpServer := makeHTTPServer(mux)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	followed := make(chan error, 1)
+	go func() {
+		followed <- follower.Run(ctx)
+	}()
+	served := make(chan error, 1)
+	go func() {
+		served <- httpServer.Serve(listener)
+	}()
+	fmt.Fprintf(c.stderr, "following %s, serving on http://%s\n", *leaderURL, listener.Addr())
+
+	select {
+	case err = <-served:
+		stop()
+		<-followed
+		return err
+	case <-ctx.Done():
+	}
+	<-followed
+	return shutdown(httpServer)
+}
+
+// mcp serves the database to an agent over stdin and stdout, saving it after
+// every change
+func (c cli) mcp(args []string) error {
+	flags := newFlagSet("mcp", c.stderr)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 0, 0); err != nil {
+		return err
+	}
+	db, err := c.loadDatabase()
+	if err != nil {
+		return err
+	}
+	mcpServer := mcp.MakeServer(db, mcp.Options{OnWrite: func() error {
+		return c.saveDatabase(db)
+	}})
+	return mcpServer.Serve(c.stdin, c.stdout)
+}
+
+func (c cli) shell(args []string) error {
+	flags := newFlagSet("shell", c.stderr)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 0, 0); err != nil {
+		return err
+	}
+	db, err := c.loadDatabase()
+	if err != nil {
+		return err
+	}
+	sh := shell.MakeShell(db, c.dbPath, c.stdout)
+	stdin, ok := c.stdin.(*os.File)
+	if ok && term.IsTerminal(int(stdin.Fd())) {
+		return sh.RunTerminal(stdin, c.stdout, int(stdin.Fd()))
+	}
+	return sh.Run(c.stdin)
+}
+
+// keysPath is the key file keys works on, from -keys, $SEDB_KEYS or
+// sedb-keys.json
+func keysPath(flags *flag.FlagSet) *string {
+	defaultPath := os.Getenv("SEDB_KEYS")
+	if defaultPath == "" {
+		defaultPath = "sedb-keys.json"
+	}
+	return flags.String("keys", defaultPath, "key file")
+}
+
+// readKeys reads the key file, treating one that doesn't exist yet as empty
+func readKeys(fileName string) (auth.KeyFile, error) {
+	keyFile, err := auth.ReadKeyFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return auth.KeyFile{}, nil
+	}
+	return keyFile, err
+}
+
+// keys manages the API keys sedb serve -keys checks. The server picks up
+// changes to the file without a restart
+func (c cli) keys(args []string) error {
+	if len(args) == 0 {
+		return usageError("keys needs a subcommand (list, create, rotate, revoke)")
+	}
+	switch args[0] {
+	case "list":
+		flags := newFlagSet("keys list", c.stderr)
+		fileName := keysPath(flags)
+		format := flags.String("format", "table", "output format (table or json)")
+		if err := parseFlags(flags, args[1:]); err != nil {
+			return err
+		}
+		if err := checkFormat(*format); err != nil {
+			return err
+		}
+		if err := expectArgs(flags, 0, 0); err != nil {
+			return err
+		}
+		keyFile, err := readKeys(*fileName)
+		if err != nil {
+			return err
+		}
+		if *format == "json" {
+			return c.writeJSON(keyFile.Keys)
+		}
+		table := c.table()
+		fmt.Fprintln(table, "ID\tGRANTS\tCREATED\tEXPIRES")
+		for _, key := range keyFile.Keys {
+			grants := make([]string, len(key.Grants))
+			for i, grant := range key.Grants {
+				grants[i] = grant.Role.String() + ":" + strings.Join(grant.Collections, ",")
+			}
+			expires := "-"
+			if !key.ExpiresAt.IsZero() {
+				expires = formatTime(key.ExpiresAt)
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", key.Id, strings.Join(grants, " "), formatTime(key.CreatedAt), expires)
+		}
+		return table.Flush()
+
+	case "create":
+		flags := newFlagSet("keys create", c.stderr)
+		fileName := keysPath(flags)
+		roleName := flags.String("role", "read", "read, write or admin")
+		collections := flags.String("collections", "*", "comma-separated collection patterns the role applies to")
+		expires := flags.Duration("expires", 0, "stop working this long from now, never if 0")
+		if err := parseFlags(flags, args[1:]); err != nil {
+			return err
+		}
+		if err := expectArgs(flags, 1, 1); err != nil {
+			return err
+		}
+		role, err := auth.ParseRole(*roleName)
+		if err != nil {
+			return usageError("%v", err)
+		}
+		keyFile, err := readKeys(*fileName)
+		if err != nil {
+			return err
+		}
+		if slices.ContainsFunc(keyFile.Keys, func(key auth.Key) bool { return key.Id == flags.Arg(0) }) {
+			return fmt.Errorf("key %s already exists, use keys rotate to replace it", flags.Arg(0))
+		}
+		secret, key, err := auth.GenerateKey(flags.Arg(0), []auth.Grant{{Role: role, Collections: strings.Split(*collections, ",")}})
+		if err != nil {
+			return err
+		}
+		if *expires > 0 {
+			key.ExpiresAt = key.CreatedAt.Add(*expires)
+		}
+		keyFile.Keys = append(keyFile.Keys, key)
+		err = auth.WriteKeyFile(*fileName, keyFile)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.stdout, secret)
+		fmt.Fprintln(c.stderr, "this is the only time the key is shown")
+		return nil
+
+	case "rotate":
+		flags := newFlagSet("keys rotate", c.stderr)
+		fileName := keysPath(flags)
+		if err := parseFlags(flags, args[1:]); err != nil {
+			return err
+		}
+		if err := expectArgs(flags, 1, 1); err != nil {
+			return err
+		}
+		keyFile, err := readKeys(*fileName)
+		if err != nil {
+			return err
+		}
+		i := slices.IndexFunc(keyFile.Keys, func(key auth.Key) bool { return key.Id == flags.Arg(0) })
+		if i < 0 {
+			return fmt.Errorf("key %s does not exist", flags.Arg(0))
+		}
+		// the new key keeps the old one's grants and lifetime
+		old := keyFile.Keys[i]
+		secret, key, err := auth.GenerateKey(old.Id, old.Grants)
+		if err != nil {
+			return err
+		}
+		if !old.ExpiresAt.IsZero() {
+			key.ExpiresAt = key.CreatedAt.Add(old.ExpiresAt.Sub(old.CreatedAt))
+		}
+		keyFile.Keys[i] = key
+		err = auth.WriteKeyFile(*fileName, keyFile)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.stdout, secret)
+		fmt.Fprintln(c.stderr, "this is the only time the key is shown, the old one no longer works")
+		return nil
+
+	case "revoke":
+		flags := newFlagSet("keys revoke", c.stderr)
+		fileName := keysPath(flags)
+		if err := parseFlags(flags, args[1:]); err != nil {
+			return err
+		}
+		if err := expectArgs(flags, 1, 1); err != nil {
+			return err
+		}
+		keyFile, err := readKeys(*fileName)
+		if err != nil {
+			return err
+		}
+		i := slices.IndexFunc(keyFile.Keys, func(key auth.Key) bool { return key.Id == flags.Arg(0) })
+		if i < 0 {
+			return fmt.Errorf("key %s does not exist", flags.Arg(0))
+		}
+		keyFile.Keys = slices.Delete(keyFile.Keys, i, i+1)
+		return auth.WriteKeyFile(*fileName, keyFile)
+
+	default:
+		return usageError("unknown keys subcommand %q", args[0])
+	}
+}
@@ -0,0 +1,244 @@
+// sedb operates on database files written by SimpleDataBase.ToFile
+//
+//	sedb [-db file] [-embedding-cache dir] <command> [subcommand] [flags] [args]
+//
+// Run `sedb help` for the list of commands
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	database "go-simple-embedding-database/database"
+	embedders "go-simple-embedding-database/embedders"
+)
+
+const usage = `usage: sedb [-db file] [-embedding-cache dir] <command> [subcommand] [flags] [args]
+
+The database file defaults to $SEDB_DB, or sedb.json if that isn't set.
+With -embedding-cache (or $SEDB_EMBEDDING_CACHE), embeddings are kept in
+dir and blobs embedded before by the same embedder aren't embedded again.
+Flags go before positional arguments.
+
+commands:
+  collections list
+  collections create [-ttl duration] <collectionId> <embedderId>
+  collections delete <collectionId>
+
+  records add [-id id] [-file path] [-vector floats] [-metadata k=v]... <collectionId>
+      the blob is read from -file, or from stdin if -file isn't given
+  records get [-format table|json] <collectionId> <recordId>
+  records delete <collectionId> <recordId>
+  records list [-limit n] [-cursor c] [-order id|insertion] [-where k=v]... [-format table|json] <collectionId>
+
+  query [-k n] [-text text | -vector floats] [-min-similarity s] [-format table|json] <collectionId>
+      the query text is read from stdin if neither -text nor -vector is given
+
+  export [-format json|jsonl|csv] [-no-embeddings] <collectionId> [file]
+  import <file>
+  import -format jsonl|csv [-upsert] <file> <collectionId>
+      json moves a whole collection. jsonl and csv move records one per line
+      (id, blob, metadata, embedding) into an existing collection, embedding
+      any rows that come without one. Use - as the file to read stdin
+
+  stats [-format table|json]
+
+  pack <file>
+      write the database in the binary format, which opens read-only with its
+      vectors memory-mapped. A binary file can be used as the -db of any
+      command that doesn't change the database
+
+  serve [-addr host:port] [-resp host:port] [-keys file [-audit file]]
+      serve the database over HTTP (see the server package) until interrupted,
+      then save it. Chroma clients can connect too, the Chroma API is under
+      /api/v1. With -resp, Redis clients can connect on that address too.
+      Followers (see follow) replicate it from /replication, and Prometheus
+      metrics are at /metrics. With -keys, every request needs one of the
+      file's API keys, and -audit logs every change as a JSON line
+  serve -tenants dir [-addr host:port] [-keys file [-audit file]]
+      serve the tenants in dir instead, each database under
+      /tenants/{tenant}/databases/{database}. -db isn't used
+
+  keys list [-keys file] [-format table|json]
+  keys create [-keys file] [-role read|write|admin] [-collections patterns] [-expires duration] <keyId>
+  keys rotate [-keys file] <keyId>
+  keys revoke [-keys file] <keyId>
+      manage the API keys serve -keys checks, in $SEDB_KEYS or sedb-keys.json
+      by default. create and rotate print the new key, which isn't stored.
+      -collections takes comma-separated patterns like docs or notes-*, and
+      defaults to * (every collection). A running serve picks up changes
+
+  follow -leader url [-addr host:port]
+      keep an in-memory replica of the database a leader's serve is serving,
+      and serve it read-only the same way until interrupted. How far behind
+      the leader it is is at /replication/status
+
+  mcp
+      serve the database to an LLM agent as Model Context Protocol tools over
+      stdin and stdout, saving it after every change
+
+  shell
+      interactive prompt over the database, run help inside it for commands
+`
+
+// exit codes
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// errUsage marks errors caused by bad arguments rather than bad data
+var errUsage = errors.New("usage error")
+
+func usageError(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", errUsage, fmt.Sprintf(format, args...))
+}
+
+type cli struct {
+	dbPath string
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("sedb", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, usage) }
+	defaultPath := os.Getenv("SEDB_DB")
+	if defaultPath == "" {
+		defaultPath = "sedb.json"
+	}
+	dbPath := flags.String("db", defaultPath, "database file")
+	cacheDir := flags.String("embedding-cache", os.Getenv("SEDB_EMBEDDING_CACHE"), "directory to cache embeddings in")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *cacheDir != "" {
+		cache, err := embedders.MakeCache(embedders.CacheOptions{Dir: *cacheDir})
+		if err != nil {
+			fmt.Fprintf(stderr, "sedb: could not open embedding cache %s: %v\n", *cacheDir, err)
+			return exitError
+		}
+		embedders.SetCache(cache)
+		defer embedders.SetCache(nil)
+	}
+
+	c := cli{dbPath: *dbPath, stdin: stdin, stdout: stdout, stderr: stderr}
+	err := c.dispatch(flags.Args())
+	if err == nil {
+		return exitOK
+	}
+	fmt.Fprintf(stderr, "sedb: %v\n", err)
+	if errors.Is(err, errUsage) {
+		fmt.Fprint(stderr, "run 'sedb help' for usage\n")
+		return exitUsage
+	}
+	return exitError
+}
+
+func (c cli) dispatch(args []string) error {
+	if len(args) == 0 {
+		return usageError("no command given")
+	}
+	command, rest := args[0], args[1:]
+	switch command {
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(c.stdout, usage)
+		return nil
+	case "collections":
+		return c.collections(rest)
+	case "records":
+		return c.records(rest)
+	case "query":
+		return c.query(rest)
+	case "export":
+		return c.export(rest)
+	case "import":
+		return c.importCollection(rest)
+	case "stats":
+		return c.stats(rest)
+	case "pack":
+		return c.pack(rest)
+	case "serve":
+		return c.serve(rest)
+	case "follow":
+		return c.follow(rest)
+	case "mcp":
+		return c.mcp(rest)
+	case "keys":
+		return c.keys(rest)
+	case "shell":
+		return c.shell(rest)
+	default:
+		return usageError("unknown command %q", command)
+	}
+}
+
+// loadDatabase reads the database file. A file that doesn't exist yet is
+// treated as an empty database, so `collections create` can make a new one.
+// Binary files (see pack) come back read-only
+func (c cli) loadDatabase() (*database.SimpleDataBase, error) {
+	_, err := os.Stat(c.dbPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return database.MakeDatabase(), nil
+	}
+	db, err := database.Open(c.dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read database %s: %w", c.dbPath, err)
+	}
+	return db, nil
+}
+
+// saveDatabase writes to a temporary file next to the database and renames
+// it into place, so a failed write never leaves a half-written database
+func (c cli) saveDatabase(db *database.SimpleDataBase) error {
+	tempFile, err := os.CreateTemp(filepath.Dir(c.dbPath), filepath.Base(c.dbPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	tempFile.Close()
+	defer os.Remove(tempPath)
+
+	err = db.ToFile(tempPath)
+	if err != nil {
+		return fmt.Errorf("could not write database %s: %w", c.dbPath, err)
+	}
+	return os.Rename(tempPath, c.dbPath)
+}
+
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {}
+	return flags
+}
+
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	err := flags.Parse(args)
+	if err != nil {
+		return usageError("%s: %v", flags.Name(), err)
+	}
+	return nil
+}
+
+func expectArgs(flags *flag.FlagSet, min int, max int) error {
+	n := flags.NArg()
+	if n < min || n > max {
+		if min == max {
+			return usageError("%s takes %d argument(s), got %d", flags.Name(), min, n)
+		}
+		return usageError("%s takes %d to %d arguments, got %d", flags.Name(), min, max, n)
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	auth "go-simple-embedding-database/auth"
+	collection "go-simple-embedding-database/collection"
+	embedders "go-simple-embedding-database/embedders"
+)
+
+// VectorEmbed treats the blob as a comma separated list of floats
+func VectorEmbed(blob []byte) ([]float64, error) {
+	vector := make([]float64, 0)
+	for _, field := range strings.Split(strings.TrimSpace(string(blob)), ",") {
+		value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, err
+		}
+		vector = append(vector, value)
+	}
+	return vector, nil
+}
+
+type result struct {
+	code   int
+	stdout string
+	stderr string
+}
+
+func sedb(t *testing.T, dbPath string, stdin string, args ...string) result {
+	t.Helper()
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := run(append([]string{"-db", dbPath}, args...), strings.NewReader(stdin), stdout, stderr)
+	return result{code: code, stdout: stdout.String(), stderr: stderr.String()}
+}
+
+func mustSedb(t *testing.T, dbPath string, stdin string, args ...string) string {
+	t.Helper()
+	r := sedb(t, dbPath, stdin, args...)
+	if r.code != exitOK {
+		t.Fatalf("sedb %v exited with %d: %s", args, r.code, r.stderr)
+	}
+	return r.stdout
+}
+
+func TestCollectionsAndRecords(t *testing.T) {
+	embedders.EmbedderRegister["vector-embedder"] = VectorEmbed
+	dbPath := filepath.Join(t.TempDir(), "db.json")
+
+	mustSedb(t, dbPath, "", "collections", "create", "docs", "vector-embedder")
+	mustSedb(t, dbPath, "", "collections", "create", "-ttl", "720h", "news", "vector-embedder")
+	out := mustSedb(t, dbPath, "", "collections", "list")
+	if out != "docs\nnews\n" {
+		t.Errorf("Unexpected collections list %q", out)
+	}
+	r := sedb(t, dbPath, "", "collections", "create", "docs", "vector-embedder")
+	if r.code != exitError {
+		t.Errorf("Expected creating a duplicate collection to fail, got exit code %d", r.code)
+	}
+
+	mustSedb(t, dbPath, "1,0", "records", "add", "-id", "x", "-metadata", "axis=x", "docs")
+	mustSedb(t, dbPath, "0,1", "records", "add", "-id", "y", "docs")
+	blobFile := filepath.Join(t.TempDir(), "xy.txt")
+	os.WriteFile(blobFile, []byte("not a vector"), 0644)
+	mustSedb(t, dbPath, "", "records", "add", "-id", "xy", "-file", blobFile, "-vector", "1,1", "docs")
+
+	out = mustSedb(t, dbPath, "", "records", "get", "-format", "json", "docs", "xy")
+	fetched := map[string]any{}
+	err := json.Unmarshal([]byte(out), &fetched)
+	if err != nil {
+		t.Fatalf("records get did not print JSON: %v\n%s", err, out)
+	}
+	if fetched["blob"] != "not a vector" {
+		t.Errorf("Unexpected blob %v", fetched["blob"])
+	}
+
+	out = mustSedb(t, dbPath, "", "records", "list", "-format", "json", "-limit", "2", "docs")
+	page := collection.RecordPage{}
+	err = json.Unmarshal([]byte(out), &page)
+	if err != nil {
+		t.Fatalf("records list did not print JSON: %v\n%s", err, out)
+	}
+	if len(page.Records) != 2 || page.Records[0].Id != "x" || page.NextCursor == "" {
+		t.Errorf("Unexpected first page %v", page)
+	}
+	out = mustSedb(t, dbPath, "", "records", "list", "-format", "json", "-limit", "2", "-cursor", page.NextCursor, "docs")
+	page = collection.RecordPage{}
+	json.Unmarshal([]byte(out), &page)
+	if len(page.Records) != 1 || page.Records[0].Id != "y" {
+		t.Errorf("Unexpected second page %v", page)
+	}
+	out = mustSedb(t, dbPath, "", "records", "list", "-where", "axis=x", "docs")
+	if !strings.Contains(out, "x") || strings.Contains(out, "xy") {
+		t.Errorf("Unexpected filtered listing %q", out)
+	}
+
+	mustSedb(t, dbPath, "", "records", "delete", "docs", "y")
+	r = sedb(t, dbPath, "", "records", "get", "docs", "y")
+	if r.code != exitError {
+		t.Errorf("Expected getting a deleted record to fail, got exit code %d", r.code)
+	}
+
+	mustSedb(t, dbPath, "", "collections", "delete", "news")
+	out = mustSedb(t, dbPath, "", "collections", "list", "-format", "json")
+	ids := []string{}
+	json.Unmarshal([]byte(out), &ids)
+	if len(ids) != 1 || ids[0] != "docs" {
+		t.Errorf("Unexpected collections after delete %q", out)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	embedders.EmbedderRegister["vector-embedder"] = VectorEmbed
+	dbPath := filepath.Join(t.TempDir(), "db.json")
+	mustSedb(t, dbPath, "", "collections", "create", "docs", "vector-embedder")
+	mustSedb(t, dbPath, "1,0", "records", "add", "-id", "x", "docs")
+	mustSedb(t, dbPath, "0,1", "records", "add", "-id", "y", "docs")
+	mustSedb(t, dbPath, "-1,0", "records", "add", "-id", "-x", "docs")
+
+	out := mustSedb(t, dbPath, "", "query", "-k", "2", "-text", "1,0.1", "-format", "json", "docs")
+	results := []collection.QueryResult{}
+	err := json.Unmarshal([]byte(out), &results)
+	if err != nil {
+		t.Fatalf("query did not print JSON: %v\n%s", err, out)
+	}
+	if len(results) != 2 || results[0].Record.Id != "x" || results[1].Record.Id != "y" {
+		t.Errorf("Unexpected query results %v", results)
+	}
+
+	out = mustSedb(t, dbPath, "", "query", "-vector", "0,1", "-min-similarity", "0.5", "docs")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], "y") {
+		t.Errorf("Unexpected table output %q", out)
+	}
+
+	// the query can come from stdin too
+	out = mustSedb(t, dbPath, "-1,0", "query", "-k", "1", "docs")
+	if !strings.Contains(out, "-x") {
+		t.Errorf("Unexpected stdin query output %q", out)
+	}
+
+	r := sedb(t, dbPath, "", "query", "-text", "1,0", "-vector", "1,0", "docs")
+	if r.code != exitUsage {
+		t.Errorf("Expected -text with -vector to be a usage error, got exit code %d", r.code)
+	}
+}
+
+func TestImportExportAndStats(t *testing.T) {
+	embedders.EmbedderRegister["vector-embedder"] = VectorEmbed
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "db.json")
+	mustSedb(t, dbPath, "", "collections", "create", "docs", "vector-embedder")
+	mustSedb(t, dbPath, "1,0,0", "records", "add", "-id", "x", "docs")
+
+	exportPath := filepath.Join(dir, "docs.json")
+	mustSedb(t, dbPath, "", "export", "docs", exportPath)
+
+	otherPath := filepath.Join(dir, "other.json")
+	mustSedb(t, otherPath, "", "import", exportPath)
+	out := mustSedb(t, otherPath, "", "records", "get", "-format", "json", "docs", "x")
+	if !strings.Contains(out, `"blob": "1,0,0"`) {
+		t.Errorf("Imported record doesn't match the exported one: %s", out)
+	}
+	r := sedb(t, otherPath, "", "import", exportPath)
+	if r.code != exitError {
+		t.Errorf("Expected importing an existing collection to fail, got exit code %d", r.code)
+	}
+
+	out = mustSedb(t, otherPath, "", "stats", "-format", "json")
+	stats := databaseStats{}
+	err := json.Unmarshal([]byte(out), &stats)
+	if err != nil {
+		t.Fatalf("stats did not print JSON: %v\n%s", err, out)
+	}
+	if len(stats.Collections) != 1 || stats.Collections[0].Records != 1 || stats.Collections[0].Dimensions != 3 {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+}
+
+func TestImportExportRows(t *testing.T) {
+	embedders.EmbedderRegister["vector-embedder"] = VectorEmbed
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "db.json")
+	mustSedb(t, dbPath, "", "collections", "create", "docs", "vector-embedder")
+
+	input := "id,blob,metadata\nx,\"1,0\",\"{\"\"lang\"\":\"\"en\"\"}\"\ny,\"0,1\",\nbad,\"not a vector\",\n"
+	r := sedb(t, dbPath, input, "import", "-format", "csv", "-", "docs")
+	if r.code != exitError || !strings.Contains(r.stderr, "line 4") {
+		t.Errorf("Expected the bad line to be reported, got exit code %d: %s", r.code, r.stderr)
+	}
+	if !strings.Contains(r.stdout, "imported 2 records, 1 errors") {
+		t.Errorf("Unexpected import summary %q", r.stdout)
+	}
+
+	out := mustSedb(t, dbPath, "", "export", "-format", "jsonl", "-no-embeddings", "docs")
+	expected := "{\"id\":\"x\",\"blob\":\"1,0\",\"metadata\":{\"lang\":\"en\"}}\n{\"id\":\"y\",\"blob\":\"0,1\"}\n"
+	if out != expected {
+		t.Errorf("Unexpected export: expected %q, got %q", expected, out)
+	}
+}
+
+func TestPack(t *testing.T) {
+	embedders.EmbedderRegister["vector-embedder"] = VectorEmbed
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "db.json")
+	mustSedb(t, dbPath, "", "collections", "create", "docs", "vector-embedder")
+	mustSedb(t, dbPath, "1,0", "records", "add", "-id", "x", "docs")
+	mustSedb(t, dbPath, "0,1", "records", "add", "-id", "y", "docs")
+
+	packedPath := filepath.Join(dir, "db.sedb")
+	mustSedb(t, dbPath, "", "pack", packedPath)
+	out := mustSedb(t, packedPath, "", "query", "-k", "1", "-text", "0.1,1", "docs")
+	if !strings.Contains(out, "y") {
+		t.Errorf("Unexpected query output from the packed database %q", out)
+	}
+	r := sedb(t, packedPath, "1,1", "records", "add", "-id", "xy", "docs")
+	if r.code != exitError || !strings.Contains(r.stderr, "read-only") {
+		t.Errorf("Expected adding to a packed database to fail as read-only, got exit code %d: %s", r.code, r.stderr)
+	}
+}
+
+func TestMCP(t *testing.T) {
+	embedders.EmbedderRegister["vector-embedder"] = VectorEmbed
+	dbPath := filepath.Join(t.TempDir(), "db.json")
+	mustSedb(t, dbPath, "", "collections", "create", "docs", "vector-embedder")
+	session := strings.Join([]string{
+		`{"jsonrpc": "2.0", "id": 1, "method": "initialize", "params": {"protocolVersion": "2025-06-18"}}`,
+		`{"jsonrpc": "2.0", "method": "notifications/initialized"}`,
+		`{"jsonrpc": "2.0", "id": 2, "method": "tools/call", "params": {"name": "add_documents", "arguments": {"collection": "docs", "documents": [{"id": "x", "text": "1,0"}]}}}`,
+	}, "\n")
+	out := mustSedb(t, dbPath, session, "mcp")
+	if strings.Count(out, "\n") != 2 || strings.Contains(out, "isError") {
+		t.Errorf("Unexpected responses %s", out)
+	}
+	// the server saves after every change
+	out = mustSedb(t, dbPath, "", "records", "get", "docs", "x")
+	if !strings.Contains(out, "1,0") {
+		t.Errorf("Expected the added document to be saved, got %q", out)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	keysPath := filepath.Join(t.TempDir(), "keys.json")
+	secret := strings.TrimSpace(mustSedb(t, "", "", "keys", "create", "-keys", keysPath, "-role", "write", "-collections", "docs,notes-*", "ingest"))
+	store, err := auth.OpenKeyStore(keysPath, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Could not open key store: %v", err)
+	}
+	key, err := store.Authenticate(secret)
+	if err != nil || !key.Allows(auth.RoleWrite, "notes-1") || key.Allows(auth.RoleWrite, "other") {
+		t.Errorf("Expected a write key for docs and notes-*, got %+v (%v)", key, err)
+	}
+	if r := sedb(t, "", "", "keys", "create", "-keys", keysPath, "ingest"); r.code != exitError {
+		t.Errorf("Expected creating ingest twice to fail, got exit code %d", r.code)
+	}
+	out := mustSedb(t, "", "", "keys", "list", "-keys", keysPath)
+	if !strings.Contains(out, "ingest") || !strings.Contains(out, "write:docs,notes-*") || strings.Contains(out, secret) {
+		t.Errorf("Unexpected key list %q", out)
+	}
+
+	rotated := strings.TrimSpace(mustSedb(t, "", "", "keys", "rotate", "-keys", keysPath, "ingest"))
+	time.Sleep(5 * time.Millisecond)
+	if _, err := store.Authenticate(secret); err == nil {
+		t.Errorf("Expected the old key to stop working once rotated")
+	}
+	if key, err := store.Authenticate(rotated); err != nil || !key.Allows(auth.RoleWrite, "docs") {
+		t.Errorf("Expected the rotated key to keep its grants, got %+v (%v)", key, err)
+	}
+	mustSedb(t, "", "", "keys", "revoke", "-keys", keysPath, "ingest")
+	time.Sleep(5 * time.Millisecond)
+	if _, err := store.Authenticate(rotated); err == nil {
+		t.Errorf("Expected the revoked key to stop working")
+	}
+}
+
+func TestEmbeddingCache(t *testing.T) {
+	calls := 0
+	embedders.EmbedderRegister["counting-embedder"] = func(blob []byte) ([]float64, error) {
+		calls++
+		return VectorEmbed(blob)
+	}
+	defer delete(embedders.EmbedderRegister, "counting-embedder")
+	dbPath := filepath.Join(t.TempDir(), "db.json")
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+
+	mustSedb(t, dbPath, "", "collections", "create", "docs", "counting-embedder")
+	// every run is a new process as far as the cache knows, so the second
+	// add and the query find the embedding on disk
+	mustSedb(t, dbPath, "1,0", "-embedding-cache", cacheDir, "records", "add", "-id", "a", "docs")
+	mustSedb(t, dbPath, "1,0", "-embedding-cache", cacheDir, "records", "add", "-id", "b", "docs")
+	mustSedb(t, dbPath, "", "-embedding-cache", cacheDir, "query", "-text", "1,0", "docs")
+	if calls != 1 {
+		t.Errorf("Expected the blob to be embedded once, got %d calls", calls)
+	}
+	mustSedb(t, dbPath, "", "query", "-text", "1,0", "docs")
+	if calls != 2 {
+		t.Errorf("Expected no caching without -embedding-cache, got %d calls", calls)
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db.json")
+	for _, args := range [][]string{
+		{},
+		{"nope"},
+		{"collections"},
+		{"collections", "create", "only-one-arg"},
+		{"records", "add", "docs"},
+		{"records", "list", "-order", "sideways", "docs"},
+		{"stats", "-format", "yaml"},
+		{"import", "-format", "csv", "rows.csv"},
+		{"export", "-format", "xml", "docs"},
+		{"pack"},
+		{"follow"},
+		{"serve", "-tenants", "tenants", "-resp", "localhost:6380"},
+		{"serve", "-keys", "keys.json", "-resp", "localhost:6380"},
+		{"serve", "-audit", "audit.jsonl"},
+		{"keys"},
+		{"keys", "create", "-role", "owner", "someone"},
+	} {
+		r := sedb(t, dbPath, "", args...)
+		if r.code != exitUsage {
+			t.Errorf("Expected sedb %v to be a usage error, got exit code %d (%s)", args, r.code, r.stderr)
+		}
+	}
+	_, err := os.Stat(dbPath)
+	if err == nil {
+		t.Errorf("Usage errors should not have created a database file")
+	}
+}
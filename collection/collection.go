@@ -1,19 +1,22 @@
 package collection
 
 import (
-	"errors"
 	"fmt"
-	"slices"
+	"time"
 
 	embedders "go-simple-embedding-database/embedders"
 	records "go-simple-embedding-database/records"
-	utils "go-simple-embedding-database/utils"
 )
 
 type Collection struct {
 	Id         string                    `json:"id"`
 	EmbedderId string                    `json:"embedderId"`
 	Records    map[string]records.Record `json:"embeddings"`
+	// Where the records live if not in Records, see RecordStore
+	Store RecordStore `json:"-"`
+	// Records added without an ExpiresAt of their own expire this long
+	// after they're added (or updated). 0 means they never expire
+	TTL time.Duration `json:"ttl,omitempty"`
 }
 
 func MakeCollection(id string, embedderId string) (*Collection, error) {
@@ -29,123 +32,152 @@ func (c Collection) String() string {
 	return fmt.Sprintf("Collection{collection.Id: %s, embedderId: %v}", c.Id, c.EmbedderId)
 }
 
+// AddRecord stores a copy of the record in the collection. If the record
+// doesn't have a CreatedAt time yet it is stamped with the current time,
+// and if the collection has a TTL the record's expiry is set from it
 func (collection Collection) AddRecord(record *records.Record) error {
-	_, ok := collection.Records[record.Id]
-	if ok {
-		return errors.New(fmt.Sprintf("Record %s already exists in collection %s\n", record.Id, collection.Id))
+	now := time.Now().UTC()
+	existing, ok, err := collection.getStored(record.Id)
+	if err != nil {
+		return err
+	}
+	if ok && !existing.Expired(now) {
+		return fmt.Errorf("%w: %s in collection %s", ErrRecordExists, record.Id, collection.Id)
+	}
+	err = collection.validateRecord(record)
+	if err != nil {
+		return err
+	}
+	if record.CreatedAt.IsZero() {
+		record.CreatedAt = now
+	}
+	if record.ExpiresAt.IsZero() && collection.TTL > 0 {
+		record.ExpiresAt = record.CreatedAt.Add(collection.TTL)
+	}
+	return collection.putStored(*record)
+}
+
+// UpsertRecord adds the record, or replaces the record with the same ID if
+// there is one, and returns whether it replaced one. A replaced record keeps
+// its CreatedAt time and gets a new UpdatedAt time; an added record never
+// has an UpdatedAt time
+func (collection Collection) UpsertRecord(record *records.Record) (bool, error) {
+	now := time.Now().UTC()
+	existing, ok, err := collection.getStored(record.Id)
+	if err != nil {
+		return false, err
+	}
+	if !ok || existing.Expired(now) {
+		record.UpdatedAt = time.Time{}
+		return false, collection.AddRecord(record)
+	}
+	err = collection.validateRecord(record)
+	if err != nil {
+		return false, err
 	}
+	record.CreatedAt = existing.CreatedAt
+	record.UpdatedAt = now
+	if record.ExpiresAt.IsZero() && collection.TTL > 0 {
+		record.ExpiresAt = record.UpdatedAt.Add(collection.TTL)
+	}
+	err = collection.putStored(*record)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PutRecord stores the record exactly as it is, times and all, replacing any
+// record with the same ID. It's for copying records that were already added
+// to another collection, like a replication leader's
+func (collection Collection) PutRecord(record records.Record) error {
+	err := collection.validateRecord(&record)
+	if err != nil {
+		return err
+	}
+	return collection.putStored(record)
+}
+
+func (collection Collection) validateRecord(record *records.Record) error {
 	if collection.EmbedderId != record.EmbedderId {
-		return errors.New(fmt.Sprintf("Record embedderId %v != collection embedderId %v", record.EmbedderId, collection.EmbedderId))
+		return fmt.Errorf("%w: record embedderId %v != collection embedderId %v", ErrEmbedderMismatch, record.EmbedderId, collection.EmbedderId)
 	}
 	if record.Embedding == nil {
-		return errors.New(fmt.Sprintf("Embedding for %v is null", record))
+		return fmt.Errorf("%w: %s", ErrMissingEmbedding, record.Id)
+	}
+	if record.Id == "" {
+		return fmt.Errorf("%w: in collection %s", ErrMissingRecordId, collection.Id)
 	}
-	collection.Records[record.Id] = *record
 	return nil
 }
 
 func (collection Collection) DeleteRecord(recordId string) error {
-	_, ok := collection.Records[recordId]
+	ok, err := collection.deleteStored(recordId)
+	if err != nil {
+		return err
+	}
 	if ok {
-		delete(collection.Records, recordId)
 		return nil
 	}
-	return errors.New(fmt.Sprintf("Could not delete record %s from collection %s: record not found in collection", recordId, collection.Id))
+	return fmt.Errorf("%w: %s in collection %s", ErrRecordNotFound, recordId, collection.Id)
 }
 
+// GetRecord treats expired records as if they had already been deleted
 func (collection Collection) GetRecord(recordId string) (*records.Record, error) {
-	record, ok := collection.Records[recordId]
-	if !ok {
-		return nil, errors.New(fmt.Sprintf("Could not get record - record with ID %s does not exist in collection", recordId))
-	}
-	return &record, nil
-}
-
-func (collection Collection) Query(query []byte, n_greatest int) (*[]records.Record, error) {
-
-	embed, err := embedders.GetEmbedderFunc(collection.EmbedderId)
+	record, ok, err := collection.getStored(recordId)
 	if err != nil {
 		return nil, err
 	}
-	queryEmbedding, err := embed(query)
-	if err != nil {
-		return nil, err
+	if !ok || record.Expired(time.Now()) {
+		return nil, fmt.Errorf("%w: %s in collection %s", ErrRecordNotFound, recordId, collection.Id)
 	}
+	return &record, nil
+}
 
-	// TODO: maybe log out an error here. I can't think of many cases where this is what we'd want to do
-	if len(collection.Records) <= n_greatest {
-		records := make([]records.Record, 0)
-		for _, record := range collection.Records {
-			records = append(records, record)
+// RemoveExpired deletes every record that has expired as of now, and
+// returns the IDs of the ones it deleted
+func (collection Collection) RemoveExpired(now time.Time) ([]string, error) {
+	expired := make([]string, 0)
+	err := collection.scan(func(record records.Record) bool {
+		if record.Expired(now) {
+			expired = append(expired, record.Id)
 		}
-		return &records, nil
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	mostSimilarRecords := make([]records.Record, 0)
-	similarities := make(map[string]float64)
-
-	// determine how close each record's embedding is to the query's embedding
-	for recordId, record := range collection.Records {
-		similarity, err := utils.CosineSimilarity(queryEmbedding, record.Embedding)
+	removed := make([]string, 0, len(expired))
+	for _, recordId := range expired {
+		ok, err := collection.deleteStored(recordId)
 		if err != nil {
-			return nil, err
+			return removed, err
 		}
-		similarities[recordId] = similarity
-	}
-
-	// basically just the records from 'similarities' map,
-	// but sorted in descending order
-	distances := make([]float64, 0)
-	for _, distance := range similarities {
-		distances = append(distances, distance)
-	}
-	slices.Sort(distances)
-	slices.Reverse(distances)
-
-	// this is an ugly hack to deal with potential duplicate values
-	finalValue := distances[n_greatest-1]
-	if finalValue == distances[n_greatest] {
-		numPicked := 0
-		for recordId, distance := range similarities {
-			if distance > finalValue {
-				record, err := collection.GetRecord(recordId)
-				if err != nil {
-					return nil, err
-				}
-				mostSimilarRecords = append(mostSimilarRecords, *record)
-				numPicked += 1
-			}
-		}
-		for recordId, distance := range similarities {
-			if distance == finalValue {
-				record, err := collection.GetRecord(recordId)
-				if err != nil {
-					return nil, err
-				}
-				mostSimilarRecords = append(mostSimilarRecords, *record)
-				numPicked += 1
-				if numPicked == n_greatest {
-					if len(mostSimilarRecords) != n_greatest {
-						return nil, errors.New(fmt.Sprintf("matching - len(mostSimilarRecords) != n_greatest (%d != %d)", len(mostSimilarRecords), n_greatest))
-					}
-					return &mostSimilarRecords, nil
-				}
-			}
+		if ok {
+			removed = append(removed, recordId)
 		}
 	}
+	return removed, nil
+}
 
-	// even the straightforward case is a little ugly
-	for recordId, distance := range similarities {
-		if distance >= finalValue {
-			record, err := collection.GetRecord(recordId)
-			if err != nil {
-				return nil, err
-			}
-			mostSimilarRecords = append(mostSimilarRecords, *record)
-		}
+// Query returns the n_greatest records most similar to the query, ranked. As
+// with QueryOptions.NGreatest, 0 means no limit and negative is an error
+func (collection Collection) Query(query []byte, n_greatest int) (*[]records.Record, error) {
+	defer queryDuration.ObserveSince(time.Now(), collection.Id)
+	options := QueryOptions{NGreatest: n_greatest}
+	err := options.validate()
+	if err != nil {
+		return nil, err
 	}
-	if len(mostSimilarRecords) != n_greatest {
-		return nil, errors.New(fmt.Sprintf("distinct - len(mostSimilarRecords) != n_greatest (%d != %d)", len(mostSimilarRecords), n_greatest))
+	queryEmbedding, err := collection.embedQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	ranked, err := collection.rankRecords([][]float64{queryEmbedding}, options.limit(), keepAll)
+	if err != nil {
+		return nil, err
 	}
+	mostSimilarRecords := unscored(ranked[0])
 	return &mostSimilarRecords, nil
 }
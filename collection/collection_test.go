@@ -3,18 +3,62 @@ package collection
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	embedders "go-simple-embedding-database/embedders"
 	records "go-simple-embedding-database/records"
+	utils "go-simple-embedding-database/utils"
 )
 
 func MockEmbed(blob []byte) ([]float64, error) {
 	return []float64{1.0, 2.0, 3.0, 4.0, 5.0}, nil
 }
 
+// VectorEmbed treats the blob as a comma separated list of floats, which
+// makes it easy to write tests with known similarities
+func VectorEmbed(blob []byte) ([]float64, error) {
+	vector := make([]float64, 0)
+	for _, field := range strings.Split(string(blob), ",") {
+		value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, err
+		}
+		vector = append(vector, value)
+	}
+	return vector, nil
+}
+
+func makeVectorCollection(t *testing.T, id string, vectors map[string]string) Collection {
+	embedders.EmbedderRegister["vector-embedder"] = VectorEmbed
+	collection := Collection{Id: id, EmbedderId: "vector-embedder", Records: make(map[string]records.Record)}
+	for recordId, vector := range vectors {
+		record, err := records.MakeRecord("vector-embedder", []byte(vector), recordId)
+		if err != nil {
+			t.Fatalf("Could not create record %s: %v", recordId, err)
+		}
+		err = collection.AddRecord(record)
+		if err != nil {
+			t.Fatalf("Could not add record %s: %v", recordId, err)
+		}
+	}
+	return collection
+}
+
+func recordIds(results []records.Record) []string {
+	ids := make([]string, len(results))
+	for i, record := range results {
+		ids[i] = record.Id
+	}
+	return ids
+}
+
 func TestJSON(t *testing.T) {
 	embedders.EmbedderRegister["mock-embedder"] = MockEmbed
 	collection := Collection{Id: "test-json-serializing", EmbedderId: "mock-embedder", Records: make(map[string]records.Record)}
@@ -68,7 +112,7 @@ func TestCollection(t *testing.T) {
 		t.Errorf("Could not add valid record to collection: %v", err)
 	}
 	err = collection.AddRecord(goodRecord1)
-	if err == nil {
+	if !errors.Is(err, ErrRecordExists) {
 		t.Errorf("Should not have been able to add duplicate record %v", goodRecord1)
 	}
 	err = collection.AddRecord(goodRecord2)
@@ -96,12 +140,23 @@ func TestCollection(t *testing.T) {
 	}
 
 	// we shouldn't be able to add a nil embedding
-	nilRecord := records.Record{}
+	nilRecord := records.Record{EmbedderId: "mock-embedder"}
 	err = collection.AddRecord(&nilRecord)
-	if err == nil {
+	if !errors.Is(err, ErrMissingEmbedding) {
 		t.Errorf("Should not have been able to add nil record %v to collection", nilRecord)
 	}
 
+	// or a record without an ID, since scans start from the empty ID
+	noIdRecord, _ := records.MakeRecord("mock-embedder", []byte("no-id"), "")
+	err = collection.AddRecord(noIdRecord)
+	if !errors.Is(err, ErrMissingRecordId) {
+		t.Errorf("Expected a missing record ID, got %v", err)
+	}
+	_, err = collection.UpsertRecord(noIdRecord)
+	if !errors.Is(err, ErrMissingRecordId) {
+		t.Errorf("Expected a missing record ID on upsert, got %v", err)
+	}
+
 	// we shouldn't be able to add an record unless the embedders match
 	embedders.EmbedderRegister["mock-embedder-mismatched-id"] = MockEmbed
 	goodRecordWrongEmbedder, err := records.MakeRecord("mock-embedder-mismatched-id", []byte("good-embedding-wrong-embedder"), "good-embedding-wrong-embedder")
@@ -109,7 +164,7 @@ func TestCollection(t *testing.T) {
 		t.Errorf("Could not create record needed for testing: %v", err)
 	}
 	err = collection.AddRecord(goodRecordWrongEmbedder)
-	if err == nil {
+	if !errors.Is(err, ErrEmbedderMismatch) {
 		t.Errorf("Should not have been able to add record %v to collection - there should be an embedder mismatch", goodRecordWrongEmbedder)
 	}
 
@@ -131,7 +186,7 @@ func TestCollection(t *testing.T) {
 
 	// we should be able to delete embeddings just fine too
 	err = collection.DeleteRecord("does-not-exist")
-	if err == nil {
+	if !errors.Is(err, ErrRecordNotFound) {
 		t.Errorf("Should not have been able to delete non-existent record")
 	}
 	err = collection.DeleteRecord(goodRecord1.Id)
@@ -196,6 +251,699 @@ func TestQueryAgainstContrivedEmbeddings(t *testing.T) {
 	}
 }
 
+func TestQueryIsRanked(t *testing.T) {
+	collection := makeVectorCollection(t, "test-query-ranked", map[string]string{
+		"x":  "1,0,0",
+		"xy": "1,1,0",
+		"y":  "0,1,0",
+		"z":  "0,0,1",
+	})
+	response, err := collection.Query([]byte("1,0.1,0"), 3)
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	expected := []string{"x", "xy", "y"}
+	if !reflect.DeepEqual(recordIds(*response), expected) {
+		t.Errorf("Expected ranked results %v, got %v", expected, recordIds(*response))
+	}
+
+	response, err = collection.Query([]byte("1,0.1,0"), 10)
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(*response) != 4 {
+		t.Errorf("Expected every record when n_greatest exceeds the collection size, got %d", len(*response))
+	}
+
+	// 0 is no limit, the same as in QueryOptions
+	response, err = collection.Query([]byte("1,0.1,0"), 0)
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(*response) != 4 {
+		t.Errorf("Expected every record when n_greatest is 0, got %d", len(*response))
+	}
+}
+
+func TestQueryBatch(t *testing.T) {
+	collection := makeVectorCollection(t, "test-query-batch", map[string]string{
+		"x": "1,0,0",
+		"y": "0,1,0",
+		"z": "0,0,1",
+	})
+
+	batchCalls := 0
+	embedders.BatchEmbedderRegister["vector-embedder"] = func(blobs [][]byte) ([][]float64, error) {
+		batchCalls += 1
+		vectors := make([][]float64, len(blobs))
+		for i, blob := range blobs {
+			vector, err := VectorEmbed(blob)
+			if err != nil {
+				return nil, err
+			}
+			vectors[i] = vector
+		}
+		return vectors, nil
+	}
+	defer delete(embedders.BatchEmbedderRegister, "vector-embedder")
+
+	queries := [][]byte{[]byte("0,0,1"), []byte("1,0.5,0"), []byte("0,1,0.1")}
+	response, err := collection.QueryBatch(queries, 2)
+	if err != nil {
+		t.Fatalf("QueryBatch failed: %v", err)
+	}
+	if batchCalls != 1 {
+		t.Errorf("Expected queries to be embedded in a single batch, got %d calls", batchCalls)
+	}
+	expected := [][]string{{"z", "x"}, {"x", "y"}, {"y", "z"}}
+	if len(*response) != len(expected) {
+		t.Fatalf("Expected %d result sets, got %d", len(expected), len(*response))
+	}
+	for i, results := range *response {
+		if !reflect.DeepEqual(recordIds(results), expected[i]) {
+			t.Errorf("Query %d: expected %v, got %v", i, expected[i], recordIds(results))
+		}
+	}
+
+	// a batch should rank the same way individual queries do
+	for i, query := range queries {
+		single, err := collection.Query(query, 2)
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		if !reflect.DeepEqual(*single, (*response)[i]) {
+			t.Errorf("Query %d: batch result %v != single result %v", i, (*response)[i], *single)
+		}
+	}
+}
+
+func resultIds(results []QueryResult) []string {
+	ids := make([]string, len(results))
+	for i, result := range results {
+		ids[i] = result.Record.Id
+	}
+	return ids
+}
+
+func TestQueryWithOptions(t *testing.T) {
+	collection := makeVectorCollection(t, "test-query-options", map[string]string{
+		"x":  "1,0",
+		"xy": "1,1",
+		"y":  "0,1",
+		"-x": "-1,0",
+	})
+
+	// no options means every record, ranked, with scores attached
+	results, err := collection.QueryWithOptions([]byte("1,0"), QueryOptions{})
+	if err != nil {
+		t.Fatalf("QueryWithOptions failed: %v", err)
+	}
+	if !reflect.DeepEqual(resultIds(results), []string{"x", "xy", "y", "-x"}) {
+		t.Errorf("Unexpected results %v", resultIds(results))
+	}
+	if results[0].Similarity != 1 || results[0].Distance != 0 {
+		t.Errorf("Expected an exact match to have similarity 1 and distance 0, got %v", results[0])
+	}
+	if results[3].Similarity != -1 || results[3].Distance != 2 {
+		t.Errorf("Expected an opposite vector to have similarity -1 and distance 2, got %v", results[3])
+	}
+
+	// a threshold drops irrelevant records even when k would allow them
+	minSimilarity := 0.5
+	results, err = collection.QueryWithOptions([]byte("1,0"), QueryOptions{NGreatest: 3, MinSimilarity: &minSimilarity})
+	if err != nil {
+		t.Fatalf("QueryWithOptions failed: %v", err)
+	}
+	if !reflect.DeepEqual(resultIds(results), []string{"x", "xy"}) {
+		t.Errorf("Expected the threshold to cut off results, got %v", resultIds(results))
+	}
+
+	// and k still applies when plenty of records pass the threshold
+	results, err = collection.QueryWithOptions([]byte("1,0"), QueryOptions{NGreatest: 1, MinSimilarity: &minSimilarity})
+	if err != nil {
+		t.Fatalf("QueryWithOptions failed: %v", err)
+	}
+	if !reflect.DeepEqual(resultIds(results), []string{"x"}) {
+		t.Errorf("Expected k to cut off results, got %v", resultIds(results))
+	}
+
+	maxDistance := 1.0
+	results, err = collection.QueryWithOptions([]byte("1,0"), QueryOptions{MaxDistance: &maxDistance})
+	if err != nil {
+		t.Fatalf("QueryWithOptions failed: %v", err)
+	}
+	if !reflect.DeepEqual(resultIds(results), []string{"x", "xy", "y"}) {
+		t.Errorf("Expected the max distance to cut off results, got %v", resultIds(results))
+	}
+
+	_, err = collection.QueryWithOptions([]byte("1,0"), QueryOptions{NGreatest: -1})
+	if err == nil {
+		t.Errorf("Should not have been able to query with a negative NGreatest")
+	}
+}
+
+func TestRangeQuery(t *testing.T) {
+	collection := makeVectorCollection(t, "test-range-query", map[string]string{
+		"x":  "1,0",
+		"xy": "1,1",
+		"y":  "0,1",
+	})
+	results, err := collection.RangeQuery([]byte("1,0"), 0.5)
+	if err != nil {
+		t.Fatalf("RangeQuery failed: %v", err)
+	}
+	if !reflect.DeepEqual(resultIds(results), []string{"x", "xy"}) {
+		t.Errorf("Unexpected range query results %v", resultIds(results))
+	}
+
+	results, err = collection.RangeQuery([]byte("-1,0"), 0.5)
+	if err != nil {
+		t.Fatalf("RangeQuery failed: %v", err)
+	}
+	if len(results) != 0 {
+		t.Errorf("Expected no records within range, got %v", resultIds(results))
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	collection := makeVectorCollection(t, "test-query-errors", map[string]string{
+		"x": "1,0",
+	})
+	_, err := collection.QueryVector([]float64{1, 0, 0}, QueryOptions{})
+	if !errors.Is(err, utils.ErrDimensionMismatch) {
+		t.Errorf("Expected a dimension mismatch, got %v", err)
+	}
+	_, err = collection.QueryWithOptions([]byte("1,0"), QueryOptions{NGreatest: -1})
+	if !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("Expected invalid options, got %v", err)
+	}
+	for _, n_greatest := range []int{-1, -5} {
+		_, err = collection.Query([]byte("1,0"), n_greatest)
+		if !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("Expected invalid options for n_greatest %d, got %v", n_greatest, err)
+		}
+		_, err = collection.QueryBatch([][]byte{[]byte("1,0")}, n_greatest)
+		if !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("Expected invalid options for a batch with n_greatest %d, got %v", n_greatest, err)
+		}
+	}
+	_, err = collection.ListRecords(ListOptions{Cursor: "nonsense!"})
+	if !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("Expected an invalid cursor, got %v", err)
+	}
+	_, err = collection.GetRecord("missing")
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Expected a missing record, got %v", err)
+	}
+	collection.EmbedderId = "no-such-embedder"
+	_, err = collection.Query([]byte("1,0"), 1)
+	if !errors.Is(err, embedders.ErrUnknownEmbedder) {
+		t.Errorf("Expected an unknown embedder, got %v", err)
+	}
+}
+
+func TestQueryEmbeddingCache(t *testing.T) {
+	collection := makeVectorCollection(t, "test-query-cache", map[string]string{
+		"x": "1,0",
+		"y": "0,1",
+	})
+	calls := 0
+	embedders.EmbedderRegister["counting-embedder"] = func(blob []byte) ([]float64, error) {
+		calls++
+		return VectorEmbed(blob)
+	}
+	defer delete(embedders.EmbedderRegister, "counting-embedder")
+	collection.EmbedderId = "counting-embedder"
+	cache, _ := embedders.MakeCache(embedders.CacheOptions{})
+	embedders.SetCache(cache)
+	defer embedders.SetCache(nil)
+
+	for i := 0; i < 3; i++ {
+		_, err := collection.Query([]byte("1,0"), 1)
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+	}
+	_, err := collection.QueryBatch([][]byte{[]byte("1,0"), []byte("0,1")}, 1)
+	if err != nil {
+		t.Fatalf("QueryBatch failed: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected each query to be embedded once, got %d calls", calls)
+	}
+	if stats := cache.Stats(); stats.Hits != 3 || stats.Misses != 2 {
+		t.Errorf("Unexpected cache stats %+v", stats)
+	}
+}
+
+func TestMMRQuery(t *testing.T) {
+	// three near-identical chunks pointing along x, and a less relevant
+	// but distinct chunk between x and y
+	collection := makeVectorCollection(t, "test-mmr", map[string]string{
+		"chunk-1": "1,0.01,0",
+		"chunk-2": "1,0.02,0",
+		"chunk-3": "1,0.03,0",
+		"other":   "1,1,0",
+	})
+
+	results, err := collection.QueryWithOptions([]byte("1,0,0"), QueryOptions{NGreatest: 2})
+	if err != nil {
+		t.Fatalf("QueryWithOptions failed: %v", err)
+	}
+	if !reflect.DeepEqual(resultIds(results), []string{"chunk-1", "chunk-2"}) {
+		t.Errorf("Expected plain relevance ranking without MMR, got %v", resultIds(results))
+	}
+
+	results, err = collection.QueryWithOptions([]byte("1,0,0"), QueryOptions{NGreatest: 2, MMR: &MMROptions{Lambda: 0.4}})
+	if err != nil {
+		t.Fatalf("QueryWithOptions failed: %v", err)
+	}
+	if !reflect.DeepEqual(resultIds(results), []string{"chunk-1", "other"}) {
+		t.Errorf("Expected MMR to skip the duplicate chunk, got %v", resultIds(results))
+	}
+
+	// lambda = 1 is pure relevance
+	results, err = collection.QueryWithOptions([]byte("1,0,0"), QueryOptions{NGreatest: 2, MMR: &MMROptions{Lambda: 1}})
+	if err != nil {
+		t.Fatalf("QueryWithOptions failed: %v", err)
+	}
+	if !reflect.DeepEqual(resultIds(results), []string{"chunk-1", "chunk-2"}) {
+		t.Errorf("Expected lambda = 1 to rank by relevance, got %v", resultIds(results))
+	}
+
+	// the candidate pool limits what MMR can choose from
+	results, err = collection.QueryWithOptions([]byte("1,0,0"), QueryOptions{NGreatest: 2, MMR: &MMROptions{Lambda: 0.4, FetchK: 3}})
+	if err != nil {
+		t.Fatalf("QueryWithOptions failed: %v", err)
+	}
+	if len(results) != 2 || slices.Contains(resultIds(results), "other") {
+		t.Errorf("Expected MMR to pick from the three closest chunks, got %v", resultIds(results))
+	}
+
+	_, err = collection.QueryWithOptions([]byte("1,0,0"), QueryOptions{NGreatest: 2, MMR: &MMROptions{Lambda: 1.5}})
+	if err == nil {
+		t.Errorf("Should not have been able to use a lambda outside [0, 1]")
+	}
+}
+
+func TestMergeResults(t *testing.T) {
+	vectors := map[string]string{
+		"chunk-1": "1,0.01,0",
+		"chunk-2": "1,0.02,0",
+		"chunk-3": "1,0.03,0",
+		"other":   "1,1,0",
+		"far":     "0,1,0",
+	}
+	all := makeVectorCollection(t, "test-merge-all", vectors)
+	halves := []Collection{
+		makeVectorCollection(t, "test-merge-1", map[string]string{"chunk-1": vectors["chunk-1"], "other": vectors["other"]}),
+		makeVectorCollection(t, "test-merge-2", map[string]string{"chunk-2": vectors["chunk-2"], "chunk-3": vectors["chunk-3"], "far": vectors["far"]}),
+	}
+
+	for _, options := range []QueryOptions{{NGreatest: 3}, {}, {NGreatest: 2, MMR: &MMROptions{Lambda: 0.4}}} {
+		expected, err := all.QueryVector([]float64{1, 0, 0}, options)
+		if err != nil {
+			t.Fatalf("QueryVector failed: %v", err)
+		}
+		resultSets := make([][]QueryResult, 0)
+		for _, half := range halves {
+			results, err := half.QueryVector([]float64{1, 0, 0}, options.CandidateOptions())
+			if err != nil {
+				t.Fatalf("QueryVector failed: %v", err)
+			}
+			resultSets = append(resultSets, results)
+		}
+		merged, err := MergeResults(resultSets, options)
+		if err != nil {
+			t.Fatalf("MergeResults failed: %v", err)
+		}
+		if !reflect.DeepEqual(resultIds(merged), resultIds(expected)) {
+			t.Errorf("Expected merged results %v, got %v", resultIds(expected), resultIds(merged))
+		}
+	}
+
+	_, err := MergeResults(nil, QueryOptions{NGreatest: -1})
+	if err == nil {
+		t.Errorf("Should not have been able to merge with a negative NGreatest")
+	}
+}
+
+func TestQueryWhere(t *testing.T) {
+	collection := makeVectorCollection(t, "test-query-where", map[string]string{
+		"x":  "1,0",
+		"xy": "1,1",
+	})
+	collection.Records["xy"] = withMetadata(collection.Records["xy"], map[string]string{"lang": "en"})
+
+	results, err := collection.QueryWithOptions([]byte("1,0"), QueryOptions{Where: map[string]string{"lang": "en"}})
+	if err != nil {
+		t.Fatalf("QueryWithOptions failed: %v", err)
+	}
+	if !reflect.DeepEqual(resultIds(results), []string{"xy"}) {
+		t.Errorf("Expected the metadata filter to drop records, got %v", resultIds(results))
+	}
+}
+
+func withMetadata(record records.Record, metadata map[string]string) records.Record {
+	record.Metadata = metadata
+	return record
+}
+
+func makeListCollection(t *testing.T) Collection {
+	embedders.EmbedderRegister["mock-embedder"] = MockEmbed
+	collection := Collection{Id: "test-list", EmbedderId: "mock-embedder", Records: make(map[string]records.Record)}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// inserted in the reverse order of their IDs
+	for i := range 5 {
+		id := fmt.Sprintf("record-%d", 4-i)
+		record, err := records.MakeRecord("mock-embedder", []byte(id), id)
+		if err != nil {
+			t.Fatalf("Could not create record: %v", err)
+		}
+		record.CreatedAt = start.Add(time.Duration(i) * time.Minute)
+		if i%2 == 0 {
+			record.Metadata = map[string]string{"parity": "even"}
+		}
+		err = collection.AddRecord(record)
+		if err != nil {
+			t.Fatalf("Could not add record: %v", err)
+		}
+	}
+	return collection
+}
+
+func TestListRecords(t *testing.T) {
+	collection := makeListCollection(t)
+
+	page, err := collection.ListRecords(ListOptions{})
+	if err != nil {
+		t.Fatalf("ListRecords failed: %v", err)
+	}
+	expected := []string{"record-0", "record-1", "record-2", "record-3", "record-4"}
+	if !reflect.DeepEqual(recordIds(page.Records), expected) || page.NextCursor != "" {
+		t.Errorf("Expected every record ordered by ID, got %v (cursor %q)", recordIds(page.Records), page.NextCursor)
+	}
+
+	// page through by insertion time
+	listed := make([]string, 0)
+	options := ListOptions{OrderBy: OrderByInsertion, Limit: 2}
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatalf("Paging never finished")
+		}
+		page, err = collection.ListRecords(options)
+		if err != nil {
+			t.Fatalf("ListRecords failed: %v", err)
+		}
+		listed = append(listed, recordIds(page.Records)...)
+		if page.NextCursor == "" {
+			break
+		}
+		options.Cursor = page.NextCursor
+	}
+	expected = []string{"record-4", "record-3", "record-2", "record-1", "record-0"}
+	if !reflect.DeepEqual(listed, expected) {
+		t.Errorf("Expected records in insertion order, got %v", listed)
+	}
+
+	// cursors survive records being deleted out from under them
+	page, err = collection.ListRecords(ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatalf("ListRecords failed: %v", err)
+	}
+	collection.DeleteRecord("record-1")
+	page, err = collection.ListRecords(ListOptions{Limit: 2, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatalf("ListRecords failed: %v", err)
+	}
+	if !reflect.DeepEqual(recordIds(page.Records), []string{"record-2", "record-3"}) {
+		t.Errorf("Unexpected second page %v", recordIds(page.Records))
+	}
+
+	_, err = collection.ListRecords(ListOptions{OrderBy: OrderByInsertion, Cursor: page.NextCursor})
+	if err == nil {
+		t.Errorf("Should not have been able to use an ID cursor for insertion order")
+	}
+	_, err = collection.ListRecords(ListOptions{Cursor: "not a cursor"})
+	if err == nil {
+		t.Errorf("Should not have been able to use a garbage cursor")
+	}
+}
+
+// countingStore is a RecordStore that counts the records its scans visit
+type countingStore struct {
+	records map[string]records.Record
+	visited int
+}
+
+func (store *countingStore) GetRecord(recordId string) (records.Record, bool, error) {
+	record, ok := store.records[recordId]
+	return record, ok, nil
+}
+
+func (store *countingStore) PutRecord(record records.Record) error {
+	store.records[record.Id] = record
+	return nil
+}
+
+func (store *countingStore) DeleteRecord(recordId string) (bool, error) {
+	_, ok := store.records[recordId]
+	delete(store.records, recordId)
+	return ok, nil
+}
+
+func (store *countingStore) ScanRecords(fn func(record records.Record) bool) error {
+	return store.ScanRecordsAfter("", fn)
+}
+
+func (store *countingStore) ScanRecordsAfter(afterId string, fn func(record records.Record) bool) error {
+	recordIds := make([]string, 0)
+	for recordId := range store.records {
+		if recordId > afterId {
+			recordIds = append(recordIds, recordId)
+		}
+	}
+	slices.Sort(recordIds)
+	for _, recordId := range recordIds {
+		store.visited++
+		if !fn(store.records[recordId]) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestListRecordsReadsOnlyThePage(t *testing.T) {
+	embedders.EmbedderRegister["vector-embedder"] = VectorEmbed
+	store := &countingStore{records: make(map[string]records.Record)}
+	collection := Collection{Id: "test-list-store", EmbedderId: "vector-embedder", Store: store}
+	for i := 0; i < 100; i++ {
+		record := records.Record{Id: fmt.Sprintf("record-%02d", i), EmbedderId: "vector-embedder", Embedding: []float64{1, 0}}
+		err := collection.AddRecord(&record)
+		if err != nil {
+			t.Fatalf("Could not add record: %v", err)
+		}
+	}
+
+	page, err := collection.ListRecords(ListOptions{Limit: 10})
+	if err != nil {
+		t.Fatalf("ListRecords failed: %v", err)
+	}
+	store.visited = 0
+	page, err = collection.ListRecords(ListOptions{Limit: 10, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatalf("ListRecords failed: %v", err)
+	}
+	if len(page.Records) != 10 || page.Records[0].Id != "record-10" || page.NextCursor == "" {
+		t.Errorf("Unexpected second page %v (cursor %q)", recordIds(page.Records), page.NextCursor)
+	}
+	if store.visited != 11 {
+		t.Errorf("Expected a page of 10 to read 11 records from the cursor on, read %d", store.visited)
+	}
+}
+
+func TestListRecordsFilterAndExclude(t *testing.T) {
+	collection := makeListCollection(t)
+
+	page, err := collection.ListRecords(ListOptions{Where: map[string]string{"parity": "even"}, ExcludeEmbeddings: true, ExcludeBlobs: true})
+	if err != nil {
+		t.Fatalf("ListRecords failed: %v", err)
+	}
+	if !reflect.DeepEqual(recordIds(page.Records), []string{"record-0", "record-2", "record-4"}) {
+		t.Errorf("Expected only records matching the filter, got %v", recordIds(page.Records))
+	}
+	for _, record := range page.Records {
+		if record.Embedding != nil || record.Blob != nil {
+			t.Errorf("Expected embedding and blob to be excluded from %s", record.Id)
+		}
+	}
+	if collection.Records["record-0"].Embedding == nil {
+		t.Errorf("Excluding embeddings from a listing should not touch the stored records")
+	}
+}
+
+func TestCountAndPeek(t *testing.T) {
+	collection := makeListCollection(t)
+	count, err := collection.Count()
+	if err != nil || count != 5 {
+		t.Errorf("Expected a count of 5, got %d (%v)", count, err)
+	}
+	peeked, err := collection.Peek(2)
+	if err != nil {
+		t.Fatalf("Peek failed: %v", err)
+	}
+	if !reflect.DeepEqual(recordIds(peeked), []string{"record-4", "record-3"}) {
+		t.Errorf("Expected to peek the first records added, got %v", recordIds(peeked))
+	}
+}
+
+func TestUpsertRecord(t *testing.T) {
+	collection := makeVectorCollection(t, "test-upsert", map[string]string{"x": "1,0"})
+	original := collection.Records["x"]
+	if original.CreatedAt.IsZero() || !original.UpdatedAt.IsZero() {
+		t.Errorf("Expected a new record to have only a CreatedAt time, got %v / %v", original.CreatedAt, original.UpdatedAt)
+	}
+
+	replacement, err := records.MakeRecord("vector-embedder", []byte("0,1"), "x")
+	if err != nil {
+		t.Fatalf("Could not create record: %v", err)
+	}
+	replaced, err := collection.UpsertRecord(replacement)
+	if err != nil || !replaced {
+		t.Fatalf("Could not replace record: %v", err)
+	}
+	updated := collection.Records["x"]
+	if !reflect.DeepEqual(updated.Embedding, []float64{0, 1}) {
+		t.Errorf("Upsert did not replace the record")
+	}
+	if !updated.CreatedAt.Equal(original.CreatedAt) || updated.UpdatedAt.IsZero() {
+		t.Errorf("Expected upsert to keep CreatedAt and set UpdatedAt, got %v / %v", updated.CreatedAt, updated.UpdatedAt)
+	}
+
+	fresh, err := records.MakeRecord("vector-embedder", []byte("1,1"), "y")
+	if err != nil {
+		t.Fatalf("Could not create record: %v", err)
+	}
+	// an UpdatedAt time from the caller doesn't survive adding
+	fresh.UpdatedAt = time.Now()
+	replaced, err = collection.UpsertRecord(fresh)
+	if err != nil || replaced {
+		t.Fatalf("Could not upsert new record: %v", err)
+	}
+	count, _ := collection.Count()
+	if count != 2 || !collection.Records["y"].UpdatedAt.IsZero() {
+		t.Errorf("Expected upsert of a new record to add it")
+	}
+
+	wrongEmbedder := records.Record{Id: "x", EmbedderId: "other", Embedding: []float64{1, 0}}
+	_, err = collection.UpsertRecord(&wrongEmbedder)
+	if err == nil {
+		t.Errorf("Should not have been able to upsert a record with the wrong embedder")
+	}
+}
+
+func TestExpiredRecords(t *testing.T) {
+	collection := makeVectorCollection(t, "test-expiry", map[string]string{
+		"live":    "1,0",
+		"expired": "1,0.1",
+	})
+	expired := collection.Records["expired"]
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	collection.Records["expired"] = expired
+
+	results, err := collection.QueryWithOptions([]byte("1,0"), QueryOptions{})
+	if err != nil {
+		t.Fatalf("QueryWithOptions failed: %v", err)
+	}
+	if !reflect.DeepEqual(resultIds(results), []string{"live"}) {
+		t.Errorf("Expected expired records to be left out of queries, got %v", resultIds(results))
+	}
+	batch, err := collection.QueryBatch([][]byte{[]byte("1,0.1")}, 5)
+	if err != nil {
+		t.Fatalf("QueryBatch failed: %v", err)
+	}
+	if !reflect.DeepEqual(recordIds((*batch)[0]), []string{"live"}) {
+		t.Errorf("Expected expired records to be left out of batch queries, got %v", recordIds((*batch)[0]))
+	}
+	page, err := collection.ListRecords(ListOptions{})
+	if err != nil {
+		t.Fatalf("ListRecords failed: %v", err)
+	}
+	if !reflect.DeepEqual(recordIds(page.Records), []string{"live"}) {
+		t.Errorf("Expected expired records to be left out of listings, got %v", recordIds(page.Records))
+	}
+	_, err = collection.GetRecord("expired")
+	if err == nil {
+		t.Errorf("Should not have been able to get an expired record")
+	}
+	count, err := collection.Count()
+	if err != nil || count != 1 {
+		t.Errorf("Expected expired records not to be counted, got %d (%v)", count, err)
+	}
+
+	// an expired record's ID is free to be reused
+	record, err := records.MakeRecord("vector-embedder", []byte("0,1"), "expired")
+	if err != nil {
+		t.Fatalf("Could not create record: %v", err)
+	}
+	err = collection.AddRecord(record)
+	if err != nil {
+		t.Errorf("Should have been able to add over an expired record: %v", err)
+	}
+
+	collection.Records["expired"] = expired
+	removed, err := collection.RemoveExpired(time.Now())
+	if err != nil || !reflect.DeepEqual(removed, []string{"expired"}) || len(collection.Records) != 1 {
+		t.Errorf("Expected RemoveExpired to remove the expired record, removed %v leaving %d", removed, len(collection.Records))
+	}
+}
+
+func TestCollectionTTL(t *testing.T) {
+	collection := makeVectorCollection(t, "test-ttl", map[string]string{})
+	collection.TTL = 30 * 24 * time.Hour
+
+	record, err := records.MakeRecord("vector-embedder", []byte("1,0"), "news")
+	if err != nil {
+		t.Fatalf("Could not create record: %v", err)
+	}
+	err = collection.AddRecord(record)
+	if err != nil {
+		t.Fatalf("Could not add record: %v", err)
+	}
+	stored := collection.Records["news"]
+	if !stored.ExpiresAt.Equal(stored.CreatedAt.Add(collection.TTL)) {
+		t.Errorf("Expected record to expire %v after it was created, got %v", collection.TTL, stored.ExpiresAt)
+	}
+
+	// a record's own expiry beats the collection's
+	record, err = records.MakeRecord("vector-embedder", []byte("1,0"), "flash")
+	if err != nil {
+		t.Fatalf("Could not create record: %v", err)
+	}
+	record.SetTTL(time.Hour)
+	expiresAt := record.ExpiresAt
+	err = collection.AddRecord(record)
+	if err != nil {
+		t.Fatalf("Could not add record: %v", err)
+	}
+	if !collection.Records["flash"].ExpiresAt.Equal(expiresAt) {
+		t.Errorf("Expected record to keep its own expiry")
+	}
+
+	JSONBody, err := json.Marshal(collection)
+	if err != nil {
+		t.Fatalf("Could not marshal collection: %v", err)
+	}
+	JSONCollection := Collection{}
+	err = json.Unmarshal(JSONBody, &JSONCollection)
+	if err != nil {
+		t.Fatalf("Could not unmarshal collection: %v", err)
+	}
+	if !reflect.DeepEqual(collection, JSONCollection) {
+		t.Errorf("Collection with TTL did not survive JSON (expected %v, got %v)", collection, JSONCollection)
+	}
+}
+
 func TestQueryAgainstRealEmbeddings(t *testing.T) {
 	// does the embedder functionality work under a semi-real scenario?
 	// the idea here is that we make embeddings for 3 vastly different sentences, then check the
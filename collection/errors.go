@@ -0,0 +1,21 @@
+package collection
+
+import "errors"
+
+// Errors from collections, and from databases and storage engines holding
+// them, wrap one of these with the details, so callers can check for them
+// with errors.Is
+var (
+	ErrCollectionNotFound = errors.New("Collection does not exist")
+	ErrCollectionExists   = errors.New("Collection already exists")
+	ErrRecordNotFound     = errors.New("Record does not exist")
+	ErrRecordExists       = errors.New("Record already exists")
+	// a record made with a different embedder than the collection's
+	ErrEmbedderMismatch = errors.New("Record and collection embedders differ")
+	ErrMissingEmbedding = errors.New("Record has no embedding")
+	// record IDs can't be empty, which is where scans start from
+	ErrMissingRecordId = errors.New("Record has no ID")
+	// bad QueryOptions or ListOptions
+	ErrInvalidOptions = errors.New("Invalid options")
+	ErrInvalidCursor  = errors.New("Invalid cursor")
+)
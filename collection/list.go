@@ -0,0 +1,219 @@
+package collection
+
+import (
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	records "go-simple-embedding-database/records"
+)
+
+type ListOrder int
+
+const (
+	// Order records by ID
+	OrderById ListOrder = iota
+	// Order records by the time they were added to the collection, oldest
+	// first. Records added at the same instant are ordered by ID
+	OrderByInsertion
+)
+
+func (order ListOrder) String() string {
+	switch order {
+	case OrderById:
+		return "id"
+	case OrderByInsertion:
+		return "insertion"
+	default:
+		return fmt.Sprintf("ListOrder(%d)", int(order))
+	}
+}
+
+// ParseListOrder is the inverse of ListOrder.String
+func ParseListOrder(order string) (ListOrder, error) {
+	switch order {
+	case "id":
+		return OrderById, nil
+	case "insertion":
+		return OrderByInsertion, nil
+	default:
+		return OrderById, fmt.Errorf("%w: unknown list order %q (expected id or insertion)", ErrInvalidOptions, order)
+	}
+}
+
+type ListOptions struct {
+	OrderBy ListOrder
+	// Cursor is the NextCursor from a previous page. Leave it empty to
+	// start from the beginning
+	Cursor string
+	// The maximum number of records in a page. 0 means no limit
+	Limit int
+	// Only list records whose metadata matches every key/value here
+	Where map[string]string
+	// Leave the embeddings and/or blobs out of the listed records
+	ExcludeEmbeddings bool
+	ExcludeBlobs      bool
+}
+
+type RecordPage struct {
+	Records []records.Record `json:"records"`
+	// Pass this back in ListOptions.Cursor to get the next page. Empty once
+	// there are no more records
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// a cursor is the sort key of the last record on the page, so paging is
+// stable even when records are added or deleted between calls
+type cursor struct {
+	order     ListOrder
+	createdAt time.Time
+	id        string
+}
+
+func makeCursor(order ListOrder, record records.Record) cursor {
+	return cursor{order: order, createdAt: record.CreatedAt, id: record.Id}
+}
+
+func (c cursor) encode() string {
+	raw := fmt.Sprintf("%d:%d:%s", c.order, c.createdAt.UnixNano(), c.id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(encoded string) (cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor{}, fmt.Errorf("%w %s: %w", ErrInvalidCursor, encoded, err)
+	}
+	fields := strings.SplitN(string(raw), ":", 3)
+	if len(fields) != 3 {
+		return cursor{}, fmt.Errorf("%w %s", ErrInvalidCursor, encoded)
+	}
+	order, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return cursor{}, fmt.Errorf("%w %s: %w", ErrInvalidCursor, encoded, err)
+	}
+	nanos, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return cursor{}, fmt.Errorf("%w %s: %w", ErrInvalidCursor, encoded, err)
+	}
+	return cursor{order: ListOrder(order), createdAt: time.Unix(0, nanos).UTC(), id: fields[2]}, nil
+}
+
+func compareRecords(order ListOrder, a cursor, b cursor) int {
+	if order == OrderByInsertion {
+		if c := a.createdAt.Compare(b.createdAt); c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(a.id, b.id)
+}
+
+func stripRecord(record records.Record, options ListOptions) records.Record {
+	if options.ExcludeEmbeddings {
+		record.Embedding = nil
+	}
+	if options.ExcludeBlobs {
+		record.Blob = nil
+	}
+	return record
+}
+
+// ListRecords returns a page of the collection's records in a stable order.
+// Pages by ID are read straight from the cursor on, in order, and only as
+// far as the end of the page; pages by insertion order have to look at
+// every record
+func (collection Collection) ListRecords(options ListOptions) (RecordPage, error) {
+	if options.OrderBy != OrderById && options.OrderBy != OrderByInsertion {
+		return RecordPage{}, fmt.Errorf("%w: unknown list order %v", ErrInvalidOptions, options.OrderBy)
+	}
+	if options.Limit < 0 {
+		return RecordPage{}, fmt.Errorf("%w: limit must not be negative (got %d)", ErrInvalidOptions, options.Limit)
+	}
+	var after *cursor
+	if options.Cursor != "" {
+		decoded, err := decodeCursor(options.Cursor)
+		if err != nil {
+			return RecordPage{}, err
+		}
+		if decoded.order != options.OrderBy {
+			return RecordPage{}, fmt.Errorf("%w: cursor was created for %v order, not %v", ErrInvalidCursor, decoded.order, options.OrderBy)
+		}
+		after = &decoded
+	}
+
+	now := time.Now()
+	matching := make([]records.Record, 0)
+	keep := func(record records.Record) bool {
+		return !record.Expired(now) && record.MatchesMetadata(options.Where)
+	}
+	var err error
+	if options.OrderBy == OrderById {
+		afterId := ""
+		if after != nil {
+			afterId = after.id
+		}
+		// one record past the page says whether there's another page
+		err = collection.scanAfter(afterId, func(record records.Record) bool {
+			if keep(record) {
+				matching = append(matching, record)
+			}
+			return options.Limit == 0 || len(matching) <= options.Limit
+		})
+	} else {
+		err = collection.scan(func(record records.Record) bool {
+			if !keep(record) {
+				return true
+			}
+			if after != nil && compareRecords(options.OrderBy, makeCursor(options.OrderBy, record), *after) <= 0 {
+				return true
+			}
+			matching = append(matching, record)
+			return true
+		})
+		slices.SortFunc(matching, func(a, b records.Record) int {
+			return compareRecords(options.OrderBy, makeCursor(options.OrderBy, a), makeCursor(options.OrderBy, b))
+		})
+	}
+	if err != nil {
+		return RecordPage{}, err
+	}
+
+	page := RecordPage{Records: matching}
+	if options.Limit > 0 && len(matching) > options.Limit {
+		page.Records = matching[:options.Limit]
+		page.NextCursor = makeCursor(options.OrderBy, page.Records[options.Limit-1]).encode()
+	}
+	for i := range page.Records {
+		page.Records[i] = stripRecord(page.Records[i], options)
+	}
+	return page, nil
+}
+
+// Count returns the number of records in the collection, not counting
+// any that have expired
+func (collection Collection) Count() (int, error) {
+	now := time.Now()
+	count := 0
+	err := collection.scan(func(record records.Record) bool {
+		if !record.Expired(now) {
+			count += 1
+		}
+		return true
+	})
+	return count, err
+}
+
+// Peek returns the first n records added to the collection
+func (collection Collection) Peek(n int) ([]records.Record, error) {
+	if n == 0 {
+		return make([]records.Record, 0), nil
+	}
+	page, err := collection.ListRecords(ListOptions{OrderBy: OrderByInsertion, Limit: n})
+	if err != nil {
+		return nil, err
+	}
+	return page.Records, nil
+}
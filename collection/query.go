@@ -0,0 +1,405 @@
+package collection
+
+import (
+	"container/heap"
+	"fmt"
+	"slices"
+	"time"
+
+	embedders "go-simple-embedding-database/embedders"
+	metrics "go-simple-embedding-database/metrics"
+	records "go-simple-embedding-database/records"
+	utils "go-simple-embedding-database/utils"
+)
+
+// queryDuration times every query, including embedding the query. A batch
+// of queries counts as one
+var queryDuration = metrics.Register(metrics.MakeHistogram("sedb_collection_query_duration_seconds", "How long queries against a collection took", nil, "collection"))
+
+// QueryResult is a record along with how close it was to the query.
+// Distance is the cosine distance, i.e. 1 - Similarity
+type QueryResult struct {
+	Record     records.Record `json:"record"`
+	Similarity float64        `json:"similarity"`
+	Distance   float64        `json:"distance"`
+}
+
+func makeQueryResult(record records.Record, similarity float64) QueryResult {
+	return QueryResult{Record: record, Similarity: similarity, Distance: 1 - similarity}
+}
+
+// QueryOptions narrows down what a query returns. The zero value returns
+// every record in the collection, ranked
+type QueryOptions struct {
+	// The maximum number of results to return. 0 means no limit
+	NGreatest int
+	// Drop records whose similarity to the query is below this
+	MinSimilarity *float64
+	// Drop records whose distance from the query is above this
+	MaxDistance *float64
+	// Only consider records whose metadata matches every key/value here
+	Where map[string]string
+	// Re-rank the results with maximal marginal relevance
+	MMR *MMROptions
+}
+
+// MMROptions controls maximal marginal relevance re-ranking. The FetchK most
+// relevant records are fetched first, then NGreatest of them are picked one
+// at a time, each time taking the record that best balances relevance to the
+// query against similarity to the records already picked.
+//
+// Lambda runs from 0 (only care about diversity) to 1 (only care about
+// relevance, which is the same as not using MMR). 0.5 is a reasonable start
+type MMROptions struct {
+	Lambda float64
+	// Size of the candidate pool. Defaults to defaultFetchK (or NGreatest if
+	// that's larger)
+	FetchK int
+}
+
+const defaultFetchK = 20
+
+func (options QueryOptions) validate() error {
+	if options.NGreatest < 0 {
+		return fmt.Errorf("%w: NGreatest must not be negative (got %d)", ErrInvalidOptions, options.NGreatest)
+	}
+	if options.MMR != nil {
+		if options.MMR.Lambda < 0 || options.MMR.Lambda > 1 {
+			return fmt.Errorf("%w: MMR lambda must be between 0 and 1 (got %f)", ErrInvalidOptions, options.MMR.Lambda)
+		}
+		if options.MMR.FetchK < 0 {
+			return fmt.Errorf("%w: MMR FetchK must not be negative (got %d)", ErrInvalidOptions, options.MMR.FetchK)
+		}
+	}
+	return nil
+}
+
+func (options QueryOptions) limit() int {
+	if options.MMR != nil {
+		return options.fetchK()
+	}
+	if options.NGreatest == 0 {
+		return noLimit
+	}
+	return options.NGreatest
+}
+
+func (options QueryOptions) fetchK() int {
+	if options.MMR.FetchK > 0 {
+		return max(options.MMR.FetchK, options.NGreatest)
+	}
+	return max(defaultFetchK, options.NGreatest)
+}
+
+func (options QueryOptions) keep(result QueryResult) bool {
+	if !result.Record.MatchesMetadata(options.Where) {
+		return false
+	}
+	if options.MinSimilarity != nil && result.Similarity < *options.MinSimilarity {
+		return false
+	}
+	if options.MaxDistance != nil && result.Distance > *options.MaxDistance {
+		return false
+	}
+	return true
+}
+
+func keepAll(result QueryResult) bool {
+	return true
+}
+
+const noLimit = -1
+
+// more similar records rank first. ties are broken on the record ID so
+// that results are stable from one query to the next
+func ranksAhead(a, b QueryResult) bool {
+	if a.Similarity != b.Similarity {
+		return a.Similarity > b.Similarity
+	}
+	return a.Record.Id < b.Record.Id
+}
+
+// topRecords keeps the n best records seen so far. It's a min-heap with
+// the worst of the kept records at the root, so a new record only needs
+// to beat the root to get in. An n of noLimit keeps everything
+type topRecords struct {
+	n     int
+	items []QueryResult
+}
+
+func (t *topRecords) Len() int           { return len(t.items) }
+func (t *topRecords) Less(i, j int) bool { return ranksAhead(t.items[j], t.items[i]) }
+func (t *topRecords) Swap(i, j int)      { t.items[i], t.items[j] = t.items[j], t.items[i] }
+func (t *topRecords) Push(x any)         { t.items = append(t.items, x.(QueryResult)) }
+func (t *topRecords) Pop() any {
+	last := t.items[len(t.items)-1]
+	t.items = t.items[:len(t.items)-1]
+	return last
+}
+
+func (t *topRecords) offer(candidate QueryResult) {
+	if t.n == noLimit {
+		t.items = append(t.items, candidate)
+		return
+	}
+	if t.n <= 0 {
+		return
+	}
+	if len(t.items) < t.n {
+		heap.Push(t, candidate)
+		return
+	}
+	if ranksAhead(candidate, t.items[0]) {
+		t.items[0] = candidate
+		heap.Fix(t, 0)
+	}
+}
+
+func (t *topRecords) sorted() []QueryResult {
+	sorted := slices.Clone(t.items)
+	if sorted == nil {
+		sorted = make([]QueryResult, 0)
+	}
+	slices.SortFunc(sorted, func(a, b QueryResult) int {
+		if ranksAhead(a, b) {
+			return -1
+		}
+		return 1
+	})
+	return sorted
+}
+
+// rankRecords scores every record in the collection against every query
+// vector in a single pass. Records are the outer loop so each embedding is
+// only pulled in once no matter how many queries are being run. Results
+// that keep rejects never make it into the rankings
+func (collection Collection) rankRecords(queryEmbeddings [][]float64, n_greatest int, keep func(QueryResult) bool) ([][]QueryResult, error) {
+	tops := make([]topRecords, len(queryEmbeddings))
+	for i := range tops {
+		tops[i].n = n_greatest
+	}
+	now := time.Now()
+	var scoreErr error
+	err := collection.scan(func(record records.Record) bool {
+		if record.Expired(now) {
+			return true
+		}
+		for i, queryEmbedding := range queryEmbeddings {
+			similarity, err := utils.CosineSimilarity(queryEmbedding, record.Embedding)
+			if err != nil {
+				scoreErr = err
+				return false
+			}
+			result := makeQueryResult(record, similarity)
+			if keep(result) {
+				tops[i].offer(result)
+			}
+		}
+		return true
+	})
+	if scoreErr != nil {
+		return nil, scoreErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ranked := make([][]QueryResult, len(tops))
+	for i := range tops {
+		ranked[i] = tops[i].sorted()
+	}
+	return ranked, nil
+}
+
+func unscored(scored []QueryResult) []records.Record {
+	results := make([]records.Record, len(scored))
+	for i, s := range scored {
+		results[i] = s.Record
+	}
+	return results
+}
+
+// QueryBatch runs several queries against the collection at once. All of the
+// queries are embedded with one call to the embedder and the collection is
+// only scanned once. Results come back in the same order as the queries, each
+// ranked from most to least similar. n_greatest is as it is for Query
+func (collection Collection) QueryBatch(queries [][]byte, n_greatest int) (*[][]records.Record, error) {
+	defer queryDuration.ObserveSince(time.Now(), collection.Id)
+	options := QueryOptions{NGreatest: n_greatest}
+	err := options.validate()
+	if err != nil {
+		return nil, err
+	}
+	queryEmbeddings, err := collection.embedQueries(queries)
+	if err != nil {
+		return nil, err
+	}
+	ranked, err := collection.rankRecords(queryEmbeddings, options.limit(), keepAll)
+	if err != nil {
+		return nil, err
+	}
+	results := make([][]records.Record, len(ranked))
+	for i, scored := range ranked {
+		results[i] = unscored(scored)
+	}
+	return &results, nil
+}
+
+func (collection Collection) embedQueries(queries [][]byte) ([][]float64, error) {
+	if len(queries) == 0 {
+		return [][]float64{}, nil
+	}
+	embed, err := embedders.GetBatchEmbedderFunc(collection.EmbedderId)
+	if err != nil {
+		return nil, err
+	}
+	queryEmbeddings, err := embed(queries)
+	if err != nil {
+		return nil, err
+	}
+	if len(queryEmbeddings) != len(queries) {
+		return nil, fmt.Errorf("%w: %s returned %d embeddings for %d queries", embedders.ErrBadEmbeddings, collection.EmbedderId, len(queryEmbeddings), len(queries))
+	}
+	return queryEmbeddings, nil
+}
+
+// QueryWithOptions is like Query, but the results carry their scores and can
+// be cut off by similarity or distance as well as by count
+func (collection Collection) QueryWithOptions(query []byte, options QueryOptions) ([]QueryResult, error) {
+	defer queryDuration.ObserveSince(time.Now(), collection.Id)
+	err := options.validate()
+	if err != nil {
+		return nil, err
+	}
+	queryEmbedding, err := collection.embedQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return collection.queryVector(queryEmbedding, options)
+}
+
+// QueryVector runs a query with an embedding the caller already has
+func (collection Collection) QueryVector(queryEmbedding []float64, options QueryOptions) ([]QueryResult, error) {
+	defer queryDuration.ObserveSince(time.Now(), collection.Id)
+	return collection.queryVector(queryEmbedding, options)
+}
+
+func (collection Collection) queryVector(queryEmbedding []float64, options QueryOptions) ([]QueryResult, error) {
+	err := options.validate()
+	if err != nil {
+		return nil, err
+	}
+	ranked, err := collection.rankRecords([][]float64{queryEmbedding}, options.limit(), options.keep)
+	if err != nil {
+		return nil, err
+	}
+	if options.MMR != nil {
+		n_greatest := options.NGreatest
+		if n_greatest == 0 {
+			n_greatest = len(ranked[0])
+		}
+		return maximalMarginalRelevance(ranked[0], n_greatest, options.MMR.Lambda)
+	}
+	return ranked[0], nil
+}
+
+// CandidateOptions are the options to run a query with against each of
+// several collections, when their results are going to be merged with
+// MergeResults. MMR has to wait for the merge, so each collection returns
+// its pick of the candidates instead
+func (options QueryOptions) CandidateOptions() QueryOptions {
+	if options.MMR == nil {
+		return options
+	}
+	candidates := options
+	candidates.NGreatest = options.fetchK()
+	candidates.MMR = nil
+	return candidates
+}
+
+// MergeResults merges the results of running a query against several
+// collections (with the query's CandidateOptions) into the results the
+// query would have had against all of their records in one collection
+func MergeResults(resultSets [][]QueryResult, options QueryOptions) ([]QueryResult, error) {
+	err := options.validate()
+	if err != nil {
+		return nil, err
+	}
+	top := topRecords{n: options.limit()}
+	for _, results := range resultSets {
+		for _, result := range results {
+			top.offer(result)
+		}
+	}
+	merged := top.sorted()
+	if options.MMR != nil {
+		n_greatest := options.NGreatest
+		if n_greatest == 0 {
+			n_greatest = len(merged)
+		}
+		return maximalMarginalRelevance(merged, n_greatest, options.MMR.Lambda)
+	}
+	return merged, nil
+}
+
+// maximalMarginalRelevance greedily picks n_greatest of the candidates
+// (which should already be ranked by relevance). Each pick maximises
+//
+//	lambda * similarity(query, candidate) - (1 - lambda) * max(similarity(candidate, picked))
+//
+// The results keep their similarity to the query, but come back in the
+// order they were picked
+func maximalMarginalRelevance(candidates []QueryResult, n_greatest int, lambda float64) ([]QueryResult, error) {
+	picked := make([]QueryResult, 0, min(n_greatest, len(candidates)))
+	isPicked := make([]bool, len(candidates))
+	// the highest similarity between each candidate and anything picked so far
+	redundancy := make([]float64, len(candidates))
+
+	for len(picked) < n_greatest && len(picked) < len(candidates) {
+		best := -1
+		bestScore := 0.0
+		for i, candidate := range candidates {
+			if isPicked[i] {
+				continue
+			}
+			score := lambda * candidate.Similarity
+			if len(picked) > 0 {
+				score -= (1 - lambda) * redundancy[i]
+			}
+			if best == -1 || score > bestScore {
+				best = i
+				bestScore = score
+			}
+		}
+
+		isPicked[best] = true
+		picked = append(picked, candidates[best])
+		for i, candidate := range candidates {
+			if isPicked[i] {
+				continue
+			}
+			similarity, err := utils.CosineSimilarity(candidate.Record.Embedding, candidates[best].Record.Embedding)
+			if err != nil {
+				return nil, err
+			}
+			if len(picked) == 1 || similarity > redundancy[i] {
+				redundancy[i] = similarity
+			}
+		}
+	}
+	return picked, nil
+}
+
+// RangeQuery returns every record within radius (cosine distance) of the
+// query, closest first
+func (collection Collection) RangeQuery(query []byte, radius float64) ([]QueryResult, error) {
+	return collection.QueryWithOptions(query, QueryOptions{MaxDistance: &radius})
+}
+
+func (collection Collection) embedQuery(query []byte) ([]float64, error) {
+	embed, err := embedders.GetEmbedderFunc(collection.EmbedderId)
+	if err != nil {
+		return nil, err
+	}
+	return embed(query)
+}
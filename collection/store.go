@@ -0,0 +1,100 @@
+package collection
+
+import (
+	"slices"
+
+	records "go-simple-embedding-database/records"
+)
+
+// RecordStore is somewhere other than the Records map for a collection to
+// keep its records, e.g. one of the engines in the storage package. A
+// collection with a Store leaves Records nil
+type RecordStore interface {
+	// GetRecord returns false if there's no record with the ID
+	GetRecord(recordId string) (records.Record, bool, error)
+	// PutRecord adds the record, replacing any with the same ID
+	PutRecord(record records.Record) error
+	// DeleteRecord returns false if there was no record with the ID
+	DeleteRecord(recordId string) (bool, error)
+	// ScanRecords calls fn with every record, in ID order, until fn returns
+	// false. fn must not change the store
+	ScanRecords(fn func(record records.Record) bool) error
+	// ScanRecordsAfter is ScanRecords starting after the record with ID
+	// afterId, which doesn't have to exist
+	ScanRecordsAfter(afterId string, fn func(record records.Record) bool) error
+}
+
+func (collection Collection) getStored(recordId string) (records.Record, bool, error) {
+	if collection.Store != nil {
+		return collection.Store.GetRecord(recordId)
+	}
+	record, ok := collection.Records[recordId]
+	return record, ok, nil
+}
+
+// StoredRecord returns the record with the ID as stored, even if it has
+// expired. ok is false if there's no such record
+func (collection Collection) StoredRecord(recordId string) (record records.Record, ok bool, err error) {
+	return collection.getStored(recordId)
+}
+
+func (collection Collection) putStored(record records.Record) error {
+	if collection.Store != nil {
+		return collection.Store.PutRecord(record)
+	}
+	collection.Records[record.Id] = record
+	return nil
+}
+
+func (collection Collection) deleteStored(recordId string) (bool, error) {
+	if collection.Store != nil {
+		return collection.Store.DeleteRecord(recordId)
+	}
+	_, ok := collection.Records[recordId]
+	delete(collection.Records, recordId)
+	return ok, nil
+}
+
+// scan is ScanRecords without the ordering, for callers that don't care
+// which order they see the records in
+func (collection Collection) scan(fn func(record records.Record) bool) error {
+	if collection.Store != nil {
+		return collection.Store.ScanRecords(fn)
+	}
+	for _, record := range collection.Records {
+		if !fn(record) {
+			break
+		}
+	}
+	return nil
+}
+
+// ScanRecords calls fn with every record in the collection, expired or not,
+// in ID order until fn returns false. fn must not change the collection
+func (collection Collection) ScanRecords(fn func(record records.Record) bool) error {
+	if collection.Store != nil {
+		return collection.Store.ScanRecords(fn)
+	}
+	return collection.scanAfter("", fn)
+}
+
+// scanAfter is ScanRecords starting after the record with ID afterId. An
+// empty afterId starts from the beginning, so records can't have an empty ID
+func (collection Collection) scanAfter(afterId string, fn func(record records.Record) bool) error {
+	if collection.Store != nil {
+		return collection.Store.ScanRecordsAfter(afterId, fn)
+	}
+	recordIds := make([]string, 0, len(collection.Records))
+	for recordId := range collection.Records {
+		if recordId > afterId {
+			recordIds = append(recordIds, recordId)
+		}
+	}
+	slices.Sort(recordIds)
+	for _, recordId := range recordIds {
+		if !fn(collection.Records[recordId]) {
+			break
+		}
+	}
+	return nil
+}
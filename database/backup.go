@@ -0,0 +1,734 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	collection "go-simple-embedding-database/collection"
+	observe "go-simple-embedding-database/observe"
+	records "go-simple-embedding-database/records"
+	storage "go-simple-embedding-database/storage"
+)
+
+// Snapshots are gzipped files in the backup directory, one JSON value per
+// line:
+//
+//	{"id": ..., "parent": ..., "taken": ..., "full": ..., "deletedCollections": [...]}
+//	{"collection": {"id": ..., "embedderId": ..., "ttl": ...}, "deletedRecords": [...], "records": 2}
+//	{record}
+//	{record}
+//	{"collection": ...}
+//	...
+//
+// A full snapshot has every collection and record. An incremental snapshot
+// only has what changed since its parent (the snapshot taken before it):
+// collections that were added or changed, with just the records that were
+// added or updated, and the IDs of anything deleted. Restoring an
+// incremental snapshot replays the chain back to the last full one
+
+const snapshotSuffix = ".snapshot.gz"
+
+// snapshot IDs sort in the order the snapshots were taken
+const snapshotIdLayout = "20060102T150405.000000000Z"
+
+type BackupOptions struct {
+	// How many snapshots to keep. Older ones are deleted unless a snapshot
+	// being kept is built on top of them. 0 keeps everything
+	KeepLast int
+	// Take a full snapshot instead of an incremental one once this many
+	// incremental snapshots have been taken since the last full one. 0 means
+	// only the first snapshot is full
+	FullEvery int
+	// Called with errors from scheduled backups, as well as them being
+	// logged
+	OnError func(err error)
+}
+
+type SnapshotInfo struct {
+	Id     string    `json:"id"`
+	Parent string    `json:"parent,omitempty"`
+	Taken  time.Time `json:"taken"`
+	Full   bool      `json:"full"`
+	// Collections and records written to the snapshot, which for incremental
+	// snapshots is only the ones that changed
+	Collections int `json:"collections"`
+	Records     int `json:"records"`
+	// Collections and records deleted since the parent snapshot
+	DeletedCollections []string `json:"deletedCollections,omitempty"`
+	DeletedRecords     int      `json:"deletedRecords,omitempty"`
+}
+
+type snapshotCollection struct {
+	Collection     snapshotCollectionInfo `json:"collection"`
+	DeletedRecords []string               `json:"deletedRecords,omitempty"`
+	Records        int                    `json:"records"`
+}
+
+type snapshotCollectionInfo struct {
+	Id         string        `json:"id"`
+	EmbedderId string        `json:"embedderId"`
+	TTL        time.Duration `json:"ttl,omitempty"`
+}
+
+type collectionChange struct {
+	info    snapshotCollectionInfo
+	records []records.Record
+	deleted []string
+}
+
+type backups struct {
+	dir     string
+	options BackupOptions
+	// held while taking, restoring or pruning snapshots so they happen one at
+	// a time
+	mutex sync.Mutex
+	// the IDs of the records in the latest snapshot, which the next
+	// incremental snapshot is worked out against. Loaded from disk the first
+	// time it's needed
+	latest   snapshotIndex
+	latestId string
+	// written and frozen are guarded by the database's lock. See cow.go
+	written writes
+	frozen  frozen
+}
+
+// snapshotIndex is what a snapshot has in it, without the records: each
+// collection's info and the IDs of its records
+type snapshotIndex map[string]indexedCollection
+
+type indexedCollection struct {
+	info      snapshotCollectionInfo
+	recordIds map[string]struct{}
+}
+
+func indexOf(collections map[string]collection.Collection) snapshotIndex {
+	index := make(snapshotIndex, len(collections))
+	for collectionId, coll := range collections {
+		recordIds := make(map[string]struct{}, len(coll.Records))
+		for recordId := range coll.Records {
+			recordIds[recordId] = struct{}{}
+		}
+		index[collectionId] = indexedCollection{info: collectionInfo(coll), recordIds: recordIds}
+	}
+	return index
+}
+
+var (
+	ErrBackupsNotEnabled = errors.New("Backups are not enabled - call EnableBackups first")
+	ErrSnapshotNotFound  = errors.New("Snapshot does not exist")
+	ErrInvalidSchedule   = errors.New("Invalid backup schedule")
+)
+
+// EnableBackups sets up snapshots in dir, which is created if it doesn't
+// exist. Snapshots already in dir are picked up, so incremental snapshots
+// carry on from the latest one. Call it before the database is shared
+// between goroutines, since copies made before then won't have backups
+func (db *SimpleDataBase) EnableBackups(dir string, options BackupOptions) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	b := &backups{dir: dir, options: options, written: make(writes)}
+	snapshots, err := b.list()
+	if err != nil {
+		return err
+	}
+	if len(snapshots) > 0 {
+		b.latestId = snapshots[len(snapshots)-1].Id
+	}
+	db.backups = b
+	return nil
+}
+
+// view copies the collections and their record maps under the read lock.
+// Records are values and their embeddings are never changed in place, so the
+// copy can be written out at leisure while writes carry on. Collections kept
+// in an engine are read into memory
+func (db SimpleDataBase) view() (map[string]collection.Collection, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.viewLocked()
+}
+
+// viewLocked expects the caller to hold the lock
+func (db SimpleDataBase) viewLocked() (map[string]collection.Collection, error) {
+	view := make(map[string]collection.Collection, len(db.Collections))
+	for collectionId, coll := range db.Collections {
+		if coll.Store == nil {
+			coll.Records = maps.Clone(coll.Records)
+			view[collectionId] = coll
+			continue
+		}
+		stored := make(map[string]records.Record)
+		err := coll.ScanRecords(func(record records.Record) bool {
+			stored[record.Id] = record
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		coll.Records = stored
+		coll.Store = nil
+		view[collectionId] = coll
+	}
+	return view, nil
+}
+
+// Snapshot saves the database as it is right now. The snapshot is
+// incremental if there's an earlier one to build on, unless
+// BackupOptions.FullEvery says it's time for a full one
+func (db SimpleDataBase) Snapshot() (SnapshotInfo, error) {
+	return db.snapshot(false)
+}
+
+// FullSnapshot saves the whole database, regardless of earlier snapshots
+func (db SimpleDataBase) FullSnapshot() (SnapshotInfo, error) {
+	return db.snapshot(true)
+}
+
+func (db SimpleDataBase) snapshot(full bool) (info SnapshotInfo, err error) {
+	b := db.backups
+	if b == nil {
+		return SnapshotInfo{}, ErrBackupsNotEnabled
+	}
+	defer db.observed(observe.Event{Operation: observe.Persist, Path: b.dir})(&err)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	snapshots, err := b.list()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if b.latestId == "" {
+		full = true
+	}
+	if !full && b.options.FullEvery > 0 && incrementalsSinceFull(snapshots, b.latestId) >= b.options.FullEvery {
+		full = true
+	}
+	// what was written before the latest snapshot was loaded isn't known,
+	// so the first incremental snapshot compares every record with it
+	var latest map[string]collection.Collection
+	if !full && b.latest == nil {
+		latest, err = b.restoreChain(b.latestId)
+		if err != nil {
+			return SnapshotInfo{}, err
+		}
+		b.latest = indexOf(latest)
+	}
+
+	// a full snapshot is everything that's changed since nothing
+	var previous snapshotIndex
+	if !full {
+		previous = b.latest
+	}
+	info = SnapshotInfo{Id: b.nextId(), Taken: time.Now().UTC(), Full: full}
+	f, err := db.freeze(full || latest != nil)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	// the index is updated in place, so until the snapshot is written the
+	// next one has to start over from the files
+	b.latest = nil
+	changes, deletedCollections, index, err := db.changesSince(f, previous, latest)
+	db.thaw()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if !full {
+		info.Parent = b.latestId
+		info.DeletedCollections = deletedCollections
+	}
+	err = b.write(&info, changes)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	b.latest = index
+	b.latestId = info.Id
+
+	err = b.prune(append(snapshots, info))
+	return info, err
+}
+
+func (b *backups) nextId() string {
+	now := time.Now().UTC()
+	id := now.Format(snapshotIdLayout)
+	for id <= b.latestId {
+		now = now.Add(time.Nanosecond)
+		id = now.Format(snapshotIdLayout)
+	}
+	return id
+}
+
+func incrementalsSinceFull(snapshots []SnapshotInfo, id string) int {
+	byId := make(map[string]SnapshotInfo, len(snapshots))
+	for _, snapshot := range snapshots {
+		byId[snapshot.Id] = snapshot
+	}
+	count := 0
+	for snapshot, ok := byId[id]; ok && !snapshot.Full; snapshot, ok = byId[snapshot.Parent] {
+		count += 1
+	}
+	return count
+}
+
+func collectionInfo(coll collection.Collection) snapshotCollectionInfo {
+	return snapshotCollectionInfo{Id: coll.Id, EmbedderId: coll.EmbedderId, TTL: coll.TTL}
+}
+
+// changesSince reads what's changed in the frozen snapshot since the
+// snapshot previous indexes, and works out the index of the new one. If
+// latest is set, records that are the same in it are left out
+func (db SimpleDataBase) changesSince(f frozen, previous snapshotIndex, latest map[string]collection.Collection) ([]collectionChange, []string, snapshotIndex, error) {
+	changes := make([]collectionChange, 0)
+	index := make(snapshotIndex, len(f))
+	for _, collectionId := range sortedKeys(f) {
+		fc := f[collectionId]
+		before, existed := previous[collectionId]
+		change := collectionChange{info: fc.info, records: make([]records.Record, 0)}
+		recordIds := before.recordIds
+		if fc.all || recordIds == nil {
+			recordIds = make(map[string]struct{})
+		}
+		for _, recordId := range db.unreadSorted(fc) {
+			record, ok, err := db.readFrozen(f, collectionId, recordId)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			_, had := before.recordIds[recordId]
+			switch {
+			case ok:
+				recordIds[recordId] = struct{}{}
+				if !sameRecord(latest[collectionId], record) {
+					change.records = append(change.records, record)
+				}
+			case had && !fc.all:
+				delete(recordIds, recordId)
+				change.deleted = append(change.deleted, recordId)
+			}
+		}
+		if fc.all {
+			for _, recordId := range sortedKeys(before.recordIds) {
+				_, ok := recordIds[recordId]
+				if !ok {
+					change.deleted = append(change.deleted, recordId)
+				}
+			}
+		}
+		index[collectionId] = indexedCollection{info: change.info, recordIds: recordIds}
+		if !existed || change.info != before.info || len(change.records) > 0 || len(change.deleted) > 0 {
+			changes = append(changes, change)
+		}
+	}
+	deletedCollections := make([]string, 0)
+	for _, collectionId := range sortedKeys(previous) {
+		_, ok := f[collectionId]
+		if !ok {
+			deletedCollections = append(deletedCollections, collectionId)
+		}
+	}
+	return changes, deletedCollections, index, nil
+}
+
+// sameRecord is whether coll has exactly the same record
+func sameRecord(coll collection.Collection, record records.Record) bool {
+	old, ok := coll.Records[record.Id]
+	if !ok {
+		return false
+	}
+	oldJSON, err := json.Marshal(old)
+	if err != nil {
+		return false
+	}
+	newJSON, err := json.Marshal(record)
+	return err == nil && bytes.Equal(oldJSON, newJSON)
+}
+
+func (b *backups) path(snapshotId string) string {
+	return filepath.Join(b.dir, snapshotId+snapshotSuffix)
+}
+
+// write fills in the counts on info and writes the snapshot. It goes to a
+// temporary file first so a crash never leaves half a snapshot behind
+func (b *backups) write(info *SnapshotInfo, changes []collectionChange) error {
+	for _, change := range changes {
+		info.Collections += 1
+		info.Records += len(change.records)
+		info.DeletedRecords += len(change.deleted)
+	}
+
+	file, err := os.CreateTemp(b.dir, info.Id+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	gzipWriter := gzip.NewWriter(file)
+	buffered := bufio.NewWriter(gzipWriter)
+	encoder := json.NewEncoder(buffered)
+	err = encoder.Encode(info)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		err = encoder.Encode(snapshotCollection{Collection: change.info, DeletedRecords: change.deleted, Records: len(change.records)})
+		if err != nil {
+			return err
+		}
+		for _, record := range change.records {
+			err = encoder.Encode(record)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = buffered.Flush()
+	if err != nil {
+		return err
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), b.path(info.Id))
+}
+
+type snapshotReader struct {
+	file    *os.File
+	gzip    *gzip.Reader
+	scanner *bufio.Scanner
+	info    SnapshotInfo
+}
+
+func (b *backups) open(snapshotId string) (*snapshotReader, error) {
+	file, err := os.Open(b.path(snapshotId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, snapshotId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	scanner := bufio.NewScanner(gzipReader)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxJSONLLine)
+	reader := &snapshotReader{file: file, gzip: gzipReader, scanner: scanner}
+	err = reader.next(&reader.info)
+	if err != nil {
+		reader.close()
+		return nil, fmt.Errorf("%w: could not read snapshot %s: %w", ErrInvalidFile, snapshotId, err)
+	}
+	return reader, nil
+}
+
+func (r *snapshotReader) next(value any) error {
+	if !r.scanner.Scan() {
+		err := r.scanner.Err()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return json.Unmarshal(r.scanner.Bytes(), value)
+}
+
+func (r *snapshotReader) close() {
+	r.gzip.Close()
+	r.file.Close()
+}
+
+// apply replays the snapshot onto collections
+func (r *snapshotReader) apply(collections map[string]collection.Collection) error {
+	for _, collectionId := range r.info.DeletedCollections {
+		delete(collections, collectionId)
+	}
+	for i := 0; i < r.info.Collections; i++ {
+		change := snapshotCollection{}
+		err := r.next(&change)
+		if err != nil {
+			return err
+		}
+		coll, ok := collections[change.Collection.Id]
+		if !ok {
+			coll = collection.Collection{Records: make(map[string]records.Record)}
+		}
+		coll.Id = change.Collection.Id
+		coll.EmbedderId = change.Collection.EmbedderId
+		coll.TTL = change.Collection.TTL
+		for _, recordId := range change.DeletedRecords {
+			delete(coll.Records, recordId)
+		}
+		for j := 0; j < change.Records; j++ {
+			record := records.Record{}
+			err = r.next(&record)
+			if err != nil {
+				return err
+			}
+			coll.Records[record.Id] = record
+		}
+		collections[coll.Id] = coll
+	}
+	return nil
+}
+
+// restoreChain rebuilds the collections as of snapshotId by replaying it and
+// every snapshot it's built on, oldest first
+func (b *backups) restoreChain(snapshotId string) (map[string]collection.Collection, error) {
+	chain := make([]string, 0)
+	for id := snapshotId; id != ""; {
+		reader, err := b.open(id)
+		if err != nil {
+			return nil, err
+		}
+		reader.close()
+		chain = append(chain, id)
+		if reader.info.Full {
+			break
+		}
+		if reader.info.Parent == "" {
+			return nil, fmt.Errorf("%w: incremental snapshot %s has no parent", ErrInvalidFile, id)
+		}
+		id = reader.info.Parent
+	}
+
+	collections := make(map[string]collection.Collection)
+	for i := len(chain) - 1; i >= 0; i-- {
+		reader, err := b.open(chain[i])
+		if err != nil {
+			return nil, err
+		}
+		err = reader.apply(collections)
+		reader.close()
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not read snapshot %s: %w", ErrInvalidFile, chain[i], err)
+		}
+	}
+	return collections, nil
+}
+
+// Restore puts the database back exactly as it was when the snapshot was
+// taken. Anything added since is thrown away. Change feed subscribers see
+// every collection deleted, then the snapshot's collections created and
+// their records added
+func (db SimpleDataBase) Restore(snapshotId string) error {
+	b := db.backups
+	if b == nil {
+		return ErrBackupsNotEnabled
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	collections, err := b.restoreChain(snapshotId)
+	if err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	err = db.checkWritable()
+	if err != nil {
+		return err
+	}
+	return db.replaceCollections(collections)
+}
+
+// replaceCollections swaps every collection in the database for
+// collections, telling change feed subscribers about it. Expects the caller
+// to hold the write lock
+func (db SimpleDataBase) replaceCollections(collections map[string]collection.Collection) error {
+	err := db.checkReplacement(collections)
+	if err != nil {
+		return err
+	}
+	for _, collectionId := range sortedKeys(db.Collections) {
+		err := db.removeCollection(collectionId)
+		if err != nil {
+			return err
+		}
+		db.notifyCollection(CollectionDeleted, storage.CollectionInfo{Id: collectionId})
+	}
+	for _, collectionId := range sortedKeys(collections) {
+		coll := collections[collectionId]
+		err := db.putCollection(coll)
+		if err != nil {
+			return err
+		}
+		if db.changes == nil {
+			continue
+		}
+		db.notifyCollection(CollectionCreated, storage.Info(coll))
+		err = coll.ScanRecords(func(record records.Record) bool {
+			db.notifyRecord(RecordAdded, collectionId, record.Id, &record)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshots lists the snapshots in the backup directory, oldest first
+func (db SimpleDataBase) Snapshots() ([]SnapshotInfo, error) {
+	b := db.backups
+	if b == nil {
+		return nil, ErrBackupsNotEnabled
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.list()
+}
+
+func (b *backups) list() ([]SnapshotInfo, error) {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]SnapshotInfo, 0)
+	for _, entry := range entries {
+		snapshotId, ok := strings.CutSuffix(entry.Name(), snapshotSuffix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		reader, err := b.open(snapshotId)
+		if err != nil {
+			return nil, err
+		}
+		reader.close()
+		snapshots = append(snapshots, reader.info)
+	}
+	slices.SortFunc(snapshots, func(a, b SnapshotInfo) int {
+		return strings.Compare(a.Id, b.Id)
+	})
+	return snapshots, nil
+}
+
+// prune deletes snapshots that fall outside BackupOptions.KeepLast and that
+// no kept snapshot is built on
+func (b *backups) prune(snapshots []SnapshotInfo) error {
+	if b.options.KeepLast <= 0 || len(snapshots) <= b.options.KeepLast {
+		return nil
+	}
+	byId := make(map[string]SnapshotInfo, len(snapshots))
+	for _, snapshot := range snapshots {
+		byId[snapshot.Id] = snapshot
+	}
+	keep := make(map[string]bool)
+	for _, snapshot := range snapshots[len(snapshots)-b.options.KeepLast:] {
+		for ok := true; ok && !keep[snapshot.Id]; snapshot, ok = byId[snapshot.Parent] {
+			keep[snapshot.Id] = true
+			if snapshot.Full {
+				break
+			}
+		}
+	}
+	for _, snapshot := range snapshots {
+		if keep[snapshot.Id] {
+			continue
+		}
+		err := os.Remove(b.path(snapshot.Id))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// schedule returns when the next backup is due after now
+type schedule func(now time.Time) time.Time
+
+// parseSchedule understands a subset of cron's syntax:
+//
+//	@every <duration>   e.g. @every 15m
+//	@hourly             at the start of every hour
+//	@daily, @midnight   at midnight every day
+//	@weekly             at midnight every Sunday
+//
+// Times are local
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "@hourly":
+		return func(now time.Time) time.Time {
+			return now.Truncate(time.Hour).Add(time.Hour)
+		}, nil
+	case "@daily", "@midnight":
+		return func(now time.Time) time.Time {
+			return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		}, nil
+	case "@weekly":
+		return func(now time.Time) time.Time {
+			days := 7 - int(now.Weekday())
+			return time.Date(now.Year(), now.Month(), now.Day()+days, 0, 0, 0, 0, now.Location())
+		}, nil
+	}
+	every, ok := strings.CutPrefix(spec, "@every ")
+	if !ok {
+		return nil, fmt.Errorf("%w %s (expected @every <duration>, @hourly, @daily or @weekly)", ErrInvalidSchedule, strconv.Quote(spec))
+	}
+	interval, err := time.ParseDuration(strings.TrimSpace(every))
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("%w: invalid interval %s", ErrInvalidSchedule, strconv.Quote(every))
+	}
+	return func(now time.Time) time.Time {
+		return now.Add(interval)
+	}, nil
+}
+
+// StartBackups takes a snapshot on the given schedule (see parseSchedule)
+// until the returned stop function is called. Errors are logged and passed
+// to BackupOptions.OnError
+func (db SimpleDataBase) StartBackups(spec string) (stop func(), err error) {
+	b := db.backups
+	if b == nil {
+		return nil, ErrBackupsNotEnabled
+	}
+	next, err := parseSchedule(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			timer := time.NewTimer(time.Until(next(time.Now())))
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case <-timer.C:
+				_, err := db.Snapshot()
+				if err != nil {
+					db.log().Error("scheduled backup failed", "dir", b.dir, "error", err)
+					if b.options.OnError != nil {
+						b.options.OnError(err)
+					}
+				}
+			}
+		}
+	}()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() { close(done) })
+	}, nil
+}
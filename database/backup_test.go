@@ -0,0 +1,334 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	collection "go-simple-embedding-database/collection"
+	records "go-simple-embedding-database/records"
+)
+
+func addMockRecord(t *testing.T, db *SimpleDataBase, collectionId string, recordId string) {
+	t.Helper()
+	record, err := records.MakeRecord("mock-embedder", []byte("blob "+recordId), recordId)
+	if err != nil {
+		t.Fatalf("Could not create record: %v", err)
+	}
+	err = db.AddRecord(collectionId, record)
+	if err != nil {
+		t.Fatalf("Could not add record: %v", err)
+	}
+}
+
+func mustView(t *testing.T, db *SimpleDataBase) map[string]collection.Collection {
+	t.Helper()
+	view, err := db.view()
+	if err != nil {
+		t.Fatalf("Could not copy the database: %v", err)
+	}
+	return view
+}
+
+func TestSnapshotsAndRestore(t *testing.T) {
+	db := makeStreamDatabase(t)
+	_, err := db.Snapshot()
+	if err == nil {
+		t.Errorf("Expected snapshots to fail before backups are enabled")
+	}
+	dir := t.TempDir()
+	err = db.EnableBackups(dir, BackupOptions{})
+	if err != nil {
+		t.Fatalf("Could not enable backups: %v", err)
+	}
+
+	first, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("Could not take snapshot: %v", err)
+	}
+	if !first.Full || first.Records != 6 {
+		t.Errorf("Expected the first snapshot to be full, got %+v", first)
+	}
+	atFirst := mustView(t, db)
+
+	addMockRecord(t, db, "notes", "d")
+	upserted, _ := records.MakeRecord("mock-embedder", []byte("new blob"), "a")
+	db.UpsertRecord("notes", upserted)
+	db.DeleteRecord("notes", "b")
+	db.DeleteCollection("empty")
+	db.SetCollectionTTL("news", time.Minute)
+	coll, _ := collection.MakeCollection("added", "mock-embedder")
+	db.AddCollection(coll)
+	addMockRecord(t, db, "added", "z")
+
+	second, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("Could not take snapshot: %v", err)
+	}
+	if second.Full || second.Parent != first.Id {
+		t.Errorf("Expected an incremental snapshot on top of %s, got %+v", first.Id, second)
+	}
+	// notes (d and a changed, b deleted), news (TTL changed) and added (z)
+	if second.Collections != 3 || second.Records != 3 || second.DeletedRecords != 1 || !reflect.DeepEqual(second.DeletedCollections, []string{"empty"}) {
+		t.Errorf("Unexpected incremental snapshot %+v", second)
+	}
+	atSecond := mustView(t, db)
+
+	// nothing changed, so the next one is empty
+	third, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("Could not take snapshot: %v", err)
+	}
+	if third.Collections != 0 || third.Records != 0 {
+		t.Errorf("Expected an empty incremental snapshot, got %+v", third)
+	}
+
+	db.DeleteCollection("notes")
+	err = db.Restore(first.Id)
+	if err != nil {
+		t.Fatalf("Could not restore snapshot: %v", err)
+	}
+	if !reflect.DeepEqual(atFirst, db.GetCollections()) {
+		t.Errorf("Not equal (expected %v, got %v)", atFirst, db.GetCollections())
+	}
+	err = db.Restore(third.Id)
+	if err != nil {
+		t.Fatalf("Could not restore snapshot: %v", err)
+	}
+	if !reflect.DeepEqual(atSecond, db.GetCollections()) {
+		t.Errorf("Not equal (expected %v, got %v)", atSecond, db.GetCollections())
+	}
+	err = db.Restore("no-such-snapshot")
+	if err == nil {
+		t.Errorf("Expected restoring a missing snapshot to fail")
+	}
+
+	// a database opened later on picks up where this one left off
+	reopened := MakeDatabase()
+	err = reopened.EnableBackups(dir, BackupOptions{})
+	if err != nil {
+		t.Fatalf("Could not enable backups: %v", err)
+	}
+	snapshots, err := reopened.Snapshots()
+	if err != nil {
+		t.Fatalf("Could not list snapshots: %v", err)
+	}
+	if len(snapshots) != 3 || snapshots[2].Id != third.Id {
+		t.Errorf("Unexpected snapshots %v", snapshots)
+	}
+	err = reopened.Restore(third.Id)
+	if err != nil {
+		t.Fatalf("Could not restore snapshot: %v", err)
+	}
+	addMockRecord(t, reopened, "added", "y")
+	fourth, err := reopened.Snapshot()
+	if err != nil {
+		t.Fatalf("Could not take snapshot: %v", err)
+	}
+	if fourth.Full || fourth.Parent != third.Id || fourth.Records != 1 {
+		t.Errorf("Expected a one record incremental snapshot, got %+v", fourth)
+	}
+}
+
+// a record deleted and added again with the same timestamps is still
+// picked up by the next incremental snapshot
+func TestSnapshotReAddedRecord(t *testing.T) {
+	db := makeStreamDatabase(t)
+	db.EnableBackups(t.TempDir(), BackupOptions{})
+	record, _ := records.MakeRecord("mock-embedder", []byte("first"), "r")
+	db.AddRecord("notes", record)
+	first, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("Could not take snapshot: %v", err)
+	}
+
+	db.DeleteRecord("notes", "r")
+	record.Blob = []byte("second")
+	record.Embedding = []float64{1, 2, 3}
+	err = db.AddRecord("notes", record)
+	if err != nil {
+		t.Fatalf("Could not add record again: %v", err)
+	}
+	second, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("Could not take snapshot: %v", err)
+	}
+	if second.Records != 1 || second.DeletedRecords != 0 {
+		t.Errorf("Expected the re-added record in the snapshot, got %+v", second)
+	}
+	db.Restore(first.Id)
+	err = db.Restore(second.Id)
+	if err != nil {
+		t.Fatalf("Could not restore snapshot: %v", err)
+	}
+	restored, err := db.GetRecord("notes", "r")
+	if err != nil || string(restored.Blob) != "second" {
+		t.Errorf("Expected the re-added record to be restored, got %+v (%v)", restored, err)
+	}
+}
+
+// writes made while a snapshot is being read don't end up in it
+func TestSnapshotCopyOnWrite(t *testing.T) {
+	db := makeStreamDatabase(t)
+	db.EnableBackups(t.TempDir(), BackupOptions{})
+	_, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("Could not take snapshot: %v", err)
+	}
+	frozenRecord, _ := records.MakeRecord("mock-embedder", []byte("frozen"), "a")
+	db.UpsertRecord("notes", frozenRecord)
+	db.DeleteRecord("notes", "b")
+
+	f, err := db.freeze(false)
+	if err != nil {
+		t.Fatalf("Could not freeze the database: %v", err)
+	}
+	after, _ := records.MakeRecord("mock-embedder", []byte("after"), "a")
+	db.UpsertRecord("notes", after)
+	after, _ = records.MakeRecord("mock-embedder", []byte("after"), "b")
+	db.AddRecord("notes", after)
+	db.DeleteCollection("notes")
+	changes, deletedCollections, _, err := db.changesSince(f, db.backups.latest, nil)
+	db.thaw()
+	if err != nil {
+		t.Fatalf("Could not read the snapshot: %v", err)
+	}
+	if len(changes) != 1 || len(deletedCollections) != 0 {
+		t.Fatalf("Expected one changed collection, got %+v (deleted %v)", changes, deletedCollections)
+	}
+	change := changes[0]
+	if change.info.Id != "notes" || len(change.records) != 1 || string(change.records[0].Blob) != "frozen" || !reflect.DeepEqual(change.deleted, []string{"b"}) {
+		t.Errorf("Expected the records as they were when the snapshot was frozen, got %+v", change)
+	}
+
+	// what was written while frozen goes in the next snapshot
+	next, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("Could not take snapshot: %v", err)
+	}
+	if !reflect.DeepEqual(next.DeletedCollections, []string{"notes"}) {
+		t.Errorf("Expected notes to be deleted in the next snapshot, got %+v", next)
+	}
+}
+
+func TestSnapshotRetention(t *testing.T) {
+	db := makeStreamDatabase(t)
+	dir := t.TempDir()
+	err := db.EnableBackups(dir, BackupOptions{KeepLast: 2, FullEvery: 2})
+	if err != nil {
+		t.Fatalf("Could not enable backups: %v", err)
+	}
+	taken := make([]SnapshotInfo, 0)
+	for _, recordId := range []string{"d", "e", "f", "g", "h"} {
+		addMockRecord(t, db, "notes", recordId)
+		info, err := db.Snapshot()
+		if err != nil {
+			t.Fatalf("Could not take snapshot: %v", err)
+		}
+		taken = append(taken, info)
+	}
+	// full, incremental, incremental, full, incremental
+	for i, full := range []bool{true, false, false, true, false} {
+		if taken[i].Full != full {
+			t.Errorf("Expected snapshot %d to have Full %v, got %+v", i, full, taken[i])
+		}
+	}
+
+	snapshots, err := db.Snapshots()
+	if err != nil {
+		t.Fatalf("Could not list snapshots: %v", err)
+	}
+	if len(snapshots) != 2 || snapshots[0].Id != taken[3].Id || snapshots[1].Id != taken[4].Id {
+		t.Errorf("Expected the last two snapshots to be kept, got %v", snapshots)
+	}
+	expected := mustView(t, db)
+	err = db.Restore(taken[4].Id)
+	if err != nil {
+		t.Fatalf("Could not restore snapshot: %v", err)
+	}
+	if !reflect.DeepEqual(expected, db.GetCollections()) {
+		t.Errorf("Not equal (expected %v, got %v)", expected, db.GetCollections())
+	}
+
+	// an incremental snapshot keeps the snapshots it's built on
+	db.backups.options.FullEvery = 0
+	addMockRecord(t, db, "notes", "i")
+	db.Snapshot()
+	snapshots, _ = db.Snapshots()
+	if len(snapshots) != 3 || snapshots[0].Id != taken[3].Id {
+		t.Errorf("Expected the full snapshot under the kept ones to stay, got %v", snapshots)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Errorf("Expected no leftover files in the backup directory, got %d", len(entries))
+	}
+}
+
+func TestRestoreReadOnly(t *testing.T) {
+	db := makeStreamDatabase(t)
+	db.EnableBackups(t.TempDir(), BackupOptions{})
+	info, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("Could not take snapshot: %v", err)
+	}
+	db.readOnly = true
+	err = db.Restore(info.Id)
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected restoring into a read-only database to fail with ErrReadOnly, got %v", err)
+	}
+}
+
+func TestBackupSchedule(t *testing.T) {
+	now := time.Date(2024, time.March, 13, 15, 42, 10, 0, time.UTC) // a Wednesday
+	for spec, expected := range map[string]time.Time{
+		"@every 90s": now.Add(90 * time.Second),
+		"@hourly":    time.Date(2024, time.March, 13, 16, 0, 0, 0, time.UTC),
+		"@daily":     time.Date(2024, time.March, 14, 0, 0, 0, 0, time.UTC),
+		"@midnight":  time.Date(2024, time.March, 14, 0, 0, 0, 0, time.UTC),
+		"@weekly":    time.Date(2024, time.March, 17, 0, 0, 0, 0, time.UTC),
+	} {
+		next, err := parseSchedule(spec)
+		if err != nil {
+			t.Errorf("Could not parse %s: %v", spec, err)
+			continue
+		}
+		if !next(now).Equal(expected) {
+			t.Errorf("Expected %s to run next at %v, got %v", spec, expected, next(now))
+		}
+	}
+	for _, spec := range []string{"", "hourly", "@every", "@every -1m", "@every soon", "*/5 * * * *"} {
+		_, err := parseSchedule(spec)
+		if err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+
+	db := makeStreamDatabase(t)
+	errorCount := atomic.Int32{}
+	db.EnableBackups(t.TempDir(), BackupOptions{OnError: func(err error) { errorCount.Add(1) }})
+	stop, err := db.StartBackups("@every 10ms")
+	if err != nil {
+		t.Fatalf("Could not start backups: %v", err)
+	}
+	defer stop()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		snapshots, _ := db.Snapshots()
+		if len(snapshots) >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Scheduled backups never ran")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	stop()
+	if errorCount.Load() != 0 {
+		t.Errorf("Expected scheduled backups to succeed, got %d errors", errorCount.Load())
+	}
+}
@@ -0,0 +1,327 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	collection "go-simple-embedding-database/collection"
+	observe "go-simple-embedding-database/observe"
+	records "go-simple-embedding-database/records"
+)
+
+// The binary format keeps the vectors apart from everything else so they can
+// be memory-mapped and used in place:
+//
+//	magic         8 bytes, binaryMagic
+//	header length uint64, little endian
+//	header        JSON, binaryHeader
+//	padding       zeros up to the next multiple of 8 bytes
+//	vectors       float64s, little endian, one collection after another
+//
+// Each record in the header says where its vector starts in the vector
+// section (counted in float64s, not bytes) and how many dimensions it has
+const binaryMagic = "SEDBBIN1"
+
+const binaryPrefixSize = len(binaryMagic) + 8
+
+// ErrReadOnly is returned by anything that would change a read-only database
+var ErrReadOnly = errors.New("Database is read-only")
+
+// ErrInvalidFile is returned for database files and snapshots that can't be
+// decoded
+var ErrInvalidFile = errors.New("Invalid database file")
+
+type binaryHeader struct {
+	Collections []binaryCollection `json:"collections"`
+}
+
+type binaryCollection struct {
+	Id         string         `json:"id"`
+	EmbedderId string         `json:"embedderId"`
+	TTL        time.Duration  `json:"ttl,omitempty"`
+	Records    []binaryRecord `json:"records"`
+}
+
+type binaryRecord struct {
+	// the record without its embedding
+	Record       records.Record `json:"record"`
+	VectorOffset int64          `json:"vectorOffset"`
+	Dimensions   int            `json:"dimensions"`
+}
+
+// mappedFile is the memory mapping behind a database opened with
+// OpenMapped. It's shared by every copy of the SimpleDataBase
+type mappedFile struct {
+	data  []byte
+	unmap func([]byte) error
+	once  sync.Once
+}
+
+func (m *mappedFile) close() error {
+	err := error(nil)
+	m.once.Do(func() {
+		err = m.unmap(m.data)
+	})
+	return err
+}
+
+// ReadOnly is true for memory-mapped databases and replicas, which can't be
+// written to
+func (db SimpleDataBase) ReadOnly() bool {
+	return db.readOnly || db.replica
+}
+
+// checkWritable expects the caller to hold the lock, since Close empties the
+// database
+func (db SimpleDataBase) checkWritable() error {
+	if db.readOnly || db.replica {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// WriteBinary writes the database to w in the binary format read by
+// OpenMapped
+func (db *SimpleDataBase) WriteBinary(w io.Writer) (int64, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	header := binaryHeader{Collections: make([]binaryCollection, 0, len(db.Collections))}
+	offset := int64(0)
+	for _, collectionId := range sortedKeys(db.Collections) {
+		coll := db.Collections[collectionId]
+		binaryColl := binaryCollection{Id: coll.Id, EmbedderId: coll.EmbedderId, TTL: coll.TTL, Records: make([]binaryRecord, 0, len(coll.Records))}
+		err := coll.ScanRecords(func(record records.Record) bool {
+			dimensions := len(record.Embedding)
+			record.Embedding = nil
+			binaryColl.Records = append(binaryColl.Records, binaryRecord{Record: record, VectorOffset: offset, Dimensions: dimensions})
+			offset += int64(dimensions)
+			return true
+		})
+		if err != nil {
+			return 0, err
+		}
+		header.Collections = append(header.Collections, binaryColl)
+	}
+	encodedHeader, err := json.Marshal(header)
+	if err != nil {
+		return 0, err
+	}
+
+	counter := &countingWriter{w: w}
+	buffered := bufio.NewWriter(counter)
+	buffered.WriteString(binaryMagic)
+	binary.Write(buffered, binary.LittleEndian, uint64(len(encodedHeader)))
+	buffered.Write(encodedHeader)
+	buffered.Write(make([]byte, vectorSectionStart(len(encodedHeader))-binaryPrefixSize-len(encodedHeader)))
+
+	// the records come out of the second scan in the same order as the first,
+	// so the vectors land where the header says they are
+	word := make([]byte, 8)
+	var writeErr error
+	for _, binaryColl := range header.Collections {
+		err = db.Collections[binaryColl.Id].ScanRecords(func(record records.Record) bool {
+			for _, value := range record.Embedding {
+				binary.LittleEndian.PutUint64(word, math.Float64bits(value))
+				_, writeErr = buffered.Write(word)
+				if writeErr != nil {
+					return false
+				}
+			}
+			return true
+		})
+		if writeErr != nil {
+			return counter.n, writeErr
+		}
+		if err != nil {
+			return counter.n, err
+		}
+	}
+	err = buffered.Flush()
+	return counter.n, err
+}
+
+// the vector section starts on an 8 byte boundary so that, with the mapping
+// itself page aligned, the float64s can be used where they are
+func vectorSectionStart(headerLength int) int {
+	end := binaryPrefixSize + headerLength
+	return (end + 7) &^ 7
+}
+
+// ToBinaryFile writes the database to a file in the binary format
+func (db *SimpleDataBase) ToBinaryFile(fileName string) (err error) {
+	defer db.observed(observe.Event{Operation: observe.Persist, Path: fileName})(&err)
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = db.WriteBinary(file)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// IsBinaryFile reports whether the file was written by ToBinaryFile
+func IsBinaryFile(fileName string) (bool, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	magic := make([]byte, len(binaryMagic))
+	_, err = io.ReadFull(file, magic)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return string(magic) == binaryMagic, nil
+}
+
+// Open reads a database file in either format. Binary files are opened with
+// OpenMapped, so the database that comes back is read-only
+func Open(fileName string) (*SimpleDataBase, error) {
+	isBinary, err := IsBinaryFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if isBinary {
+		return OpenMapped(fileName)
+	}
+	db := MakeDatabase()
+	err = db.FromFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// OpenMapped opens a file written by ToBinaryFile without reading the vectors
+// in. The file is memory-mapped and every record's Embedding points straight
+// into the mapping, so startup only has to decode the header and processes
+// opening the same file share one copy of the vectors in the page cache.
+//
+// The database is read-only: anything that would change it returns
+// ErrReadOnly. Embeddings must not be written to (the mapping is read-only
+// and writing to it will crash the program), and must not be used after
+// Close
+func OpenMapped(fileName string) (*SimpleDataBase, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > math.MaxInt {
+		return nil, fmt.Errorf("%w: %s is too large to map", ErrInvalidFile, fileName)
+	}
+	data, unmap, err := mapFile(file, int(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+	mapped := &mappedFile{data: data, unmap: unmap}
+
+	collections, err := decodeBinary(data)
+	if err != nil {
+		mapped.close()
+		return nil, fmt.Errorf("Could not read %s: %w", fileName, err)
+	}
+	return &SimpleDataBase{mutex: &sync.RWMutex{}, Collections: collections, readOnly: true, mapped: mapped}, nil
+}
+
+func decodeBinary(data []byte) (map[string]collection.Collection, error) {
+	if len(data) < binaryPrefixSize || string(data[:len(binaryMagic)]) != binaryMagic {
+		return nil, fmt.Errorf("%w: not a binary database file", ErrInvalidFile)
+	}
+	headerLength := binary.LittleEndian.Uint64(data[len(binaryMagic):binaryPrefixSize])
+	if headerLength > uint64(len(data)-binaryPrefixSize) {
+		return nil, fmt.Errorf("%w: header length %d runs past the end of the file", ErrInvalidFile, headerLength)
+	}
+	header := binaryHeader{}
+	err := json.Unmarshal(data[binaryPrefixSize:binaryPrefixSize+int(headerLength)], &header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not decode header: %w", ErrInvalidFile, err)
+	}
+	start := vectorSectionStart(int(headerLength))
+	if start > len(data) {
+		return nil, fmt.Errorf("%w: file ends before the vector section", ErrInvalidFile)
+	}
+	vectors := data[start:]
+	if len(vectors)%8 != 0 {
+		return nil, fmt.Errorf("%w: vector section is %d bytes, which isn't a whole number of float64s", ErrInvalidFile, len(vectors))
+	}
+	vectorCount := int64(len(vectors) / 8)
+
+	collections := make(map[string]collection.Collection, len(header.Collections))
+	for _, binaryColl := range header.Collections {
+		coll := collection.Collection{Id: binaryColl.Id, EmbedderId: binaryColl.EmbedderId, TTL: binaryColl.TTL, Records: make(map[string]records.Record, len(binaryColl.Records))}
+		for _, binaryRecord := range binaryColl.Records {
+			offset, dimensions := binaryRecord.VectorOffset, int64(binaryRecord.Dimensions)
+			// offset+dimensions could overflow, so dimensions is checked
+			// against what's left after offset instead
+			if offset < 0 || dimensions < 0 || offset > vectorCount || dimensions > vectorCount-offset {
+				return nil, fmt.Errorf("%w: vector for record %s in collection %s is out of bounds", ErrInvalidFile, binaryRecord.Record.Id, coll.Id)
+			}
+			record := binaryRecord.Record
+			record.Embedding = float64s(vectors[offset*8 : (offset+dimensions)*8])
+			coll.Records[record.Id] = record
+		}
+		collections[coll.Id] = coll
+	}
+	return collections, nil
+}
+
+var littleEndianHost = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// float64s returns the little endian float64s in b. Where it can, the slice
+// points at b itself rather than a copy
+func float64s(b []byte) []float64 {
+	n := len(b) / 8
+	if n == 0 {
+		return []float64{}
+	}
+	if littleEndianHost && uintptr(unsafe.Pointer(&b[0]))%8 == 0 {
+		return unsafe.Slice((*float64)(unsafe.Pointer(&b[0])), n)
+	}
+	values := make([]float64, n)
+	binary.Read(bytes.NewReader(b), binary.LittleEndian, values)
+	return values
+}
+
+// Close releases the memory mapping of a database opened with OpenMapped.
+// The database is emptied first so later reads find nothing rather than
+// reading unmapped memory. A database opened with OpenDatabase closes its
+// engine. For other databases Close does nothing
+func (db SimpleDataBase) Close() error {
+	if db.engine != nil {
+		return db.engine.Close()
+	}
+	if db.mapped == nil {
+		return nil
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for collectionId := range db.Collections {
+		delete(db.Collections, collectionId)
+	}
+	return db.mapped.close()
+}
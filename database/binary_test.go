@@ -0,0 +1,166 @@
+package database
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"unsafe"
+
+	collection "go-simple-embedding-database/collection"
+	records "go-simple-embedding-database/records"
+)
+
+func TestMappedDatabase(t *testing.T) {
+	db := makeStreamDatabase(t)
+	fileName := filepath.Join(t.TempDir(), "db.sedb")
+	err := db.ToBinaryFile(fileName)
+	if err != nil {
+		t.Fatalf("Could not write binary file: %v", err)
+	}
+
+	mapped, err := Open(fileName)
+	if err != nil {
+		t.Fatalf("Could not open binary file: %v", err)
+	}
+	defer mapped.Close()
+	if !mapped.ReadOnly() {
+		t.Errorf("Expected a mapped database to be read-only")
+	}
+	if !reflect.DeepEqual(db.GetCollections(), mapped.GetCollections()) {
+		t.Errorf("Not equal (expected %v, got %v)", db.GetCollections(), mapped.GetCollections())
+	}
+
+	// the embeddings should be the mapping itself, not a copy of it
+	record, err := mapped.GetRecord("notes", "b")
+	if err != nil {
+		t.Fatalf("Could not get record: %v", err)
+	}
+	data := mapped.mapped.data
+	start := uintptr(unsafe.Pointer(&data[0]))
+	address := uintptr(unsafe.Pointer(&record.Embedding[0]))
+	if littleEndianHost && (address < start || address >= start+uintptr(len(data))) {
+		t.Errorf("Expected the embedding to point into the mapping")
+	}
+
+	expected, err := db.QueryWithOptions("news", []byte("anything"), collection.QueryOptions{NGreatest: 2})
+	if err != nil {
+		t.Fatalf("Could not query database: %v", err)
+	}
+	results, err := mapped.QueryWithOptions("news", []byte("anything"), collection.QueryOptions{NGreatest: 2})
+	if err != nil {
+		t.Fatalf("Could not query mapped database: %v", err)
+	}
+	if !reflect.DeepEqual(expected, results) {
+		t.Errorf("Not equal (expected %v, got %v)", expected, results)
+	}
+
+	newRecord, _ := records.MakeRecord("mock-embedder", []byte("new"), "new")
+	newColl, _ := collection.MakeCollection("new", "mock-embedder")
+	for name, err := range map[string]error{
+		"AddRecord":        mapped.AddRecord("notes", newRecord),
+		"UpsertRecord":     mapped.UpsertRecord("notes", newRecord),
+		"DeleteRecord":     mapped.DeleteRecord("notes", "a"),
+		"AddCollection":    mapped.AddCollection(newColl),
+		"DeleteCollection": mapped.DeleteCollection("notes"),
+		"SetCollectionTTL": mapped.SetCollectionTTL("notes", 0),
+	} {
+		if !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Expected %s to fail with ErrReadOnly, got %v", name, err)
+		}
+	}
+	count, _ := mapped.Count("notes")
+	if count != 3 {
+		t.Errorf("Rejected changes should leave the database alone, got %d records", count)
+	}
+
+	err = mapped.Close()
+	if err != nil {
+		t.Errorf("Could not close mapped database: %v", err)
+	}
+	if len(mapped.GetCollections()) != 0 {
+		t.Errorf("Expected a closed database to be empty")
+	}
+}
+
+func TestBadBinaryFiles(t *testing.T) {
+	db := makeStreamDatabase(t)
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "db.sedb")
+	err := db.ToBinaryFile(fileName)
+	if err != nil {
+		t.Fatalf("Could not write binary file: %v", err)
+	}
+	data, _ := os.ReadFile(fileName)
+
+	for name, contents := range map[string][]byte{
+		"empty":           {},
+		"wrong magic":     append([]byte("NOTSEDB!"), data[8:]...),
+		"short header":    data[:binaryPrefixSize+4],
+		"missing vectors": data[:len(data)-8],
+	} {
+		badFile := filepath.Join(dir, "bad.sedb")
+		os.WriteFile(badFile, contents, 0644)
+		_, err = OpenMapped(badFile)
+		if !errors.Is(err, ErrInvalidFile) {
+			t.Errorf("Expected opening a file with %s to fail with ErrInvalidFile, got %v", name, err)
+		}
+	}
+
+	// JSON files still open the normal way
+	jsonFile := filepath.Join(dir, "db.json")
+	db.ToFile(jsonFile)
+	opened, err := Open(jsonFile)
+	if err != nil {
+		t.Fatalf("Could not open JSON file: %v", err)
+	}
+	if opened.ReadOnly() {
+		t.Errorf("Expected a database read from JSON to be writable")
+	}
+}
+
+// binaryFile lays out a binary database file around a header that may not
+// match the vectors
+func binaryFile(t *testing.T, header binaryHeader, vectorCount int) []byte {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		t.Fatalf("Could not encode header: %v", err)
+	}
+	data := make([]byte, vectorSectionStart(len(headerJSON))+8*vectorCount)
+	copy(data, binaryMagic)
+	binary.LittleEndian.PutUint64(data[len(binaryMagic):], uint64(len(headerJSON)))
+	copy(data[binaryPrefixSize:], headerJSON)
+	return data
+}
+
+func TestCorruptBinaryHeader(t *testing.T) {
+	for name, record := range map[string]binaryRecord{
+		"negative offset":     {VectorOffset: -1, Dimensions: 2},
+		"negative dimensions": {VectorOffset: 0, Dimensions: -1},
+		"past the end":        {VectorOffset: 3, Dimensions: 2},
+		"overflowing offset":  {VectorOffset: math.MaxInt64 - 1, Dimensions: 5},
+		"overflowing vector":  {VectorOffset: 1, Dimensions: math.MaxInt},
+	} {
+		record.Record = records.Record{Id: "r", EmbedderId: "mock-embedder"}
+		header := binaryHeader{Collections: []binaryCollection{{Id: "docs", EmbedderId: "mock-embedder", Records: []binaryRecord{record}}}}
+		_, err := decodeBinary(binaryFile(t, header, 4))
+		if !errors.Is(err, ErrInvalidFile) {
+			t.Errorf("Expected a header with a %s to fail with ErrInvalidFile, got %v", name, err)
+		}
+	}
+
+	// a vector right up against the end is fine
+	record := binaryRecord{Record: records.Record{Id: "r", EmbedderId: "mock-embedder"}, VectorOffset: 2, Dimensions: 2}
+	header := binaryHeader{Collections: []binaryCollection{{Id: "docs", EmbedderId: "mock-embedder", Records: []binaryRecord{record}}}}
+	collections, err := decodeBinary(binaryFile(t, header, 4))
+	if err != nil {
+		t.Fatalf("Could not decode binary file: %v", err)
+	}
+	if embedding := collections["docs"].Records["r"].Embedding; len(embedding) != 2 {
+		t.Errorf("Expected a 2 dimensional embedding, got %v", embedding)
+	}
+}
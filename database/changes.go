@@ -0,0 +1,276 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	records "go-simple-embedding-database/records"
+	storage "go-simple-embedding-database/storage"
+)
+
+type ChangeType string
+
+const (
+	CollectionCreated ChangeType = "collection_created"
+	// a collection's TTL changed
+	CollectionUpdated ChangeType = "collection_updated"
+	// deleting a collection deletes its records too, without a RecordDeleted
+	// for each of them
+	CollectionDeleted ChangeType = "collection_deleted"
+	RecordAdded       ChangeType = "record_added"
+	RecordUpdated     ChangeType = "record_updated"
+	RecordDeleted     ChangeType = "record_deleted"
+)
+
+var ChangeTypes = []ChangeType{CollectionCreated, CollectionUpdated, CollectionDeleted, RecordAdded, RecordUpdated, RecordDeleted}
+
+func ParseChangeType(name string) (ChangeType, error) {
+	for _, changeType := range ChangeTypes {
+		if string(changeType) == name {
+			return changeType, nil
+		}
+	}
+	return "", fmt.Errorf("%w: unknown change type %s", ErrInvalidChange, name)
+}
+
+// Change is one change to the database. Sequence numbers go up by one with
+// every change, so a gap means changes were dropped
+type Change struct {
+	Sequence     uint64     `json:"sequence"`
+	Type         ChangeType `json:"type"`
+	Time         time.Time  `json:"time"`
+	CollectionId string     `json:"collectionId"`
+	// set for collection changes other than deletes
+	Collection *storage.CollectionInfo `json:"collection,omitempty"`
+	// set for record changes
+	RecordId string `json:"recordId,omitempty"`
+	// the record as stored, for added and updated records
+	Record *records.Record `json:"record,omitempty"`
+}
+
+// SlowConsumerPolicy is what happens when a subscriber's buffer is full
+type SlowConsumerPolicy int
+
+const (
+	// close the subscription. Err returns ErrSlowConsumer
+	DisconnectSlowConsumers SlowConsumerPolicy = iota
+	// leave the change out and carry on. The subscriber sees a gap in the
+	// sequence numbers
+	DropChanges
+)
+
+type ChangeFeedOptions struct {
+	// How many changes to keep for subscribers resuming from a sequence
+	// number. Defaults to 1024
+	History int
+}
+
+type ChangeFilter struct {
+	// Only changes to these collections. Empty means every collection
+	Collections []string
+	// Only these types of change. Empty means every type
+	Types []ChangeType
+	// Resume after this sequence number: changes after it that are still in
+	// the history are sent first. 0 starts from the next change
+	After uint64
+	// How many changes can wait to be received before the policy kicks in.
+	// Defaults to 256
+	Buffer int
+	Policy SlowConsumerPolicy
+}
+
+func (filter ChangeFilter) matches(change Change) bool {
+	if len(filter.Collections) > 0 && !slices.Contains(filter.Collections, change.CollectionId) {
+		return false
+	}
+	return len(filter.Types) == 0 || slices.Contains(filter.Types, change.Type)
+}
+
+const (
+	defaultChangeHistory = 1024
+	defaultChangeBuffer  = 256
+)
+
+var (
+	ErrChangeFeedNotEnabled = errors.New("The change feed is not enabled - call EnableChangeFeed first")
+	ErrSlowConsumer         = errors.New("Subscription closed: changes weren't received fast enough")
+	// returned by Subscribe when ChangeFilter.After is a change that hasn't
+	// happened yet
+	ErrFutureChange = errors.New("Cannot resume after a change that hasn't happened")
+	// a change that can't be applied, like one missing its record
+	ErrInvalidChange = errors.New("Invalid change")
+	// returned by Subscribe when the changes after ChangeFilter.After have
+	// already left the history. The subscriber has to start over from the
+	// database as it is now
+	ErrChangesGone = errors.New("Changes are no longer in the history")
+)
+
+type changeFeed struct {
+	mutex    sync.Mutex
+	sequence uint64
+	// the most recent changes, oldest first
+	history     []Change
+	historySize int
+	subscribers map[*Subscription]bool
+}
+
+// EnableChangeFeed starts recording changes so they can be subscribed to.
+// Changes made before it's called aren't recorded. Call it before the
+// database is shared between goroutines, since copies made before then
+// won't record changes
+func (db *SimpleDataBase) EnableChangeFeed(options ChangeFeedOptions) {
+	historySize := options.History
+	if historySize <= 0 {
+		historySize = defaultChangeHistory
+	}
+	db.changes = &changeFeed{historySize: historySize, subscribers: make(map[*Subscription]bool)}
+}
+
+// Subscription receives changes on Changes until Close is called. If the
+// subscription is closed for any other reason, Changes is closed and Err
+// says why
+type Subscription struct {
+	feed    *changeFeed
+	filter  ChangeFilter
+	changes chan Change
+	err     error
+	closed  bool
+}
+
+// Subscribe sends changes matching filter to the returned subscription
+func (db SimpleDataBase) Subscribe(filter ChangeFilter) (*Subscription, error) {
+	feed := db.changes
+	if feed == nil {
+		return nil, ErrChangeFeedNotEnabled
+	}
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+
+	backlog := make([]Change, 0)
+	if filter.After > 0 {
+		if filter.After > feed.sequence {
+			return nil, fmt.Errorf("%w: change %d, the latest change is %d", ErrFutureChange, filter.After, feed.sequence)
+		}
+		if filter.After < feed.sequence && (len(feed.history) == 0 || feed.history[0].Sequence > filter.After+1) {
+			return nil, fmt.Errorf("%w: cannot resume after change %d", ErrChangesGone, filter.After)
+		}
+		for _, change := range feed.history {
+			if change.Sequence > filter.After && filter.matches(change) {
+				backlog = append(backlog, change)
+			}
+		}
+	}
+	buffer := filter.Buffer
+	if buffer <= 0 {
+		buffer = defaultChangeBuffer
+	}
+	// the backlog goes on top of the buffer, so resuming doesn't immediately
+	// count as being slow
+	subscription := &Subscription{feed: feed, filter: filter, changes: make(chan Change, buffer+len(backlog))}
+	for _, change := range backlog {
+		subscription.changes <- change
+	}
+	feed.subscribers[subscription] = true
+	return subscription, nil
+}
+
+func (subscription *Subscription) Changes() <-chan Change {
+	return subscription.changes
+}
+
+// Err is nil until the subscription has been closed
+func (subscription *Subscription) Err() error {
+	subscription.feed.mutex.Lock()
+	defer subscription.feed.mutex.Unlock()
+	return subscription.err
+}
+
+func (subscription *Subscription) Close() {
+	subscription.feed.mutex.Lock()
+	defer subscription.feed.mutex.Unlock()
+	subscription.close(errors.New("Subscription closed"))
+}
+
+// close expects the caller to hold the feed's lock
+func (subscription *Subscription) close(err error) {
+	if subscription.closed {
+		return
+	}
+	subscription.closed = true
+	subscription.err = err
+	delete(subscription.feed.subscribers, subscription)
+	close(subscription.changes)
+}
+
+// LatestSequence is the sequence number of the latest change, or 0 if there
+// hasn't been one
+func (db SimpleDataBase) LatestSequence() uint64 {
+	if db.changes == nil {
+		return 0
+	}
+	return db.changes.latest()
+}
+
+func (feed *changeFeed) latest() uint64 {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	return feed.sequence
+}
+
+// publish numbers the change and hands it to the subscribers without
+// blocking. Changes are published while the database's write lock is held,
+// so they're numbered in the order they happened
+func (feed *changeFeed) publish(change Change) {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	feed.sequence++
+	change.Sequence = feed.sequence
+	change.Time = time.Now().UTC()
+	if len(feed.history) == feed.historySize {
+		feed.history = slices.Delete(feed.history, 0, 1)
+	}
+	feed.history = append(feed.history, change)
+	for subscription := range feed.subscribers {
+		if !subscription.filter.matches(change) {
+			continue
+		}
+		select {
+		case subscription.changes <- change:
+		default:
+			if subscription.filter.Policy == DisconnectSlowConsumers {
+				subscription.close(ErrSlowConsumer)
+			}
+		}
+	}
+}
+
+// The notify methods do nothing unless the change feed is enabled. They
+// expect the caller to hold the write lock
+
+func (db SimpleDataBase) notifyCollection(changeType ChangeType, info storage.CollectionInfo) {
+	if db.changes == nil {
+		return
+	}
+	change := Change{Type: changeType, CollectionId: info.Id}
+	if changeType != CollectionDeleted {
+		change.Collection = &info
+	}
+	db.changes.publish(change)
+}
+
+func (db SimpleDataBase) notifyRecord(changeType ChangeType, collectionId string, recordId string, record *records.Record) {
+	countRecordChange(changeType, collectionId)
+	if db.changes == nil {
+		return
+	}
+	change := Change{Type: changeType, CollectionId: collectionId, RecordId: recordId}
+	if record != nil {
+		// a copy, since the caller still has the record
+		stored := *record
+		change.Record = &stored
+	}
+	db.changes.publish(change)
+}
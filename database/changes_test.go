@@ -0,0 +1,206 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	records "go-simple-embedding-database/records"
+)
+
+// receive takes every change waiting on the subscription
+func receive(subscription *Subscription) []Change {
+	changes := make([]Change, 0)
+	for {
+		select {
+		case change, ok := <-subscription.Changes():
+			if !ok {
+				return changes
+			}
+			changes = append(changes, change)
+		default:
+			return changes
+		}
+	}
+}
+
+func changeTypes(changes []Change) []ChangeType {
+	types := make([]ChangeType, len(changes))
+	for i, change := range changes {
+		types[i] = change.Type
+	}
+	return types
+}
+
+func TestChangeFeed(t *testing.T) {
+	db := MakeDatabase()
+	_, err := db.Subscribe(ChangeFilter{})
+	if !errors.Is(err, ErrChangeFeedNotEnabled) {
+		t.Errorf("Expected subscribing to fail before the change feed is enabled")
+	}
+	db.EnableChangeFeed(ChangeFeedOptions{History: 8})
+	all, _ := db.Subscribe(ChangeFilter{})
+	notes, _ := db.Subscribe(ChangeFilter{Collections: []string{"notes"}, Types: []ChangeType{RecordAdded, RecordDeleted}})
+	disconnected, _ := db.Subscribe(ChangeFilter{Buffer: 2})
+	dropping, _ := db.Subscribe(ChangeFilter{Buffer: 2, Policy: DropChanges})
+
+	fillDatabase(t, db)
+	changes := receive(all)
+	expectedTypes := []ChangeType{CollectionCreated, CollectionCreated, CollectionCreated, CollectionUpdated}
+	for i := 0; i < 6; i++ {
+		expectedTypes = append(expectedTypes, RecordAdded)
+	}
+	if !reflect.DeepEqual(changeTypes(changes), expectedTypes) {
+		t.Fatalf("Unexpected changes %v", changeTypes(changes))
+	}
+	for i, change := range changes {
+		if change.Sequence != uint64(i+1) {
+			t.Errorf("Expected change %d to have sequence %d, got %d", i, i+1, change.Sequence)
+		}
+	}
+	if changes[3].Collection == nil || changes[3].Collection.TTL == 0 || changes[4].Record == nil || changes[4].Record.CreatedAt.IsZero() {
+		t.Errorf("Expected changes to carry the collection and record, got %+v and %+v", changes[3], changes[4])
+	}
+
+	changes = receive(notes)
+	if len(changes) != 3 || changes[0].CollectionId != "notes" || changes[0].RecordId != "b" {
+		t.Errorf("Expected the filter to apply, got %+v", changes)
+	}
+	changes = receive(disconnected)
+	if len(changes) != 2 || !errors.Is(disconnected.Err(), ErrSlowConsumer) {
+		t.Errorf("Expected a slow subscriber to be disconnected after 2 changes, got %d (%v)", len(changes), disconnected.Err())
+	}
+	changes = receive(dropping)
+	if len(changes) != 2 || dropping.Err() != nil {
+		t.Errorf("Expected a slow subscriber to keep 2 changes and stay subscribed, got %d (%v)", len(changes), dropping.Err())
+	}
+
+	record, _ := records.MakeRecord("mock-embedder", []byte("blob b"), "b")
+	db.UpsertRecord("notes", record)
+	db.DeleteRecord("notes", "a")
+	db.DeleteCollection("empty")
+	changes = receive(all)
+	if !reflect.DeepEqual(changeTypes(changes), []ChangeType{RecordUpdated, RecordDeleted, CollectionDeleted}) || changes[2].Sequence != 13 {
+		t.Errorf("Unexpected changes %+v", changes)
+	}
+	if len(receive(dropping)) != 2 {
+		t.Errorf("Expected a subscriber that dropped changes to get new ones")
+	}
+	if len(receive(notes)) != 1 {
+		t.Errorf("Expected the record delete to reach the filtered subscriber")
+	}
+
+	// the history has the last 8 changes, 6 to 13
+	resumed, err := db.Subscribe(ChangeFilter{After: 5})
+	if err != nil {
+		t.Fatalf("Could not resume: %v", err)
+	}
+	changes = receive(resumed)
+	if len(changes) != 8 || changes[0].Sequence != 6 {
+		t.Errorf("Expected to resume from change 6, got %+v", changes)
+	}
+	_, err = db.Subscribe(ChangeFilter{After: 4})
+	if !errors.Is(err, ErrChangesGone) {
+		t.Errorf("Expected resuming from a change that's left the history to fail, got %v", err)
+	}
+	_, err = db.Subscribe(ChangeFilter{After: 14})
+	if !errors.Is(err, ErrFutureChange) {
+		t.Errorf("Expected resuming from a change that hasn't happened to fail")
+	}
+	if db.LatestSequence() != 13 {
+		t.Errorf("Expected the latest sequence to be 13, got %d", db.LatestSequence())
+	}
+
+	all.Close()
+	_, ok := <-all.Changes()
+	if ok || all.Err() == nil {
+		t.Errorf("Expected a closed subscription's channel to be closed")
+	}
+}
+
+func TestUpsertChangeTypes(t *testing.T) {
+	db := fillDatabase(t, MakeDatabase())
+	db.EnableChangeFeed(ChangeFeedOptions{})
+	subscription, _ := db.Subscribe(ChangeFilter{})
+
+	// an UpdatedAt time from the caller doesn't make an add an update
+	record, _ := records.MakeRecord("mock-embedder", []byte("blob d"), "d")
+	record.UpdatedAt = time.Now()
+	err := db.UpsertRecord("notes", record)
+	if err != nil {
+		t.Fatalf("Could not upsert: %v", err)
+	}
+	if !record.UpdatedAt.IsZero() {
+		t.Errorf("Expected an added record to have no UpdatedAt time, got %v", record.UpdatedAt)
+	}
+	record, _ = records.MakeRecord("mock-embedder", []byte("blob a"), "a")
+	err = db.UpsertRecord("notes", record)
+	if err != nil {
+		t.Fatalf("Could not upsert: %v", err)
+	}
+	changes := receive(subscription)
+	if !reflect.DeepEqual(changeTypes(changes), []ChangeType{RecordAdded, RecordUpdated}) {
+		t.Errorf("Expected an add then an update, got %v", changeTypes(changes))
+	}
+}
+
+// blockingWriter calls write the first time it's written to, as if the
+// reader on the other end stalled until something else happened
+type blockingWriter struct {
+	bytes.Buffer
+	write  func()
+	called bool
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	if !w.called {
+		w.called = true
+		w.write()
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestWriteSnapshot(t *testing.T) {
+	db := fillDatabase(t, MakeDatabase())
+	_, _, err := db.WriteSnapshot(&bytes.Buffer{})
+	if !errors.Is(err, ErrChangeFeedNotEnabled) {
+		t.Errorf("Expected a snapshot to need the change feed, got %v", err)
+	}
+	db.EnableChangeFeed(ChangeFeedOptions{})
+	expected, err := json.Marshal(db)
+	if err != nil {
+		t.Fatalf("Could not marshal: %v", err)
+	}
+
+	// writes carry on while the snapshot is being written, and don't show up
+	// in it
+	w := &blockingWriter{}
+	w.write = func() {
+		done := make(chan error)
+		go func() {
+			record, _ := records.MakeRecord("mock-embedder", []byte("blob d"), "d")
+			done <- db.AddRecord("notes", record)
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Could not add a record during the snapshot: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Writing the snapshot blocked writes")
+		}
+	}
+	sequence, n, err := db.WriteSnapshot(w)
+	if err != nil {
+		t.Fatalf("Could not write the snapshot: %v", err)
+	}
+	if sequence != 0 || n != int64(len(expected)) || w.String() != string(expected) {
+		t.Errorf("Expected the snapshot at sequence 0 to be %s, got %d: %s", expected, sequence, w.String())
+	}
+	if db.LatestSequence() != 1 {
+		t.Errorf("Expected the record added during the snapshot to be change 1, got %d", db.LatestSequence())
+	}
+}
@@ -0,0 +1,209 @@
+package database
+
+import (
+	collection "go-simple-embedding-database/collection"
+	records "go-simple-embedding-database/records"
+)
+
+// Incremental snapshots don't diff the whole database. Every write tells
+// the backups which record it's about to change, so a snapshot only has to
+// look at the records written since the one before it.
+//
+// Taking a snapshot freezes that list under the write lock, which is quick
+// since no records are copied. The records are then read one at a time, with
+// writes carrying on in between. A write to a record the snapshot hasn't read
+// yet saves the record as it was first (copy on write), so the snapshot
+// still sees the database as it was when it was frozen
+
+// writes is what's been written since the last snapshot was frozen, by
+// collection ID
+type writes map[string]*collectionWrites
+
+type collectionWrites struct {
+	// the collection was added, replaced or deleted, so every record in it
+	// has to be looked at
+	all     bool
+	records map[string]struct{}
+}
+
+func (w writes) record(collectionId string, recordId string) {
+	written, ok := w[collectionId]
+	if !ok {
+		written = &collectionWrites{records: make(map[string]struct{})}
+		w[collectionId] = written
+	}
+	if !written.all {
+		written.records[recordId] = struct{}{}
+	}
+}
+
+func (w writes) collection(collectionId string) {
+	w[collectionId] = &collectionWrites{all: true}
+}
+
+// frozen is a snapshot being taken: the collections as they were when it
+// was frozen, by ID
+type frozen map[string]*frozenCollection
+
+type frozenCollection struct {
+	info snapshotCollectionInfo
+	// every record in the collection has to be looked at. unread has all of
+	// their IDs
+	all bool
+	// the records the snapshot has to look at that it hasn't read yet
+	unread map[string]struct{}
+	// records written since the snapshot was frozen, as they were before.
+	// nil if there wasn't a record with the ID
+	saved map[string]*records.Record
+}
+
+// The write hooks below are nil safe, so they do nothing unless backups are
+// enabled. They expect the caller to hold the write lock
+
+// writingRecord is called before a record is added, changed or deleted
+func (b *backups) writingRecord(coll collection.Collection, recordId string) error {
+	if b == nil {
+		return nil
+	}
+	err := b.frozen.save(coll, recordId)
+	if err != nil {
+		return err
+	}
+	b.written.record(coll.Id, recordId)
+	return nil
+}
+
+// wroteRecord is for writes that save what they're about to change with
+// savingCollection first, like removing expired records
+func (b *backups) wroteRecord(collectionId string, recordId string) {
+	if b == nil {
+		return
+	}
+	b.written.record(collectionId, recordId)
+}
+
+// savingCollection saves the records in the collection a snapshot being
+// taken hasn't read yet
+func (b *backups) savingCollection(coll collection.Collection) error {
+	if b == nil {
+		return nil
+	}
+	for recordId := range b.frozen[coll.Id].unreadIds() {
+		err := b.frozen.save(coll, recordId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writingCollection is called before a collection is added, replaced or
+// deleted, with the collection as it is now if there is one
+func (b *backups) writingCollection(coll *collection.Collection, collectionId string) error {
+	if b == nil {
+		return nil
+	}
+	if coll != nil {
+		err := b.savingCollection(*coll)
+		if err != nil {
+			return err
+		}
+	}
+	b.written.collection(collectionId)
+	return nil
+}
+
+func (fc *frozenCollection) unreadIds() map[string]struct{} {
+	if fc == nil {
+		return nil
+	}
+	return fc.unread
+}
+
+func (f frozen) save(coll collection.Collection, recordId string) error {
+	fc, ok := f[coll.Id]
+	if !ok {
+		return nil
+	}
+	_, unread := fc.unread[recordId]
+	_, saved := fc.saved[recordId]
+	if !unread || saved {
+		return nil
+	}
+	record, ok, err := coll.StoredRecord(recordId)
+	if err != nil {
+		return err
+	}
+	if ok {
+		fc.saved[recordId] = &record
+	} else {
+		fc.saved[recordId] = nil
+	}
+	return nil
+}
+
+// freeze starts a snapshot of what's been written since the last one, or of
+// everything if everything is true
+func (db SimpleDataBase) freeze(everything bool) (frozen, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	b := db.backups
+	f := make(frozen, len(db.Collections))
+	for collectionId, coll := range db.Collections {
+		written := b.written[collectionId]
+		fc := &frozenCollection{info: collectionInfo(coll), unread: make(map[string]struct{}), saved: make(map[string]*records.Record)}
+		switch {
+		case everything || (written != nil && written.all):
+			fc.all = true
+			err := coll.ScanRecords(func(record records.Record) bool {
+				fc.unread[record.Id] = struct{}{}
+				return true
+			})
+			if err != nil {
+				return nil, err
+			}
+		case written != nil:
+			fc.unread = written.records
+		}
+		f[collectionId] = fc
+	}
+	b.written = make(writes)
+	b.frozen = f
+	return f, nil
+}
+
+// thaw ends the snapshot, whether it was written or not
+func (db SimpleDataBase) thaw() {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.backups.frozen = nil
+}
+
+// readFrozen reads the record as it was when the snapshot was frozen
+func (db SimpleDataBase) readFrozen(f frozen, collectionId string, recordId string) (records.Record, bool, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	fc := f[collectionId]
+	// only the snapshot itself reads or changes unread under the read lock.
+	// Writers, which look at it, hold the write lock
+	delete(fc.unread, recordId)
+	saved, ok := fc.saved[recordId]
+	if ok {
+		if saved == nil {
+			return records.Record{}, false, nil
+		}
+		return *saved, true, nil
+	}
+	coll, ok := db.Collections[collectionId]
+	if !ok {
+		return records.Record{}, false, nil
+	}
+	return coll.StoredRecord(recordId)
+}
+
+// unreadSorted is the IDs of the records left to read, in order
+func (db SimpleDataBase) unreadSorted(fc *frozenCollection) []string {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return sortedKeys(fc.unread)
+}
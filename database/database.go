@@ -2,14 +2,15 @@ package database
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
-	"os"
+	"log/slog"
 	"sync"
+	"time"
 
 	collection "go-simple-embedding-database/collection"
+	observe "go-simple-embedding-database/observe"
 	records "go-simple-embedding-database/records"
+	storage "go-simple-embedding-database/storage"
 )
 
 type DataBase interface {
@@ -18,22 +19,129 @@ type DataBase interface {
 	GetCollection(collectionId string) (*collection.Collection, error)
 
 	AddRecord(collectionId string, record *records.Record) error
-	GetRecord(collectionId string, recordId string) error
+	UpsertRecord(collectionId string, record *records.Record) error
+	GetRecord(collectionId string, recordId string) (*records.Record, error)
 	DeleteRecord(collectionId string, recordId string) error
+	ListRecords(collectionId string, options collection.ListOptions) (collection.RecordPage, error)
 
-	Query(collectionId string, query []byte, n_greatest int) []*records.Record
+	Query(collectionId string, query []byte, n_greatest int) (*[]records.Record, error)
+	QueryWithOptions(collectionId string, query []byte, options collection.QueryOptions) ([]collection.QueryResult, error)
 }
 
+var _ DataBase = SimpleDataBase{}
+
 type SimpleDataBase struct {
-	mutex       *sync.Mutex
+	mutex       *sync.RWMutex
 	Collections map[string]collection.Collection `json:"collections"`
+	// set for databases opened with OpenMapped
+	readOnly bool
+	mapped   *mappedFile
+	// set by EnableBackups
+	backups *backups
+	// set by EnableChangeFeed
+	changes *changeFeed
+	// set by SetReplica
+	replica bool
+	// set by SetQuotaTracker
+	quota *QuotaTracker
+	// set by SetLogger and SetObserver
+	logger   *slog.Logger
+	observer observe.Observer
+	// set by OpenDatabase. Without one, collections keep their records in
+	// their Records maps
+	engine storage.Engine
 }
 
 func MakeDatabase() *SimpleDataBase {
-	db := SimpleDataBase{mutex: &sync.Mutex{}, Collections: make(map[string]collection.Collection)}
+	db := SimpleDataBase{mutex: &sync.RWMutex{}, Collections: make(map[string]collection.Collection)}
 	return &db
 }
 
+// OpenDatabase makes a database that keeps its collections in engine,
+// picking up any collections already there. The collections' records stay
+// in the engine (their Records maps are nil), so a disk engine can hold more
+// than fits in memory. Close closes the engine
+func OpenDatabase(engine storage.Engine) (*SimpleDataBase, error) {
+	infos, err := engine.ListCollections()
+	if err != nil {
+		return nil, err
+	}
+	db := MakeDatabase()
+	db.engine = engine
+	for _, info := range infos {
+		db.Collections[info.Id] = db.engineCollection(info)
+	}
+	return db, nil
+}
+
+func (db SimpleDataBase) engineCollection(info storage.CollectionInfo) collection.Collection {
+	return collection.Collection{Id: info.Id, EmbedderId: info.EmbedderId, TTL: info.TTL, Store: storage.Store(db.engine, info.Id)}
+}
+
+// putCollection stores the collection along with all of its records,
+// replacing any collection with the same ID. Expects the caller to hold the
+// write lock
+func (db SimpleDataBase) putCollection(coll collection.Collection) error {
+	err := db.removeCollection(coll.Id)
+	if err != nil {
+		return err
+	}
+	err = db.backups.writingCollection(nil, coll.Id)
+	if err != nil {
+		return err
+	}
+	usage, err := db.reserveCollection(coll)
+	if err != nil {
+		return err
+	}
+	if db.engine == nil {
+		db.Collections[coll.Id] = coll
+		return nil
+	}
+	err = db.engine.CreateCollection(storage.Info(coll))
+	if err != nil {
+		db.releaseUsage(usage)
+		return err
+	}
+	err = coll.ScanRecords(func(record records.Record) bool {
+		err = db.engine.PutRecord(coll.Id, record)
+		return err == nil
+	})
+	if err != nil {
+		db.engine.DeleteCollection(coll.Id)
+		db.releaseUsage(usage)
+		return err
+	}
+	db.Collections[coll.Id] = db.engineCollection(storage.Info(coll))
+	return nil
+}
+
+// removeCollection deletes the collection if it exists. Expects the caller to
+// hold the write lock
+func (db SimpleDataBase) removeCollection(collectionId string) error {
+	coll, ok := db.Collections[collectionId]
+	if !ok {
+		return nil
+	}
+	usage, err := db.storedCollectionUsage(collectionId)
+	if err != nil {
+		return err
+	}
+	err = db.backups.writingCollection(&coll, collectionId)
+	if err != nil {
+		return err
+	}
+	if db.engine != nil {
+		err := db.engine.DeleteCollection(collectionId)
+		if err != nil {
+			return err
+		}
+	}
+	delete(db.Collections, collectionId)
+	db.releaseUsage(usage)
+	return nil
+}
+
 func (db SimpleDataBase) MarshalJSON() ([]byte, error) {
 	type Alias SimpleDataBase
 
@@ -57,31 +165,140 @@ func (db *SimpleDataBase) UnmarshalJSON(bytes []byte) error {
 		return err
 	}
 	db.Collections = newDB.Collections
-	db.mutex = &sync.Mutex{}
+	db.mutex = &sync.RWMutex{}
 	return nil
 }
 
-// TODO: if there's a way to refactor this, do it. It's incredibly ugly.
-// Specifically, I don't have a good way to pluck the max N elements
-// from a list
-func (db SimpleDataBase) Query(collectionId string, query []byte, n_greatest int) (*[]records.Record, error) {
-	collection, err := db.GetCollection(collectionId)
+// Reads (queries, gets, listing) take the read lock and can run side by
+// side. Anything that changes a collection takes the write lock
+func (db SimpleDataBase) Query(collectionId string, query []byte, n_greatest int) (results *[]records.Record, err error) {
+	defer db.observed(observe.Event{Operation: observe.Query, Collection: collectionId, Count: 1})(&err)
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	collection, err := db.getCollection(collectionId)
 	if err != nil {
 		return nil, err
 	}
+	queryCount.Inc(collectionId)
 	return collection.Query(query, n_greatest)
 }
 
-func (db SimpleDataBase) AddRecord(collectionId string, record *records.Record) error {
-	collection, err := db.GetCollection(collectionId)
+func (db SimpleDataBase) QueryBatch(collectionId string, queries [][]byte, n_greatest int) (results *[][]records.Record, err error) {
+	defer db.observed(observe.Event{Operation: observe.Query, Collection: collectionId, Count: len(queries)})(&err)
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	collection, err := db.getCollection(collectionId)
+	if err != nil {
+		return nil, err
+	}
+	queryCount.Add(float64(len(queries)), collectionId)
+	return collection.QueryBatch(queries, n_greatest)
+}
+
+func (db SimpleDataBase) QueryWithOptions(collectionId string, query []byte, options collection.QueryOptions) (results []collection.QueryResult, err error) {
+	defer db.observed(observe.Event{Operation: observe.Query, Collection: collectionId, Count: 1})(&err)
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	collection, err := db.getCollection(collectionId)
+	if err != nil {
+		return nil, err
+	}
+	queryCount.Inc(collectionId)
+	return collection.QueryWithOptions(query, options)
+}
+
+func (db SimpleDataBase) QueryVector(collectionId string, queryEmbedding []float64, options collection.QueryOptions) (results []collection.QueryResult, err error) {
+	defer db.observed(observe.Event{Operation: observe.Query, Collection: collectionId, Count: 1})(&err)
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	collection, err := db.getCollection(collectionId)
+	if err != nil {
+		return nil, err
+	}
+	queryCount.Inc(collectionId)
+	return collection.QueryVector(queryEmbedding, options)
+}
+
+func (db SimpleDataBase) RangeQuery(collectionId string, query []byte, radius float64) (results []collection.QueryResult, err error) {
+	defer db.observed(observe.Event{Operation: observe.Query, Collection: collectionId, Count: 1})(&err)
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	collection, err := db.getCollection(collectionId)
+	if err != nil {
+		return nil, err
+	}
+	queryCount.Inc(collectionId)
+	return collection.RangeQuery(query, radius)
+}
+
+func (db SimpleDataBase) AddRecord(collectionId string, record *records.Record) (err error) {
+	defer db.observed(observe.Event{Operation: observe.Add, Collection: collectionId, RecordId: record.Id, Count: 1})(&err)
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	err = db.checkWritable()
+	if err != nil {
+		return err
+	}
+	collection, err := db.getCollection(collectionId)
 	if err != nil {
 		return err
 	}
-	return collection.AddRecord(record)
+	reserved, err := db.reserveRecord(*collection, *record)
+	if err != nil {
+		return err
+	}
+	err = db.backups.writingRecord(*collection, record.Id)
+	if err != nil {
+		db.releaseUsage(reserved)
+		return err
+	}
+	err = collection.AddRecord(record)
+	if err != nil {
+		db.releaseUsage(reserved)
+		return err
+	}
+	db.notifyRecord(RecordAdded, collectionId, record.Id, record)
+	return nil
+}
+
+func (db SimpleDataBase) UpsertRecord(collectionId string, record *records.Record) (err error) {
+	defer db.observed(observe.Event{Operation: observe.Add, Collection: collectionId, RecordId: record.Id, Count: 1})(&err)
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	err = db.checkWritable()
+	if err != nil {
+		return err
+	}
+	collection, err := db.getCollection(collectionId)
+	if err != nil {
+		return err
+	}
+	reserved, err := db.reserveRecord(*collection, *record)
+	if err != nil {
+		return err
+	}
+	err = db.backups.writingRecord(*collection, record.Id)
+	if err != nil {
+		db.releaseUsage(reserved)
+		return err
+	}
+	replaced, err := collection.UpsertRecord(record)
+	if err != nil {
+		db.releaseUsage(reserved)
+		return err
+	}
+	if replaced {
+		db.notifyRecord(RecordUpdated, collectionId, record.Id, record)
+	} else {
+		db.notifyRecord(RecordAdded, collectionId, record.Id, record)
+	}
+	return nil
 }
 
 func (db SimpleDataBase) GetRecord(collectionId string, recordId string) (*records.Record, error) {
-	collection, err := db.GetCollection(collectionId)
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	collection, err := db.getCollection(collectionId)
 	if err != nil {
 		return nil, err
 	}
@@ -89,23 +306,109 @@ func (db SimpleDataBase) GetRecord(collectionId string, recordId string) (*recor
 }
 
 func (db SimpleDataBase) DeleteRecord(collectionId string, recordId string) error {
-	collection, err := db.GetCollection(collectionId)
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	err := db.checkWritable()
+	if err != nil {
+		return err
+	}
+	collection, err := db.getCollection(collectionId)
 	if err != nil {
 		return err
 	}
-	return collection.DeleteRecord(recordId)
+	usage, err := db.storedRecordUsage(*collection, recordId)
+	if err != nil {
+		return err
+	}
+	err = db.backups.writingRecord(*collection, recordId)
+	if err != nil {
+		return err
+	}
+	err = collection.DeleteRecord(recordId)
+	if err != nil {
+		return err
+	}
+	db.releaseUsage(usage)
+	db.notifyRecord(RecordDeleted, collectionId, recordId, nil)
+	return nil
+}
+
+func (db SimpleDataBase) ListRecords(collectionId string, options collection.ListOptions) (collection.RecordPage, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	coll, err := db.getCollection(collectionId)
+	if err != nil {
+		return collection.RecordPage{}, err
+	}
+	return coll.ListRecords(options)
+}
+
+func (db SimpleDataBase) Count(collectionId string) (int, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	collection, err := db.getCollection(collectionId)
+	if err != nil {
+		return 0, err
+	}
+	return collection.Count()
+}
+
+func (db SimpleDataBase) Peek(collectionId string, n int) ([]records.Record, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	collection, err := db.getCollection(collectionId)
+	if err != nil {
+		return nil, err
+	}
+	return collection.Peek(n)
 }
 
 func (db SimpleDataBase) AddCollection(collection *collection.Collection) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	err := db.checkWritable()
+	if err != nil {
+		return err
+	}
 	_, ok := db.Collections[collection.Id]
 	if ok {
-		err := errors.New(fmt.Sprintf("Cannot create collection %s: a collection with id %s already exists", collection.Id, collection.Id))
+		return collectionExists(collection.Id)
+	}
+	err = db.putCollection(*collection)
+	if err != nil {
 		return err
-	} else {
-		db.mutex.Lock()
-		defer db.mutex.Unlock()
-		db.Collections[collection.Id] = *collection
 	}
+	db.notifyCollection(CollectionCreated, storage.Info(*collection))
+	return nil
+}
+
+// SetCollectionTTL changes the TTL applied to records added to the collection
+// from now on. Records already in the collection keep their expiry
+func (db SimpleDataBase) SetCollectionTTL(collectionId string, ttl time.Duration) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	err := db.checkWritable()
+	if err != nil {
+		return err
+	}
+	collection, err := db.getCollection(collectionId)
+	if err != nil {
+		return err
+	}
+	return db.setCollectionTTL(*collection, ttl)
+}
+
+// setCollectionTTL expects the caller to hold the write lock
+func (db SimpleDataBase) setCollectionTTL(collection collection.Collection, ttl time.Duration) error {
+	collection.TTL = ttl
+	if db.engine != nil {
+		err := db.engine.UpdateCollection(storage.Info(collection))
+		if err != nil {
+			return err
+		}
+	}
+	db.Collections[collection.Id] = collection
+	db.notifyCollection(CollectionUpdated, storage.Info(collection))
 	return nil
 }
 
@@ -115,68 +418,62 @@ func (db SimpleDataBase) isCollectionInDB(collectionId string) bool {
 	return ok
 }
 
+func noCollection(collectionId string) error {
+	return fmt.Errorf("%w: %s", collection.ErrCollectionNotFound, collectionId)
+}
+
+func collectionExists(collectionId string) error {
+	return fmt.Errorf("%w: %s", collection.ErrCollectionExists, collectionId)
+}
+
 func (db SimpleDataBase) GetCollection(collectionId string) (*collection.Collection, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.getCollection(collectionId)
+}
+
+// getCollection expects the caller to hold the lock
+func (db SimpleDataBase) getCollection(collectionId string) (*collection.Collection, error) {
 	collection, ok := db.Collections[collectionId]
 	if ok {
 		return &collection, nil
 	}
-	return nil, errors.New(fmt.Sprintf("Could not get collection - no collection with ID %s exists in the database", collectionId))
+	return nil, noCollection(collectionId)
 }
 
 func (db SimpleDataBase) DeleteCollection(collectionId string) error {
-	_, ok := db.Collections[collectionId]
-	if ok {
-		db.mutex.Lock()
-		defer db.mutex.Unlock()
-		delete(db.Collections, collectionId)
-	} else {
-		err := errors.New(fmt.Sprintf("Cannot delete collection %s: does not exist", collectionId))
-		return err
-	}
-	return nil
-}
-
-func (db SimpleDataBase) GetCollections() map[string]collection.Collection {
-	// I think the locking here is needed?
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
-	return db.Collections
-}
-
-func (db *SimpleDataBase) FromFile(fileName string) error {
-	file, err := os.Open(fileName)
-	defer file.Close()
+	err := db.checkWritable()
 	if err != nil {
 		return err
 	}
-	reader := io.Reader(file)
-	buffer, err := io.ReadAll(reader)
-	if err != nil {
-		return err
+	_, ok := db.Collections[collectionId]
+	if !ok {
+		return noCollection(collectionId)
 	}
-
-	err = json.Unmarshal(buffer, db)
+	err = db.removeCollection(collectionId)
 	if err != nil {
 		return err
 	}
+	db.notifyCollection(CollectionDeleted, storage.CollectionInfo{Id: collectionId})
 	return nil
 }
 
-func (db *SimpleDataBase) ToFile(fileName string) error {
-	file, err := os.Create(fileName)
-	defer file.Close()
-
-	bytes, err := json.Marshal(db)
-	if err != nil {
-		return err
-	}
-
-	writer := io.Writer(file)
-	_, err = writer.Write(bytes)
-	if err != nil {
-		fmt.Println("bad write")
-		return err
+// ListCollections returns every collection's info in ID order
+func (db SimpleDataBase) ListCollections() []storage.CollectionInfo {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	infos := make([]storage.CollectionInfo, 0, len(db.Collections))
+	for _, collectionId := range sortedKeys(db.Collections) {
+		infos = append(infos, storage.Info(db.Collections[collectionId]))
 	}
+	return infos
+}
 
-	return nil
+func (db SimpleDataBase) GetCollections() map[string]collection.Collection {
+	// I think the locking here is needed?
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.Collections
 }
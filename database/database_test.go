@@ -3,9 +3,12 @@ package database
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"reflect"
 	"sync"
 	"testing"
+	"time"
 
 	collection "go-simple-embedding-database/collection"
 	embedders "go-simple-embedding-database/embedders"
@@ -76,7 +79,9 @@ func TestJSON(t *testing.T) {
 	if err != nil {
 		t.Errorf("Could not marshal JSON for database: %v", err)
 	}
-	ExpectedJSONBody := []byte("{\"collections\":{\"test-collection-id\":{\"id\":\"test-collection-id\",\"embedderId\":\"mock-embed\",\"embeddings\":{\"test-record-id\":{\"blob\":\"blob\",\"embedding\":[1,2,3,4,5],\"embedderId\":\"mock-embed\",\"id\":\"test-record-id\"}}}}}")
+	// adding the record to the collection stamps it with the time it was added
+	createdAt := record.CreatedAt.Format(time.RFC3339Nano)
+	ExpectedJSONBody := []byte(fmt.Sprintf("{\"collections\":{\"test-collection-id\":{\"id\":\"test-collection-id\",\"embedderId\":\"mock-embed\",\"embeddings\":{\"test-record-id\":{\"blob\":\"blob\",\"createdAt\":\"%s\",\"embedding\":[1,2,3,4,5],\"embedderId\":\"mock-embed\",\"id\":\"test-record-id\"}}}}}", createdAt))
 	if !bytes.Equal(JSONBody, ExpectedJSONBody) {
 		t.Errorf("Failure marshaling JSON: expected %v, got %v", string(ExpectedJSONBody), string(JSONBody))
 	}
@@ -92,7 +97,7 @@ func TestJSON(t *testing.T) {
 }
 
 func TestDatabaseCollectionAPI(t *testing.T) {
-	db := SimpleDataBase{mutex: &sync.Mutex{}, Collections: make(map[string]collection.Collection)}
+	db := SimpleDataBase{mutex: &sync.RWMutex{}, Collections: make(map[string]collection.Collection)}
 	if len(db.Collections) > 0 {
 		t.Errorf("Database should have no records yet")
 	}
@@ -107,7 +112,7 @@ func TestDatabaseCollectionAPI(t *testing.T) {
 		t.Errorf("Error adding collection1: %v", err)
 	}
 	err = db.AddCollection(collection1)
-	if err == nil {
+	if !errors.Is(err, collection.ErrCollectionExists) {
 		t.Errorf("Should not have been able to add duplicate collection")
 	}
 
@@ -134,7 +139,121 @@ func TestDatabaseCollectionAPI(t *testing.T) {
 	}
 
 	err = db.DeleteCollection(collection1.Id)
-	if err == nil {
+	if !errors.Is(err, collection.ErrCollectionNotFound) {
 		t.Errorf("Should not be able to delete collection1 as it was already deleted")
 	}
 }
+
+func TestConcurrentRecordAccess(t *testing.T) {
+	embedders.EmbedderRegister["mock-embedder"] = MockEmbed
+	db := MakeDatabase()
+	coll, err := collection.MakeCollection("concurrent", "mock-embedder")
+	if err != nil {
+		t.Fatalf("Could not create collection: %v", err)
+	}
+	err = db.AddCollection(coll)
+	if err != nil {
+		t.Fatalf("Could not add collection: %v", err)
+	}
+
+	wg := sync.WaitGroup{}
+	for writer := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 50 {
+				record, err := records.MakeRecord("mock-embedder", []byte("blob"), fmt.Sprintf("record-%d-%d", writer, i))
+				if err != nil {
+					t.Errorf("Could not create record: %v", err)
+					return
+				}
+				err = db.AddRecord("concurrent", record)
+				if err != nil {
+					t.Errorf("Could not add record: %v", err)
+				}
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				_, err := db.ListRecords("concurrent", collection.ListOptions{Limit: 10})
+				if err != nil {
+					t.Errorf("Could not list records: %v", err)
+				}
+				_, err = db.Query("concurrent", []byte("query"), 3)
+				if err != nil {
+					t.Errorf("Could not query: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	count, err := db.Count("concurrent")
+	if err != nil {
+		t.Fatalf("Could not count records: %v", err)
+	}
+	if count != 200 {
+		t.Errorf("Expected 200 records, got %d", count)
+	}
+	peeked, err := db.Peek("concurrent", 3)
+	if err != nil {
+		t.Fatalf("Could not peek: %v", err)
+	}
+	if len(peeked) != 3 {
+		t.Errorf("Expected to peek 3 records, got %d", len(peeked))
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	embedders.EmbedderRegister["mock-embedder"] = MockEmbed
+	db := MakeDatabase()
+	coll, err := collection.MakeCollection("news", "mock-embedder")
+	if err != nil {
+		t.Fatalf("Could not create collection: %v", err)
+	}
+	err = db.AddCollection(coll)
+	if err != nil {
+		t.Fatalf("Could not add collection: %v", err)
+	}
+	err = db.SetCollectionTTL("news", 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Could not set collection TTL: %v", err)
+	}
+	record, err := records.MakeRecord("mock-embedder", []byte("old news"), "old-news")
+	if err != nil {
+		t.Fatalf("Could not create record: %v", err)
+	}
+	err = db.AddRecord("news", record)
+	if err != nil {
+		t.Fatalf("Could not add record: %v", err)
+	}
+
+	db.EnableChangeFeed(ChangeFeedOptions{})
+	subscription, err := db.Subscribe(ChangeFilter{})
+	if err != nil {
+		t.Fatalf("Could not subscribe: %v", err)
+	}
+
+	stop := db.StartJanitor(10 * time.Millisecond)
+	defer stop()
+	deadline := time.Now().Add(2 * time.Second)
+	stored := func() int {
+		db.mutex.RLock()
+		defer db.mutex.RUnlock()
+		return len(db.Collections["news"].Records)
+	}
+	for stored() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Janitor never removed the expired record")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	stop()
+	changes := receive(subscription)
+	if len(changes) != 1 || changes[0].Type != RecordDeleted || changes[0].CollectionId != "news" || changes[0].RecordId != "old-news" {
+		t.Errorf("Expected subscribers to be told the expired record was deleted, got %+v", changes)
+	}
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	collection "go-simple-embedding-database/collection"
+	records "go-simple-embedding-database/records"
+	storage "go-simple-embedding-database/storage"
+)
+
+func TestDatabaseEngines(t *testing.T) {
+	expected := makeStreamDatabase(t)
+	expectedJSON := &bytes.Buffer{}
+	expected.WriteTo(expectedJSON)
+	expectedResults, err := expected.QueryWithOptions("notes", []byte("anything"), collection.QueryOptions{NGreatest: 2})
+	if err != nil {
+		t.Fatalf("Could not query: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "engine.db")
+	disk, err := storage.OpenDiskEngine(path)
+	if err != nil {
+		t.Fatalf("Could not open disk engine: %v", err)
+	}
+	for name, engine := range map[string]storage.Engine{"memory": storage.MakeMemoryEngine(), "disk": disk} {
+		db, err := OpenDatabase(engine)
+		if err != nil {
+			t.Fatalf("Could not open %s database: %v", name, err)
+		}
+		// the records end up with their own timestamps, so load the expected
+		// ones in rather than adding them again
+		_, err = db.ReadFrom(bytes.NewReader(expectedJSON.Bytes()))
+		if err != nil {
+			t.Fatalf("Could not load %s database: %v", name, err)
+		}
+		if db.Collections["notes"].Records != nil {
+			t.Errorf("Expected %s database records to stay in the engine", name)
+		}
+
+		written := &bytes.Buffer{}
+		db.WriteTo(written)
+		if !bytes.Equal(written.Bytes(), expectedJSON.Bytes()) {
+			t.Errorf("%s database wrote\n%s\nexpected\n%s", name, written, expectedJSON)
+		}
+		results, err := db.QueryWithOptions("notes", []byte("anything"), collection.QueryOptions{NGreatest: 2})
+		if err != nil {
+			t.Fatalf("Could not query %s database: %v", name, err)
+		}
+		if !reflect.DeepEqual(results, expectedResults) {
+			t.Errorf("Not equal (expected %v, got %v)", expectedResults, results)
+		}
+
+		addMockRecord(t, db, "notes", "d")
+		record, _ := records.MakeRecord("mock-embedder", []byte("new blob"), "a")
+		err = db.UpsertRecord("notes", record)
+		if err != nil {
+			t.Fatalf("Could not upsert into %s database: %v", name, err)
+		}
+		err = db.DeleteRecord("notes", "b")
+		if err != nil {
+			t.Fatalf("Could not delete from %s database: %v", name, err)
+		}
+		page, err := db.ListRecords("notes", collection.ListOptions{})
+		if err != nil {
+			t.Fatalf("Could not list %s database: %v", name, err)
+		}
+		if !reflect.DeepEqual(recordIds(page.Records), []string{"a", "c", "d"}) {
+			t.Errorf("Unexpected records in %s database %v", name, recordIds(page.Records))
+		}
+		err = db.DeleteCollection("empty")
+		if err != nil {
+			t.Fatalf("Could not delete collection from %s database: %v", name, err)
+		}
+		infos, _ := engine.ListCollections()
+		if len(infos) != 2 {
+			t.Errorf("Expected the deleted collection to be gone from the %s engine, got %v", name, infos)
+		}
+	}
+
+	// the disk database is still there after closing and reopening
+	disk.Close()
+	disk, err = storage.OpenDiskEngine(path)
+	if err != nil {
+		t.Fatalf("Could not reopen disk engine: %v", err)
+	}
+	db, err := OpenDatabase(disk)
+	if err != nil {
+		t.Fatalf("Could not reopen disk database: %v", err)
+	}
+	defer db.Close()
+	count, err := db.Count("notes")
+	if err != nil || count != 3 {
+		t.Errorf("Expected 3 records after reopening, got %d (%v)", count, err)
+	}
+	coll, err := db.GetCollection("news")
+	if err != nil {
+		t.Fatalf("Could not get collection: %v", err)
+	}
+	if coll.TTL == 0 {
+		t.Errorf("Expected the collection TTL to survive reopening")
+	}
+
+	// snapshots work the same on an engine
+	db.EnableBackups(t.TempDir(), BackupOptions{})
+	info, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("Could not take snapshot: %v", err)
+	}
+	addMockRecord(t, db, "news", "d")
+	db.DeleteRecord("news", "a")
+	incremental, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("Could not take snapshot: %v", err)
+	}
+	if incremental.Full || incremental.Collections != 1 || incremental.Records != 1 || incremental.DeletedRecords != 1 {
+		t.Errorf("Expected an incremental snapshot of news with one record added and one deleted, got %+v", incremental)
+	}
+	db.DeleteCollection("notes")
+	err = db.Restore(info.Id)
+	if err != nil {
+		t.Fatalf("Could not restore snapshot: %v", err)
+	}
+	count, _ = db.Count("notes")
+	if count != 3 {
+		t.Errorf("Expected the restored collection to have 3 records, got %d", count)
+	}
+}
+
+func recordIds(page []records.Record) []string {
+	ids := make([]string, len(page))
+	for i, record := range page {
+		ids[i] = record.Id
+	}
+	return ids
+}
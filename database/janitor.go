@@ -0,0 +1,75 @@
+package database
+
+import (
+	"sync"
+	"time"
+)
+
+// RemoveExpired deletes expired records from every collection and returns
+// how many were deleted. Expired records are already hidden from reads, this
+// just frees up the memory they're using, but change feed subscribers are
+// told about each one. Read-only databases are left alone
+func (db SimpleDataBase) RemoveExpired() int {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.readOnly {
+		return 0
+	}
+	now := time.Now()
+	removed := 0
+	for _, collectionId := range sortedKeys(db.Collections) {
+		collection := db.Collections[collectionId]
+		// a collection that can't be cleaned up now gets another go on the
+		// janitor's next run
+		before, err := db.storedCollectionUsage(collection.Id)
+		if err != nil {
+			continue
+		}
+		err = db.backups.savingCollection(collection)
+		if err != nil {
+			continue
+		}
+		expired, err := collection.RemoveExpired(now)
+		if err != nil {
+			db.log().Warn("could not remove expired records", "collection", collection.Id, "error", err)
+		}
+		for _, recordId := range expired {
+			db.backups.wroteRecord(collection.Id, recordId)
+			db.notifyRecord(RecordDeleted, collection.Id, recordId, nil)
+		}
+		removed += len(expired)
+		if len(expired) > 0 {
+			after, err := db.storedCollectionUsage(collection.Id)
+			if err == nil {
+				db.releaseUsage(before.minus(after))
+			}
+		}
+	}
+	if removed > 0 {
+		db.log().Debug("removed expired records", "records", removed)
+	}
+	return removed
+}
+
+// StartJanitor removes expired records every interval until the returned
+// stop function is called
+func (db SimpleDataBase) StartJanitor(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				db.RemoveExpired()
+			}
+		}
+	}()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
@@ -0,0 +1,52 @@
+package database
+
+import (
+	metrics "go-simple-embedding-database/metrics"
+)
+
+// Counted across every database in the process, by collection ID
+var (
+	recordsAdded   = metrics.Register(metrics.MakeCounter("sedb_records_added_total", "Records added to a collection", "collection"))
+	recordsUpdated = metrics.Register(metrics.MakeCounter("sedb_records_updated_total", "Records replaced by an upsert", "collection"))
+	recordsDeleted = metrics.Register(metrics.MakeCounter("sedb_records_deleted_total", "Records deleted from a collection", "collection"))
+	queryCount     = metrics.Register(metrics.MakeCounter("sedb_queries_total", "Queries run against a collection, counting each query in a batch", "collection"))
+)
+
+// countRecordChange counts a record change in the metrics above
+func countRecordChange(changeType ChangeType, collectionId string) {
+	switch changeType {
+	case RecordAdded:
+		recordsAdded.Inc(collectionId)
+	case RecordUpdated:
+		recordsUpdated.Inc(collectionId)
+	case RecordDeleted:
+		recordsDeleted.Inc(collectionId)
+	}
+}
+
+// RegisterMetrics adds gauges for the database's collections and their
+// sizes to registry, worked out whenever it's served. Their names are the
+// same for every database, so a registry can only have one database's
+func (db *SimpleDataBase) RegisterMetrics(registry *metrics.Registry) error {
+	collections := metrics.MakeGaugeFunc("sedb_collections", "Collections in the database", func(observe func(float64, ...string)) {
+		observe(float64(len(db.ListCollections())))
+	})
+	sizes := metrics.MakeGaugeFunc("sedb_collection_records", "Records in a collection that haven't expired", func(observe func(float64, ...string)) {
+		for _, info := range db.ListCollections() {
+			count, err := db.Count(info.Id)
+			if err == nil {
+				observe(float64(count), info.Id)
+			}
+		}
+	}, "collection")
+	err := registry.Register(collections)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(sizes)
+	if err != nil {
+		registry.Unregister(collections.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	collection "go-simple-embedding-database/collection"
+	embedders "go-simple-embedding-database/embedders"
+	metrics "go-simple-embedding-database/metrics"
+	records "go-simple-embedding-database/records"
+)
+
+func TestMetrics(t *testing.T) {
+	embedders.EmbedderRegister["mock-embedder"] = MockEmbed
+	db := MakeDatabase()
+	coll, _ := collection.MakeCollection("metrics-docs", "mock-embedder")
+	db.AddCollection(coll)
+	added, updated, deleted, queried := recordsAdded.Value("metrics-docs"), recordsUpdated.Value("metrics-docs"), recordsDeleted.Value("metrics-docs"), queryCount.Value("metrics-docs")
+
+	for _, id := range []string{"a", "b", "a"} {
+		record, _ := records.MakeRecord("mock-embedder", []byte(id), id)
+		err := db.UpsertRecord("metrics-docs", record)
+		if err != nil {
+			t.Fatalf("Could not upsert record: %v", err)
+		}
+	}
+	db.DeleteRecord("metrics-docs", "b")
+	db.Query("metrics-docs", []byte("query"), 1)
+	db.QueryBatch("metrics-docs", [][]byte{[]byte("one"), []byte("two")}, 1)
+	// failures aren't counted
+	db.DeleteRecord("metrics-docs", "missing")
+	db.Query("missing", []byte("query"), 1)
+
+	for _, test := range []struct {
+		name     string
+		counter  *metrics.Counter
+		before   float64
+		expected float64
+	}{
+		{"added", recordsAdded, added, 2},
+		{"updated", recordsUpdated, updated, 1},
+		{"deleted", recordsDeleted, deleted, 1},
+		{"queries", queryCount, queried, 3},
+	} {
+		if got := test.counter.Value("metrics-docs") - test.before; got != test.expected {
+			t.Errorf("Expected %v %s, got %v", test.expected, test.name, got)
+		}
+	}
+
+	// expired records aren't counted, even before the janitor removes them
+	expired, _ := records.MakeRecord("mock-embedder", []byte("c"), "c")
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	err := db.AddRecord("metrics-docs", expired)
+	if err != nil {
+		t.Fatalf("Could not add expired record: %v", err)
+	}
+
+	registry := metrics.MakeRegistry()
+	err = db.RegisterMetrics(registry)
+	if err != nil {
+		t.Fatalf("Could not register metrics: %v", err)
+	}
+	buffer := &bytes.Buffer{}
+	registry.WriteTo(buffer)
+	for _, line := range []string{"sedb_collections 1\n", `sedb_collection_records{collection="metrics-docs"} 1` + "\n"} {
+		if !strings.Contains(buffer.String(), line) {
+			t.Errorf("Expected %q in\n%s", line, buffer)
+		}
+	}
+	if err := MakeDatabase().RegisterMetrics(registry); err == nil {
+		t.Errorf("Should not have been able to register a second database's metrics")
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package database
+
+import (
+	"io"
+	"os"
+)
+
+// no mmap here, so the file is read into memory instead. Everything still
+// works, the vectors just aren't shared between processes
+func mapFile(file *os.File, size int) ([]byte, func([]byte) error, error) {
+	data := make([]byte, size)
+	_, err := io.ReadFull(file, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func([]byte) error { return nil }, nil
+}
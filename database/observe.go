@@ -0,0 +1,38 @@
+package database
+
+import (
+	"log/slog"
+
+	observe "go-simple-embedding-database/observe"
+)
+
+// SetLogger sets the logger the database logs to, such as failures in the
+// janitor or scheduled backups. The default, nil, logs to slog.Default()
+func (db *SimpleDataBase) SetLogger(logger *slog.Logger) {
+	db.logger = logger
+}
+
+func (db SimpleDataBase) log() *slog.Logger {
+	if db.logger == nil {
+		return slog.Default()
+	}
+	return db.logger
+}
+
+// SetObserver sets an observer for the database's queries, adds and
+// upserts, and writes to files and snapshots. nil turns observing off.
+// Embedding is observed separately, see embedders.SetObserver
+func (db *SimpleDataBase) SetObserver(observer observe.Observer) {
+	db.observer = observer
+}
+
+// observed starts a span for event and returns a func that ends it with
+// *err, for deferring:
+//
+//	defer db.observed(event)(&err)
+func (db SimpleDataBase) observed(event observe.Event) func(err *error) {
+	span := observe.Start(db.observer, event)
+	return func(err *error) {
+		span.End(*err)
+	}
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	collection "go-simple-embedding-database/collection"
+	embedders "go-simple-embedding-database/embedders"
+	observe "go-simple-embedding-database/observe"
+	records "go-simple-embedding-database/records"
+)
+
+// spanRecorder keeps every span it sees, with the error it ended with
+type spanRecorder struct {
+	mutex *sync.Mutex
+	spans []string
+}
+
+func (r *spanRecorder) Start(event observe.Event) observe.Span {
+	return recordedSpan{r, event}
+}
+
+type recordedSpan struct {
+	r     *spanRecorder
+	event observe.Event
+}
+
+func (span recordedSpan) End(err error) {
+	span.r.mutex.Lock()
+	defer span.r.mutex.Unlock()
+	description := string(span.event.Operation) + " " + span.event.Collection + span.event.Embedder + span.event.RecordId
+	if err != nil {
+		description += " failed"
+	}
+	span.r.spans = append(span.r.spans, description)
+}
+
+func TestObserver(t *testing.T) {
+	embedders.EmbedderRegister["mock-embedder"] = MockEmbed
+	db := MakeDatabase()
+	coll, _ := collection.MakeCollection("docs", "mock-embedder")
+	db.AddCollection(coll)
+	observer := &spanRecorder{mutex: &sync.Mutex{}}
+	db.SetObserver(observer)
+	embedders.SetObserver(observer)
+	defer embedders.SetObserver(nil)
+
+	// making the record embeds it
+	record, _ := records.MakeRecord("mock-embedder", []byte("a"), "a")
+	db.AddRecord("docs", record)
+	db.AddRecord("docs", record)
+	db.QueryWithOptions("docs", []byte("query"), collection.QueryOptions{NGreatest: 1})
+	db.QueryVector("missing", []float64{1, 2, 3, 4, 5}, collection.QueryOptions{})
+	fileName := filepath.Join(t.TempDir(), "db.json")
+	db.ToFile(fileName)
+
+	expected := []string{
+		"embed mock-embedder",
+		"add docsa",
+		"add docsa failed",
+		"embed mock-embedder",
+		"query docs",
+		"query missing failed",
+		"persist ",
+	}
+	if !reflect.DeepEqual(observer.spans, expected) {
+		t.Errorf("Expected spans %v, got %v", expected, observer.spans)
+	}
+
+	// without an observer nothing is recorded
+	db.SetObserver(nil)
+	db.DeleteRecord("docs", "a")
+	db.AddRecord("docs", record)
+	if len(observer.spans) != len(expected) {
+		t.Errorf("Expected no more spans, got %v", observer.spans[len(expected):])
+	}
+}
+
+// lockedBuffer is a buffer that can be logged to from the backup goroutine
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(data []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(data)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+func TestLogger(t *testing.T) {
+	buffer := &lockedBuffer{}
+	db := MakeDatabase()
+	db.SetLogger(slog.New(slog.NewTextHandler(buffer, nil)))
+	dir := filepath.Join(t.TempDir(), "backups")
+	failed := make(chan error, 1)
+	db.EnableBackups(dir, BackupOptions{OnError: func(err error) {
+		select {
+		case failed <- err:
+		default:
+		}
+	}})
+	// with the directory gone every backup fails
+	os.RemoveAll(dir)
+	stop, err := db.StartBackups("@every 1ms")
+	if err != nil {
+		t.Fatalf("Could not start backups: %v", err)
+	}
+	<-failed
+	stop()
+	if !strings.Contains(buffer.String(), "scheduled backup failed") {
+		t.Errorf("Expected the failed backup to be logged, got %q", buffer.String())
+	}
+}
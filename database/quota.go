@@ -0,0 +1,279 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	collection "go-simple-embedding-database/collection"
+	records "go-simple-embedding-database/records"
+)
+
+// Quota limits how much a database (or several sharing a QuotaTracker) can
+// hold. 0 means no limit
+type Quota struct {
+	MaxRecords int   `json:"maxRecords,omitempty"`
+	MaxBytes   int64 `json:"maxBytes,omitempty"`
+}
+
+// Usage is what counts against a quota: every stored record, including
+// expired records the janitor hasn't removed yet, and their sizes as
+// RecordSize measures them
+type Usage struct {
+	Records int   `json:"records"`
+	Bytes   int64 `json:"bytes"`
+}
+
+func (usage Usage) plus(other Usage) Usage {
+	return Usage{Records: usage.Records + other.Records, Bytes: usage.Bytes + other.Bytes}
+}
+
+func (usage Usage) minus(other Usage) Usage {
+	return Usage{Records: usage.Records - other.Records, Bytes: usage.Bytes - other.Bytes}
+}
+
+// ErrQuotaExceeded is returned (wrapped) by writes that would take a
+// database over its quota
+var ErrQuotaExceeded = errors.New("Quota exceeded")
+
+// RecordSize is roughly how many bytes of data a record holds: its ID,
+// embedder ID, blob, embedding and metadata. It isn't what the record takes
+// up on disk or in memory, but it's the same however the record is stored
+func RecordSize(record records.Record) int64 {
+	size := int64(len(record.Id) + len(record.EmbedderId) + len(record.Blob) + 8*len(record.Embedding))
+	for key, value := range record.Metadata {
+		size += int64(len(key) + len(value))
+	}
+	return size
+}
+
+// QuotaTracker keeps count of the usage of the databases it's set on (see
+// SetQuotaTracker), and stops writes to them that would go over its quota
+type QuotaTracker struct {
+	mutex *sync.Mutex
+	quota Quota
+	usage Usage
+}
+
+func MakeQuotaTracker(quota Quota) *QuotaTracker {
+	return &QuotaTracker{mutex: &sync.Mutex{}, quota: quota}
+}
+
+func (tracker *QuotaTracker) Quota() Quota {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	return tracker.quota
+}
+
+// SetQuota changes the quota. Usage already over the new quota is left
+// alone, but nothing more can be added until it's back under
+func (tracker *QuotaTracker) SetQuota(quota Quota) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.quota = quota
+}
+
+func (tracker *QuotaTracker) Usage() Usage {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	return tracker.usage
+}
+
+// check expects the caller to hold the lock. Only increases are checked, so
+// a database over its quota can still shrink
+func (tracker *QuotaTracker) check(delta Usage) error {
+	usage := tracker.usage.plus(delta)
+	if delta.Records > 0 && tracker.quota.MaxRecords > 0 && usage.Records > tracker.quota.MaxRecords {
+		return fmt.Errorf("%w: %d records would go over the limit of %d", ErrQuotaExceeded, usage.Records, tracker.quota.MaxRecords)
+	}
+	if delta.Bytes > 0 && tracker.quota.MaxBytes > 0 && usage.Bytes > tracker.quota.MaxBytes {
+		return fmt.Errorf("%w: %d bytes would go over the limit of %d", ErrQuotaExceeded, usage.Bytes, tracker.quota.MaxBytes)
+	}
+	return nil
+}
+
+// reserve adds delta to the usage if it fits in the quota
+func (tracker *QuotaTracker) reserve(delta Usage) error {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	err := tracker.check(delta)
+	if err != nil {
+		return err
+	}
+	tracker.usage = tracker.usage.plus(delta)
+	return nil
+}
+
+// add adds delta to the usage, even if it goes over the quota
+func (tracker *QuotaTracker) add(delta Usage) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.usage = tracker.usage.plus(delta)
+}
+
+func (tracker *QuotaTracker) release(delta Usage) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.usage = tracker.usage.minus(delta)
+}
+
+// SetQuotaTracker makes the database count against tracker's quota, adding
+// what's already in the database to its usage (even if that's over the
+// quota). Several databases can share a tracker. Call it before the
+// database is shared between goroutines
+func (db *SimpleDataBase) SetQuotaTracker(tracker *QuotaTracker) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	usage, err := db.usage()
+	if err != nil {
+		return err
+	}
+	if db.quota != nil {
+		db.quota.release(usage)
+	}
+	db.quota = tracker
+	if tracker != nil {
+		tracker.mutex.Lock()
+		defer tracker.mutex.Unlock()
+		tracker.usage = tracker.usage.plus(usage)
+	}
+	return nil
+}
+
+// Usage adds up the usage of every collection in the database
+func (db SimpleDataBase) Usage() (Usage, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.usage()
+}
+
+// usage expects the caller to hold the lock
+func (db SimpleDataBase) usage() (Usage, error) {
+	total := Usage{}
+	for _, coll := range db.Collections {
+		usage, err := collectionUsage(coll)
+		if err != nil {
+			return Usage{}, err
+		}
+		total = total.plus(usage)
+	}
+	return total, nil
+}
+
+func collectionUsage(coll collection.Collection) (Usage, error) {
+	usage := Usage{}
+	err := coll.ScanRecords(func(record records.Record) bool {
+		usage.Records++
+		usage.Bytes += RecordSize(record)
+		return true
+	})
+	return usage, err
+}
+
+// The quota methods do nothing unless the database has a quota tracker.
+// They expect the caller to hold the write lock
+
+// reserveRecord reserves what storing record in coll would add to the
+// usage, which depends on what's stored under its ID already. It returns
+// the reservation, to be released if the record isn't stored after all
+func (db SimpleDataBase) reserveRecord(coll collection.Collection, record records.Record) (Usage, error) {
+	if db.quota == nil {
+		return Usage{}, nil
+	}
+	delta, err := recordDelta(coll, record)
+	if err != nil {
+		return Usage{}, err
+	}
+	return delta, db.quota.reserve(delta)
+}
+
+// addRecord is reserveRecord for records that are stored whether or not
+// they fit, like changes from another database's change feed, which that
+// database's quota already allowed
+func (db SimpleDataBase) addRecord(coll collection.Collection, record records.Record) (Usage, error) {
+	if db.quota == nil {
+		return Usage{}, nil
+	}
+	delta, err := recordDelta(coll, record)
+	if err != nil {
+		return Usage{}, err
+	}
+	db.quota.add(delta)
+	return delta, nil
+}
+
+// recordDelta is what storing record in coll would add to the usage
+func recordDelta(coll collection.Collection, record records.Record) (Usage, error) {
+	delta := Usage{Records: 1, Bytes: RecordSize(record)}
+	existing, ok, err := coll.StoredRecord(record.Id)
+	if err != nil {
+		return Usage{}, err
+	}
+	if ok {
+		delta = Usage{Bytes: delta.Bytes - RecordSize(existing)}
+	}
+	return delta, nil
+}
+
+// reserveCollection reserves the usage of a collection about to be stored
+func (db SimpleDataBase) reserveCollection(coll collection.Collection) (Usage, error) {
+	if db.quota == nil {
+		return Usage{}, nil
+	}
+	usage, err := collectionUsage(coll)
+	if err != nil {
+		return Usage{}, err
+	}
+	return usage, db.quota.reserve(usage)
+}
+
+// storedRecordUsage is the usage of the record stored with the ID, if any
+func (db SimpleDataBase) storedRecordUsage(coll collection.Collection, recordId string) (Usage, error) {
+	if db.quota == nil {
+		return Usage{}, nil
+	}
+	existing, ok, err := coll.StoredRecord(recordId)
+	if err != nil || !ok {
+		return Usage{}, err
+	}
+	return Usage{Records: 1, Bytes: RecordSize(existing)}, nil
+}
+
+// storedCollectionUsage is the usage of the collection stored with the ID,
+// if any
+func (db SimpleDataBase) storedCollectionUsage(collectionId string) (Usage, error) {
+	coll, ok := db.Collections[collectionId]
+	if db.quota == nil || !ok {
+		return Usage{}, nil
+	}
+	return collectionUsage(coll)
+}
+
+func (db SimpleDataBase) releaseUsage(usage Usage) {
+	if db.quota != nil {
+		db.quota.release(usage)
+	}
+}
+
+// checkReplacement checks that replacing every collection in the database
+// with collections would fit in the quota, without reserving anything
+func (db SimpleDataBase) checkReplacement(collections map[string]collection.Collection) error {
+	if db.quota == nil {
+		return nil
+	}
+	current, err := db.usage()
+	if err != nil {
+		return err
+	}
+	replacement := Usage{}
+	for _, coll := range collections {
+		usage, err := collectionUsage(coll)
+		if err != nil {
+			return err
+		}
+		replacement = replacement.plus(usage)
+	}
+	db.quota.mutex.Lock()
+	defer db.quota.mutex.Unlock()
+	return db.quota.check(replacement.minus(current))
+}
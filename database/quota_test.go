@@ -0,0 +1,213 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	collection "go-simple-embedding-database/collection"
+	embedders "go-simple-embedding-database/embedders"
+	records "go-simple-embedding-database/records"
+	storage "go-simple-embedding-database/storage"
+)
+
+func quotaRecord(t *testing.T, id string, blob string) *records.Record {
+	record, err := records.MakeRecord("mock-embedder", []byte(blob), id)
+	if err != nil {
+		t.Fatalf("Could not create record %s: %v", id, err)
+	}
+	return record
+}
+
+func TestQuota(t *testing.T) {
+	embedders.EmbedderRegister["mock-embedder"] = MockEmbed
+	// MockEmbed's 5 floats, the embedder ID and a 1 byte ID
+	size := func(blob string) int64 {
+		return int64(1 + len("mock-embedder") + len(blob) + 8*5)
+	}
+
+	memoryDB := MakeDatabase()
+	diskDB, err := OpenDatabase(storage.MakeMemoryEngine())
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	tracker := MakeQuotaTracker(Quota{MaxRecords: 3})
+	for _, db := range []*SimpleDataBase{memoryDB, diskDB} {
+		coll, _ := collection.MakeCollection("docs", "mock-embedder")
+		err = db.AddCollection(coll)
+		if err != nil {
+			t.Fatalf("Could not add collection: %v", err)
+		}
+	}
+	err = memoryDB.AddRecord("docs", quotaRecord(t, "a", "before"))
+	if err != nil {
+		t.Fatalf("Could not add record: %v", err)
+	}
+	// records already in a database count once the tracker is set
+	for _, db := range []*SimpleDataBase{memoryDB, diskDB} {
+		err = db.SetQuotaTracker(tracker)
+		if err != nil {
+			t.Fatalf("Could not set quota tracker: %v", err)
+		}
+	}
+	if usage := tracker.Usage(); usage != (Usage{Records: 1, Bytes: size("before")}) {
+		t.Errorf("Expected usage to include the existing record, got %+v", usage)
+	}
+
+	// the databases share the quota
+	err = diskDB.AddRecord("docs", quotaRecord(t, "b", "bb"))
+	if err != nil {
+		t.Fatalf("Could not add record: %v", err)
+	}
+	err = memoryDB.UpsertRecord("docs", quotaRecord(t, "c", "ccc"))
+	if err != nil {
+		t.Fatalf("Could not upsert record: %v", err)
+	}
+	err = diskDB.AddRecord("docs", quotaRecord(t, "d", "d"))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected the fourth record to go over the quota, got %v", err)
+	}
+	if _, err := diskDB.GetRecord("docs", "d"); err == nil {
+		t.Errorf("The record that went over the quota should not have been added")
+	}
+	// replacing a record doesn't add one
+	err = memoryDB.UpsertRecord("docs", quotaRecord(t, "a", "after!"))
+	if err != nil {
+		t.Errorf("Could not replace record: %v", err)
+	}
+	expected := Usage{Records: 3, Bytes: size("after!") + size("bb") + size("ccc")}
+	if usage := tracker.Usage(); usage != expected {
+		t.Errorf("Expected usage %+v, got %+v", expected, usage)
+	}
+	// adding an existing record fails without changing the usage
+	err = memoryDB.AddRecord("docs", quotaRecord(t, "a", "a much longer blob"))
+	if err == nil || errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected adding an existing record to fail, got %v", err)
+	}
+	if usage := tracker.Usage(); usage != expected {
+		t.Errorf("Expected a failed add to leave usage at %+v, got %+v", expected, usage)
+	}
+
+	err = diskDB.DeleteRecord("docs", "b")
+	if err != nil {
+		t.Fatalf("Could not delete record: %v", err)
+	}
+	err = diskDB.AddRecord("docs", quotaRecord(t, "d", "d"))
+	if err != nil {
+		t.Errorf("Expected deleting a record to make room, got %v", err)
+	}
+	err = memoryDB.DeleteCollection("docs")
+	if err != nil {
+		t.Fatalf("Could not delete collection: %v", err)
+	}
+	if usage := tracker.Usage(); usage != (Usage{Records: 1, Bytes: size("d")}) {
+		t.Errorf("Expected deleting a collection to release its records, got %+v", usage)
+	}
+
+	tracker.SetQuota(Quota{MaxBytes: size("d") + size("ee")})
+	coll, _ := collection.MakeCollection("docs", "mock-embedder")
+	memoryDB.AddCollection(coll)
+	err = memoryDB.AddRecord("docs", quotaRecord(t, "e", "eee"))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected a record over the byte quota to fail, got %v", err)
+	}
+	err = memoryDB.AddRecord("docs", quotaRecord(t, "e", "ee"))
+	if err != nil {
+		t.Errorf("Expected a record that just fits to be added, got %v", err)
+	}
+
+	// replacing the whole database is checked up front
+	replacement := MakeDatabase()
+	big, _ := collection.MakeCollection("big", "mock-embedder")
+	replacement.AddCollection(big)
+	for i := 0; i < 3; i++ {
+		replacement.AddRecord("big", quotaRecord(t, fmt.Sprint(i), "x"))
+	}
+	buffer := &bytes.Buffer{}
+	replacement.WriteTo(buffer)
+	err = memoryDB.ReplaceFrom(buffer)
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected replacing the database to go over the quota, got %v", err)
+	}
+	if _, err := memoryDB.GetRecord("docs", "e"); err != nil {
+		t.Errorf("A replacement over the quota should leave the database alone: %v", err)
+	}
+}
+
+func TestQuotaExpiredRecords(t *testing.T) {
+	embedders.EmbedderRegister["mock-embedder"] = MockEmbed
+	db := MakeDatabase()
+	coll, _ := collection.MakeCollection("docs", "mock-embedder")
+	db.AddCollection(coll)
+	tracker := MakeQuotaTracker(Quota{MaxRecords: 2})
+	db.SetQuotaTracker(tracker)
+
+	expired := quotaRecord(t, "old", "old")
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	err := db.AddRecord("docs", expired)
+	if err != nil {
+		t.Fatalf("Could not add record: %v", err)
+	}
+	err = db.AddRecord("docs", quotaRecord(t, "new", "new"))
+	if err != nil {
+		t.Fatalf("Could not add record: %v", err)
+	}
+	// expired records count until the janitor removes them
+	err = db.AddRecord("docs", quotaRecord(t, "newer", "newer"))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected the expired record to still count, got %v", err)
+	}
+	if removed := db.RemoveExpired(); removed != 1 {
+		t.Errorf("Expected to remove 1 expired record, removed %d", removed)
+	}
+	if usage := tracker.Usage(); usage.Records != 1 {
+		t.Errorf("Expected removing the expired record to release it, got %+v", usage)
+	}
+	err = db.AddRecord("docs", quotaRecord(t, "newer", "newer"))
+	if err != nil {
+		t.Errorf("Expected room for another record, got %v", err)
+	}
+
+	// taking the tracker off releases the database's usage
+	err = db.SetQuotaTracker(nil)
+	if err != nil || tracker.Usage() != (Usage{}) {
+		t.Errorf("Expected no usage once the tracker is removed, got %+v (%v)", tracker.Usage(), err)
+	}
+}
+
+func TestQuotaAppliedChanges(t *testing.T) {
+	embedders.EmbedderRegister["mock-embedder"] = MockEmbed
+	db := MakeDatabase()
+	coll, _ := collection.MakeCollection("docs", "mock-embedder")
+	db.AddCollection(coll)
+	tracker := MakeQuotaTracker(Quota{MaxRecords: 1})
+	db.SetQuotaTracker(tracker)
+
+	// changes from the leader count, even over the quota it already allowed
+	expired := quotaRecord(t, "old", "old")
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	for _, record := range []*records.Record{expired, quotaRecord(t, "new", "new")} {
+		err := db.ApplyChange(Change{Type: RecordAdded, CollectionId: "docs", RecordId: record.Id, Record: record})
+		if err != nil {
+			t.Fatalf("Could not apply change: %v", err)
+		}
+	}
+	if usage := tracker.Usage(); usage.Records != 2 {
+		t.Errorf("Expected applied records to count, got %+v", usage)
+	}
+
+	// a delete for a record that's expired but still stored removes it
+	err := db.ApplyChange(Change{Type: RecordDeleted, CollectionId: "docs", RecordId: "old"})
+	if err != nil {
+		t.Fatalf("Could not apply change: %v", err)
+	}
+	stored, _ := db.getCollection("docs")
+	if _, ok, _ := stored.StoredRecord("old"); ok {
+		t.Errorf("Expected the expired record to be deleted")
+	}
+	if usage := tracker.Usage(); usage.Records != 1 {
+		t.Errorf("Expected the deleted record to be released, got %+v", usage)
+	}
+}
@@ -0,0 +1,154 @@
+package database
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	collection "go-simple-embedding-database/collection"
+	records "go-simple-embedding-database/records"
+	storage "go-simple-embedding-database/storage"
+)
+
+// A replica is kept in step with another database (see the replication
+// package). Writes to it fail with ErrReadOnly; changes only come in
+// through ReplaceFrom and ApplyChange, which copy the other database's
+// changes exactly
+
+// SetReplica makes the database a replica, or stops it being one. Call it
+// before the database is shared between goroutines
+func (db *SimpleDataBase) SetReplica(replica bool) {
+	db.replica = replica
+}
+
+// WriteSnapshot is WriteTo, but it also returns the sequence number of the
+// latest change the snapshot includes, so a replica made from the snapshot
+// knows where to pick up the change feed. The database is copied under the
+// lock and written out after it's released, so a slow reader doesn't hold
+// up writes
+func (db *SimpleDataBase) WriteSnapshot(w io.Writer) (uint64, int64, error) {
+	if db.changes == nil {
+		return 0, 0, ErrChangeFeedNotEnabled
+	}
+	db.mutex.RLock()
+	// changes are published under the write lock, so none can happen
+	// between reading the sequence number and copying the collections
+	sequence := db.changes.latest()
+	view, err := db.viewLocked()
+	db.mutex.RUnlock()
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err := writeCollections(w, view)
+	return sequence, n, err
+}
+
+// ReplaceFrom replaces everything in the database with the database read
+// from r, which is in the format WriteTo writes
+func (db *SimpleDataBase) ReplaceFrom(r io.Reader) error {
+	collections, err := readDatabaseJSON(json.NewDecoder(bufio.NewReader(r)))
+	if err != nil {
+		return err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	return db.replaceCollections(collections)
+}
+
+// ApplyChange makes a change from another database's change feed. Records
+// are stored exactly as they are in the change. They count against the
+// database's quota, if it has one, but aren't held back by it, since the
+// database the change came from already allowed them
+func (db SimpleDataBase) ApplyChange(change Change) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	switch change.Type {
+	case CollectionCreated:
+		if change.Collection == nil {
+			return fmt.Errorf("%w: change %d has no collection", ErrInvalidChange, change.Sequence)
+		}
+		info := *change.Collection
+		err := db.putCollection(collection.Collection{Id: info.Id, EmbedderId: info.EmbedderId, TTL: info.TTL, Records: make(map[string]records.Record)})
+		if err != nil {
+			return err
+		}
+		db.notifyCollection(CollectionCreated, info)
+		return nil
+	case CollectionUpdated:
+		if change.Collection == nil {
+			return fmt.Errorf("%w: change %d has no collection", ErrInvalidChange, change.Sequence)
+		}
+		coll, err := db.getCollection(change.CollectionId)
+		if err != nil {
+			return err
+		}
+		return db.setCollectionTTL(*coll, change.Collection.TTL)
+	case CollectionDeleted:
+		err := db.removeCollection(change.CollectionId)
+		if err != nil {
+			return err
+		}
+		db.notifyCollection(CollectionDeleted, storage.CollectionInfo{Id: change.CollectionId})
+		return nil
+	case RecordAdded, RecordUpdated:
+		if change.Record == nil {
+			return fmt.Errorf("%w: change %d has no record", ErrInvalidChange, change.Sequence)
+		}
+		coll, err := db.getCollection(change.CollectionId)
+		if err != nil {
+			return err
+		}
+		err = db.backups.writingRecord(*coll, change.RecordId)
+		if err != nil {
+			return err
+		}
+		usage, err := db.addRecord(*coll, *change.Record)
+		if err != nil {
+			return err
+		}
+		err = coll.PutRecord(*change.Record)
+		if err != nil {
+			db.releaseUsage(usage)
+			return err
+		}
+		db.notifyRecord(change.Type, change.CollectionId, change.RecordId, change.Record)
+		return nil
+	case RecordDeleted:
+		coll, err := db.getCollection(change.CollectionId)
+		if err != nil {
+			return err
+		}
+		// the janitor may have beaten the change to an expired record. One
+		// that's expired but still stored is deleted all the same
+		_, ok, err := coll.StoredRecord(change.RecordId)
+		if err != nil {
+			return err
+		}
+		if ok {
+			usage, err := db.storedRecordUsage(*coll, change.RecordId)
+			if err != nil {
+				return err
+			}
+			err = db.backups.writingRecord(*coll, change.RecordId)
+			if err != nil {
+				return err
+			}
+			err = coll.DeleteRecord(change.RecordId)
+			if err != nil {
+				return err
+			}
+			db.releaseUsage(usage)
+		}
+		db.notifyRecord(RecordDeleted, change.CollectionId, change.RecordId, nil)
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown change type %s", ErrInvalidChange, change.Type)
+	}
+}
@@ -0,0 +1,326 @@
+package database
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	collection "go-simple-embedding-database/collection"
+	observe "go-simple-embedding-database/observe"
+	records "go-simple-embedding-database/records"
+)
+
+// WriteTo and ReadFrom produce and consume the same JSON as MarshalJSON and
+// UnmarshalJSON, but only ever hold one record's worth of JSON in memory, so
+// large databases can be streamed to and from files, gzip streams or network
+// connections
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// WriteTo writes the database to w as JSON, one collection and one record
+// at a time. Collections and records are written in ID order, so the output
+// is byte for byte what json.Marshal produces
+func (db *SimpleDataBase) WriteTo(w io.Writer) (int64, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return writeCollections(w, db.Collections)
+}
+
+// writeCollections expects the caller to hold the lock, unless collections
+// is a copy
+func writeCollections(w io.Writer, collections map[string]collection.Collection) (int64, error) {
+	counter := &countingWriter{w: w}
+	buffered := bufio.NewWriter(counter)
+	err := writeJSON(buffered, collections)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	return counter.n, err
+}
+
+func writeJSON(w *bufio.Writer, collections map[string]collection.Collection) error {
+	w.WriteString(`{"collections":{`)
+	for i, collectionId := range sortedKeys(collections) {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		err := writeJSONValue(w, collectionId)
+		if err != nil {
+			return err
+		}
+		w.WriteByte(':')
+		err = writeCollectionJSON(w, collections[collectionId])
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.WriteString(`}}`)
+	return err
+}
+
+// the fields here need to be kept in step with collection.Collection
+func writeCollectionJSON(w *bufio.Writer, collection collection.Collection) error {
+	w.WriteString(`{"id":`)
+	err := writeJSONValue(w, collection.Id)
+	if err != nil {
+		return err
+	}
+	w.WriteString(`,"embedderId":`)
+	err = writeJSONValue(w, collection.EmbedderId)
+	if err != nil {
+		return err
+	}
+	w.WriteString(`,"embeddings":{`)
+	first := true
+	var writeErr error
+	err = collection.ScanRecords(func(record records.Record) bool {
+		if !first {
+			w.WriteByte(',')
+		}
+		first = false
+		writeErr = writeJSONValue(w, record.Id)
+		if writeErr != nil {
+			return false
+		}
+		w.WriteByte(':')
+		writeErr = writeJSONValue(w, record)
+		return writeErr == nil
+	})
+	if writeErr != nil {
+		return writeErr
+	}
+	if err != nil {
+		return err
+	}
+	w.WriteByte('}')
+	if collection.TTL != 0 {
+		w.WriteString(`,"ttl":`)
+		err = writeJSONValue(w, collection.TTL)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = w.WriteString(`}`)
+	return err
+}
+
+func writeJSONValue(w *bufio.Writer, value any) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(encoded)
+	return err
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// ReadFrom reads a database written by WriteTo (or ToFile, or json.Marshal)
+// from r, decoding one record at a time. Like UnmarshalJSON, the collections
+// read are added to the ones already in the database. Nothing is added
+// unless the whole stream decodes. The stream is decoded into memory before
+// anything is handed to the database's engine
+func (db *SimpleDataBase) ReadFrom(r io.Reader) (int64, error) {
+	counter := &countingReader{r: r}
+	decoder := json.NewDecoder(bufio.NewReader(counter))
+	collections, err := readDatabaseJSON(decoder)
+	if err != nil {
+		return counter.n, err
+	}
+
+	if db.mutex == nil {
+		db.mutex = &sync.RWMutex{}
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	err = db.checkWritable()
+	if err != nil {
+		return counter.n, err
+	}
+	if db.Collections == nil {
+		db.Collections = make(map[string]collection.Collection)
+	}
+	for _, collectionId := range sortedKeys(collections) {
+		err = db.putCollection(collections[collectionId])
+		if err != nil {
+			return counter.n, err
+		}
+	}
+	return counter.n, nil
+}
+
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("%w: expected %v at offset %d, got %v", ErrInvalidFile, delim, decoder.InputOffset(), token)
+	}
+	return nil
+}
+
+// readObject calls readField for every key in the JSON object the decoder
+// is sitting at. readField has to consume the key's value
+func readObject(decoder *json.Decoder, readField func(key string) error) error {
+	err := expectDelim(decoder, '{')
+	if err != nil {
+		return err
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := token.(string)
+		if !ok {
+			return fmt.Errorf("%w: expected an object key at offset %d, got %v", ErrInvalidFile, decoder.InputOffset(), token)
+		}
+		err = readField(key)
+		if err != nil {
+			return err
+		}
+	}
+	return expectDelim(decoder, '}')
+}
+
+func skipValue(decoder *json.Decoder) error {
+	return decoder.Decode(&json.RawMessage{})
+}
+
+func readDatabaseJSON(decoder *json.Decoder) (map[string]collection.Collection, error) {
+	collections := make(map[string]collection.Collection)
+	err := readObject(decoder, func(key string) error {
+		if key != "collections" {
+			return skipValue(decoder)
+		}
+		return readObject(decoder, func(collectionId string) error {
+			collection, err := readCollectionJSON(decoder)
+			if err != nil {
+				return fmt.Errorf("Could not read collection %s: %w", collectionId, err)
+			}
+			collections[collectionId] = collection
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return collections, nil
+}
+
+func readCollectionJSON(decoder *json.Decoder) (collection.Collection, error) {
+	coll := collection.Collection{}
+	err := readObject(decoder, func(key string) error {
+		switch key {
+		case "id":
+			return decoder.Decode(&coll.Id)
+		case "embedderId":
+			return decoder.Decode(&coll.EmbedderId)
+		case "ttl":
+			return decoder.Decode(&coll.TTL)
+		case "embeddings":
+			coll.Records = make(map[string]records.Record)
+			return readObject(decoder, func(recordId string) error {
+				record := records.Record{}
+				err := decoder.Decode(&record)
+				if err != nil {
+					return fmt.Errorf("Could not read record %s: %w", recordId, err)
+				}
+				coll.Records[recordId] = record
+				return nil
+			})
+		default:
+			return skipValue(decoder)
+		}
+	})
+	return coll, err
+}
+
+func isGzipFile(fileName string) bool {
+	return strings.HasSuffix(fileName, ".gz")
+}
+
+// FromFile reads a database written by ToFile. Files ending in .gz are
+// decompressed on the way in
+func (db *SimpleDataBase) FromFile(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if isGzipFile(fileName) {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	_, err = db.ReadFrom(reader)
+	return err
+}
+
+// ToFile writes the database out as JSON. Files ending in .gz are gzipped
+func (db *SimpleDataBase) ToFile(fileName string) (err error) {
+	defer db.observed(observe.Event{Operation: observe.Persist, Path: fileName})(&err)
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if !isGzipFile(fileName) {
+		_, err = db.WriteTo(file)
+		if err != nil {
+			return err
+		}
+		return file.Close()
+	}
+
+	gzipWriter := gzip.NewWriter(file)
+	_, err = db.WriteTo(gzipWriter)
+	if err != nil {
+		return err
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,164 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	collection "go-simple-embedding-database/collection"
+	embedders "go-simple-embedding-database/embedders"
+	records "go-simple-embedding-database/records"
+)
+
+func makeStreamDatabase(t *testing.T) *SimpleDataBase {
+	t.Helper()
+	return fillDatabase(t, MakeDatabase())
+}
+
+// fillDatabase adds three collections, one of them empty and one with a TTL
+func fillDatabase(t *testing.T, db *SimpleDataBase) *SimpleDataBase {
+	t.Helper()
+	embedders.EmbedderRegister["mock-embedder"] = MockEmbed
+	for _, collectionId := range []string{"notes", "news", "empty"} {
+		coll, err := collection.MakeCollection(collectionId, "mock-embedder")
+		if err != nil {
+			t.Fatalf("Could not create collection: %v", err)
+		}
+		err = db.AddCollection(coll)
+		if err != nil {
+			t.Fatalf("Could not add collection: %v", err)
+		}
+	}
+	err := db.SetCollectionTTL("news", time.Hour)
+	if err != nil {
+		t.Fatalf("Could not set collection TTL: %v", err)
+	}
+	for _, collectionId := range []string{"notes", "news"} {
+		for _, recordId := range []string{"b", "a", "c"} {
+			record, err := records.MakeRecord("mock-embedder", []byte("blob "+recordId), recordId)
+			if err != nil {
+				t.Fatalf("Could not create record: %v", err)
+			}
+			record.Metadata = map[string]string{"name": recordId, "quote": `"` + recordId + `"`}
+			err = db.AddRecord(collectionId, record)
+			if err != nil {
+				t.Fatalf("Could not add record: %v", err)
+			}
+		}
+	}
+	return db
+}
+
+func TestWriteToMatchesMarshal(t *testing.T) {
+	db := makeStreamDatabase(t)
+	expected, err := json.Marshal(db)
+	if err != nil {
+		t.Fatalf("Could not marshal database: %v", err)
+	}
+	buffer := &bytes.Buffer{}
+	n, err := db.WriteTo(buffer)
+	if err != nil {
+		t.Fatalf("Could not write database: %v", err)
+	}
+	if n != int64(buffer.Len()) {
+		t.Errorf("WriteTo reported %d bytes but wrote %d", n, buffer.Len())
+	}
+	if !bytes.Equal(expected, buffer.Bytes()) {
+		t.Errorf("WriteTo output differs from json.Marshal\nexpected %s\ngot      %s", expected, buffer.Bytes())
+	}
+
+	newDB := &SimpleDataBase{}
+	n, err = newDB.ReadFrom(bytes.NewReader(buffer.Bytes()))
+	if err != nil {
+		t.Fatalf("Could not read database: %v", err)
+	}
+	if n != int64(buffer.Len()) {
+		t.Errorf("ReadFrom reported %d bytes, expected %d", n, buffer.Len())
+	}
+	if !reflect.DeepEqual(db, newDB) {
+		t.Errorf("Not equal (expected %v, got %v)", db, newDB)
+	}
+}
+
+func TestGzipFiles(t *testing.T) {
+	db := makeStreamDatabase(t)
+	fileName := filepath.Join(t.TempDir(), "db.json.gz")
+	err := db.ToFile(fileName)
+	if err != nil {
+		t.Fatalf("Could not write database to file: %v", err)
+	}
+	newDB := MakeDatabase()
+	err = newDB.FromFile(fileName)
+	if err != nil {
+		t.Fatalf("Could not read database from file: %v", err)
+	}
+	if !reflect.DeepEqual(db, newDB) {
+		t.Errorf("Not equal (expected %v, got %v)", db, newDB)
+	}
+
+	// and the same stream works over anything else that compresses
+	compressed := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(compressed)
+	_, err = db.WriteTo(gzipWriter)
+	if err != nil {
+		t.Fatalf("Could not write database: %v", err)
+	}
+	gzipWriter.Close()
+	gzipReader, err := gzip.NewReader(compressed)
+	if err != nil {
+		t.Fatalf("Could not open gzip stream: %v", err)
+	}
+	newDB = MakeDatabase()
+	_, err = newDB.ReadFrom(gzipReader)
+	if err != nil {
+		t.Fatalf("Could not read database: %v", err)
+	}
+	if !reflect.DeepEqual(db, newDB) {
+		t.Errorf("Not equal (expected %v, got %v)", db, newDB)
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	embedders.EmbedderRegister["mock-embedder"] = MockEmbed
+	db := MakeDatabase()
+	coll, _ := collection.MakeCollection("existing", "mock-embedder")
+	db.AddCollection(coll)
+
+	// unknown fields are skipped so files from newer versions still load
+	input := `{"version": 2, "collections": {"docs": {"id": "docs", "embedderId": "mock-embedder", "extra": [1, {"x": 2}],
+		"embeddings": {"a": {"id": "a", "blob": "hey", "embedding": [1, 2], "embedderId": "mock-embedder"}}}}}`
+	_, err := db.ReadFrom(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Could not read database: %v", err)
+	}
+	if len(db.GetCollections()) != 2 {
+		t.Errorf("Expected the read collection to be added to the existing one, got %v", db.GetCollections())
+	}
+	record, err := db.GetRecord("docs", "a")
+	if err != nil {
+		t.Fatalf("Could not get record: %v", err)
+	}
+	if string(record.Blob) != "hey" || len(record.Embedding) != 2 {
+		t.Errorf("Unexpected record %v", record)
+	}
+
+	for _, bad := range []string{
+		``,
+		`[]`,
+		`{"collections": {"bad": {"id": "bad", "embeddings": {"a": {"embedding": "nope"}}}}}`,
+		`{"collections": {"cut-off": {"id": "cut-off", "embeddings": {"a": {"id": "a"}`,
+	} {
+		_, err = db.ReadFrom(strings.NewReader(bad))
+		if err == nil {
+			t.Errorf("Expected an error reading %q", bad)
+		}
+	}
+	if len(db.GetCollections()) != 2 {
+		t.Errorf("Failed reads should not change the database, got %v", db.GetCollections())
+	}
+}
@@ -0,0 +1,411 @@
+package database
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	embedders "go-simple-embedding-database/embedders"
+	records "go-simple-embedding-database/records"
+)
+
+// Format is a format for moving a single collection's records in and out of
+// the database one row at a time
+type Format int
+
+const (
+	// One JSON object per line:
+	//
+	//	{"id": "...", "blob": "...", "metadata": {"k": "v"}, "embedding": [0.1, 0.2]}
+	JSONL Format = iota
+	// A header row naming the columns, then one record per row. The id and
+	// blob columns are required. metadata holds a JSON object and embedding
+	// holds a JSON array; both can be left empty or left out entirely
+	CSV
+)
+
+func (format Format) String() string {
+	switch format {
+	case JSONL:
+		return "jsonl"
+	case CSV:
+		return "csv"
+	default:
+		return fmt.Sprintf("Format(%d)", int(format))
+	}
+}
+
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "jsonl", "ndjson":
+		return JSONL, nil
+	case "csv":
+		return CSV, nil
+	default:
+		return 0, fmt.Errorf("%w %s (expected jsonl or csv)", ErrUnknownFormat, name)
+	}
+}
+
+var csvHeader = []string{"id", "blob", "metadata", "embedding"}
+
+type transferRow struct {
+	Id        string            `json:"id"`
+	Blob      string            `json:"blob"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Embedding []float64         `json:"embedding,omitempty"`
+}
+
+type ExportOptions struct {
+	Format Format
+	// Leave the embedding column out, e.g. when the rows are going to be
+	// re-embedded with a different model
+	ExcludeEmbeddings bool
+}
+
+// ExportCollection writes every live record in the collection to w, ordered
+// by ID, and returns how many were written
+func (db SimpleDataBase) ExportCollection(collectionId string, w io.Writer, options ExportOptions) (int, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	collection, err := db.getCollection(collectionId)
+	if err != nil {
+		return 0, err
+	}
+
+	buffered := bufio.NewWriter(w)
+	var writeRow func(row transferRow) error
+	switch options.Format {
+	case JSONL:
+		encoder := json.NewEncoder(buffered)
+		writeRow = func(row transferRow) error {
+			return encoder.Encode(row)
+		}
+	case CSV:
+		csvWriter := csv.NewWriter(buffered)
+		header := csvHeader
+		if options.ExcludeEmbeddings {
+			header = csvHeader[:3]
+		}
+		err = csvWriter.Write(header)
+		if err != nil {
+			return 0, err
+		}
+		writeRow = func(row transferRow) error {
+			fields, err := row.csvFields(!options.ExcludeEmbeddings)
+			if err != nil {
+				return err
+			}
+			err = csvWriter.Write(fields)
+			if err != nil {
+				return err
+			}
+			// flush every row so the csv writer doesn't hold its own copy
+			// of the whole collection
+			csvWriter.Flush()
+			return csvWriter.Error()
+		}
+	default:
+		return 0, fmt.Errorf("%w %v", ErrUnknownFormat, options.Format)
+	}
+
+	now := time.Now()
+	written := 0
+	var writeErr error
+	err = collection.ScanRecords(func(record records.Record) bool {
+		if record.Expired(now) {
+			return true
+		}
+		row := transferRow{Id: record.Id, Blob: string(record.Blob), Metadata: record.Metadata}
+		if !options.ExcludeEmbeddings {
+			row.Embedding = record.Embedding
+		}
+		writeErr = writeRow(row)
+		if writeErr != nil {
+			return false
+		}
+		written += 1
+		return true
+	})
+	if writeErr != nil {
+		return written, writeErr
+	}
+	if err != nil {
+		return written, err
+	}
+	return written, buffered.Flush()
+}
+
+func (row transferRow) csvFields(includeEmbedding bool) ([]string, error) {
+	metadata := ""
+	if len(row.Metadata) > 0 {
+		encoded, err := json.Marshal(row.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		metadata = string(encoded)
+	}
+	fields := []string{row.Id, row.Blob, metadata}
+	if includeEmbedding {
+		embedding := ""
+		if row.Embedding != nil {
+			encoded, err := json.Marshal(row.Embedding)
+			if err != nil {
+				return nil, err
+			}
+			embedding = string(encoded)
+		}
+		fields = append(fields, embedding)
+	}
+	return fields, nil
+}
+
+type ImportOptions struct {
+	Format Format
+	// Replace records that already exist instead of reporting an error
+	Upsert bool
+	// How many rows without an embedding to send to the embedder at once.
+	// Defaults to defaultImportBatchSize
+	BatchSize int
+}
+
+const defaultImportBatchSize = 32
+
+var (
+	ErrUnknownFormat = errors.New("Unknown format")
+	// wrapped by the Err of every LineError for a row that couldn't be read,
+	// and returned for a CSV file without a usable header
+	ErrMalformedRow = errors.New("Malformed row")
+)
+
+// LineError is a problem with a single line of an import. Lines are
+// numbered from 1, and for CSV the header is line 1
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e LineError) Unwrap() error {
+	return e.Err
+}
+
+type ImportReport struct {
+	Imported int
+	// Lines that couldn't be imported. The rest of the import carries on
+	// regardless
+	Errors []LineError
+}
+
+type pendingRow struct {
+	line int
+	row  transferRow
+}
+
+// ImportCollection reads records from r into an existing collection. Rows
+// that come with an embedding are added as they are; rows without one are
+// embedded in batches with the collection's embedder. Bad rows are reported
+// in the ImportReport rather than stopping the import. The returned error is
+// only set if the input couldn't be read at all
+func (db SimpleDataBase) ImportCollection(collectionId string, r io.Reader, options ImportOptions) (ImportReport, error) {
+	report := ImportReport{Errors: make([]LineError, 0)}
+	if db.ReadOnly() {
+		return report, ErrReadOnly
+	}
+	collection, err := db.GetCollection(collectionId)
+	if err != nil {
+		return report, err
+	}
+	embedderId := collection.EmbedderId
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+
+	add := func(line int, record *records.Record) {
+		var err error
+		if options.Upsert {
+			err = db.UpsertRecord(collectionId, record)
+		} else {
+			err = db.AddRecord(collectionId, record)
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, LineError{Line: line, Err: err})
+			return
+		}
+		report.Imported += 1
+	}
+
+	pending := make([]pendingRow, 0, batchSize)
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		blobs := make([][]byte, len(pending))
+		for i, p := range pending {
+			blobs[i] = []byte(p.row.Blob)
+		}
+		vectors, err := embedBatch(embedderId, blobs)
+		if err == nil {
+			for i, p := range pending {
+				add(p.line, p.row.record(embedderId, vectors[i]))
+			}
+			pending = pending[:0]
+			return
+		}
+		// one bad blob shouldn't sink the rest of the batch, so go through
+		// the rows one at a time to find out which ones failed
+		for _, p := range pending {
+			vectors, err := embedBatch(embedderId, [][]byte{[]byte(p.row.Blob)})
+			if err != nil {
+				report.Errors = append(report.Errors, LineError{Line: p.line, Err: err})
+				continue
+			}
+			add(p.line, p.row.record(embedderId, vectors[0]))
+		}
+		pending = pending[:0]
+	}
+
+	handleRow := func(line int, row transferRow, err error) {
+		if err == nil && row.Id == "" {
+			err = errors.New("no id")
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, LineError{Line: line, Err: fmt.Errorf("%w: %w", ErrMalformedRow, err)})
+			return
+		}
+		if row.Embedding != nil {
+			add(line, row.record(embedderId, row.Embedding))
+			return
+		}
+		pending = append(pending, pendingRow{line: line, row: row})
+		if len(pending) == batchSize {
+			flush()
+		}
+	}
+
+	switch options.Format {
+	case JSONL:
+		err = readJSONL(r, handleRow)
+	case CSV:
+		err = readCSV(r, handleRow)
+	default:
+		err = fmt.Errorf("%w %v", ErrUnknownFormat, options.Format)
+	}
+	if err != nil {
+		return report, err
+	}
+	flush()
+	// batched rows finish out of order
+	slices.SortStableFunc(report.Errors, func(a, b LineError) int {
+		return a.Line - b.Line
+	})
+	return report, nil
+}
+
+func embedBatch(embedderId string, blobs [][]byte) ([][]float64, error) {
+	embed, err := embedders.GetBatchEmbedderFunc(embedderId)
+	if err != nil {
+		return nil, err
+	}
+	vectors, err := embed(blobs)
+	if err != nil {
+		return nil, err
+	}
+	if len(vectors) != len(blobs) {
+		return nil, fmt.Errorf("%w: %s returned %d embeddings for %d blobs", embedders.ErrBadEmbeddings, embedderId, len(vectors), len(blobs))
+	}
+	return vectors, nil
+}
+
+func (row transferRow) record(embedderId string, embedding []float64) *records.Record {
+	return &records.Record{Embedding: embedding, EmbedderId: embedderId, Blob: []byte(row.Blob), Id: row.Id, Metadata: row.Metadata}
+}
+
+const maxJSONLLine = 64 * 1024 * 1024
+
+func readJSONL(r io.Reader, handleRow func(line int, row transferRow, err error)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxJSONLLine)
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		row := transferRow{}
+		err := json.Unmarshal([]byte(text), &row)
+		handleRow(line, row, err)
+	}
+	return scanner.Err()
+}
+
+func readCSV(r io.Reader, handleRow func(line int, row transferRow, err error)) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("%w: could not read CSV header: %w", ErrMalformedRow, err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, required := range []string{"id", "blob"} {
+		_, ok := columns[required]
+		if !ok {
+			return fmt.Errorf("%w: CSV header is missing the %s column", ErrMalformedRow, required)
+		}
+	}
+	field := func(fields []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(fields) {
+			return ""
+		}
+		return fields[i]
+	}
+
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		line, _ := reader.FieldPos(0)
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				handleRow(parseErr.StartLine, transferRow{}, err)
+				continue
+			}
+			return err
+		}
+
+		row := transferRow{Id: field(fields, "id"), Blob: field(fields, "blob")}
+		metadata := field(fields, "metadata")
+		if metadata != "" {
+			err = json.Unmarshal([]byte(metadata), &row.Metadata)
+			if err != nil {
+				handleRow(line, row, fmt.Errorf("could not parse metadata: %w", err))
+				continue
+			}
+		}
+		embedding := field(fields, "embedding")
+		if embedding != "" {
+			err = json.Unmarshal([]byte(embedding), &row.Embedding)
+			if err != nil {
+				handleRow(line, row, fmt.Errorf("could not parse embedding: %w", err))
+				continue
+			}
+		}
+		handleRow(line, row, nil)
+	}
+}
@@ -0,0 +1,193 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	collection "go-simple-embedding-database/collection"
+	embedders "go-simple-embedding-database/embedders"
+	records "go-simple-embedding-database/records"
+)
+
+func makeTransferDatabase(t *testing.T, collectionIds ...string) *SimpleDataBase {
+	embedders.EmbedderRegister["mock-embedder"] = MockEmbed
+	db := MakeDatabase()
+	for _, collectionId := range collectionIds {
+		coll, err := collection.MakeCollection(collectionId, "mock-embedder")
+		if err != nil {
+			t.Fatalf("Could not create collection: %v", err)
+		}
+		err = db.AddCollection(coll)
+		if err != nil {
+			t.Fatalf("Could not add collection: %v", err)
+		}
+	}
+	return db
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	for _, format := range []Format{JSONL, CSV} {
+		db := makeTransferDatabase(t, "source", "destination")
+		for _, id := range []string{"b", "a"} {
+			record := &records.Record{Embedding: []float64{1, 2}, EmbedderId: "mock-embedder", Blob: []byte("blob, with \"quotes\"\nand a newline " + id), Id: id}
+			if id == "a" {
+				record.Metadata = map[string]string{"lang": "en"}
+			}
+			err := db.AddRecord("source", record)
+			if err != nil {
+				t.Fatalf("Could not add record: %v", err)
+			}
+		}
+
+		buffer := &bytes.Buffer{}
+		written, err := db.ExportCollection("source", buffer, ExportOptions{Format: format})
+		if err != nil || written != 2 {
+			t.Fatalf("%v: export failed (%d written): %v", format, written, err)
+		}
+		report, err := db.ImportCollection("destination", buffer, ImportOptions{Format: format})
+		if err != nil {
+			t.Fatalf("%v: import failed: %v", format, err)
+		}
+		if report.Imported != 2 || len(report.Errors) != 0 {
+			t.Errorf("%v: unexpected import report %v", format, report)
+		}
+		for _, id := range []string{"a", "b"} {
+			original, _ := db.GetRecord("source", id)
+			imported, err := db.GetRecord("destination", id)
+			if err != nil {
+				t.Fatalf("%v: record %s was not imported: %v", format, id, err)
+			}
+			if !bytes.Equal(original.Blob, imported.Blob) || !reflect.DeepEqual(original.Embedding, imported.Embedding) || !reflect.DeepEqual(original.Metadata, imported.Metadata) {
+				t.Errorf("%v: imported record %v doesn't match %v", format, imported, original)
+			}
+		}
+	}
+}
+
+func TestExportFormats(t *testing.T) {
+	db := makeTransferDatabase(t, "source")
+	record := &records.Record{Embedding: []float64{1, 2}, EmbedderId: "mock-embedder", Blob: []byte("hello"), Id: "a", Metadata: map[string]string{"k": "v"}}
+	db.AddRecord("source", record)
+
+	buffer := &bytes.Buffer{}
+	_, err := db.ExportCollection("source", buffer, ExportOptions{Format: JSONL})
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	expected := "{\"id\":\"a\",\"blob\":\"hello\",\"metadata\":{\"k\":\"v\"},\"embedding\":[1,2]}\n"
+	if buffer.String() != expected {
+		t.Errorf("Unexpected JSONL: expected %q, got %q", expected, buffer.String())
+	}
+
+	buffer.Reset()
+	_, err = db.ExportCollection("source", buffer, ExportOptions{Format: CSV, ExcludeEmbeddings: true})
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	expected = "id,blob,metadata\na,hello,\"{\"\"k\"\":\"\"v\"\"}\"\n"
+	if buffer.String() != expected {
+		t.Errorf("Unexpected CSV: expected %q, got %q", expected, buffer.String())
+	}
+
+	_, err = db.ExportCollection("does-not-exist", buffer, ExportOptions{})
+	if err == nil {
+		t.Errorf("Should not have been able to export a collection that doesn't exist")
+	}
+}
+
+func TestImportEmbedsInBatches(t *testing.T) {
+	db := makeTransferDatabase(t, "docs")
+	batches := make([]int, 0)
+	embedders.BatchEmbedderRegister["mock-embedder"] = func(blobs [][]byte) ([][]float64, error) {
+		batches = append(batches, len(blobs))
+		vectors := make([][]float64, len(blobs))
+		for i := range blobs {
+			vectors[i] = []float64{1, 2, 3, 4, 5}
+		}
+		return vectors, nil
+	}
+	defer delete(embedders.BatchEmbedderRegister, "mock-embedder")
+
+	input := strings.Join([]string{
+		"id,blob,embedding",
+		"a,first,",
+		"b,second,[9]",
+		"c,third,",
+		"d,fourth,",
+	}, "\n")
+	report, err := db.ImportCollection("docs", strings.NewReader(input), ImportOptions{Format: CSV, BatchSize: 2})
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if report.Imported != 4 || len(report.Errors) != 0 {
+		t.Errorf("Unexpected import report %v", report)
+	}
+	if !reflect.DeepEqual(batches, []int{2, 1}) {
+		t.Errorf("Expected rows without embeddings to be embedded in batches of 2, got %v", batches)
+	}
+	record, _ := db.GetRecord("docs", "b")
+	if !reflect.DeepEqual(record.Embedding, []float64{9}) {
+		t.Errorf("Expected a row's own embedding to be kept, got %v", record.Embedding)
+	}
+}
+
+func TestImportReportsLineErrors(t *testing.T) {
+	db := makeTransferDatabase(t, "docs")
+	db.AddRecord("docs", &records.Record{Embedding: []float64{1}, EmbedderId: "mock-embedder", Blob: []byte("existing"), Id: "existing"})
+
+	input := strings.Join([]string{
+		`{"id": "good", "blob": "fine"}`,
+		`not json`,
+		``,
+		`{"blob": "no id"}`,
+		`{"id": "existing", "blob": "duplicate"}`,
+		`{"id": "also-good", "blob": "fine", "embedding": [1, 2]}`,
+	}, "\n")
+	report, err := db.ImportCollection("docs", strings.NewReader(input), ImportOptions{Format: JSONL})
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if report.Imported != 2 {
+		t.Errorf("Expected 2 rows to be imported, got %d", report.Imported)
+	}
+	lines := make([]int, len(report.Errors))
+	for i, lineErr := range report.Errors {
+		lines[i] = lineErr.Line
+	}
+	if !reflect.DeepEqual(lines, []int{2, 4, 5}) {
+		t.Errorf("Expected errors on lines 2, 4 and 5, got %v", report.Errors)
+	} else if !errors.Is(report.Errors[0], ErrMalformedRow) || !errors.Is(report.Errors[1], ErrMalformedRow) || !errors.Is(report.Errors[2], collection.ErrRecordExists) {
+		t.Errorf("Expected two malformed rows and a duplicate, got %v", report.Errors)
+	}
+
+	// upserting replaces the duplicate instead
+	report, err = db.ImportCollection("docs", strings.NewReader(`{"id": "existing", "blob": "replaced"}`), ImportOptions{Format: JSONL, Upsert: true})
+	if err != nil || report.Imported != 1 {
+		t.Fatalf("Upsert import failed: %v %v", report, err)
+	}
+	record, _ := db.GetRecord("docs", "existing")
+	if string(record.Blob) != "replaced" {
+		t.Errorf("Expected upsert import to replace the record, got %s", record.Blob)
+	}
+
+	embedders.EmbedderRegister["failing-embedder"] = func(blob []byte) ([]float64, error) {
+		return nil, errors.New("embedder is down")
+	}
+	failing, _ := collection.MakeCollection("failing", "failing-embedder")
+	db.AddCollection(failing)
+	report, err = db.ImportCollection("failing", strings.NewReader("id,blob\na,b\nc,d\n"), ImportOptions{Format: CSV})
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if report.Imported != 0 || len(report.Errors) != 2 || report.Errors[1].Line != 3 {
+		t.Errorf("Expected an embedder failure to be reported per line, got %v", report.Errors)
+	}
+
+	_, err = db.ImportCollection("docs", strings.NewReader("name,text\n"), ImportOptions{Format: CSV})
+	if err == nil {
+		t.Errorf("Should not have been able to import a CSV without id and blob columns")
+	}
+}
@@ -0,0 +1,305 @@
+package embedders
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	metrics "go-simple-embedding-database/metrics"
+)
+
+// how many embeddings a Cache keeps in memory by default
+const DefaultCacheSize = 10000
+
+type CacheOptions struct {
+	// the most embeddings kept in memory, the least recently used are dropped
+	// first. Defaults to DefaultCacheSize
+	Size int
+	// if set, embeddings are also kept in files under Dir, so they outlive
+	// the process. The directory is created if it doesn't exist
+	Dir string
+}
+
+// CacheStats counts lookups since the cache was made. Hits includes
+// DiskHits
+type CacheStats struct {
+	Hits     uint64 `json:"hits"`
+	DiskHits uint64 `json:"diskHits"`
+	Misses   uint64 `json:"misses"`
+	// embeddings in memory
+	Entries int `json:"entries"`
+}
+
+// Cache keeps embeddings by embedder ID and the SHA-256 of the blob, so a
+// blob that's been embedded before doesn't have to be embedded again.
+// Vectors are copied in and out of the cache, so callers are free to change
+// them
+type Cache struct {
+	mutex   *sync.Mutex
+	size    int
+	dir     string
+	entries map[cacheKey]*list.Element
+	// most recently used at the front
+	order *list.List
+	stats CacheStats
+}
+
+type cacheKey struct {
+	embedderId string
+	sum        [sha256.Size]byte
+}
+
+type cacheEntry struct {
+	key    cacheKey
+	vector []float64
+}
+
+// ErrInvalidCache is returned for bad cache options, and for embeddings
+// on disk that can't be read back
+var ErrInvalidCache = errors.New("Invalid embedding cache")
+
+var (
+	cacheHits   = metrics.Register(metrics.MakeCounter("sedb_embedding_cache_hits_total", "Embeddings found in the embedding cache", "embedder", "tier"))
+	cacheMisses = metrics.Register(metrics.MakeCounter("sedb_embedding_cache_misses_total", "Embeddings not found in the embedding cache", "embedder"))
+)
+
+func MakeCache(options CacheOptions) (*Cache, error) {
+	if options.Size < 0 {
+		return nil, fmt.Errorf("%w: size %d", ErrInvalidCache, options.Size)
+	}
+	if options.Size == 0 {
+		options.Size = DefaultCacheSize
+	}
+	if options.Dir != "" {
+		err := os.MkdirAll(options.Dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Cache{
+		mutex:   &sync.Mutex{},
+		size:    options.Size,
+		dir:     options.Dir,
+		entries: make(map[cacheKey]*list.Element),
+		order:   list.New(),
+	}, nil
+}
+
+func makeCacheKey(embedderId string, blob []byte) cacheKey {
+	return cacheKey{embedderId: embedderId, sum: sha256.Sum256(blob)}
+}
+
+// path is where key's embedding is kept on disk:
+// <dir>/<embedderId>/<first two hex digits of the hash>/<hash>
+func (cache *Cache) path(key cacheKey) string {
+	sum := hex.EncodeToString(key.sum[:])
+	return filepath.Join(cache.dir, url.PathEscape(key.embedderId), sum[:2], sum)
+}
+
+// Get returns the embedding of blob by embedderId, if it's in memory or on
+// disk
+func (cache *Cache) Get(embedderId string, blob []byte) ([]float64, bool) {
+	key := makeCacheKey(embedderId, blob)
+	cache.mutex.Lock()
+	element, ok := cache.entries[key]
+	if ok {
+		cache.order.MoveToFront(element)
+		cache.stats.Hits++
+		vector := slices.Clone(element.Value.(*cacheEntry).vector)
+		cache.mutex.Unlock()
+		cacheHits.Inc(embedderId, "memory")
+		return vector, true
+	}
+	cache.mutex.Unlock()
+
+	if cache.dir != "" {
+		vector, err := readVector(cache.path(key))
+		if err == nil {
+			cache.mutex.Lock()
+			cache.add(key, slices.Clone(vector))
+			cache.stats.Hits++
+			cache.stats.DiskHits++
+			cache.mutex.Unlock()
+			cacheHits.Inc(embedderId, "disk")
+			return vector, true
+		}
+	}
+	cache.mutex.Lock()
+	cache.stats.Misses++
+	cache.mutex.Unlock()
+	cacheMisses.Inc(embedderId)
+	return nil, false
+}
+
+// Put keeps the embedding of blob by embedderId. The error is from writing
+// it to disk; it's kept in memory either way
+func (cache *Cache) Put(embedderId string, blob []byte, vector []float64) error {
+	key := makeCacheKey(embedderId, blob)
+	cache.mutex.Lock()
+	cache.add(key, slices.Clone(vector))
+	cache.mutex.Unlock()
+	if cache.dir == "" {
+		return nil
+	}
+	return writeVector(cache.path(key), vector)
+}
+
+// add expects the caller to hold the lock
+func (cache *Cache) add(key cacheKey, vector []float64) {
+	element, ok := cache.entries[key]
+	if ok {
+		element.Value.(*cacheEntry).vector = vector
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.entries[key] = cache.order.PushFront(&cacheEntry{key: key, vector: vector})
+	for cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (cache *Cache) Stats() CacheStats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	stats := cache.stats
+	stats.Entries = cache.order.Len()
+	return stats
+}
+
+// Vectors are kept on disk as little-endian float64s
+func readVector(path string) ([]float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%8 != 0 {
+		return nil, fmt.Errorf("%w: %s is %d bytes, which is not a whole number of floats", ErrInvalidCache, path, len(data))
+	}
+	vector := make([]float64, len(data)/8)
+	for i := range vector {
+		vector[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[i*8:]))
+	}
+	return vector, nil
+}
+
+// writeVector writes to a temporary file and renames it into place, so a
+// reader never sees half of it
+func writeVector(path string, vector []float64) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, len(vector)*8)
+	for i, value := range vector {
+		binary.LittleEndian.PutUint64(data[i*8:], math.Float64bits(value))
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(data)
+	closeErr := tempFile.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(tempFile.Name(), path)
+}
+
+var embeddingCache *Cache
+
+// SetCache sets the cache every embedder got through GetEmbedderFunc or
+// GetBatchEmbedderFunc looks blobs up in before embedding them, and keeps
+// new embeddings in. nil (the default) turns caching off. Embeddings are
+// cached by embedder name, so an embedder registered under a name that was
+// used for a different one needs a fresh cache
+func SetCache(c *Cache) {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+	embeddingCache = c
+}
+
+func getCache() *Cache {
+	hooksMutex.RLock()
+	defer hooksMutex.RUnlock()
+	return embeddingCache
+}
+
+func putCached(c *Cache, name string, blob []byte, vector []float64) {
+	err := c.Put(name, blob, vector)
+	if err != nil {
+		getLogger().Warn("could not write embedding to the cache", "embedder", name, "error", err)
+	}
+}
+
+func cached(name string, embedderFunc func(blob []byte) ([]float64, error)) func(blob []byte) ([]float64, error) {
+	return func(blob []byte) ([]float64, error) {
+		c := getCache()
+		if c == nil {
+			return embedderFunc(blob)
+		}
+		vector, ok := c.Get(name, blob)
+		if ok {
+			return vector, nil
+		}
+		vector, err := embedderFunc(blob)
+		if err != nil {
+			return nil, err
+		}
+		putCached(c, name, blob, vector)
+		return vector, nil
+	}
+}
+
+// cachedBatch only sends the embedder the blobs that aren't in the cache
+func cachedBatch(name string, batchFunc func(blobs [][]byte) ([][]float64, error)) func(blobs [][]byte) ([][]float64, error) {
+	return func(blobs [][]byte) ([][]float64, error) {
+		c := getCache()
+		if c == nil {
+			return batchFunc(blobs)
+		}
+		vectors := make([][]float64, len(blobs))
+		missing := []int{}
+		for i, blob := range blobs {
+			vector, ok := c.Get(name, blob)
+			if ok {
+				vectors[i] = vector
+			} else {
+				missing = append(missing, i)
+			}
+		}
+		if len(missing) == 0 {
+			return vectors, nil
+		}
+		missingBlobs := make([][]byte, len(missing))
+		for i, index := range missing {
+			missingBlobs[i] = blobs[index]
+		}
+		embedded, err := batchFunc(missingBlobs)
+		if err != nil {
+			return nil, err
+		}
+		if len(embedded) != len(missing) {
+			return nil, fmt.Errorf("%w: %s returned %d embeddings for %d blobs", ErrBadEmbeddings, name, len(embedded), len(missing))
+		}
+		for i, index := range missing {
+			vectors[index] = embedded[i]
+			putCached(c, name, blobs[index], embedded[i])
+		}
+		return vectors, nil
+	}
+}
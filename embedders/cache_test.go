@@ -0,0 +1,122 @@
+package embedders
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	cache, err := MakeCache(CacheOptions{Size: 2})
+	if err != nil {
+		t.Fatalf("Could not make cache: %v", err)
+	}
+	cache.Put("mock-embedder", []byte("a"), []float64{1})
+	cache.Put("mock-embedder", []byte("b"), []float64{2})
+	// a is used, so b is the one dropped for c
+	cache.Get("mock-embedder", []byte("a"))
+	cache.Put("mock-embedder", []byte("c"), []float64{3})
+	if _, ok := cache.Get("mock-embedder", []byte("b")); ok {
+		t.Errorf("Expected b to have been dropped")
+	}
+	if vector, ok := cache.Get("mock-embedder", []byte("a")); !ok || !reflect.DeepEqual(vector, []float64{1}) {
+		t.Errorf("Expected a to be cached, got %v", vector)
+	}
+	// embeddings are kept per embedder
+	if _, ok := cache.Get("other-embedder", []byte("a")); ok {
+		t.Errorf("Expected a to be cached for mock-embedder only")
+	}
+	expected := CacheStats{Hits: 2, Misses: 2, Entries: 2}
+	if cache.Stats() != expected {
+		t.Errorf("Expected stats %+v, got %+v", expected, cache.Stats())
+	}
+
+	_, err = MakeCache(CacheOptions{Size: -1})
+	if !errors.Is(err, ErrInvalidCache) {
+		t.Errorf("Expected a negative size to be rejected")
+	}
+
+	// changing a vector put in or got out doesn't change the cache
+	vector := []float64{4}
+	cache.Put("mock-embedder", []byte("d"), vector)
+	vector[0] = 5
+	got, _ := cache.Get("mock-embedder", []byte("d"))
+	got[0] = 6
+	if got, _ := cache.Get("mock-embedder", []byte("d")); !reflect.DeepEqual(got, []float64{4}) {
+		t.Errorf("Expected the cached vector to stay the same, got %v", got)
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	cache, _ := MakeCache(CacheOptions{Dir: dir})
+	err := cache.Put("hugging-face/some/model", []byte("blob"), []float64{0.5, -1, 3e10})
+	if err != nil {
+		t.Fatalf("Could not put embedding: %v", err)
+	}
+	// a new cache on the same directory finds it on disk, then in memory
+	cache, _ = MakeCache(CacheOptions{Dir: dir})
+	for i := 0; i < 2; i++ {
+		vector, ok := cache.Get("hugging-face/some/model", []byte("blob"))
+		if !ok || !reflect.DeepEqual(vector, []float64{0.5, -1, 3e10}) {
+			t.Errorf("Expected the embedding from disk, got %v", vector)
+		}
+	}
+	expected := CacheStats{Hits: 2, DiskHits: 1, Entries: 1}
+	if cache.Stats() != expected {
+		t.Errorf("Expected stats %+v, got %+v", expected, cache.Stats())
+	}
+
+	// a file cut short is a miss
+	path := cache.path(makeCacheKey("hugging-face/some/model", []byte("blob")))
+	err = os.WriteFile(path, []byte{1, 2, 3}, 0644)
+	if err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	_, err = readVector(path)
+	if !errors.Is(err, ErrInvalidCache) {
+		t.Errorf("Expected a short file to be an invalid cache, got %v", err)
+	}
+	cache, _ = MakeCache(CacheOptions{Dir: dir})
+	_, ok := cache.Get("hugging-face/some/model", []byte("blob"))
+	if ok {
+		t.Errorf("Expected a short file to be a miss")
+	}
+}
+
+func TestCachedEmbedders(t *testing.T) {
+	calls := atomic.Int64{}
+	EmbedderRegister["counting-embedder"] = func(blob []byte) ([]float64, error) {
+		calls.Add(1)
+		return []float64{float64(len(blob))}, nil
+	}
+	defer delete(EmbedderRegister, "counting-embedder")
+	cache, _ := MakeCache(CacheOptions{})
+	SetCache(cache)
+	defer SetCache(nil)
+
+	embed, _ := GetEmbedderFunc("counting-embedder")
+	embed([]byte("a"))
+	vector, _ := embed([]byte("a"))
+	if calls.Load() != 1 || !reflect.DeepEqual(vector, []float64{1}) {
+		t.Errorf("Expected one call for the same blob, got %d", calls.Load())
+	}
+
+	// batches only embed the blobs that aren't cached
+	embedBatch, _ := GetBatchEmbedderFunc("counting-embedder")
+	vectors, err := embedBatch([][]byte{[]byte("a"), []byte("bb"), []byte("a"), []byte("ccc")})
+	if err != nil {
+		t.Fatalf("Could not embed batch: %v", err)
+	}
+	if calls.Load() != 3 || !reflect.DeepEqual(vectors, [][]float64{{1}, {2}, {1}, {3}}) {
+		t.Errorf("Expected 3 calls and vectors in order, got %d and %v", calls.Load(), vectors)
+	}
+
+	SetCache(nil)
+	embed([]byte("a"))
+	if calls.Load() != 4 {
+		t.Errorf("Expected no caching without a cache")
+	}
+}
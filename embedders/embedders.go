@@ -6,13 +6,82 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"time"
+
+	metrics "go-simple-embedding-database/metrics"
+	observe "go-simple-embedding-database/observe"
 )
 
 var EmbedderRegister = make(map[string]func(blob []byte) ([]float64, error))
 
+// Embedders which can embed many blobs in one call (a single HTTP request,
+// a single forward pass, etc.) can register themselves here as well
+var BatchEmbedderRegister = make(map[string]func(blobs [][]byte) ([][]float64, error))
+
+// ClientEmbedder is for collections whose embeddings always come from the
+// client, e.g. ones created through the Chroma API. Embedding anything with
+// it is an error
+const ClientEmbedder = "client"
+
+var (
+	// ErrUnknownEmbedder is returned for an embedder name that isn't
+	// registered or built in
+	ErrUnknownEmbedder = errors.New("Invalid embedder name")
+	// ErrClientEmbedder is returned for anything embedded with ClientEmbedder
+	ErrClientEmbedder = errors.New("Embeddings for this collection have to be supplied by the client")
+	// ErrEmbedderUnavailable is returned when an embedder can't be reached, or
+	// isn't set up, or refuses to embed. It's worth trying again later
+	ErrEmbedderUnavailable = errors.New("Embedder is unavailable")
+	// ErrBadEmbeddings is returned when an embedder answers with something
+	// other than one embedding per blob
+	ErrBadEmbeddings = errors.New("Embedder returned bad embeddings")
+)
+
+func clientEmbed(blob []byte) ([]float64, error) {
+	return nil, ErrClientEmbedder
+}
+
+var (
+	hooksMutex = &sync.RWMutex{}
+	logger     *slog.Logger
+	observer   observe.Observer
+)
+
+// SetLogger sets the logger embedders log to, slog.Default() if it's nil
+func SetLogger(l *slog.Logger) {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+	logger = l
+}
+
+func getLogger() *slog.Logger {
+	hooksMutex.RLock()
+	defer hooksMutex.RUnlock()
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
+
+// SetObserver sets an observer for every call to an embedder got through
+// GetEmbedderFunc or GetBatchEmbedderFunc. nil turns observing off
+func SetObserver(o observe.Observer) {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+	observer = o
+}
+
+func getObserver() observe.Observer {
+	hooksMutex.RLock()
+	defer hooksMutex.RUnlock()
+	return observer
+}
+
 type HuggingFaceRequestOptions struct {
 	UseCache     bool `json:"use_cache"`
 	WaitForModel bool `json:"wait_for_model"`
@@ -24,14 +93,31 @@ type HuggingFaceRequestBody struct {
 }
 
 func HuggingFaceEmbed(modelId string) func(blob []byte) ([]float64, error) {
+	embedBatch := HuggingFaceBatchEmbed(modelId)
 	return func(blob []byte) ([]float64, error) {
+		vectors, err := embedBatch([][]byte{blob})
+		if err != nil {
+			return nil, err
+		}
+		return vectors[0], nil
+	}
+}
+
+// The feature extraction endpoint accepts a list of inputs, so a whole
+// batch of blobs can be embedded with a single request
+func HuggingFaceBatchEmbed(modelId string) func(blobs [][]byte) ([][]float64, error) {
+	return func(blobs [][]byte) ([][]float64, error) {
 		apiKey := os.Getenv("HUGGING_FACE_API_KEY")
 		if apiKey == "" {
-			return nil, errors.New("HUGGING_FACE_API_KEY environment variable not set.")
+			return nil, fmt.Errorf("%w: HUGGING_FACE_API_KEY environment variable not set", ErrEmbedderUnavailable)
 		}
 		endpoint := "https://api-inference.huggingface.co/pipeline/feature-extraction"
 
-		body := HuggingFaceRequestBody{Inputs: []string{string(blob)}, Value: HuggingFaceRequestOptions{UseCache: true, WaitForModel: true}}
+		inputs := make([]string, len(blobs))
+		for i, blob := range blobs {
+			inputs[i] = string(blob)
+		}
+		body := HuggingFaceRequestBody{Inputs: inputs, Value: HuggingFaceRequestOptions{UseCache: true, WaitForModel: true}}
 		jsonBody, err := json.Marshal(body)
 		if err != nil {
 			return nil, err
@@ -47,49 +133,121 @@ func HuggingFaceEmbed(modelId string) func(blob []byte) ([]float64, error) {
 		client := &http.Client{}
 		resp, err := client.Do(req)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("%w: %w", ErrEmbedderUnavailable, err)
 		}
 
 		defer resp.Body.Close()
 		respBody, err := io.ReadAll(resp.Body)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
-		// TODO: I copied this over from another module. Fix it.
-		//
-		// Check the status code
-		//
 		// If wait_for_model is set to False and the model is first loading up,
 		// it may return a 503 error
 		//
 		// See https://huggingface.co/docs/api-inference/detailed_parameters
 		if resp.StatusCode != 200 {
-			io.Copy(os.Stdout, resp.Body)
-			panic(fmt.Sprintf("Response has non-200 status code %d. Response body: %v", resp.StatusCode, respBody))
+			getLogger().Warn("hugging face request failed", "model", modelId, "status", resp.StatusCode, "body", string(respBody))
+			return nil, fmt.Errorf("%w: hugging face returned status %d for model %s", ErrEmbedderUnavailable, resp.StatusCode, modelId)
 		}
 
-		var embedding [][]float64
-		err = json.Unmarshal(respBody, &embedding)
+		var embeddings [][]float64
+		err = json.Unmarshal(respBody, &embeddings)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("%w: could not decode embeddings from hugging face: %w", ErrBadEmbeddings, err)
 		}
+		if len(embeddings) != len(blobs) {
+			return nil, fmt.Errorf("%w: expected %d embeddings from hugging face, got %d", ErrBadEmbeddings, len(blobs), len(embeddings))
+		}
+		return embeddings, nil
+	}
+}
+
+// Calls to embedders got through GetEmbedderFunc and GetBatchEmbedderFunc
+// are counted and timed, by embedder name, and passed to the observer.
+// Blobs found in the cache (see SetCache) never get as far as the embedder,
+// so they aren't counted here
+var (
+	embedderCalls    = metrics.Register(metrics.MakeCounter("sedb_embedder_calls_total", "Calls to an embedder", "embedder"))
+	embedderErrors   = metrics.Register(metrics.MakeCounter("sedb_embedder_errors_total", "Calls to an embedder that failed", "embedder"))
+	embedderBlobs    = metrics.Register(metrics.MakeCounter("sedb_embedder_blobs_total", "Blobs sent to an embedder", "embedder"))
+	embedderDuration = metrics.Register(metrics.MakeHistogram("sedb_embedder_duration_seconds", "How long calls to an embedder took", nil, "embedder"))
+)
+
+func observeEmbed(name string, blobs int, start time.Time, span observe.Span, err error) {
+	span.End(err)
+	embedderCalls.Inc(name)
+	embedderBlobs.Add(float64(blobs), name)
+	embedderDuration.ObserveSince(start, name)
+	if err != nil {
+		embedderErrors.Inc(name)
+	}
+}
+
+func instrument(name string, embedderFunc func(blob []byte) ([]float64, error)) func(blob []byte) ([]float64, error) {
+	return func(blob []byte) ([]float64, error) {
+		start, span := time.Now(), observe.Start(getObserver(), observe.Event{Operation: observe.Embed, Embedder: name, Count: 1})
+		vector, err := embedderFunc(blob)
+		observeEmbed(name, 1, start, span, err)
+		return vector, err
+	}
+}
 
-		vector := embedding[0]
-		return vector, nil
+func instrumentBatch(name string, batchFunc func(blobs [][]byte) ([][]float64, error)) func(blobs [][]byte) ([][]float64, error) {
+	return func(blobs [][]byte) ([][]float64, error) {
+		start, span := time.Now(), observe.Start(getObserver(), observe.Event{Operation: observe.Embed, Embedder: name, Count: len(blobs)})
+		vectors, err := batchFunc(blobs)
+		observeEmbed(name, len(blobs), start, span, err)
+		return vectors, err
 	}
 }
 
 func GetEmbedderFunc(name string) (func(blob []byte) ([]float64, error), error) {
 	embedderFunc, ok := EmbedderRegister[name]
 	if ok {
-		return embedderFunc, nil
+		return cached(name, instrument(name, embedderFunc)), nil
+	}
+	switch {
+	case name == ClientEmbedder:
+		return clientEmbed, nil
+	case strings.HasPrefix(name, "hugging-face"):
+		modelId := strings.TrimPrefix(name, "hugging-face/")
+		return cached(name, instrument(name, HuggingFaceEmbed(modelId))), nil
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownEmbedder, name)
+	}
+}
+
+// GetBatchEmbedderFunc returns a function embedding many blobs at once.
+// Embedders that only registered a single-blob function are called once per blob
+func GetBatchEmbedderFunc(name string) (func(blobs [][]byte) ([][]float64, error), error) {
+	batchFunc, ok := BatchEmbedderRegister[name]
+	if ok {
+		return cachedBatch(name, instrumentBatch(name, batchFunc)), nil
+	}
+	embedderFunc, ok := EmbedderRegister[name]
+	if ok {
+		return cachedBatch(name, instrumentBatch(name, func(blobs [][]byte) ([][]float64, error) {
+			vectors := make([][]float64, len(blobs))
+			for i, blob := range blobs {
+				vector, err := embedderFunc(blob)
+				if err != nil {
+					return nil, err
+				}
+				vectors[i] = vector
+			}
+			return vectors, nil
+		})), nil
 	}
 	switch {
+	case name == ClientEmbedder:
+		return func(blobs [][]byte) ([][]float64, error) {
+			return nil, ErrClientEmbedder
+		}, nil
 	case strings.HasPrefix(name, "hugging-face"):
 		modelId := strings.TrimPrefix(name, "hugging-face/")
-		return HuggingFaceEmbed(modelId), nil
+		return cachedBatch(name, instrumentBatch(name, HuggingFaceBatchEmbed(modelId))), nil
 	default:
-		return nil, errors.New("Invalid embedder name")
+		return nil, fmt.Errorf("%w %q", ErrUnknownEmbedder, name)
 	}
 }
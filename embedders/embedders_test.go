@@ -1,6 +1,8 @@
 package embedders
 
 import (
+	"errors"
+	"reflect"
 	"testing"
 )
 
@@ -10,13 +12,67 @@ func MockEmbed(blob []byte) ([]float64, error) {
 
 func TestEmbedders(t *testing.T) {
 	_, err := GetEmbedderFunc("not-registered")
-	if err == nil {
+	if !errors.Is(err, ErrUnknownEmbedder) {
 		t.Errorf("Should not have been able to get embedder func")
 	}
 
 	EmbedderRegister["mock-embedder"] = MockEmbed
-	_, err = GetEmbedderFunc("mock-embedder")
+	embed, err := GetEmbedderFunc("mock-embedder")
 	if err != nil {
 		t.Errorf("Could not get embedder: %v", err)
 	}
+	calls, durations := embedderCalls.Value("mock-embedder"), embedderDuration.Count("mock-embedder")
+	embed([]byte("blob"))
+	if embedderCalls.Value("mock-embedder") != calls+1 || embedderDuration.Count("mock-embedder") != durations+1 {
+		t.Errorf("Expected the call to be counted and timed")
+	}
+}
+
+func TestBatchEmbedders(t *testing.T) {
+	_, err := GetBatchEmbedderFunc("not-registered")
+	if !errors.Is(err, ErrUnknownEmbedder) {
+		t.Errorf("Should not have been able to get batch embedder func")
+	}
+
+	// single blob embedders get called once per blob
+	EmbedderRegister["mock-embedder"] = MockEmbed
+	embedBatch, err := GetBatchEmbedderFunc("mock-embedder")
+	if err != nil {
+		t.Fatalf("Could not get batch embedder: %v", err)
+	}
+	vectors, err := embedBatch([][]byte{[]byte("a"), []byte("b")})
+	if err != nil {
+		t.Fatalf("Could not embed batch: %v", err)
+	}
+	if len(vectors) != 2 || !reflect.DeepEqual(vectors[1], []float64{1.0, 2.0, 3.0, 4.0, 5.0}) {
+		t.Errorf("Unexpected batch embeddings %v", vectors)
+	}
+
+	// registered batch embedders take priority
+	BatchEmbedderRegister["mock-embedder"] = func(blobs [][]byte) ([][]float64, error) {
+		return [][]float64{{42}}, nil
+	}
+	defer delete(BatchEmbedderRegister, "mock-embedder")
+	embedBatch, err = GetBatchEmbedderFunc("mock-embedder")
+	if err != nil {
+		t.Fatalf("Could not get batch embedder: %v", err)
+	}
+	vectors, _ = embedBatch([][]byte{[]byte("a")})
+	if !reflect.DeepEqual(vectors, [][]float64{{42}}) {
+		t.Errorf("Expected registered batch embedder to be used, got %v", vectors)
+	}
+}
+
+func TestEmbedderErrors(t *testing.T) {
+	embed, _ := GetEmbedderFunc(ClientEmbedder)
+	_, err := embed([]byte("blob"))
+	if !errors.Is(err, ErrClientEmbedder) {
+		t.Errorf("Expected the client embedder to refuse, got %v", err)
+	}
+	t.Setenv("HUGGING_FACE_API_KEY", "")
+	embed, _ = GetEmbedderFunc("hugging-face/some/model")
+	_, err = embed([]byte("blob"))
+	if !errors.Is(err, ErrEmbedderUnavailable) {
+		t.Errorf("Expected hugging face to be unavailable without a key, got %v", err)
+	}
 }
@@ -1,3 +1,10 @@
 module go-simple-embedding-database
 
 go 1.22.5
+
+require (
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/term v0.27.0
+)
+
+require golang.org/x/sys v0.28.0 // indirect
@@ -0,0 +1,188 @@
+// Package mcp serves a database to LLM agents over the Model Context
+// Protocol. Messages are JSON-RPC 2.0, one per line, over a pair of streams
+// (normally stdin and stdout), and the database's collections are exposed as
+// tools: list_collections, query_collection, add_documents and get_record
+package mcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	database "go-simple-embedding-database/database"
+)
+
+// the protocol versions the server understands, newest last
+var protocolVersions = []string{"2024-11-05", "2025-03-26", "2025-06-18"}
+
+// JSON-RPC error codes
+const (
+	codeParseError     = -32700
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+)
+
+type Options struct {
+	// Reported to the client when it connects. Name defaults to "sedb"
+	Name    string
+	Version string
+	// Called after a tool changes the database, e.g. to save it. If it
+	// returns an error the tool call fails with it
+	OnWrite func() error
+}
+
+type Server struct {
+	db      *database.SimpleDataBase
+	options Options
+	tools   []tool
+}
+
+func MakeServer(db *database.SimpleDataBase, options Options) *Server {
+	if options.Name == "" {
+		options.Name = "sedb"
+	}
+	server := &Server{db: db, options: options}
+	server.tools = server.makeTools()
+	return server
+}
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// notifications have no ID and get no response
+func (r request) isNotification() bool {
+	return len(r.Id) == 0
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+func invalidParams(format string, args ...any) *rpcError {
+	return &rpcError{Code: codeInvalidParams, Message: fmt.Sprintf(format, args...)}
+}
+
+// Serve answers messages from r until it's closed. Each message has to be
+// on a line of its own
+func (server *Server) Serve(r io.Reader, w io.Writer) error {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			writeErr := server.handleLine(line, w)
+			if writeErr != nil {
+				return writeErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (server *Server) handleLine(line []byte, w io.Writer) error {
+	trimmed := bytes.TrimSpace(line)
+	if len(trimmed) == 0 {
+		return nil
+	}
+	req := request{}
+	err := json.Unmarshal(trimmed, &req)
+	if err != nil {
+		return server.write(w, response{JSONRPC: "2.0", Id: json.RawMessage("null"), Error: &rpcError{Code: codeParseError, Message: fmt.Sprintf("Could not parse message: %v", err)}})
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		if req.isNotification() {
+			return nil
+		}
+		return server.write(w, response{JSONRPC: "2.0", Id: req.Id, Error: &rpcError{Code: codeInvalidRequest, Message: "Expected a JSON-RPC 2.0 request with a method"}})
+	}
+	result, err := server.handle(req)
+	if req.isNotification() {
+		return nil
+	}
+	resp := response{JSONRPC: "2.0", Id: req.Id, Result: result}
+	if err != nil {
+		rpcErr := &rpcError{}
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &rpcError{Code: codeInvalidParams, Message: err.Error()}
+		}
+		resp.Result = nil
+		resp.Error = rpcErr
+	}
+	return server.write(w, resp)
+}
+
+func (server *Server) write(w io.Writer, resp response) error {
+	encoded, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(encoded, '\n'))
+	return err
+}
+
+func (server *Server) handle(req request) (any, error) {
+	switch req.Method {
+	case "initialize":
+		return server.initialize(req.Params)
+	case "ping":
+		return struct{}{}, nil
+	case "tools/list":
+		return map[string]any{"tools": server.listTools()}, nil
+	case "tools/call":
+		return server.callTool(req.Params)
+	case "notifications/initialized", "notifications/cancelled":
+		return nil, nil
+	default:
+		return nil, &rpcError{Code: codeMethodNotFound, Message: fmt.Sprintf("Unknown method %s", req.Method)}
+	}
+}
+
+type initializeParams struct {
+	ProtocolVersion string `json:"protocolVersion"`
+}
+
+// initialize agrees on the client's protocol version if the server knows it,
+// and offers the newest one it knows otherwise
+func (server *Server) initialize(params json.RawMessage) (any, error) {
+	initParams := initializeParams{}
+	if len(params) > 0 {
+		err := json.Unmarshal(params, &initParams)
+		if err != nil {
+			return nil, invalidParams("Invalid initialize params: %v", err)
+		}
+	}
+	version := protocolVersions[len(protocolVersions)-1]
+	if slices.Contains(protocolVersions, initParams.ProtocolVersion) {
+		version = initParams.ProtocolVersion
+	}
+	return map[string]any{
+		"protocolVersion": version,
+		"capabilities":    map[string]any{"tools": map[string]any{}},
+		"serverInfo":      map[string]string{"name": server.options.Name, "version": server.options.Version},
+	}, nil
+}
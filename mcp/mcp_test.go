@@ -0,0 +1,261 @@
+package mcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	collection "go-simple-embedding-database/collection"
+	database "go-simple-embedding-database/database"
+	embedders "go-simple-embedding-database/embedders"
+)
+
+func mockEmbed(blob []byte) ([]float64, error) {
+	return []float64{float64(bytes.Count(blob, []byte("a"))), float64(bytes.Count(blob, []byte("b"))), 1}, nil
+}
+
+// scriptedClient talks to a server running in another goroutine, the same
+// way an agent would over stdio
+type scriptedClient struct {
+	t         *testing.T
+	toServer  *io.PipeWriter
+	responses *bufio.Reader
+	nextId    int
+	done      chan error
+}
+
+func startServer(t *testing.T, server *Server) *scriptedClient {
+	t.Helper()
+	serverIn, toServer := io.Pipe()
+	fromServer, serverOut := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := server.Serve(serverIn, serverOut)
+		serverOut.Close()
+		done <- err
+	}()
+	return &scriptedClient{t: t, toServer: toServer, responses: bufio.NewReader(fromServer), done: done}
+}
+
+func (client *scriptedClient) send(line string) {
+	client.t.Helper()
+	_, err := io.WriteString(client.toServer, line+"\n")
+	if err != nil {
+		client.t.Fatalf("Could not write to server: %v", err)
+	}
+}
+
+type testResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result"`
+	Error   *rpcError       `json:"error"`
+}
+
+func (client *scriptedClient) receive() testResponse {
+	client.t.Helper()
+	line, err := client.responses.ReadBytes('\n')
+	if err != nil {
+		client.t.Fatalf("Could not read from server: %v", err)
+	}
+	resp := testResponse{}
+	err = json.Unmarshal(line, &resp)
+	if err != nil {
+		client.t.Fatalf("Could not decode response %s: %v", line, err)
+	}
+	return resp
+}
+
+// request sends a request and decodes the result into out
+func (client *scriptedClient) request(method string, params any, out any) *rpcError {
+	client.t.Helper()
+	client.nextId++
+	encoded, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": client.nextId, "method": method, "params": params})
+	client.send(string(encoded))
+	resp := client.receive()
+	if string(resp.Id) != strings.TrimSpace(string(mustMarshal(client.nextId))) {
+		client.t.Errorf("Expected a response to request %d, got %s", client.nextId, resp.Id)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if out != nil {
+		err := json.Unmarshal(resp.Result, out)
+		if err != nil {
+			client.t.Fatalf("Could not decode result %s: %v", resp.Result, err)
+		}
+	}
+	return nil
+}
+
+// callTool calls a tool and decodes the JSON in its text content into out
+func (client *scriptedClient) callTool(name string, arguments any, out any) (bool, string) {
+	client.t.Helper()
+	result := toolResult{}
+	rpcErr := client.request("tools/call", map[string]any{"name": name, "arguments": arguments}, &result)
+	if rpcErr != nil {
+		client.t.Fatalf("Could not call %s: %v", name, rpcErr)
+	}
+	if len(result.Content) != 1 || result.Content[0].Type != "text" {
+		client.t.Fatalf("Unexpected content from %s: %+v", name, result)
+	}
+	text := result.Content[0].Text
+	if !result.IsError && out != nil {
+		err := json.Unmarshal([]byte(text), out)
+		if err != nil {
+			client.t.Fatalf("Could not decode %s output %s: %v", name, text, err)
+		}
+	}
+	return result.IsError, text
+}
+
+func (client *scriptedClient) close() {
+	client.t.Helper()
+	client.toServer.Close()
+	err := <-client.done
+	if err != nil {
+		client.t.Errorf("Server stopped with an error: %v", err)
+	}
+}
+
+func mustMarshal(value any) []byte {
+	encoded, _ := json.Marshal(value)
+	return encoded
+}
+
+func makeTestDatabase(t *testing.T) *database.SimpleDataBase {
+	t.Helper()
+	embedders.EmbedderRegister["mock-embedder"] = mockEmbed
+	db := database.MakeDatabase()
+	for _, collectionId := range []string{"notes", "docs"} {
+		coll, _ := collection.MakeCollection(collectionId, "mock-embedder")
+		err := db.AddCollection(coll)
+		if err != nil {
+			t.Fatalf("Could not add collection: %v", err)
+		}
+	}
+	return db
+}
+
+func TestSession(t *testing.T) {
+	db := makeTestDatabase(t)
+	writes := 0
+	client := startServer(t, MakeServer(db, Options{Version: "test", OnWrite: func() error {
+		writes++
+		return nil
+	}}))
+	defer client.close()
+
+	initialized := map[string]any{}
+	client.request("initialize", map[string]any{"protocolVersion": "2024-11-05", "capabilities": map[string]any{}, "clientInfo": map[string]string{"name": "test"}}, &initialized)
+	if initialized["protocolVersion"] != "2024-11-05" || initialized["serverInfo"].(map[string]any)["name"] != "sedb" {
+		t.Errorf("Unexpected initialize result %v", initialized)
+	}
+	// notifications don't get a response, so the next thing read is the
+	// ping's
+	client.send(`{"jsonrpc": "2.0", "method": "notifications/initialized"}`)
+	rpcErr := client.request("ping", nil, nil)
+	if rpcErr != nil {
+		t.Errorf("Could not ping: %v", rpcErr)
+	}
+
+	listed := struct {
+		Tools []toolDescription `json:"tools"`
+	}{}
+	client.request("tools/list", nil, &listed)
+	names := make([]string, len(listed.Tools))
+	for i, tool := range listed.Tools {
+		names[i] = tool.Name
+	}
+	if !reflect.DeepEqual(names, []string{"list_collections", "query_collection", "add_documents", "get_record"}) {
+		t.Errorf("Unexpected tools %v", names)
+	}
+	collectionProperty := listed.Tools[1].InputSchema["properties"].(map[string]any)["collection"].(map[string]any)
+	if !reflect.DeepEqual(collectionProperty["enum"], []any{"docs", "notes"}) {
+		t.Errorf("Expected the schema to list the collections, got %v", collectionProperty)
+	}
+
+	added := map[string][]string{}
+	isError, text := client.callTool("add_documents", map[string]any{"collection": "docs", "documents": []map[string]any{
+		{"id": "a", "text": "aaa", "metadata": map[string]string{"kind": "letters"}},
+		{"id": "b", "text": "bbb"},
+		{"id": "ab", "text": "ab"},
+	}}, &added)
+	if isError || !reflect.DeepEqual(added["added"], []string{"a", "b", "ab"}) || writes != 1 {
+		t.Errorf("Unexpected add_documents result %s (%d writes)", text, writes)
+	}
+	isError, text = client.callTool("add_documents", map[string]any{"collection": "docs", "documents": []map[string]any{{"id": "a", "text": "again"}}}, nil)
+	if !isError || !strings.Contains(text, "already exists") {
+		t.Errorf("Expected adding an existing record to fail, got %s", text)
+	}
+
+	results := []document{}
+	client.callTool("query_collection", map[string]any{"collection": "docs", "query": "aaaa", "n_results": 2}, &results)
+	if len(results) != 2 || results[0].Id != "a" || results[0].Text != "aaa" || results[0].Similarity == nil || *results[0].Similarity < 0.99 {
+		t.Errorf("Unexpected query results %s", mustMarshal(results))
+	}
+	results = []document{}
+	client.callTool("query_collection", map[string]any{"collection": "docs", "query": "b", "where": map[string]string{"kind": "letters"}}, &results)
+	if len(results) != 1 || results[0].Id != "a" {
+		t.Errorf("Expected the where filter to apply, got %s", mustMarshal(results))
+	}
+
+	got := document{}
+	client.callTool("get_record", map[string]any{"collection": "docs", "id": "a"}, &got)
+	if !reflect.DeepEqual(got, document{Id: "a", Text: "aaa", Metadata: map[string]string{"kind": "letters"}}) {
+		t.Errorf("Unexpected record %+v", got)
+	}
+	isError, text = client.callTool("get_record", map[string]any{"collection": "docs", "id": "missing"}, nil)
+	if !isError {
+		t.Errorf("Expected getting a missing record to fail, got %s", text)
+	}
+
+	summaries := []collectionSummary{}
+	client.callTool("list_collections", nil, &summaries)
+	if !reflect.DeepEqual(summaries, []collectionSummary{{Id: "docs", EmbedderId: "mock-embedder", Records: 3}, {Id: "notes", EmbedderId: "mock-embedder", Records: 0}}) {
+		t.Errorf("Unexpected collections %+v", summaries)
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	client := startServer(t, MakeServer(makeTestDatabase(t), Options{}))
+	defer client.close()
+
+	initialized := map[string]any{}
+	client.request("initialize", map[string]any{"protocolVersion": "1999-01-01"}, &initialized)
+	if initialized["protocolVersion"] != protocolVersions[len(protocolVersions)-1] {
+		t.Errorf("Expected the newest protocol version to be offered, got %v", initialized["protocolVersion"])
+	}
+
+	client.send(`{"jsonrpc": "2.0", "id": 1, "method": `)
+	resp := client.receive()
+	if resp.Error == nil || resp.Error.Code != codeParseError || string(resp.Id) != "null" {
+		t.Errorf("Expected a parse error, got %+v", resp)
+	}
+	client.send(`{"id": "x", "method": "ping"}`)
+	resp = client.receive()
+	if resp.Error == nil || resp.Error.Code != codeInvalidRequest || string(resp.Id) != `"x"` {
+		t.Errorf("Expected an invalid request error, got %+v", resp)
+	}
+	for method, params := range map[string]any{
+		"resources/list": nil,
+		"tools/call":     map[string]any{"name": "drop_tables"},
+	} {
+		rpcErr := client.request(method, params, nil)
+		expected := codeMethodNotFound
+		if method == "tools/call" {
+			expected = codeInvalidParams
+		}
+		if rpcErr == nil || rpcErr.Code != expected {
+			t.Errorf("Expected %s to fail with %d, got %v", method, expected, rpcErr)
+		}
+	}
+	rpcErr := client.request("tools/call", map[string]any{"name": "query_collection", "arguments": map[string]any{"collection": "docs"}}, nil)
+	if rpcErr == nil || rpcErr.Code != codeInvalidParams || !strings.Contains(rpcErr.Message, "query") {
+		t.Errorf("Expected a missing argument to be an invalid params error, got %v", rpcErr)
+	}
+}
@@ -0,0 +1,348 @@
+package mcp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	collection "go-simple-embedding-database/collection"
+	embedders "go-simple-embedding-database/embedders"
+	records "go-simple-embedding-database/records"
+)
+
+type tool struct {
+	name        string
+	description string
+	// the schema is rebuilt every time the tools are listed, since it lists
+	// the collections
+	schema func() map[string]any
+	call   func(arguments json.RawMessage) (any, error)
+}
+
+type toolDescription struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema map[string]any `json:"inputSchema"`
+}
+
+type textContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type toolResult struct {
+	Content []textContent `json:"content"`
+	IsError bool          `json:"isError,omitempty"`
+}
+
+func (server *Server) makeTools() []tool {
+	return []tool{
+		{
+			name:        "list_collections",
+			description: "List the collections in the database, with the embedder each one uses and how many records it has",
+			schema: func() map[string]any {
+				return objectSchema(map[string]any{})
+			},
+			call: server.listCollections,
+		},
+		{
+			name:        "query_collection",
+			description: "Find the records in a collection whose text is most similar to a query. Results come back most similar first, with their cosine similarity to the query",
+			schema: func() map[string]any {
+				return objectSchema(map[string]any{
+					"collection":     server.collectionSchema(),
+					"query":          map[string]any{"type": "string", "description": "Text to search for"},
+					"n_results":      map[string]any{"type": "integer", "minimum": 1, "default": defaultResults, "description": "How many records to return"},
+					"min_similarity": map[string]any{"type": "number", "minimum": -1, "maximum": 1, "description": "Leave out records less similar to the query than this"},
+					"where":          metadataSchema("Only return records whose metadata has all of these keys and values"),
+				}, "collection", "query")
+			},
+			call: server.queryCollection,
+		},
+		{
+			name:        "add_documents",
+			description: "Embed documents with the collection's embedder and add them to the collection",
+			schema: func() map[string]any {
+				document := objectSchema(map[string]any{
+					"id":       map[string]any{"type": "string", "description": "Record ID, unique within the collection"},
+					"text":     map[string]any{"type": "string", "description": "The document's text"},
+					"metadata": metadataSchema("Metadata to store with the document"),
+				}, "id", "text")
+				return objectSchema(map[string]any{
+					"collection": server.collectionSchema(),
+					"documents":  map[string]any{"type": "array", "items": document, "minItems": 1},
+					"upsert":     map[string]any{"type": "boolean", "default": false, "description": "Replace records that already exist instead of failing"},
+				}, "collection", "documents")
+			},
+			call: server.addDocuments,
+		},
+		{
+			name:        "get_record",
+			description: "Get a record from a collection by its ID",
+			schema: func() map[string]any {
+				return objectSchema(map[string]any{
+					"collection": server.collectionSchema(),
+					"id":         map[string]any{"type": "string", "description": "Record ID"},
+				}, "collection", "id")
+			},
+			call: server.getRecord,
+		},
+	}
+}
+
+const defaultResults = 5
+
+func objectSchema(properties map[string]any, required ...string) map[string]any {
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func metadataSchema(description string) map[string]any {
+	return map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "string"}, "description": description}
+}
+
+// collectionSchema lists the collections there are right now
+func (server *Server) collectionSchema() map[string]any {
+	schema := map[string]any{"type": "string", "description": "Collection ID"}
+	infos := server.db.ListCollections()
+	if len(infos) > 0 {
+		ids := make([]string, len(infos))
+		for i, info := range infos {
+			ids[i] = info.Id
+		}
+		schema["enum"] = ids
+	}
+	return schema
+}
+
+func (server *Server) listTools() []toolDescription {
+	descriptions := make([]toolDescription, len(server.tools))
+	for i, tool := range server.tools {
+		descriptions[i] = toolDescription{Name: tool.name, Description: tool.description, InputSchema: tool.schema()}
+	}
+	return descriptions
+}
+
+type callParams struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// callTool reports problems with the call itself (an unknown tool, arguments
+// that don't fit the schema) as JSON-RPC errors. Errors from running the tool
+// go back in the result, so the model can see them and try something else
+func (server *Server) callTool(params json.RawMessage) (any, error) {
+	call := callParams{}
+	err := json.Unmarshal(params, &call)
+	if err != nil {
+		return nil, invalidParams("Invalid tools/call params: %v", err)
+	}
+	for _, tool := range server.tools {
+		if tool.name != call.Name {
+			continue
+		}
+		arguments := call.Arguments
+		if len(arguments) == 0 || string(arguments) == "null" {
+			arguments = json.RawMessage("{}")
+		}
+		result, err := tool.call(arguments)
+		if err != nil {
+			rpcErr := &rpcError{}
+			if errors.As(err, &rpcErr) {
+				return nil, err
+			}
+			return toolResult{Content: []textContent{{Type: "text", Text: err.Error()}}, IsError: true}, nil
+		}
+		encoded, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return toolResult{Content: []textContent{{Type: "text", Text: string(encoded)}}}, nil
+	}
+	return nil, invalidParams("Unknown tool %s", call.Name)
+}
+
+func decodeArguments(arguments json.RawMessage, value any) error {
+	err := json.Unmarshal(arguments, value)
+	if err != nil {
+		return invalidParams("Invalid arguments: %v", err)
+	}
+	return nil
+}
+
+func required(name string, value string) error {
+	if value == "" {
+		return invalidParams("Missing required argument %s", name)
+	}
+	return nil
+}
+
+// document is how records are shown to the model: without their embeddings,
+// which would only fill up its context
+type document struct {
+	Id         string            `json:"id"`
+	Text       string            `json:"text"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Similarity *float64          `json:"similarity,omitempty"`
+}
+
+func makeDocument(record records.Record) document {
+	return document{Id: record.Id, Text: string(record.Blob), Metadata: record.Metadata}
+}
+
+type collectionSummary struct {
+	Id         string `json:"id"`
+	EmbedderId string `json:"embedderId"`
+	Records    int    `json:"records"`
+	TTL        string `json:"ttl,omitempty"`
+}
+
+func (server *Server) listCollections(arguments json.RawMessage) (any, error) {
+	infos := server.db.ListCollections()
+	summaries := make([]collectionSummary, 0, len(infos))
+	for _, info := range infos {
+		count, err := server.db.Count(info.Id)
+		if err != nil {
+			return nil, err
+		}
+		summary := collectionSummary{Id: info.Id, EmbedderId: info.EmbedderId, Records: count}
+		if info.TTL > 0 {
+			summary.TTL = info.TTL.String()
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+type queryArguments struct {
+	Collection    string            `json:"collection"`
+	Query         string            `json:"query"`
+	NResults      int               `json:"n_results"`
+	MinSimilarity *float64          `json:"min_similarity"`
+	Where         map[string]string `json:"where"`
+}
+
+func (server *Server) queryCollection(arguments json.RawMessage) (any, error) {
+	args := queryArguments{NResults: defaultResults}
+	err := decodeArguments(arguments, &args)
+	if err != nil {
+		return nil, err
+	}
+	err = errors.Join(required("collection", args.Collection), required("query", args.Query))
+	if err != nil {
+		return nil, err
+	}
+	if args.NResults < 1 {
+		return nil, invalidParams("n_results must be at least 1 (got %d)", args.NResults)
+	}
+	results, err := server.db.QueryWithOptions(args.Collection, []byte(args.Query), collection.QueryOptions{NGreatest: args.NResults, MinSimilarity: args.MinSimilarity, Where: args.Where})
+	if err != nil {
+		return nil, err
+	}
+	documents := make([]document, len(results))
+	for i, result := range results {
+		documents[i] = makeDocument(result.Record)
+		similarity := result.Similarity
+		documents[i].Similarity = &similarity
+	}
+	return documents, nil
+}
+
+type addArguments struct {
+	Collection string `json:"collection"`
+	Documents  []struct {
+		Id       string            `json:"id"`
+		Text     string            `json:"text"`
+		Metadata map[string]string `json:"metadata"`
+	} `json:"documents"`
+	Upsert bool `json:"upsert"`
+}
+
+// addDocuments embeds every document before adding any of them, so a failed
+// embedding doesn't leave half the documents added
+func (server *Server) addDocuments(arguments json.RawMessage) (any, error) {
+	args := addArguments{}
+	err := decodeArguments(arguments, &args)
+	if err != nil {
+		return nil, err
+	}
+	err = required("collection", args.Collection)
+	if err != nil {
+		return nil, err
+	}
+	if len(args.Documents) == 0 {
+		return nil, invalidParams("Missing required argument documents")
+	}
+	blobs := make([][]byte, len(args.Documents))
+	for i, doc := range args.Documents {
+		err = required(fmt.Sprintf("documents[%d].id", i), doc.Id)
+		if err != nil {
+			return nil, err
+		}
+		blobs[i] = []byte(doc.Text)
+	}
+
+	coll, err := server.db.GetCollection(args.Collection)
+	if err != nil {
+		return nil, err
+	}
+	embed, err := embedders.GetBatchEmbedderFunc(coll.EmbedderId)
+	if err != nil {
+		return nil, err
+	}
+	embeddings, err := embed(blobs)
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddings) != len(blobs) {
+		return nil, fmt.Errorf("%w: %s returned %d embeddings for %d documents", embedders.ErrBadEmbeddings, coll.EmbedderId, len(embeddings), len(blobs))
+	}
+	put := server.db.AddRecord
+	if args.Upsert {
+		put = server.db.UpsertRecord
+	}
+	added := make([]string, 0, len(args.Documents))
+	for i, doc := range args.Documents {
+		record := &records.Record{Id: doc.Id, EmbedderId: coll.EmbedderId, Blob: blobs[i], Embedding: embeddings[i], Metadata: doc.Metadata}
+		err = put(args.Collection, record)
+		if err != nil {
+			break
+		}
+		added = append(added, doc.Id)
+	}
+	if len(added) > 0 && server.options.OnWrite != nil {
+		writeErr := server.options.OnWrite()
+		if writeErr != nil {
+			return nil, writeErr
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Added %d of %d documents: %w", len(added), len(args.Documents), err)
+	}
+	return map[string]any{"added": added}, nil
+}
+
+type getArguments struct {
+	Collection string `json:"collection"`
+	Id         string `json:"id"`
+}
+
+func (server *Server) getRecord(arguments json.RawMessage) (any, error) {
+	args := getArguments{}
+	err := decodeArguments(arguments, &args)
+	if err != nil {
+		return nil, err
+	}
+	err = errors.Join(required("collection", args.Collection), required("id", args.Id))
+	if err != nil {
+		return nil, err
+	}
+	record, err := server.db.GetRecord(args.Collection, args.Id)
+	if err != nil {
+		return nil, err
+	}
+	return makeDocument(*record), nil
+}
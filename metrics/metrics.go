@@ -0,0 +1,448 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text exposition format. A Registry is an http.Handler, so
+// it can be mounted at /metrics in any service:
+//
+//	http.Handle("/metrics", metrics.Default)
+//
+// The database, collection and embedders packages register their metrics
+// with Default, which also has the Go runtime's memory and goroutine
+// gauges. Each metric can have labels; the values are passed after the
+// metric's own arguments, in the order the labels were given:
+//
+//	added := metrics.MakeCounter("records_added_total", "Records added", "collection")
+//	added.Inc("docs")
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	namePattern  = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// Metric is anything a Registry can serve. The Make functions make them
+type Metric interface {
+	Name() string
+	write(buffer *bytes.Buffer)
+}
+
+// family is what every kind of metric has in common
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+// makeFamily checks the names, which are fixed in the code, so a bad one is
+// a bug and panics
+func makeFamily(name string, help string, kind string, labels []string) family {
+	if !namePattern.MatchString(name) {
+		panic(fmt.Sprintf("metrics: invalid metric name %q", name))
+	}
+	for _, label := range labels {
+		if !labelPattern.MatchString(label) || strings.HasPrefix(label, "__") {
+			panic(fmt.Sprintf("metrics: invalid label name %q for %s", label, name))
+		}
+	}
+	return family{name: name, help: help, kind: kind, labels: labels}
+}
+
+func (f family) Name() string {
+	return f.name
+}
+
+func (f family) checkLabels(labelValues []string) {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s has labels %v, got %d values", f.name, f.labels, len(labelValues)))
+	}
+}
+
+func (f family) writeHeader(buffer *bytes.Buffer) {
+	helpEscaper := strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	fmt.Fprintf(buffer, "# HELP %s %s\n# TYPE %s %s\n", f.name, helpEscaper.Replace(f.help), f.name, f.kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// writeSample writes a line for one value. extraLabel is a label the
+// metric's own labels don't include, like a histogram bucket's le
+func (f family) writeSample(buffer *bytes.Buffer, suffix string, labelValues []string, extraLabel string, extraValue string, value float64) {
+	buffer.WriteString(f.name)
+	buffer.WriteString(suffix)
+	if len(labelValues) > 0 || extraLabel != "" {
+		pairs := make([]string, 0, len(labelValues)+1)
+		for i, labelValue := range labelValues {
+			pairs = append(pairs, f.labels[i]+`="`+labelEscaper.Replace(labelValue)+`"`)
+		}
+		if extraLabel != "" {
+			pairs = append(pairs, extraLabel+`="`+extraValue+`"`)
+		}
+		buffer.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	buffer.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// series holds one value per combination of label values
+type series[T any] struct {
+	mutex  *sync.Mutex
+	values map[string]*T
+	// the label values each key stands for
+	labelValues map[string][]string
+}
+
+func makeSeries[T any]() series[T] {
+	return series[T]{mutex: &sync.Mutex{}, values: make(map[string]*T), labelValues: make(map[string][]string)}
+}
+
+// get returns the value for the label values, making it with make if it's
+// new. Expects the caller to hold the lock
+func (s series[T]) get(labelValues []string, make func() *T) *T {
+	key := strings.Join(labelValues, "\xff")
+	value, ok := s.values[key]
+	if !ok {
+		value = make()
+		s.values[key] = value
+		s.labelValues[key] = slices.Clone(labelValues)
+	}
+	return value
+}
+
+// find returns the value for the label values, if there is one. Expects the
+// caller to hold the lock
+func (s series[T]) find(labelValues []string) (T, bool) {
+	value, ok := s.values[strings.Join(labelValues, "\xff")]
+	if !ok {
+		var zero T
+		return zero, false
+	}
+	return *value, true
+}
+
+// sortedKeys returns the keys in a stable order for writing. Expects the
+// caller to hold the lock
+func (s series[T]) sortedKeys() []string {
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Counter is a value that only goes up, like a number of requests
+type Counter struct {
+	family
+	series series[float64]
+}
+
+func MakeCounter(name string, help string, labels ...string) *Counter {
+	return &Counter{family: makeFamily(name, help, "counter", labels), series: makeSeries[float64]()}
+}
+
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+// Add adds value, which can't be negative
+func (counter *Counter) Add(value float64, labelValues ...string) {
+	counter.checkLabels(labelValues)
+	if value < 0 {
+		panic(fmt.Sprintf("metrics: counter %s can't go down", counter.name))
+	}
+	counter.series.mutex.Lock()
+	defer counter.series.mutex.Unlock()
+	*counter.series.get(labelValues, func() *float64 { return new(float64) }) += value
+}
+
+// Value returns the counter's value for the label values
+func (counter *Counter) Value(labelValues ...string) float64 {
+	counter.checkLabels(labelValues)
+	counter.series.mutex.Lock()
+	defer counter.series.mutex.Unlock()
+	value, _ := counter.series.find(labelValues)
+	return value
+}
+
+func (counter *Counter) write(buffer *bytes.Buffer) {
+	counter.writeHeader(buffer)
+	counter.series.mutex.Lock()
+	defer counter.series.mutex.Unlock()
+	for _, key := range counter.series.sortedKeys() {
+		counter.writeSample(buffer, "", counter.series.labelValues[key], "", "", *counter.series.values[key])
+	}
+}
+
+// Gauge is a value that goes up and down, like a number of open connections
+type Gauge struct {
+	family
+	series series[float64]
+}
+
+func MakeGauge(name string, help string, labels ...string) *Gauge {
+	return &Gauge{family: makeFamily(name, help, "gauge", labels), series: makeSeries[float64]()}
+}
+
+func (gauge *Gauge) Set(value float64, labelValues ...string) {
+	gauge.checkLabels(labelValues)
+	gauge.series.mutex.Lock()
+	defer gauge.series.mutex.Unlock()
+	*gauge.series.get(labelValues, func() *float64 { return new(float64) }) = value
+}
+
+func (gauge *Gauge) Add(value float64, labelValues ...string) {
+	gauge.checkLabels(labelValues)
+	gauge.series.mutex.Lock()
+	defer gauge.series.mutex.Unlock()
+	*gauge.series.get(labelValues, func() *float64 { return new(float64) }) += value
+}
+
+func (gauge *Gauge) Value(labelValues ...string) float64 {
+	gauge.checkLabels(labelValues)
+	gauge.series.mutex.Lock()
+	defer gauge.series.mutex.Unlock()
+	value, _ := gauge.series.find(labelValues)
+	return value
+}
+
+func (gauge *Gauge) write(buffer *bytes.Buffer) {
+	gauge.writeHeader(buffer)
+	gauge.series.mutex.Lock()
+	defer gauge.series.mutex.Unlock()
+	for _, key := range gauge.series.sortedKeys() {
+		gauge.writeSample(buffer, "", gauge.series.labelValues[key], "", "", *gauge.series.values[key])
+	}
+}
+
+// GaugeFunc is a gauge whose values are worked out when it's served, like
+// the size of something that's expensive to keep track of as it changes
+type GaugeFunc struct {
+	family
+	collect func(observe func(value float64, labelValues ...string))
+}
+
+// MakeGaugeFunc makes a gauge that calls collect every time it's served.
+// collect calls observe with each value, one for each combination of label
+// values
+func MakeGaugeFunc(name string, help string, collect func(observe func(value float64, labelValues ...string)), labels ...string) *GaugeFunc {
+	return &GaugeFunc{family: makeFamily(name, help, "gauge", labels), collect: collect}
+}
+
+func (gauge *GaugeFunc) write(buffer *bytes.Buffer) {
+	gauge.writeHeader(buffer)
+	samples := &bytes.Buffer{}
+	sorted := make([]string, 0)
+	gauge.collect(func(value float64, labelValues ...string) {
+		gauge.checkLabels(labelValues)
+		gauge.writeSample(samples, "", labelValues, "", "", value)
+		sorted = append(sorted, samples.String())
+		samples.Reset()
+	})
+	slices.Sort(sorted)
+	for _, line := range sorted {
+		buffer.WriteString(line)
+	}
+}
+
+// DefaultBuckets are histogram buckets for latencies in seconds, from 5ms
+// to 10s
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts values into buckets, like how long requests take
+type Histogram struct {
+	family
+	buckets []float64
+	series  series[histogramValue]
+}
+
+type histogramValue struct {
+	// counts[i] is how many values were at most buckets[i], but more than
+	// buckets[i-1]. The last one is for values over every bucket
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// MakeHistogram makes a histogram with the given bucket upper bounds, or
+// DefaultBuckets if buckets is nil
+func MakeHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	if !slices.IsSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets for %s are not in order", name))
+	}
+	if slices.Contains(labels, "le") {
+		panic(fmt.Sprintf("metrics: histogram %s can't have an le label", name))
+	}
+	return &Histogram{family: makeFamily(name, help, "histogram", labels), buckets: slices.Clone(buckets), series: makeSeries[histogramValue]()}
+}
+
+func (histogram *Histogram) Observe(value float64, labelValues ...string) {
+	histogram.checkLabels(labelValues)
+	histogram.series.mutex.Lock()
+	defer histogram.series.mutex.Unlock()
+	h := histogram.series.get(labelValues, histogram.makeValue)
+	i, _ := slices.BinarySearch(histogram.buckets, value)
+	h.counts[i]++
+	h.sum += value
+	h.count++
+}
+
+// ObserveSince observes the seconds since start
+func (histogram *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	histogram.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// Count returns how many values have been observed for the label values
+func (histogram *Histogram) Count(labelValues ...string) uint64 {
+	histogram.checkLabels(labelValues)
+	histogram.series.mutex.Lock()
+	defer histogram.series.mutex.Unlock()
+	value, _ := histogram.series.find(labelValues)
+	return value.count
+}
+
+func (histogram *Histogram) makeValue() *histogramValue {
+	return &histogramValue{counts: make([]uint64, len(histogram.buckets)+1)}
+}
+
+func (histogram *Histogram) write(buffer *bytes.Buffer) {
+	histogram.writeHeader(buffer)
+	histogram.series.mutex.Lock()
+	defer histogram.series.mutex.Unlock()
+	for _, key := range histogram.series.sortedKeys() {
+		labelValues, h := histogram.series.labelValues[key], histogram.series.values[key]
+		cumulative := uint64(0)
+		for i, bound := range histogram.buckets {
+			cumulative += h.counts[i]
+			histogram.writeSample(buffer, "_bucket", labelValues, "le", formatFloat(bound), float64(cumulative))
+		}
+		histogram.writeSample(buffer, "_bucket", labelValues, "le", "+Inf", float64(h.count))
+		histogram.writeSample(buffer, "_sum", labelValues, "", "", h.sum)
+		histogram.writeSample(buffer, "_count", labelValues, "", "", float64(h.count))
+	}
+}
+
+// Registry is a set of metrics, served in name order
+type Registry struct {
+	mutex   *sync.Mutex
+	metrics map[string]Metric
+}
+
+func MakeRegistry() *Registry {
+	return &Registry{mutex: &sync.Mutex{}, metrics: make(map[string]Metric)}
+}
+
+// Default is the registry the repo's packages register their metrics with
+var Default = MakeRegistry()
+
+func (registry *Registry) Register(metric Metric) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	_, exists := registry.metrics[metric.Name()]
+	if exists {
+		return errors.New(fmt.Sprintf("A metric called %s is already registered", metric.Name()))
+	}
+	registry.metrics[metric.Name()] = metric
+	return nil
+}
+
+// Unregister removes the metric with the name, reporting whether there was
+// one
+func (registry *Registry) Unregister(name string) bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	_, exists := registry.metrics[name]
+	delete(registry.metrics, name)
+	return exists
+}
+
+// Register registers metric with Default and returns it, so a package can
+// declare its metrics as variables. It panics if the name is taken
+func Register[M Metric](metric M) M {
+	err := Default.Register(metric)
+	if err != nil {
+		panic(err)
+	}
+	return metric
+}
+
+// WriteTo writes every metric in the text exposition format
+func (registry *Registry) WriteTo(w io.Writer) (int64, error) {
+	registry.mutex.Lock()
+	names := make([]string, 0, len(registry.metrics))
+	for name := range registry.metrics {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	metrics := make([]Metric, len(names))
+	for i, name := range names {
+		metrics[i] = registry.metrics[name]
+	}
+	registry.mutex.Unlock()
+
+	buffer := &bytes.Buffer{}
+	for _, metric := range metrics {
+		metric.write(buffer)
+	}
+	return buffer.WriteTo(w)
+}
+
+// ContentType is the content type of the text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	if r.Method == http.MethodGet {
+		registry.WriteTo(w)
+	}
+}
+
+// memStat makes a gauge's collect func out of one of the runtime's memory
+// statistics
+func memStat(read func(stats *runtime.MemStats) uint64) func(observe func(float64, ...string)) {
+	return func(observe func(float64, ...string)) {
+		stats := runtime.MemStats{}
+		runtime.ReadMemStats(&stats)
+		observe(float64(read(&stats)))
+	}
+}
+
+var (
+	_ = Register(MakeGaugeFunc("go_goroutines", "Number of goroutines that currently exist", func(observe func(float64, ...string)) {
+		observe(float64(runtime.NumGoroutine()))
+	}))
+	_ = Register(MakeGaugeFunc("go_memstats_heap_alloc_bytes", "Bytes of allocated heap objects", memStat(func(stats *runtime.MemStats) uint64 { return stats.HeapAlloc })))
+	_ = Register(MakeGaugeFunc("go_memstats_heap_inuse_bytes", "Bytes in in-use heap spans", memStat(func(stats *runtime.MemStats) uint64 { return stats.HeapInuse })))
+	_ = Register(MakeGaugeFunc("go_memstats_sys_bytes", "Bytes of memory obtained from the OS", memStat(func(stats *runtime.MemStats) uint64 { return stats.Sys })))
+)
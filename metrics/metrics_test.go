@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	registry := MakeRegistry()
+	requests := MakeCounter("requests_total", "Requests served", "method", "code")
+	requests.Inc("GET", "200")
+	requests.Add(2, "POST", "500")
+	requests.Inc("GET", "200")
+	temperature := MakeGauge("temperature", "Line one\nline two")
+	temperature.Set(21.5)
+	sizes := MakeGaugeFunc("size_bytes", "Sizes", func(observe func(float64, ...string)) {
+		observe(3, "b")
+		observe(1, `quote"d`)
+		observe(2, "a")
+	}, "name")
+	latency := MakeHistogram("latency_seconds", "Latency", []float64{0.1, 1})
+	for _, value := range []float64{0.05, 0.1, 0.5, 2} {
+		latency.Observe(value)
+	}
+	for _, metric := range []Metric{requests, temperature, sizes, latency} {
+		err := registry.Register(metric)
+		if err != nil {
+			t.Fatalf("Could not register %s: %v", metric.Name(), err)
+		}
+	}
+	if err := registry.Register(MakeCounter("requests_total", "Again")); err == nil {
+		t.Errorf("Should not have been able to register requests_total twice")
+	}
+
+	expected := `# HELP latency_seconds Latency
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 2.65
+latency_seconds_count 4
+# HELP requests_total Requests served
+# TYPE requests_total counter
+requests_total{method="GET",code="200"} 2
+requests_total{method="POST",code="500"} 2
+# HELP size_bytes Sizes
+# TYPE size_bytes gauge
+size_bytes{name="a"} 2
+size_bytes{name="b"} 3
+size_bytes{name="quote\"d"} 1
+# HELP temperature Line one\nline two
+# TYPE temperature gauge
+temperature 21.5
+`
+	buffer := &bytes.Buffer{}
+	_, err := registry.WriteTo(buffer)
+	if err != nil {
+		t.Fatalf("Could not write metrics: %v", err)
+	}
+	if buffer.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, buffer)
+	}
+	if requests.Value("GET", "200") != 2 || requests.Value("PUT", "200") != 0 || latency.Count() != 4 {
+		t.Errorf("Unexpected values %v %v %v", requests.Value("GET", "200"), requests.Value("PUT", "200"), latency.Count())
+	}
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != ContentType || recorder.Body.String() != expected {
+		t.Errorf("Unexpected response %d %s: %s", recorder.Code, recorder.Header().Get("Content-Type"), recorder.Body)
+	}
+	recorder = httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("POST", "/metrics", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected POST to be turned away, got %d", recorder.Code)
+	}
+
+	if !registry.Unregister("temperature") || registry.Unregister("temperature") {
+		t.Errorf("Expected temperature to be unregistered once")
+	}
+}
+
+func TestDefault(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	Default.WriteTo(buffer)
+	for _, name := range []string{"go_goroutines", "go_memstats_heap_alloc_bytes"} {
+		if !strings.Contains(buffer.String(), "\n"+name+" ") {
+			t.Errorf("Expected %s in the default registry, got\n%s", name, buffer)
+		}
+	}
+}
+
+func TestBadLabels(t *testing.T) {
+	counter := MakeCounter("labelled_total", "Labelled", "a", "b")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected the wrong number of label values to panic")
+		}
+	}()
+	counter.Inc("only one")
+}
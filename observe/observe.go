@@ -0,0 +1,128 @@
+// Package observe lets a program watch what the library is doing, to feed
+// a tracing backend. An Observer gets a Start call when an operation begins
+// and an End call on the Span it returns when the operation is over:
+//
+//	db.SetObserver(tracer)         // queries, adds and saves on db
+//	embedders.SetObserver(tracer)  // every call to an embedder
+//
+// Observers are called on the goroutine doing the work, so they should be
+// quick. Nothing is observed until an observer is set
+package observe
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+type Operation string
+
+const (
+	// a call to an embedder, with Count blobs
+	Embed Operation = "embed"
+	// a query against Collection, or a batch of Count of them
+	Query Operation = "query"
+	// a record added to (or upserted into) Collection
+	Add Operation = "add"
+	// the database being written to Path
+	Persist Operation = "persist"
+)
+
+// Event describes an operation. Fields that don't apply to the operation
+// are left empty
+type Event struct {
+	Operation  Operation
+	Collection string
+	Embedder   string
+	RecordId   string
+	Count      int
+	Path       string
+}
+
+type Observer interface {
+	Start(event Event) Span
+}
+
+// Span is an operation in progress
+type Span interface {
+	// End is called once, with the error the operation failed with if it
+	// did
+	End(err error)
+}
+
+type nopSpan struct{}
+
+func (nopSpan) End(err error) {}
+
+// Start starts a span on observer, or returns one that does nothing if
+// observer is nil
+func Start(observer Observer, event Event) Span {
+	if observer == nil {
+		return nopSpan{}
+	}
+	return observer.Start(event)
+}
+
+// Observers passes every operation to all of observers
+func Observers(observers ...Observer) Observer {
+	return multiObserver(observers)
+}
+
+type multiObserver []Observer
+
+func (observers multiObserver) Start(event Event) Span {
+	spans := make(multiSpan, len(observers))
+	for i, observer := range observers {
+		spans[i] = observer.Start(event)
+	}
+	return spans
+}
+
+type multiSpan []Span
+
+func (spans multiSpan) End(err error) {
+	for _, span := range spans {
+		span.End(err)
+	}
+}
+
+// LogObserver logs every operation as it ends, with how long it took. Failed
+// operations are logged at warn and the rest at debug
+type LogObserver struct {
+	Logger *slog.Logger
+}
+
+func (observer LogObserver) Start(event Event) Span {
+	return logSpan{logger: observer.Logger, event: event, start: time.Now()}
+}
+
+type logSpan struct {
+	logger *slog.Logger
+	event  Event
+	start  time.Time
+}
+
+func (span logSpan) End(err error) {
+	attrs := []slog.Attr{slog.Duration("duration", time.Since(span.start))}
+	for _, field := range []struct {
+		key   string
+		value string
+	}{{"collection", span.event.Collection}, {"embedder", span.event.Embedder}, {"recordId", span.event.RecordId}, {"path", span.event.Path}} {
+		if field.value != "" {
+			attrs = append(attrs, slog.String(field.key, field.value))
+		}
+	}
+	if span.event.Count > 0 {
+		attrs = append(attrs, slog.Int("count", span.event.Count))
+	}
+	level := slog.LevelDebug
+	if err != nil {
+		level = slog.LevelWarn
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	logger := span.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.LogAttrs(context.Background(), level, string(span.event.Operation), attrs...)
+}
@@ -0,0 +1,63 @@
+package observe
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+type recorder struct {
+	started []Event
+	ended   []error
+}
+
+func (r *recorder) Start(event Event) Span {
+	r.started = append(r.started, event)
+	return recorderSpan{r}
+}
+
+type recorderSpan struct {
+	r *recorder
+}
+
+func (span recorderSpan) End(err error) {
+	span.r.ended = append(span.r.ended, err)
+}
+
+func TestObservers(t *testing.T) {
+	a, b := &recorder{}, &recorder{}
+	broken := errors.New("broken")
+	span := Start(Observers(a, b), Event{Operation: Query, Collection: "docs"})
+	span.End(broken)
+	for _, r := range []*recorder{a, b} {
+		if len(r.started) != 1 || r.started[0].Collection != "docs" || len(r.ended) != 1 || r.ended[0] != broken {
+			t.Errorf("Expected both observers to see the span, got %+v", r)
+		}
+	}
+	// no observer is fine
+	Start(nil, Event{Operation: Query}).End(nil)
+}
+
+func TestLogObserver(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(buffer, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	observer := LogObserver{Logger: logger}
+	observer.Start(Event{Operation: Embed, Embedder: "mock", Count: 3}).End(nil)
+	observer.Start(Event{Operation: Persist, Path: "db.json"}).End(errors.New("disk full"))
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", buffer)
+	}
+	for i, expected := range [][]string{
+		{"level=DEBUG", "msg=embed", "embedder=mock", "count=3", "duration="},
+		{"level=WARN", "msg=persist", "path=db.json", `error="disk full"`},
+	} {
+		for _, part := range expected {
+			if !strings.Contains(lines[i], part) {
+				t.Errorf("Expected %s in %q", part, lines[i])
+			}
+		}
+	}
+}
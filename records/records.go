@@ -4,15 +4,33 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"time"
 
 	embedders "go-simple-embedding-database/embedders"
 )
 
 type Record struct {
-	Embedding  []float64 `json:"embedding"`
-	EmbedderId string    `json:"embedderId"`
-	Blob       []byte    `json:"blob"`
-	Id         string    `json:"id"`
+	Embedding  []float64         `json:"embedding"`
+	EmbedderId string            `json:"embedderId"`
+	Blob       []byte            `json:"blob"`
+	Id         string            `json:"id"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	// Set when the record is added to a collection
+	CreatedAt time.Time `json:"createdAt"`
+	// Set when the record is replaced by a newer version
+	UpdatedAt time.Time `json:"updatedAt"`
+	// The record is treated as deleted from this time on. The zero value
+	// means the record never expires
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// the zero time marshals as "0001-01-01T00:00:00Z", so unset times are
+// swapped out for nil pointers and dropped from the JSON instead
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
 }
 
 // GPT
@@ -22,11 +40,17 @@ func (r Record) MarshalJSON() ([]byte, error) {
 
 	// Create a new struct with the new type and an additional field for the custom Blob
 	newRecord := &struct {
-		Blob string `json:"blob"`
+		Blob      string     `json:"blob"`
+		CreatedAt *time.Time `json:"createdAt,omitempty"`
+		UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+		ExpiresAt *time.Time `json:"expiresAt,omitempty"`
 		*Alias
 	}{
-		Blob:  string(r.Blob),
-		Alias: (*Alias)(&r),
+		Blob:      string(r.Blob),
+		CreatedAt: optionalTime(r.CreatedAt),
+		UpdatedAt: optionalTime(r.UpdatedAt),
+		ExpiresAt: optionalTime(r.ExpiresAt),
+		Alias:     (*Alias)(&r),
 	}
 
 	return json.Marshal(newRecord)
@@ -39,7 +63,10 @@ func (r *Record) UnmarshalJSON(bytes []byte) error {
 
 	// Create a new struct with the new type and an additional field for the custom Blob
 	newRecord := &struct {
-		Blob string `json:"blob"`
+		Blob      string     `json:"blob"`
+		CreatedAt *time.Time `json:"createdAt,omitempty"`
+		UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+		ExpiresAt *time.Time `json:"expiresAt,omitempty"`
 		*Alias
 	}{
 		Alias: (*Alias)(r),
@@ -50,6 +77,15 @@ func (r *Record) UnmarshalJSON(bytes []byte) error {
 	}
 
 	r.Blob = []byte(newRecord.Blob)
+	if newRecord.CreatedAt != nil {
+		r.CreatedAt = *newRecord.CreatedAt
+	}
+	if newRecord.UpdatedAt != nil {
+		r.UpdatedAt = *newRecord.UpdatedAt
+	}
+	if newRecord.ExpiresAt != nil {
+		r.ExpiresAt = *newRecord.ExpiresAt
+	}
 	return nil
 }
 
@@ -70,7 +106,7 @@ func (e Record) String() string {
 	}
 	if len(e.Embedding) > 5 {
 		embeddingString += " ..."
-	} else {
+	} else if len(e.Embedding) > 0 {
 		embeddingString = embeddingString[:len(embeddingString)-2]
 	}
 	embeddingString += "]"
@@ -78,6 +114,27 @@ func (e Record) String() string {
 	return fmt.Sprintf("Embedding{Embedding: %s, EmbedderId: %s, Blob: %v, Id: %s}", embeddingString, e.EmbedderId, defaultBlob, e.Id)
 }
 
+// SetTTL makes the record expire ttl from now
+func (r *Record) SetTTL(ttl time.Duration) {
+	r.ExpiresAt = time.Now().UTC().Add(ttl)
+}
+
+func (r Record) Expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && !now.Before(r.ExpiresAt)
+}
+
+// MatchesMetadata reports whether every key in where is present in the
+// record's metadata with the same value. An empty filter matches everything
+func (r Record) MatchesMetadata(where map[string]string) bool {
+	for key, value := range where {
+		recordValue, ok := r.Metadata[key]
+		if !ok || recordValue != value {
+			return false
+		}
+	}
+	return true
+}
+
 func MakeRecord(embedderId string, blob []byte, id string) (*Record, error) {
 	embed, err := embedders.GetEmbedderFunc(embedderId)
 	if err != nil {
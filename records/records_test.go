@@ -6,6 +6,7 @@ import (
 	"errors"
 	"reflect"
 	"testing"
+	"time"
 
 	embedders "go-simple-embedding-database/embedders"
 )
@@ -82,4 +83,79 @@ func TestStringer(t *testing.T) {
 	if stringValue != expectedValue {
 		t.Errorf("Expected %s, got %s", expectedValue, stringValue)
 	}
+
+	// records listed without their embeddings still need to print
+	stringValue = Record{Id: "test"}.String()
+	expectedValue = "Embedding{Embedding: [], EmbedderId: , Blob: , Id: test}"
+	if stringValue != expectedValue {
+		t.Errorf("Expected %s, got %s", expectedValue, stringValue)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	embedders.EmbedderRegister["embedder"] = ShortEmbed
+	record, err := MakeRecord("embedder", []byte("blob"), "record-id")
+	if err != nil {
+		t.Fatalf("Could not create record: %v", err)
+	}
+	record.Metadata = map[string]string{"source": "wiki", "lang": "en"}
+	record.CreatedAt = time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+
+	JSONBody, err := json.Marshal(record)
+	if err != nil {
+		t.Fatalf("Could not marshal record %v: %v", record, err)
+	}
+	expectedJSONBody := []byte("{\"blob\":\"blob\",\"createdAt\":\"2024-01-02T03:04:05.000000006Z\",\"embedding\":[1],\"embedderId\":\"embedder\",\"id\":\"record-id\",\"metadata\":{\"lang\":\"en\",\"source\":\"wiki\"}}")
+	if !bytes.Equal(JSONBody, expectedJSONBody) {
+		t.Errorf("Unexpected JSON: expected %s, got %s", string(expectedJSONBody), string(JSONBody))
+	}
+	newRecord := &Record{}
+	err = json.Unmarshal(JSONBody, newRecord)
+	if err != nil {
+		t.Fatalf("Could not unmarshal JSON: %v", err)
+	}
+	if !reflect.DeepEqual(record, newRecord) {
+		t.Errorf("Unmarshal failed: expected %v, got %v", record, newRecord)
+	}
+
+	if !record.MatchesMetadata(nil) || !record.MatchesMetadata(map[string]string{"lang": "en"}) {
+		t.Errorf("Record should have matched filter")
+	}
+	if record.MatchesMetadata(map[string]string{"lang": "fr"}) || record.MatchesMetadata(map[string]string{"author": "me"}) {
+		t.Errorf("Record should not have matched filter")
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	record := &Record{Embedding: []float64{1}, EmbedderId: "embedder", Blob: []byte("blob"), Id: "record-id"}
+	record.CreatedAt = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	record.UpdatedAt = time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	record.ExpiresAt = time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)
+
+	JSONBody, err := json.Marshal(record)
+	if err != nil {
+		t.Fatalf("Could not marshal record %v: %v", record, err)
+	}
+	expectedJSONBody := []byte("{\"blob\":\"blob\",\"createdAt\":\"2024-01-01T00:00:00Z\",\"updatedAt\":\"2024-01-02T00:00:00Z\",\"expiresAt\":\"2024-01-31T00:00:00Z\",\"embedding\":[1],\"embedderId\":\"embedder\",\"id\":\"record-id\"}")
+	if !bytes.Equal(JSONBody, expectedJSONBody) {
+		t.Errorf("Unexpected JSON: expected %s, got %s", string(expectedJSONBody), string(JSONBody))
+	}
+	newRecord := &Record{}
+	err = json.Unmarshal(JSONBody, newRecord)
+	if err != nil {
+		t.Fatalf("Could not unmarshal JSON: %v", err)
+	}
+	if !reflect.DeepEqual(record, newRecord) {
+		t.Errorf("Unmarshal failed: expected %v, got %v", record, newRecord)
+	}
+
+	if record.Expired(time.Date(2024, 1, 30, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Record should not have expired yet")
+	}
+	if !record.Expired(time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Record should have expired")
+	}
+	if (&Record{}).Expired(time.Now()) {
+		t.Errorf("Records without an expiry should never expire")
+	}
 }
@@ -0,0 +1,270 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	database "go-simple-embedding-database/database"
+)
+
+type FollowerOptions struct {
+	// Defaults to http.DefaultClient. It shouldn't have a timeout, since the
+	// log is one long response
+	HTTPClient *http.Client
+	// How long to wait before reconnecting when the connection to the leader
+	// fails. Defaults to a second
+	RetryInterval time.Duration
+	// Called with every error talking to the leader. Run retries them, so
+	// this is the only place they show up (other than Status)
+	OnError func(err error)
+}
+
+// Status is how a follower is doing. Sequence numbers are the leader's
+type Status struct {
+	// the latest change applied
+	Applied uint64 `json:"applied"`
+	// the leader's latest change, as of LastContact
+	Leader uint64 `json:"leader"`
+	// how many of the leader's changes are still to be applied
+	Lag uint64 `json:"lag"`
+	// how long after the leader made the latest applied change it was applied
+	Delay       time.Duration `json:"delay"`
+	Connected   bool          `json:"connected"`
+	LastContact time.Time     `json:"lastContact"`
+	// how many snapshots have been loaded. More than one means the follower
+	// has fallen behind (or the leader restarted) and had to start over
+	Snapshots int    `json:"snapshots"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// Follower keeps a replica of the leader's database. The replica can be
+// read (and served) like any other database, but writes to it fail with
+// database.ErrReadOnly. A Follower is an http.Handler serving its Status as
+// JSON
+type Follower struct {
+	db        *database.SimpleDataBase
+	leaderURL string
+	options   FollowerOptions
+
+	mutex        *sync.Mutex
+	status       Status
+	bootstrapped bool
+	// closed and replaced every time the applied sequence number changes
+	applied chan struct{}
+}
+
+const defaultRetryInterval = time.Second
+
+// MakeFollower makes a follower of the leader at leaderURL (where its Leader
+// handler is mounted). Nothing happens until Run is called. The replica has
+// its own change feed, so it can be subscribed to, or have followers of its
+// own
+func MakeFollower(leaderURL string, options FollowerOptions) *Follower {
+	if options.HTTPClient == nil {
+		options.HTTPClient = http.DefaultClient
+	}
+	if options.RetryInterval <= 0 {
+		options.RetryInterval = defaultRetryInterval
+	}
+	db := database.MakeDatabase()
+	db.EnableChangeFeed(database.ChangeFeedOptions{})
+	db.SetReplica(true)
+	return &Follower{db: db, leaderURL: strings.TrimSuffix(leaderURL, "/"), options: options, mutex: &sync.Mutex{}, applied: make(chan struct{})}
+}
+
+func (follower *Follower) Database() *database.SimpleDataBase {
+	return follower.db
+}
+
+func (follower *Follower) Status() Status {
+	follower.mutex.Lock()
+	defer follower.mutex.Unlock()
+	status := follower.status
+	if status.Leader > status.Applied {
+		status.Lag = status.Leader - status.Applied
+	}
+	return status
+}
+
+func (follower *Follower) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(follower.Status())
+}
+
+// WaitFor waits until the follower has applied the leader's change with the
+// given sequence number, e.g. to read a write just made on the leader
+func (follower *Follower) WaitFor(ctx context.Context, sequence uint64) error {
+	for {
+		follower.mutex.Lock()
+		applied, done := follower.status.Applied, follower.applied
+		follower.mutex.Unlock()
+		if applied >= sequence {
+			return nil
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Run follows the leader until ctx is done, reconnecting whenever the
+// connection fails. It returns ctx's error
+func (follower *Follower) Run(ctx context.Context) error {
+	for {
+		err := follower.follow(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		follower.mutex.Lock()
+		follower.status.LastError = err.Error()
+		follower.mutex.Unlock()
+		if follower.options.OnError != nil {
+			follower.options.OnError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(follower.options.RetryInterval):
+		}
+	}
+}
+
+// setApplied expects the caller to hold the lock
+func (follower *Follower) setApplied(sequence uint64) {
+	follower.status.Applied = sequence
+	close(follower.applied)
+	follower.applied = make(chan struct{})
+}
+
+func (follower *Follower) get(ctx context.Context, path string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, follower.leaderURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return follower.options.HTTPClient.Do(request)
+}
+
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return errors.New(fmt.Sprintf("Leader replied %s: %s", resp.Status, strings.TrimSpace(string(body))))
+}
+
+// loadSnapshot replaces the replica with a snapshot of the leader
+func (follower *Follower) loadSnapshot(ctx context.Context) error {
+	resp, err := follower.get(ctx, "/snapshot")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	// the replica is only replaced once the whole snapshot has been read,
+	// and the trailer only arrives after that
+	err = follower.db.ReplaceFrom(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Could not load snapshot: %w", err)
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return err
+	}
+	sequence, err := strconv.ParseUint(resp.Trailer.Get(SequenceTrailer), 10, 64)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Snapshot has no %s trailer, it may have been cut short", SequenceTrailer))
+	}
+
+	follower.mutex.Lock()
+	defer follower.mutex.Unlock()
+	follower.bootstrapped = true
+	follower.status.Snapshots++
+	follower.status.LastContact = time.Now()
+	if sequence > follower.status.Leader {
+		follower.status.Leader = sequence
+	}
+	follower.setApplied(sequence)
+	return nil
+}
+
+// follow loads a snapshot if the replica needs one, then applies the log
+// until the connection fails
+func (follower *Follower) follow(ctx context.Context) error {
+	follower.mutex.Lock()
+	bootstrapped := follower.bootstrapped
+	follower.mutex.Unlock()
+	if !bootstrapped {
+		err := follower.loadSnapshot(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	resp, err := follower.get(ctx, "/log?after="+strconv.FormatUint(follower.Status().Applied, 10))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// the changes the replica needs are gone, or the leader restarted and
+		// its sequence numbers started over. Either way, start over too
+		follower.mutex.Lock()
+		follower.bootstrapped = false
+		follower.mutex.Unlock()
+		return responseError(resp)
+	}
+
+	follower.mutex.Lock()
+	follower.status.Connected = true
+	follower.mutex.Unlock()
+	defer func() {
+		follower.mutex.Lock()
+		follower.status.Connected = false
+		follower.mutex.Unlock()
+	}()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		message := LogMessage{}
+		err := decoder.Decode(&message)
+		if err != nil {
+			return err
+		}
+		err = follower.apply(message)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (follower *Follower) apply(message LogMessage) error {
+	follower.mutex.Lock()
+	defer follower.mutex.Unlock()
+	follower.status.LastContact = time.Now()
+	follower.status.Leader = message.Latest
+	change := message.Change
+	if change == nil {
+		return nil
+	}
+	if change.Sequence != follower.status.Applied+1 {
+		follower.bootstrapped = false
+		return fmt.Errorf("%w: expected change %d from the leader, got %d", database.ErrInvalidChange, follower.status.Applied+1, change.Sequence)
+	}
+	err := follower.db.ApplyChange(*change)
+	if err != nil {
+		follower.bootstrapped = false
+		return fmt.Errorf("Could not apply change %d: %w", change.Sequence, err)
+	}
+	follower.status.Delay = time.Since(change.Time)
+	follower.setApplied(change.Sequence)
+	return nil
+}
@@ -0,0 +1,147 @@
+// Package replication keeps read-only copies of a database (followers) in
+// step with the database they copy (the leader) over HTTP. The leader
+// serves
+//
+//	GET /snapshot         the database as JSON, with the sequence number of
+//	                      the latest change it includes in the Sedb-Sequence
+//	                      trailer
+//	GET /log?after=n      the leader's changes after n, one LogMessage per
+//	                      line, until the follower hangs up
+//
+// A follower loads the snapshot, then tails the log from the snapshot's
+// sequence number, applying changes in order. If it falls so far behind that
+// the changes it needs have left the leader's change feed history, it loads
+// a new snapshot and carries on from there
+package replication
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	database "go-simple-embedding-database/database"
+)
+
+// SequenceTrailer is the trailer the snapshot's sequence number is sent in.
+// It has to be a trailer, since the sequence number is only known once the
+// database is locked for writing the snapshot
+const SequenceTrailer = "Sedb-Sequence"
+
+// LogMessage is a line of the log. Latest is the leader's latest sequence
+// number when the message was sent, so followers can tell how far behind
+// they are. Messages without a Change are heartbeats, sent when there
+// haven't been any changes for a while
+type LogMessage struct {
+	Latest uint64           `json:"latest"`
+	Change *database.Change `json:"change,omitempty"`
+}
+
+type LeaderOptions struct {
+	// How often to send a heartbeat when there are no changes. Defaults to a
+	// second
+	Heartbeat time.Duration
+	// How many changes can be waiting to be sent to a follower before it's
+	// disconnected. Defaults to 4096
+	Buffer int
+}
+
+// Leader is an http.Handler serving a database to followers. The database
+// needs its change feed enabled
+type Leader struct {
+	db      *database.SimpleDataBase
+	options LeaderOptions
+	mux     *http.ServeMux
+}
+
+const (
+	defaultHeartbeat = time.Second
+	defaultBuffer    = 4096
+)
+
+func MakeLeader(db *database.SimpleDataBase, options LeaderOptions) *Leader {
+	if options.Heartbeat <= 0 {
+		options.Heartbeat = defaultHeartbeat
+	}
+	if options.Buffer <= 0 {
+		options.Buffer = defaultBuffer
+	}
+	leader := &Leader{db: db, options: options, mux: http.NewServeMux()}
+	leader.mux.HandleFunc("GET /snapshot", leader.snapshot)
+	leader.mux.HandleFunc("GET /log", leader.log)
+	return leader
+}
+
+func (leader *Leader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	leader.mux.ServeHTTP(w, r)
+}
+
+func (leader *Leader) snapshot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Trailer", SequenceTrailer)
+	w.Header().Set("Content-Type", "application/json")
+	sequence, n, err := leader.db.WriteSnapshot(w)
+	if err != nil {
+		// once some of the snapshot has gone it's too late to change the
+		// status, but without the trailer the follower knows the snapshot
+		// is no good
+		if n == 0 {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set(SequenceTrailer, strconv.FormatUint(sequence, 10))
+}
+
+func (leader *Leader) log(w http.ResponseWriter, r *http.Request) {
+	after, err := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid after %s", r.URL.Query().Get("after")), http.StatusBadRequest)
+		return
+	}
+	subscription, err := leader.db.Subscribe(database.ChangeFilter{After: after, Buffer: leader.options.Buffer})
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, database.ErrChangesGone) {
+			status = http.StatusGone
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer subscription.Close()
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	err = controller.Flush()
+	if err != nil {
+		return
+	}
+	encoder := json.NewEncoder(w)
+	heartbeat := time.NewTicker(leader.options.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		message := LogMessage{}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+		case change, ok := <-subscription.Changes():
+			if !ok {
+				// too slow, the follower will reconnect
+				return
+			}
+			message.Change = &change
+			heartbeat.Reset(leader.options.Heartbeat)
+		}
+		message.Latest = leader.db.LatestSequence()
+		err = encoder.Encode(message)
+		if err == nil {
+			err = controller.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
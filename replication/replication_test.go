@@ -0,0 +1,183 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	collection "go-simple-embedding-database/collection"
+	database "go-simple-embedding-database/database"
+	embedders "go-simple-embedding-database/embedders"
+	records "go-simple-embedding-database/records"
+)
+
+func mockEmbed(blob []byte) ([]float64, error) {
+	return []float64{float64(bytes.Count(blob, []byte("a"))), float64(bytes.Count(blob, []byte("b"))), 1}, nil
+}
+
+func addRecords(t *testing.T, db *database.SimpleDataBase, collectionId string, blobs ...string) {
+	t.Helper()
+	for _, blob := range blobs {
+		record, _ := records.MakeRecord("mock-embedder", []byte(blob), blob)
+		err := db.UpsertRecord(collectionId, record)
+		if err != nil {
+			t.Fatalf("Could not add record: %v", err)
+		}
+	}
+}
+
+// startFollower runs a new follower until the test ends
+func startFollower(t *testing.T, leaderURL string) (*Follower, context.CancelFunc) {
+	t.Helper()
+	follower := MakeFollower(leaderURL, FollowerOptions{RetryInterval: 10 * time.Millisecond})
+	return follower, run(t, follower)
+}
+
+// run runs the follower until the test ends or the returned function is
+// called
+func run(t *testing.T, follower *Follower) context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- follower.Run(ctx)
+	}()
+	stop := func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(func() {
+		if ctx.Err() == nil {
+			stop()
+		}
+	})
+	return stop
+}
+
+func waitFor(t *testing.T, follower *Follower, sequence uint64) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := follower.WaitFor(ctx, sequence)
+	if err != nil {
+		t.Fatalf("Follower didn't catch up to %d (status %+v): %v", sequence, follower.Status(), err)
+	}
+}
+
+func expectSameDatabase(t *testing.T, expected *database.SimpleDataBase, got *database.SimpleDataBase) {
+	t.Helper()
+	expectedJSON, gotJSON := &bytes.Buffer{}, &bytes.Buffer{}
+	expected.WriteTo(expectedJSON)
+	got.WriteTo(gotJSON)
+	if expectedJSON.String() != gotJSON.String() {
+		t.Errorf("Replica doesn't match (expected %s, got %s)", expectedJSON, gotJSON)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	embedders.EmbedderRegister["mock-embedder"] = mockEmbed
+	leaderDB := database.MakeDatabase()
+	leaderDB.EnableChangeFeed(database.ChangeFeedOptions{History: 16})
+	coll, _ := collection.MakeCollection("docs", "mock-embedder")
+	leaderDB.AddCollection(coll)
+	addRecords(t, leaderDB, "docs", "aaa", "bbb")
+	leaderServer := httptest.NewServer(MakeLeader(leaderDB, LeaderOptions{Heartbeat: 10 * time.Millisecond}))
+	// cleanups run last first, so the followers stop before the servers
+	// they're connected to
+	t.Cleanup(leaderServer.Close)
+
+	follower, stop := startFollower(t, leaderServer.URL)
+	waitFor(t, follower, leaderDB.LatestSequence())
+	expectSameDatabase(t, leaderDB, follower.Database())
+
+	// changes after the snapshot come through the log
+	addRecords(t, leaderDB, "docs", "ab", "aaa")
+	leaderDB.DeleteRecord("docs", "bbb")
+	leaderDB.SetCollectionTTL("docs", time.Hour)
+	coll, _ = collection.MakeCollection("news", "mock-embedder")
+	leaderDB.AddCollection(coll)
+	addRecords(t, leaderDB, "news", "b")
+	waitFor(t, follower, leaderDB.LatestSequence())
+	expectSameDatabase(t, leaderDB, follower.Database())
+
+	status := follower.Status()
+	if status.Applied != leaderDB.LatestSequence() || status.Lag != 0 || status.Snapshots != 1 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	record, _ := records.MakeRecord("mock-embedder", []byte("a"), "a")
+	err := follower.Database().AddRecord("docs", record)
+	if !errors.Is(err, database.ErrReadOnly) {
+		t.Errorf("Expected writes to the replica to fail, got %v", err)
+	}
+
+	// a follower of the follower
+	followerServer := httptest.NewServer(MakeLeader(follower.Database(), LeaderOptions{Heartbeat: 10 * time.Millisecond}))
+	t.Cleanup(followerServer.Close)
+	chained, _ := startFollower(t, followerServer.URL)
+	waitFor(t, chained, follower.Database().LatestSequence())
+	expectSameDatabase(t, leaderDB, chained.Database())
+
+	// a follower that's been away for longer than the leader's history has
+	// to start over from a new snapshot
+	stop()
+	leaderDB.DeleteCollection("news")
+	for i := 0; i < 16; i++ {
+		addRecords(t, leaderDB, "docs", strings.Repeat("ab", i+1))
+	}
+	run(t, follower)
+	waitFor(t, follower, leaderDB.LatestSequence())
+	expectSameDatabase(t, leaderDB, follower.Database())
+	if follower.Status().Snapshots != 2 {
+		t.Errorf("Expected the follower to load a new snapshot, got %+v", follower.Status())
+	}
+	// which reaches its own followers as ordinary changes
+	waitFor(t, chained, follower.Database().LatestSequence())
+	expectSameDatabase(t, leaderDB, chained.Database())
+}
+
+func TestFollowerStatus(t *testing.T) {
+	embedders.EmbedderRegister["mock-embedder"] = mockEmbed
+	leaderDB := database.MakeDatabase()
+	leaderDB.EnableChangeFeed(database.ChangeFeedOptions{History: 2})
+	leader := MakeLeader(leaderDB, LeaderOptions{})
+	leaderServer := httptest.NewServer(leader)
+	defer leaderServer.Close()
+	coll, _ := collection.MakeCollection("docs", "mock-embedder")
+	leaderDB.AddCollection(coll)
+	addRecords(t, leaderDB, "docs", "a", "b", "c")
+
+	for target, expected := range map[string]int{
+		"/log?after=x":  http.StatusBadRequest,
+		"/log?after=1":  http.StatusGone,
+		"/log?after=99": http.StatusBadRequest,
+	} {
+		recorder := httptest.NewRecorder()
+		leader.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+		if recorder.Code != expected {
+			t.Errorf("GET %s: expected %d, got %d", target, expected, recorder.Code)
+		}
+	}
+
+	// a leader that isn't there
+	errs := make(chan error, 1)
+	follower := MakeFollower("http://127.0.0.1:1", FollowerOptions{RetryInterval: time.Hour, OnError: func(err error) {
+		errs <- err
+	}})
+	ctx, cancel := context.WithCancel(context.Background())
+	go follower.Run(ctx)
+	<-errs
+	cancel()
+	status := follower.Status()
+	if status.Connected || status.LastError == "" || status.Snapshots != 0 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	recorder := httptest.NewRecorder()
+	follower.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusOK || !bytes.Contains(recorder.Body.Bytes(), []byte(`"lastError"`)) {
+		t.Errorf("Unexpected status response %d %s", recorder.Code, recorder.Body)
+	}
+}
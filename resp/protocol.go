@@ -0,0 +1,218 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// limits on what a client can send, the same as Redis's defaults
+const (
+	maxBulkLength  = 512 << 20
+	maxArrayLength = 1 << 20
+	maxInlineSize  = 64 << 10
+)
+
+// errProtocol is returned for input that isn't RESP. The connection is
+// closed after replying with it, since there's no telling where the next
+// command starts
+var errProtocol = errors.New("Protocol error")
+
+func protocolError(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", errProtocol, fmt.Sprintf(format, args...))
+}
+
+// readCommand reads one command, either a RESP array of bulk strings (what
+// client libraries and redis-cli send) or an inline command, which is a
+// line of space separated words (what you type into telnet)
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] != '*' {
+		line, err := readLine(r, maxInlineSize)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.Fields(line), nil
+	}
+
+	line, err := readLine(r, maxInlineSize)
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(string(line[1:]))
+	if err != nil || count > maxArrayLength {
+		return nil, protocolError("invalid multibulk length")
+	}
+	args := make([][]byte, 0, max(count, 0))
+	for i := 0; i < count; i++ {
+		line, err := readLine(r, maxInlineSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protocolError("expected '$', got '%s'", firstByte(line))
+		}
+		length, err := strconv.Atoi(string(line[1:]))
+		if err != nil || length < 0 || length > maxBulkLength {
+			return nil, protocolError("invalid bulk length")
+		}
+		arg := make([]byte, length+2)
+		_, err = io.ReadFull(r, arg)
+		if err != nil {
+			return nil, err
+		}
+		if arg[length] != '\r' || arg[length+1] != '\n' {
+			return nil, protocolError("bulk string isn't followed by CRLF")
+		}
+		args = append(args, arg[:length])
+	}
+	return args, nil
+}
+
+func firstByte(line []byte) string {
+	if len(line) == 0 {
+		return ""
+	}
+	return string(line[:1])
+}
+
+// readLine reads up to the next newline and strips the line ending
+func readLine(r *bufio.Reader, limit int) ([]byte, error) {
+	line := make([]byte, 0, 64)
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > limit {
+			return nil, protocolError("line too long")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+}
+
+// The types a command can reply with. Anything else that writeValue knows
+// about (nil, int, string, []byte, error) maps to the obvious RESP type
+type (
+	simpleString string
+	// array elements can be any reply type
+	array []any
+	// a map's entries are written in the order they're given. RESP2 clients
+	// get them as a flat array of keys and values
+	respMap []mapEntry
+	// a double goes out as a bulk string to RESP2 clients
+	double float64
+)
+
+type mapEntry struct {
+	key   string
+	value any
+}
+
+// stringMap turns a map into a respMap with sorted keys, so replies are the
+// same every time
+func stringMap(m map[string]string) respMap {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	entries := make(respMap, len(keys))
+	for i, key := range keys {
+		entries[i] = mapEntry{key: key, value: m[key]}
+	}
+	return entries
+}
+
+// writer writes replies in the protocol version the client asked for with
+// HELLO
+type writer struct {
+	w       *bufio.Writer
+	version int
+}
+
+func (w *writer) writeValue(value any) {
+	switch value := value.(type) {
+	case nil:
+		if w.version >= 3 {
+			w.w.WriteString("_\r\n")
+		} else {
+			w.w.WriteString("$-1\r\n")
+		}
+	case simpleString:
+		w.w.WriteString("+" + string(value) + "\r\n")
+	case error:
+		w.writeError(value)
+	case int:
+		w.w.WriteString(":" + strconv.Itoa(value) + "\r\n")
+	case string:
+		w.writeBulk([]byte(value))
+	case []byte:
+		w.writeBulk(value)
+	case double:
+		formatted := formatDouble(float64(value))
+		if w.version >= 3 {
+			w.w.WriteString("," + formatted + "\r\n")
+		} else {
+			w.writeBulk([]byte(formatted))
+		}
+	case array:
+		w.w.WriteString("*" + strconv.Itoa(len(value)) + "\r\n")
+		for _, element := range value {
+			w.writeValue(element)
+		}
+	case respMap:
+		if w.version >= 3 {
+			w.w.WriteString("%" + strconv.Itoa(len(value)) + "\r\n")
+		} else {
+			w.w.WriteString("*" + strconv.Itoa(2*len(value)) + "\r\n")
+		}
+		for _, entry := range value {
+			w.writeBulk([]byte(entry.key))
+			w.writeValue(entry.value)
+		}
+	default:
+		w.writeError(errors.New(fmt.Sprintf("ERR cannot reply with %T", value)))
+	}
+}
+
+func (w *writer) writeBulk(value []byte) {
+	w.w.WriteString("$" + strconv.Itoa(len(value)) + "\r\n")
+	w.w.Write(value)
+	w.w.WriteString("\r\n")
+}
+
+// writeError sends the error's message, which should start with an error
+// code like ERR, on a single line
+func (w *writer) writeError(err error) {
+	message := bytes.ReplaceAll([]byte(err.Error()), []byte("\r\n"), []byte(" "))
+	message = bytes.ReplaceAll(message, []byte("\n"), []byte(" "))
+	w.w.WriteString("-")
+	w.w.Write(bytes.TrimSpace(message))
+	w.w.WriteString("\r\n")
+}
+
+func formatDouble(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "inf"
+	case math.IsInf(value, -1):
+		return "-inf"
+	case math.IsNaN(value):
+		return "nan"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,509 @@
+// Package resp serves a database to Redis clients. It speaks RESP2 and RESP3
+// (clients switch with HELLO 3) and has a handful of vector commands:
+//
+//	VCOLL.CREATE collection embedder [TTL seconds]
+//	VCOLL.DROP collection
+//	VCOLL.LIST
+//	VADD collection id blob [VECTOR v1,v2,...] [META key value]... [REPLACE]
+//	VGET collection id [WITHVECTOR]
+//	VDEL collection id [id ...]
+//	VCOUNT collection
+//	VSEARCH collection query [K n] [FILTER key value]... [MINSIM similarity] [WITHVECTORS]
+//
+// VADD embeds the blob with the collection's embedder unless VECTOR is
+// given, and replies 1 if the record is new or 0 if REPLACE replaced one.
+// VSEARCH embeds the query the same way; use VECTOR v1,v2,... in place of
+// the query to search with a vector. Each VSEARCH result is a map (a flat
+// array for RESP2) of id, similarity, distance, blob and metadata
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	collection "go-simple-embedding-database/collection"
+	database "go-simple-embedding-database/database"
+	records "go-simple-embedding-database/records"
+)
+
+type Server struct {
+	db *database.SimpleDataBase
+
+	mutex     *sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+	wg        *sync.WaitGroup
+}
+
+func MakeServer(db *database.SimpleDataBase) *Server {
+	return &Server{db: db, mutex: &sync.Mutex{}, listeners: make(map[net.Listener]bool), conns: make(map[net.Conn]bool), wg: &sync.WaitGroup{}}
+}
+
+// ErrServerClosed is returned by Serve once Close has been called
+var ErrServerClosed = errors.New("RESP server closed")
+
+func (server *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return server.Serve(listener)
+}
+
+// Serve accepts connections on listener until Close is called, and serves
+// each one on its own goroutine
+func (server *Server) Serve(listener net.Listener) error {
+	server.mutex.Lock()
+	if server.closed {
+		server.mutex.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	server.listeners[listener] = true
+	server.mutex.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			server.mutex.Lock()
+			closed := server.closed
+			delete(server.listeners, listener)
+			server.mutex.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		server.mutex.Lock()
+		if server.closed {
+			server.mutex.Unlock()
+			conn.Close()
+			continue
+		}
+		server.conns[conn] = true
+		server.wg.Add(1)
+		server.mutex.Unlock()
+		go server.serveConn(conn)
+	}
+}
+
+// Close stops the listeners, closes every connection and waits for their
+// goroutines to finish
+func (server *Server) Close() error {
+	server.mutex.Lock()
+	server.closed = true
+	for listener := range server.listeners {
+		listener.Close()
+	}
+	for conn := range server.conns {
+		conn.Close()
+	}
+	server.mutex.Unlock()
+	server.wg.Wait()
+	return nil
+}
+
+func (server *Server) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		server.mutex.Lock()
+		delete(server.conns, conn)
+		server.mutex.Unlock()
+		server.wg.Done()
+	}()
+	reader := bufio.NewReader(conn)
+	w := &writer{w: bufio.NewWriter(conn), version: 2}
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				w.writeError(errors.New("ERR " + err.Error()))
+				w.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		reply, quit := server.execute(w, args)
+		w.writeValue(reply)
+		// pipelined commands are answered together
+		if reader.Buffered() == 0 || quit {
+			err = w.w.Flush()
+			if err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// errorReply makes an error reply out of an error from the database. Redis
+// clients treat the first word as the error code
+func errorReply(err error) error {
+	if errors.Is(err, database.ErrReadOnly) {
+		return errors.New("READONLY You can't write against a read-only database")
+	}
+	return errors.New("ERR " + err.Error())
+}
+
+func wrongArgs(command string) error {
+	return errors.New(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+}
+
+func syntaxError() error {
+	return errors.New("ERR syntax error")
+}
+
+// execute runs a command and returns the reply, and whether the connection
+// should be closed after sending it
+func (server *Server) execute(w *writer, args [][]byte) (any, bool) {
+	name := string(args[0])
+	command := strings.ToUpper(name)
+	args = args[1:]
+	switch command {
+	case "PING":
+		if len(args) > 1 {
+			return wrongArgs(command), false
+		}
+		if len(args) == 1 {
+			return args[0], false
+		}
+		return simpleString("PONG"), false
+	case "ECHO":
+		if len(args) != 1 {
+			return wrongArgs(command), false
+		}
+		return args[0], false
+	case "QUIT":
+		return simpleString("OK"), true
+	case "HELLO":
+		return server.hello(w, args), false
+	case "SELECT":
+		if len(args) != 1 {
+			return wrongArgs(command), false
+		}
+		if string(args[0]) != "0" {
+			return errors.New("ERR DB index is out of range"), false
+		}
+		return simpleString("OK"), false
+	case "CLIENT":
+		// client libraries name themselves when they connect
+		return simpleString("OK"), false
+	case "COMMAND":
+		// redis-cli asks for command docs on startup, for hints
+		return array{}, false
+	case "VCOLL.CREATE":
+		return server.createCollection(args), false
+	case "VCOLL.DROP":
+		if len(args) != 1 {
+			return wrongArgs(command), false
+		}
+		err := server.db.DeleteCollection(string(args[0]))
+		if err != nil {
+			return errorReply(err), false
+		}
+		return simpleString("OK"), false
+	case "VCOLL.LIST":
+		if len(args) != 0 {
+			return wrongArgs(command), false
+		}
+		infos := server.db.ListCollections()
+		ids := make(array, len(infos))
+		for i, info := range infos {
+			ids[i] = info.Id
+		}
+		return ids, false
+	case "VADD":
+		return server.add(args), false
+	case "VGET":
+		return server.get(args), false
+	case "VDEL":
+		return server.delete(args), false
+	case "VCOUNT":
+		if len(args) != 1 {
+			return wrongArgs(command), false
+		}
+		count, err := server.db.Count(string(args[0]))
+		if err != nil {
+			return errorReply(err), false
+		}
+		return count, false
+	case "VSEARCH":
+		return server.search(args), false
+	default:
+		return errors.New(fmt.Sprintf("ERR unknown command '%s'", name)), false
+	}
+}
+
+// hello switches protocol versions. AUTH and SETNAME are accepted and
+// ignored
+func (server *Server) hello(w *writer, args [][]byte) any {
+	version := w.version
+	if len(args) > 0 {
+		requested, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			return errors.New("ERR Protocol version is not an integer or out of range")
+		}
+		if requested != 2 && requested != 3 {
+			return errors.New("NOPROTO unsupported protocol version")
+		}
+		version = requested
+	}
+	w.version = version
+	return respMap{
+		{key: "server", value: "sedb"},
+		{key: "version", value: "1.0.0"},
+		{key: "proto", value: version},
+		{key: "mode", value: "standalone"},
+		{key: "role", value: "master"},
+		{key: "modules", value: array{}},
+	}
+}
+
+func (server *Server) createCollection(args [][]byte) any {
+	if len(args) != 2 && len(args) != 4 {
+		return wrongArgs("VCOLL.CREATE")
+	}
+	coll, err := collection.MakeCollection(string(args[0]), string(args[1]))
+	if err != nil {
+		return errorReply(err)
+	}
+	if len(args) == 4 {
+		if !strings.EqualFold(string(args[2]), "TTL") {
+			return syntaxError()
+		}
+		seconds, err := strconv.Atoi(string(args[3]))
+		if err != nil || seconds < 0 {
+			return errors.New("ERR TTL is not a non-negative integer")
+		}
+		coll.TTL = time.Duration(seconds) * time.Second
+	}
+	err = server.db.AddCollection(coll)
+	if err != nil {
+		return errorReply(err)
+	}
+	return simpleString("OK")
+}
+
+func parseVector(arg []byte) ([]float64, error) {
+	fields := strings.Split(string(arg), ",")
+	vector := make([]float64, len(fields))
+	for i, field := range fields {
+		value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("ERR invalid vector component '%s'", field))
+		}
+		vector[i] = value
+	}
+	return vector, nil
+}
+
+func (server *Server) add(args [][]byte) any {
+	if len(args) < 3 {
+		return wrongArgs("VADD")
+	}
+	collectionId, recordId, blob := string(args[0]), string(args[1]), args[2]
+	var vector []float64
+	metadata := map[string]string(nil)
+	replace := false
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "VECTOR":
+			if i+1 >= len(args) {
+				return syntaxError()
+			}
+			var err error
+			vector, err = parseVector(args[i+1])
+			if err != nil {
+				return err
+			}
+			i++
+		case "META":
+			if i+2 >= len(args) {
+				return syntaxError()
+			}
+			if metadata == nil {
+				metadata = make(map[string]string)
+			}
+			metadata[string(args[i+1])] = string(args[i+2])
+			i += 2
+		case "REPLACE":
+			replace = true
+		default:
+			return syntaxError()
+		}
+	}
+
+	coll, err := server.db.GetCollection(collectionId)
+	if err != nil {
+		return errorReply(err)
+	}
+	record := &records.Record{Id: recordId, EmbedderId: coll.EmbedderId, Blob: blob, Embedding: vector, Metadata: metadata}
+	if vector == nil {
+		record, err = records.MakeRecord(coll.EmbedderId, blob, recordId)
+		if err != nil {
+			return errorReply(err)
+		}
+		record.Metadata = metadata
+	}
+	if !replace {
+		err = server.db.AddRecord(collectionId, record)
+		if err != nil {
+			return errorReply(err)
+		}
+		return 1
+	}
+	err = server.db.UpsertRecord(collectionId, record)
+	if err != nil {
+		return errorReply(err)
+	}
+	// the collection only keeps the original CreatedAt when it replaces a
+	// record, and sets UpdatedAt when it does
+	if record.UpdatedAt.IsZero() {
+		return 1
+	}
+	return 0
+}
+
+func recordReply(record records.Record, similarity *collection.QueryResult, withVector bool) respMap {
+	reply := respMap{{key: "id", value: record.Id}}
+	if similarity != nil {
+		reply = append(reply, mapEntry{key: "similarity", value: double(similarity.Similarity)}, mapEntry{key: "distance", value: double(similarity.Distance)})
+	}
+	reply = append(reply, mapEntry{key: "blob", value: record.Blob}, mapEntry{key: "metadata", value: stringMap(record.Metadata)})
+	if !record.CreatedAt.IsZero() {
+		reply = append(reply, mapEntry{key: "createdAt", value: record.CreatedAt.Format(time.RFC3339Nano)})
+	}
+	if withVector {
+		vector := make(array, len(record.Embedding))
+		for i, value := range record.Embedding {
+			vector[i] = double(value)
+		}
+		reply = append(reply, mapEntry{key: "vector", value: vector})
+	}
+	return reply
+}
+
+func (server *Server) get(args [][]byte) any {
+	if len(args) != 2 && len(args) != 3 {
+		return wrongArgs("VGET")
+	}
+	withVector := len(args) == 3
+	if withVector && !strings.EqualFold(string(args[2]), "WITHVECTOR") {
+		return syntaxError()
+	}
+	// a missing record is a null reply, a missing collection an error
+	_, err := server.db.GetCollection(string(args[0]))
+	if err != nil {
+		return errorReply(err)
+	}
+	record, err := server.db.GetRecord(string(args[0]), string(args[1]))
+	if err != nil {
+		return nil
+	}
+	return recordReply(*record, nil, withVector)
+}
+
+func (server *Server) delete(args [][]byte) any {
+	if len(args) < 2 {
+		return wrongArgs("VDEL")
+	}
+	collectionId := string(args[0])
+	_, err := server.db.GetCollection(collectionId)
+	if err != nil {
+		return errorReply(err)
+	}
+	deleted := 0
+	for _, recordId := range args[1:] {
+		err = server.db.DeleteRecord(collectionId, string(recordId))
+		if errors.Is(err, database.ErrReadOnly) {
+			return errorReply(err)
+		}
+		if err == nil {
+			deleted++
+		}
+	}
+	return deleted
+}
+
+const defaultK = 10
+
+func (server *Server) search(args [][]byte) any {
+	if len(args) < 2 {
+		return wrongArgs("VSEARCH")
+	}
+	collectionId, query := string(args[0]), args[1]
+	rest := args[2:]
+	var vector []float64
+	if strings.EqualFold(string(query), "VECTOR") && len(rest) > 0 {
+		var err error
+		vector, err = parseVector(rest[0])
+		if err != nil {
+			return err
+		}
+		rest = rest[1:]
+	}
+
+	options := collection.QueryOptions{NGreatest: defaultK}
+	withVectors := false
+	for i := 0; i < len(rest); i++ {
+		switch strings.ToUpper(string(rest[i])) {
+		case "K":
+			if i+1 >= len(rest) {
+				return syntaxError()
+			}
+			k, err := strconv.Atoi(string(rest[i+1]))
+			if err != nil || k < 1 {
+				return errors.New("ERR K must be a positive integer")
+			}
+			options.NGreatest = k
+			i++
+		case "FILTER":
+			if i+2 >= len(rest) {
+				return syntaxError()
+			}
+			if options.Where == nil {
+				options.Where = make(map[string]string)
+			}
+			options.Where[string(rest[i+1])] = string(rest[i+2])
+			i += 2
+		case "MINSIM":
+			if i+1 >= len(rest) {
+				return syntaxError()
+			}
+			minSimilarity, err := strconv.ParseFloat(string(rest[i+1]), 64)
+			if err != nil {
+				return errors.New("ERR MINSIM is not a number")
+			}
+			options.MinSimilarity = &minSimilarity
+			i++
+		case "WITHVECTORS":
+			withVectors = true
+		default:
+			return syntaxError()
+		}
+	}
+
+	var results []collection.QueryResult
+	var err error
+	if vector != nil {
+		results, err = server.db.QueryVector(collectionId, vector, options)
+	} else {
+		results, err = server.db.QueryWithOptions(collectionId, query, options)
+	}
+	if err != nil {
+		return errorReply(err)
+	}
+	reply := make(array, len(results))
+	for i := range results {
+		reply[i] = recordReply(results[i].Record, &results[i], withVectors)
+	}
+	return reply
+}
@@ -0,0 +1,335 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	database "go-simple-embedding-database/database"
+	embedders "go-simple-embedding-database/embedders"
+)
+
+func mockEmbed(blob []byte) ([]float64, error) {
+	return []float64{float64(bytes.Count(blob, []byte("a"))), float64(bytes.Count(blob, []byte("b"))), 1}, nil
+}
+
+// testClient is a bare bones RESP client. Replies are decoded into
+//
+//	simple strings  string
+//	errors          replyError
+//	integers        int64
+//	bulk strings    string
+//	nulls           nil
+//	doubles         float64
+//	arrays          []any
+//	maps            map[string]any
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type replyError string
+
+func startServer(t *testing.T, db *database.SimpleDataBase) (*Server, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	server := MakeServer(db)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		server.Close()
+		err := <-done
+		if !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Expected Serve to return ErrServerClosed, got %v", err)
+		}
+	})
+	return server, listener.Addr().String()
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (client *testClient) send(args ...string) {
+	client.t.Helper()
+	command := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(client.conn, command)
+	if err != nil {
+		client.t.Fatalf("Could not send command: %v", err)
+	}
+}
+
+func (client *testClient) do(args ...string) any {
+	client.t.Helper()
+	client.send(args...)
+	return client.read()
+}
+
+func (client *testClient) read() any {
+	client.t.Helper()
+	reply, err := readReply(client.reader)
+	if err != nil {
+		client.t.Fatalf("Could not read reply: %v", err)
+	}
+	return reply
+}
+
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	kind, rest := line[0], line[1:]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return replyError(rest), nil
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '_':
+		return nil, nil
+	case ',':
+		return strconv.ParseFloat(rest, 64)
+	case '$':
+		length, _ := strconv.Atoi(rest)
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		_, err = io.ReadFull(r, data)
+		return string(data[:length]), err
+	case '*':
+		length, _ := strconv.Atoi(rest)
+		if length < 0 {
+			return nil, nil
+		}
+		elements := make([]any, length)
+		for i := range elements {
+			elements[i], err = readReply(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return elements, nil
+	case '%':
+		length, _ := strconv.Atoi(rest)
+		entries := make(map[string]any, length)
+		for i := 0; i < length; i++ {
+			key, err := readReply(r)
+			if err != nil {
+				return nil, err
+			}
+			entries[key.(string)], err = readReply(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return entries, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown reply type %q", kind))
+	}
+}
+
+func isError(reply any, prefix string) bool {
+	replyErr, ok := reply.(replyError)
+	return ok && strings.HasPrefix(string(replyErr), prefix)
+}
+
+// similarAbove parses a RESP2 double, which comes back as a bulk string
+func similarAbove(reply any, threshold float64) bool {
+	text, ok := reply.(string)
+	if !ok {
+		return false
+	}
+	similarity, err := strconv.ParseFloat(text, 64)
+	return err == nil && similarity > threshold
+}
+
+func TestCommands(t *testing.T) {
+	embedders.EmbedderRegister["mock-embedder"] = mockEmbed
+	_, addr := startServer(t, database.MakeDatabase())
+	client := dial(t, addr)
+
+	for _, test := range []struct {
+		args     []string
+		expected any
+	}{
+		{[]string{"PING"}, "PONG"},
+		{[]string{"ping", "hello"}, "hello"},
+		{[]string{"VCOLL.CREATE", "docs", "mock-embedder"}, "OK"},
+		{[]string{"VCOLL.CREATE", "news", "mock-embedder", "TTL", "3600"}, "OK"},
+		{[]string{"VCOLL.LIST"}, []any{"docs", "news"}},
+		{[]string{"VADD", "docs", "a", "aaa", "META", "kind", "letters", "META", "lang", "en"}, int64(1)},
+		{[]string{"VADD", "docs", "b", "bbb"}, int64(1)},
+		{[]string{"VADD", "docs", "v", "vector", "VECTOR", "1,1,1"}, int64(1)},
+		{[]string{"VADD", "docs", "b", "bb", "REPLACE"}, int64(0)},
+		{[]string{"VCOUNT", "docs"}, int64(3)},
+		{[]string{"VGET", "docs", "missing"}, nil},
+		{[]string{"VDEL", "docs", "v", "missing"}, int64(1)},
+		{[]string{"VCOUNT", "docs"}, int64(2)},
+		{[]string{"VCOLL.DROP", "news"}, "OK"},
+	} {
+		reply := client.do(test.args...)
+		if !reflect.DeepEqual(reply, test.expected) {
+			t.Errorf("%v: expected %#v, got %#v", test.args, test.expected, reply)
+		}
+	}
+
+	// RESP2 maps come back as flat arrays
+	reply := client.do("VGET", "docs", "a")
+	fields, ok := reply.([]any)
+	if !ok || len(fields) != 8 || fields[0] != "id" || fields[1] != "a" || fields[3] != "aaa" || !reflect.DeepEqual(fields[5], []any{"kind", "letters", "lang", "en"}) {
+		t.Errorf("Unexpected VGET reply %#v", reply)
+	}
+	reply = client.do("VSEARCH", "docs", "aaaa", "K", "1")
+	results, ok := reply.([]any)
+	if !ok || len(results) != 1 || results[0].([]any)[1] != "a" || !similarAbove(results[0].([]any)[3], 0.99) {
+		t.Errorf("Unexpected VSEARCH reply %#v", reply)
+	}
+
+	for _, test := range []struct {
+		args   []string
+		prefix string
+	}{
+		{[]string{"FLUSHALL"}, "ERR unknown command 'FLUSHALL'"},
+		{[]string{"VADD", "docs", "a"}, "ERR wrong number of arguments"},
+		{[]string{"VADD", "docs", "a", "aaa"}, "ERR Record already exists: a"},
+		{[]string{"VADD", "docs", "c", "ccc", "META", "k"}, "ERR syntax error"},
+		{[]string{"VADD", "docs", "c", "ccc", "VECTOR", "1,x"}, "ERR invalid vector"},
+		{[]string{"VADD", "missing", "c", "ccc"}, "ERR Collection does not exist: missing"},
+		{[]string{"VSEARCH", "docs", "a", "K", "0"}, "ERR K must be"},
+		{[]string{"VCOLL.CREATE", "docs", "mock-embedder"}, "ERR Collection already exists: docs"},
+		{[]string{"VCOLL.CREATE", "other", "no-such-embedder"}, "ERR Invalid embedder"},
+		{[]string{"HELLO", "4"}, "NOPROTO"},
+	} {
+		reply := client.do(test.args...)
+		if !isError(reply, test.prefix) {
+			t.Errorf("%v: expected an error starting %q, got %#v", test.args, test.prefix, reply)
+		}
+	}
+}
+
+func TestRESP3(t *testing.T) {
+	embedders.EmbedderRegister["mock-embedder"] = mockEmbed
+	_, addr := startServer(t, database.MakeDatabase())
+	client := dial(t, addr)
+
+	hello, ok := client.do("HELLO", "3").(map[string]any)
+	if !ok || hello["proto"] != int64(3) || hello["server"] != "sedb" {
+		t.Fatalf("Unexpected HELLO reply %#v", hello)
+	}
+	client.do("VCOLL.CREATE", "docs", "mock-embedder")
+	client.do("VADD", "docs", "a", "aa", "META", "kind", "letters")
+	client.do("VADD", "docs", "b", "bb", "META", "kind", "letters")
+	client.do("VADD", "docs", "ab", "ab")
+
+	if client.do("VGET", "docs", "missing") != nil {
+		t.Errorf("Expected a null for a missing record")
+	}
+	record, ok := client.do("VGET", "docs", "a", "WITHVECTOR").(map[string]any)
+	if !ok || record["blob"] != "aa" || !reflect.DeepEqual(record["metadata"], map[string]any{"kind": "letters"}) || !reflect.DeepEqual(record["vector"], []any{2.0, 0.0, 1.0}) {
+		t.Errorf("Unexpected VGET reply %#v", record)
+	}
+
+	reply := client.do("VSEARCH", "docs", "bb", "K", "5", "FILTER", "kind", "letters")
+	results, ok := reply.([]any)
+	if !ok || len(results) != 2 {
+		t.Fatalf("Unexpected VSEARCH reply %#v", reply)
+	}
+	first := results[0].(map[string]any)
+	if first["id"] != "b" || first["similarity"].(float64) < 0.99 || first["distance"].(float64) > 0.01 {
+		t.Errorf("Unexpected first result %#v", first)
+	}
+	reply = client.do("VSEARCH", "docs", "VECTOR", "1,0,1", "K", "1", "MINSIM", "0.5")
+	results, ok = reply.([]any)
+	if !ok || len(results) != 1 || results[0].(map[string]any)["id"] != "a" {
+		t.Errorf("Unexpected vector search reply %#v", reply)
+	}
+}
+
+func TestPipeliningAndInlineCommands(t *testing.T) {
+	_, addr := startServer(t, database.MakeDatabase())
+	client := dial(t, addr)
+
+	// several commands in one write are all answered
+	_, err := io.WriteString(client.conn, "*1\r\n$4\r\nPING\r\n*2\r\n$4\r\nECHO\r\n$2\r\nhi\r\nPING\r\n")
+	if err != nil {
+		t.Fatalf("Could not write: %v", err)
+	}
+	for _, expected := range []any{"PONG", "hi", "PONG"} {
+		reply := client.read()
+		if reply != expected {
+			t.Errorf("Expected %#v, got %#v", expected, reply)
+		}
+	}
+
+	if client.do("QUIT") != "OK" {
+		t.Errorf("Expected QUIT to reply OK")
+	}
+	_, err = client.reader.ReadByte()
+	if err != io.EOF {
+		t.Errorf("Expected the connection to be closed after QUIT, got %v", err)
+	}
+
+	client = dial(t, addr)
+	io.WriteString(client.conn, "*1\r\n$x\r\n")
+	if !isError(client.read(), "ERR Protocol error") {
+		t.Errorf("Expected a protocol error")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	embedders.EmbedderRegister["mock-embedder"] = mockEmbed
+	db := database.MakeDatabase()
+	_, addr := startServer(t, db)
+	client := dial(t, addr)
+	client.do("VCOLL.CREATE", "docs", "mock-embedder")
+	client.do("VADD", "docs", "a", "aa")
+
+	fileName := filepath.Join(t.TempDir(), "db.sedb")
+	err := db.ToBinaryFile(fileName)
+	if err != nil {
+		t.Fatalf("Could not write binary file: %v", err)
+	}
+	mapped, err := database.OpenMapped(fileName)
+	if err != nil {
+		t.Fatalf("Could not open binary file: %v", err)
+	}
+	defer mapped.Close()
+	_, addr = startServer(t, mapped)
+	client = dial(t, addr)
+	if client.do("VCOUNT", "docs") != int64(1) {
+		t.Errorf("Expected reads to work on a read-only database")
+	}
+	for _, args := range [][]string{{"VADD", "docs", "b", "bb"}, {"VDEL", "docs", "a"}, {"VCOLL.DROP", "docs"}} {
+		reply := client.do(args...)
+		if !isError(reply, "READONLY") {
+			t.Errorf("%v: expected a READONLY error, got %#v", args, reply)
+		}
+	}
+}
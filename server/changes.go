@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	database "go-simple-embedding-database/database"
+)
+
+// how often an idle change stream gets a comment, so proxies don't time it
+// out
+var keepAliveInterval = 15 * time.Second
+
+// parseChangeFilter reads a change filter from the query string:
+// collection and type can be repeated, after resumes from a sequence number.
+// An SSE client reconnecting sends the last id it saw as Last-Event-ID,
+// which takes the place of after
+func parseChangeFilter(r *http.Request) (database.ChangeFilter, error) {
+	values := r.URL.Query()
+	filter := database.ChangeFilter{Collections: values["collection"]}
+	for _, name := range values["type"] {
+		changeType, err := database.ParseChangeType(name)
+		if err != nil {
+			return filter, invalidArgument{err}
+		}
+		filter.Types = append(filter.Types, changeType)
+	}
+	after := values.Get("after")
+	if lastEventId := r.Header.Get("Last-Event-ID"); lastEventId != "" {
+		after = lastEventId
+	}
+	if after != "" {
+		sequence, err := strconv.ParseUint(after, 10, 64)
+		if err != nil {
+			return filter, invalidArgument{errors.New(fmt.Sprintf("Invalid sequence number %s", after))}
+		}
+		filter.After = sequence
+	}
+	if values.Has("buffer") {
+		buffer, err := strconv.Atoi(values.Get("buffer"))
+		if err != nil || buffer < 1 {
+			return filter, invalidArgument{errors.New(fmt.Sprintf("Invalid buffer %s", values.Get("buffer")))}
+		}
+		filter.Buffer = buffer
+	}
+	return filter, nil
+}
+
+// changes streams the change feed as Server-Sent Events. Each change is an
+// event whose id is its sequence number, whose name is its type and whose
+// data is the Change as JSON. If the subscription is closed for being slow,
+// an error event is sent before the stream ends, and the client can
+// reconnect to pick up where it left off
+func (server *Server) changes(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseChangeFilter(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	subscription, err := server.db.Subscribe(filter)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer subscription.Close()
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	err = controller.Flush()
+	if err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case change, ok := <-subscription.Changes():
+			if !ok {
+				err := subscription.Err()
+				code, reason := errorReason(err)
+				encoded, _ := json.Marshal(ErrorBody{Code: code, Reason: reason, Message: err.Error()})
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", encoded)
+				controller.Flush()
+				return
+			}
+			encoded, err := json.Marshal(change)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", change.Sequence, change.Type, encoded)
+		}
+		err = controller.Flush()
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,765 @@
+package server
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	collection "go-simple-embedding-database/collection"
+	database "go-simple-embedding-database/database"
+	embedders "go-simple-embedding-database/embedders"
+	records "go-simple-embedding-database/records"
+	storage "go-simple-embedding-database/storage"
+)
+
+// ChromaServer serves the part of Chroma's v1 REST API that chromadb's
+// HttpClient needs: heartbeat, collections, add, upsert, get, delete, query
+// and count. It maps onto the database like this:
+//
+//   - a Chroma collection's name is the collection ID. Its Chroma ID is a UUID
+//     derived from the name, and either can be used in URLs
+//   - documents are record blobs
+//   - metadata values are stored as strings, so numbers and bools come back
+//     as strings
+//   - distances are cosine distances (Chroma's "hnsw:space": "cosine")
+//   - where filters can only test for equality ({"k": v}, {"k": {"$eq": v}}
+//     and $and of those), and where_document isn't supported
+//
+// There's only one tenant and one database, so every tenant and database
+// name is accepted and they all see the same collections
+type ChromaServer struct {
+	db      *database.SimpleDataBase
+	options ChromaOptions
+	mux     *http.ServeMux
+}
+
+type ChromaOptions struct {
+	// The embedder for collections created without an "embedder" metadata
+	// key. Defaults to embedders.ClientEmbedder, so those collections only
+	// take records with embeddings
+	Embedder string
+	// What the API reports as its version. Defaults to chromaVersion
+	Version string
+}
+
+// the Chroma release whose API this follows
+const chromaVersion = "0.5.0"
+
+// the most records the server takes in one add or upsert
+const chromaMaxBatchSize = 5461
+
+func MakeChromaServer(db *database.SimpleDataBase, options ChromaOptions) *ChromaServer {
+	if options.Embedder == "" {
+		options.Embedder = embedders.ClientEmbedder
+	}
+	if options.Version == "" {
+		options.Version = chromaVersion
+	}
+	server := &ChromaServer{db: db, options: options, mux: http.NewServeMux()}
+	server.mux.HandleFunc("GET /api/v1", server.heartbeat)
+	server.mux.HandleFunc("GET /api/v1/heartbeat", server.heartbeat)
+	server.mux.HandleFunc("GET /api/v1/version", server.version)
+	server.mux.HandleFunc("GET /api/v1/pre-flight-checks", server.preFlightChecks)
+	server.mux.HandleFunc("POST /api/v1/tenants", server.accept)
+	server.mux.HandleFunc("GET /api/v1/tenants/{tenant}", server.getTenant)
+	server.mux.HandleFunc("POST /api/v1/databases", server.accept)
+	server.mux.HandleFunc("GET /api/v1/databases/{database}", server.getDatabase)
+	server.mux.HandleFunc("GET /api/v1/collections", server.listCollections)
+	server.mux.HandleFunc("GET /api/v1/count_collections", server.countCollections)
+	server.mux.HandleFunc("POST /api/v1/collections", server.createCollection)
+	server.mux.HandleFunc("GET /api/v1/collections/{name}", server.getCollection)
+	server.mux.HandleFunc("DELETE /api/v1/collections/{name}", server.deleteCollection)
+	server.mux.HandleFunc("POST /api/v1/collections/{id}/add", server.add)
+	server.mux.HandleFunc("POST /api/v1/collections/{id}/upsert", server.upsert)
+	server.mux.HandleFunc("POST /api/v1/collections/{id}/get", server.get)
+	server.mux.HandleFunc("POST /api/v1/collections/{id}/delete", server.delete)
+	server.mux.HandleFunc("POST /api/v1/collections/{id}/query", server.query)
+	server.mux.HandleFunc("GET /api/v1/collections/{id}/count", server.count)
+	return server
+}
+
+func (server *ChromaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mux.ServeHTTP(w, r)
+}
+
+// Chroma's clients turn the error name into an exception class
+var chromaErrorNames = map[string]string{
+	CodeInvalidArgument:  "InvalidArgumentError",
+	CodeUnauthenticated:  "AuthorizationError",
+	CodeReadOnly:         "AuthorizationError",
+	CodePermissionDenied: "AuthorizationError",
+	CodeNotFound:         "NotFoundError",
+	CodeAlreadyExists:    "UniqueConstraintError",
+	CodeGone:             "ChromaError",
+	CodeQuotaExceeded:    "QuotaError",
+	CodeInternal:         "ChromaError",
+	CodeUnavailable:      "ChromaError",
+}
+
+func writeChromaError(w http.ResponseWriter, err error) {
+	code := errorCode(err)
+	writeJSON(w, codeStatus[code], map[string]string{"error": chromaErrorNames[code], "message": err.Error()})
+}
+
+type chromaCollection struct {
+	Id       string         `json:"id"`
+	Name     string         `json:"name"`
+	Metadata map[string]any `json:"metadata"`
+	Tenant   string         `json:"tenant"`
+	Database string         `json:"database"`
+}
+
+const (
+	defaultTenant   = "default_tenant"
+	defaultDatabase = "default_database"
+)
+
+// chromaId makes a UUID (version 5 style) out of a collection name, so a
+// collection keeps the same Chroma ID for as long as it exists
+func chromaId(name string) string {
+	sum := sha1.Sum([]byte("sedb/collections/" + name))
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+func makeChromaCollection(info storage.CollectionInfo, r *http.Request) chromaCollection {
+	tenant, databaseName := r.URL.Query().Get("tenant"), r.URL.Query().Get("database")
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	if databaseName == "" {
+		databaseName = defaultDatabase
+	}
+	return chromaCollection{Id: chromaId(info.Id), Name: info.Id, Metadata: map[string]any{"embedder": info.EmbedderId, "hnsw:space": "cosine"}, Tenant: tenant, Database: databaseName}
+}
+
+// collectionId finds the collection a URL refers to, by name or Chroma ID
+func (server *ChromaServer) collectionId(idOrName string) (string, error) {
+	infos := server.db.ListCollections()
+	for _, info := range infos {
+		if info.Id == idOrName {
+			return info.Id, nil
+		}
+	}
+	for _, info := range infos {
+		if chromaId(info.Id) == idOrName {
+			return info.Id, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", collection.ErrCollectionNotFound, idOrName)
+}
+
+func (server *ChromaServer) heartbeat(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]int64{"nanosecond heartbeat": time.Now().UnixNano()})
+}
+
+func (server *ChromaServer) version(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, server.options.Version)
+}
+
+func (server *ChromaServer) preFlightChecks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]int{"max_batch_size": chromaMaxBatchSize})
+}
+
+// accept answers requests to create tenants and databases, which always
+// exist
+func (server *ChromaServer) accept(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{})
+}
+
+func (server *ChromaServer) getTenant(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"name": r.PathValue("tenant")})
+}
+
+func (server *ChromaServer) getDatabase(w http.ResponseWriter, r *http.Request) {
+	tenant := r.URL.Query().Get("tenant")
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"id": chromaId(tenant + "/" + r.PathValue("database")), "name": r.PathValue("database"), "tenant": tenant})
+}
+
+func (server *ChromaServer) listCollections(w http.ResponseWriter, r *http.Request) {
+	infos := server.db.ListCollections()
+	offset, limit, err := offsetAndLimit(r.URL.Query().Get("offset"), r.URL.Query().Get("limit"))
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	infos = page(infos, offset, limit)
+	collections := make([]chromaCollection, 0, len(infos))
+	for _, info := range infos {
+		collections = append(collections, makeChromaCollection(info, r))
+	}
+	writeJSON(w, http.StatusOK, collections)
+}
+
+func offsetAndLimit(offsetParam string, limitParam string) (int, int, error) {
+	offset, limit := 0, 0
+	var err error
+	if offsetParam != "" {
+		offset, err = strconv.Atoi(offsetParam)
+		if err != nil || offset < 0 {
+			return 0, 0, invalidArgument{errors.New(fmt.Sprintf("Invalid offset %s", offsetParam))}
+		}
+	}
+	if limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 0 {
+			return 0, 0, invalidArgument{errors.New(fmt.Sprintf("Invalid limit %s", limitParam))}
+		}
+	}
+	return offset, limit, nil
+}
+
+// page skips offset values and keeps at most limit (0 for no limit) of the
+// rest
+func page[V any](values []V, offset int, limit int) []V {
+	if offset >= len(values) {
+		return values[:0]
+	}
+	values = values[offset:]
+	if limit > 0 && limit < len(values) {
+		values = values[:limit]
+	}
+	return values
+}
+
+func (server *ChromaServer) countCollections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, len(server.db.ListCollections()))
+}
+
+type chromaCreateRequest struct {
+	Name        string         `json:"name"`
+	Metadata    map[string]any `json:"metadata"`
+	GetOrCreate bool           `json:"get_or_create"`
+}
+
+func (server *ChromaServer) createCollection(w http.ResponseWriter, r *http.Request) {
+	request := chromaCreateRequest{}
+	err := readJSON(r, &request)
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	if request.GetOrCreate {
+		coll, err := server.db.GetCollection(request.Name)
+		if err == nil {
+			writeJSON(w, http.StatusOK, makeChromaCollection(storage.Info(*coll), r))
+			return
+		}
+	}
+	embedderId := server.options.Embedder
+	embedder, ok := request.Metadata["embedder"]
+	if ok {
+		embedderId = fmt.Sprint(embedder)
+	}
+	if request.Name == "" {
+		writeChromaError(w, invalidArgument{errors.New("Collection name must not be empty")})
+		return
+	}
+	coll, err := collection.MakeCollection(request.Name, embedderId)
+	if err != nil {
+		writeChromaError(w, invalidArgument{err})
+		return
+	}
+	err = server.db.AddCollection(coll)
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, makeChromaCollection(storage.Info(*coll), r))
+}
+
+func (server *ChromaServer) getCollection(w http.ResponseWriter, r *http.Request) {
+	collectionId, err := server.collectionId(r.PathValue("name"))
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	coll, err := server.db.GetCollection(collectionId)
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, makeChromaCollection(storage.Info(*coll), r))
+}
+
+func (server *ChromaServer) deleteCollection(w http.ResponseWriter, r *http.Request) {
+	collectionId, err := server.collectionId(r.PathValue("name"))
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	err = server.db.DeleteCollection(collectionId)
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nil)
+}
+
+// chromaRecords is the column-oriented body of add and upsert. The columns
+// that are there must be as long as ids
+type chromaRecords struct {
+	Ids        []string         `json:"ids"`
+	Embeddings [][]float64      `json:"embeddings"`
+	Metadatas  []map[string]any `json:"metadatas"`
+	Documents  []*string        `json:"documents"`
+}
+
+// metadataString turns a Chroma metadata value into the string it's stored
+// (or compared) as
+func metadataString(value any) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	default:
+		return "", invalidArgument{errors.New(fmt.Sprintf("Unsupported metadata value %v", value))}
+	}
+}
+
+func chromaMetadata(metadata map[string]string) map[string]any {
+	if len(metadata) == 0 {
+		return nil
+	}
+	converted := make(map[string]any, len(metadata))
+	for key, value := range metadata {
+		converted[key] = value
+	}
+	return converted
+}
+
+// makeRecords turns the columns into records, embedding the documents of any
+// records that come without an embedding
+func (server *ChromaServer) makeRecords(collectionId string, columns chromaRecords) ([]*records.Record, error) {
+	coll, err := server.db.GetCollection(collectionId)
+	if err != nil {
+		return nil, err
+	}
+	n := len(columns.Ids)
+	if n > chromaMaxBatchSize {
+		return nil, invalidArgument{errors.New(fmt.Sprintf("Cannot add %d records at once (the most is %d)", n, chromaMaxBatchSize))}
+	}
+	for name, length := range map[string]int{"embeddings": len(columns.Embeddings), "metadatas": len(columns.Metadatas), "documents": len(columns.Documents)} {
+		if length != 0 && length != n {
+			return nil, invalidArgument{errors.New(fmt.Sprintf("Got %d ids but %d %s", n, length, name))}
+		}
+	}
+
+	added := make([]*records.Record, n)
+	seen := make(map[string]bool, n)
+	toEmbed := make([]int, 0)
+	for i, id := range columns.Ids {
+		if seen[id] {
+			return nil, invalidArgument{errors.New(fmt.Sprintf("Record ID %s appears more than once", id))}
+		}
+		seen[id] = true
+		record := &records.Record{Id: id, EmbedderId: coll.EmbedderId}
+		if len(columns.Documents) > 0 && columns.Documents[i] != nil {
+			record.Blob = []byte(*columns.Documents[i])
+		}
+		if len(columns.Metadatas) > 0 && len(columns.Metadatas[i]) > 0 {
+			record.Metadata = make(map[string]string, len(columns.Metadatas[i]))
+			for key, value := range columns.Metadatas[i] {
+				record.Metadata[key], err = metadataString(value)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if len(columns.Embeddings) > 0 && columns.Embeddings[i] != nil {
+			record.Embedding = columns.Embeddings[i]
+		} else if len(columns.Documents) > 0 && columns.Documents[i] != nil {
+			toEmbed = append(toEmbed, i)
+		} else {
+			return nil, invalidArgument{errors.New(fmt.Sprintf("Record %s has neither an embedding nor a document", id))}
+		}
+		added[i] = record
+	}
+
+	if len(toEmbed) > 0 {
+		embed, err := embedders.GetBatchEmbedderFunc(coll.EmbedderId)
+		if err != nil {
+			return nil, err
+		}
+		blobs := make([][]byte, len(toEmbed))
+		for j, i := range toEmbed {
+			blobs[j] = added[i].Blob
+		}
+		embeddings, err := embed(blobs)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range toEmbed {
+			added[i].Embedding = embeddings[j]
+		}
+	}
+	return added, nil
+}
+
+// add skips records whose IDs are already in the collection, the way Chroma
+// does. Records are written one at a time, so if one fails the ones before
+// it stay written
+func (server *ChromaServer) add(w http.ResponseWriter, r *http.Request) {
+	server.write(w, r, func(collectionId string, record *records.Record) error {
+		err := server.db.AddRecord(collectionId, record)
+		if err != nil && errorCode(err) == CodeAlreadyExists {
+			return nil
+		}
+		return err
+	})
+}
+
+func (server *ChromaServer) upsert(w http.ResponseWriter, r *http.Request) {
+	server.write(w, r, server.db.UpsertRecord)
+}
+
+func (server *ChromaServer) write(w http.ResponseWriter, r *http.Request, put func(collectionId string, record *records.Record) error) {
+	collectionId, err := server.collectionId(r.PathValue("id"))
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	columns := chromaRecords{}
+	err = readJSON(r, &columns)
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	added, err := server.makeRecords(collectionId, columns)
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	for _, record := range added {
+		err = put(collectionId, record)
+		if err != nil {
+			writeChromaError(w, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusCreated, true)
+}
+
+// parseWhere turns a Chroma where filter into the metadata the records have
+// to match
+func parseWhere(where map[string]any) (map[string]string, error) {
+	if len(where) == 0 {
+		return nil, nil
+	}
+	matches := make(map[string]string)
+	err := addWhere(matches, where)
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+func addWhere(matches map[string]string, where map[string]any) error {
+	for key, value := range where {
+		if key == "$and" {
+			clauses, ok := value.([]any)
+			if !ok {
+				return invalidArgument{errors.New("$and takes a list of filters")}
+			}
+			for _, clause := range clauses {
+				clause, ok := clause.(map[string]any)
+				if !ok {
+					return invalidArgument{errors.New("$and takes a list of filters")}
+				}
+				err := addWhere(matches, clause)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		operator, ok := value.(map[string]any)
+		if ok {
+			equals, ok := operator["$eq"]
+			if len(operator) != 1 || !ok {
+				return invalidArgument{errors.New(fmt.Sprintf("Unsupported filter on %s (only $eq is supported)", key))}
+			}
+			value = equals
+		}
+		matched, err := metadataString(value)
+		if err != nil {
+			return err
+		}
+		existing, ok := matches[key]
+		if ok && existing != matched {
+			return invalidArgument{errors.New(fmt.Sprintf("Filter needs %s to be both %s and %s", key, existing, matched))}
+		}
+		matches[key] = matched
+	}
+	return nil
+}
+
+type chromaFilter struct {
+	Ids           []string       `json:"ids"`
+	Where         map[string]any `json:"where"`
+	WhereDocument map[string]any `json:"where_document"`
+}
+
+func (filter chromaFilter) parse() (map[string]string, error) {
+	if len(filter.WhereDocument) > 0 {
+		return nil, invalidArgument{errors.New("where_document is not supported")}
+	}
+	return parseWhere(filter.Where)
+}
+
+// find returns the records matching the filter in ID order, skipping the
+// first offset and keeping at most limit (0 for no limit)
+func (server *ChromaServer) find(collectionId string, filter chromaFilter, offset int, limit int) ([]records.Record, error) {
+	where, err := filter.parse()
+	if err != nil {
+		return nil, err
+	}
+	if filter.Ids == nil {
+		listLimit := 0
+		if limit > 0 {
+			listLimit = offset + limit
+		}
+		listed, err := server.db.ListRecords(collectionId, collection.ListOptions{Limit: listLimit, Where: where})
+		if err != nil {
+			return nil, err
+		}
+		return page(listed.Records, offset, limit), nil
+	}
+	found := make([]records.Record, 0, len(filter.Ids))
+	for _, id := range filter.Ids {
+		record, err := server.db.GetRecord(collectionId, id)
+		if err != nil {
+			if errorCode(err) == CodeNotFound {
+				continue
+			}
+			return nil, err
+		}
+		if record.MatchesMetadata(where) {
+			found = append(found, *record)
+		}
+	}
+	return page(found, offset, limit), nil
+}
+
+type chromaGetRequest struct {
+	chromaFilter
+	Limit   int      `json:"limit"`
+	Offset  int      `json:"offset"`
+	Include []string `json:"include"`
+}
+
+// chromaResult is the column-oriented response to get. Columns that weren't
+// asked for are null
+type chromaResult struct {
+	Ids        []string         `json:"ids"`
+	Embeddings [][]float64      `json:"embeddings"`
+	Metadatas  []map[string]any `json:"metadatas"`
+	Documents  []string         `json:"documents"`
+	Uris       []string         `json:"uris"`
+	Data       []any            `json:"data"`
+	Included   []string         `json:"included"`
+}
+
+func included(include []string) (map[string]bool, error) {
+	set := make(map[string]bool, len(include))
+	for _, column := range include {
+		switch column {
+		case "embeddings", "metadatas", "documents", "distances", "uris", "data":
+			set[column] = true
+		default:
+			return nil, invalidArgument{errors.New(fmt.Sprintf("Unknown include %s", column))}
+		}
+	}
+	return set, nil
+}
+
+func makeChromaResult(found []records.Record, include map[string]bool, includeList []string) chromaResult {
+	result := chromaResult{Ids: make([]string, len(found)), Included: includeList}
+	if include["embeddings"] {
+		result.Embeddings = make([][]float64, len(found))
+	}
+	if include["metadatas"] {
+		result.Metadatas = make([]map[string]any, len(found))
+	}
+	if include["documents"] {
+		result.Documents = make([]string, len(found))
+	}
+	for i, record := range found {
+		result.Ids[i] = record.Id
+		if result.Embeddings != nil {
+			result.Embeddings[i] = record.Embedding
+		}
+		if result.Metadatas != nil {
+			result.Metadatas[i] = chromaMetadata(record.Metadata)
+		}
+		if result.Documents != nil {
+			result.Documents[i] = string(record.Blob)
+		}
+	}
+	return result
+}
+
+func (server *ChromaServer) get(w http.ResponseWriter, r *http.Request) {
+	collectionId, err := server.collectionId(r.PathValue("id"))
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	request := chromaGetRequest{Include: []string{"metadatas", "documents"}}
+	err = readJSON(r, &request)
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	include, err := included(request.Include)
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	if request.Offset < 0 || request.Limit < 0 {
+		writeChromaError(w, invalidArgument{errors.New("Offset and limit must not be negative")})
+		return
+	}
+	found, err := server.find(collectionId, request.chromaFilter, request.Offset, request.Limit)
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, makeChromaResult(found, include, request.Include))
+}
+
+// delete sends back the IDs it deleted
+func (server *ChromaServer) delete(w http.ResponseWriter, r *http.Request) {
+	collectionId, err := server.collectionId(r.PathValue("id"))
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	filter := chromaFilter{}
+	err = readJSON(r, &filter)
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	if filter.Ids == nil && len(filter.Where) == 0 && len(filter.WhereDocument) == 0 {
+		writeChromaError(w, invalidArgument{errors.New("Delete needs ids or a where filter")})
+		return
+	}
+	found, err := server.find(collectionId, filter, 0, 0)
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	deleted := make([]string, 0, len(found))
+	for _, record := range found {
+		err = server.db.DeleteRecord(collectionId, record.Id)
+		if err != nil {
+			writeChromaError(w, err)
+			return
+		}
+		deleted = append(deleted, record.Id)
+	}
+	writeJSON(w, http.StatusOK, deleted)
+}
+
+type chromaQueryRequest struct {
+	QueryEmbeddings [][]float64    `json:"query_embeddings"`
+	NResults        int            `json:"n_results"`
+	Where           map[string]any `json:"where"`
+	WhereDocument   map[string]any `json:"where_document"`
+	Include         []string       `json:"include"`
+}
+
+// chromaQueryResult has a row of results for each query embedding
+type chromaQueryResult struct {
+	Ids        [][]string         `json:"ids"`
+	Distances  [][]float64        `json:"distances"`
+	Embeddings [][][]float64      `json:"embeddings"`
+	Metadatas  [][]map[string]any `json:"metadatas"`
+	Documents  [][]string         `json:"documents"`
+	Uris       [][]string         `json:"uris"`
+	Data       []any              `json:"data"`
+	Included   []string           `json:"included"`
+}
+
+func (server *ChromaServer) query(w http.ResponseWriter, r *http.Request) {
+	collectionId, err := server.collectionId(r.PathValue("id"))
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	request := chromaQueryRequest{NResults: 10, Include: []string{"metadatas", "documents", "distances"}}
+	err = readJSON(r, &request)
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	include, err := included(request.Include)
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	where, err := chromaFilter{Where: request.Where, WhereDocument: request.WhereDocument}.parse()
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	if request.NResults <= 0 {
+		writeChromaError(w, invalidArgument{errors.New(fmt.Sprintf("n_results must be positive (got %d)", request.NResults))})
+		return
+	}
+
+	result := chromaQueryResult{Ids: make([][]string, 0, len(request.QueryEmbeddings)), Included: request.Include}
+	for _, queryEmbedding := range request.QueryEmbeddings {
+		results, err := server.db.QueryVector(collectionId, queryEmbedding, collection.QueryOptions{NGreatest: request.NResults, Where: where})
+		if err != nil {
+			writeChromaError(w, err)
+			return
+		}
+		found := make([]records.Record, len(results))
+		distances := make([]float64, len(results))
+		for i, queryResult := range results {
+			found[i] = queryResult.Record
+			distances[i] = queryResult.Distance
+		}
+		row := makeChromaResult(found, include, request.Include)
+		result.Ids = append(result.Ids, row.Ids)
+		if include["distances"] {
+			result.Distances = append(result.Distances, distances)
+		}
+		if include["embeddings"] {
+			result.Embeddings = append(result.Embeddings, row.Embeddings)
+		}
+		if include["metadatas"] {
+			result.Metadatas = append(result.Metadatas, row.Metadatas)
+		}
+		if include["documents"] {
+			result.Documents = append(result.Documents, row.Documents)
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (server *ChromaServer) count(w http.ResponseWriter, r *http.Request) {
+	collectionId, err := server.collectionId(r.PathValue("id"))
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	count, err := server.db.Count(collectionId)
+	if err != nil {
+		writeChromaError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, count)
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	database "go-simple-embedding-database/database"
+	embedders "go-simple-embedding-database/embedders"
+)
+
+// chromaCall sends a request the way chromadb's HttpClient would and decodes
+// the response into out
+func chromaCall(t *testing.T, handler http.Handler, method string, target string, body string, out any) int {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, target, strings.NewReader(body)))
+	if out != nil {
+		err := json.Unmarshal(recorder.Body.Bytes(), out)
+		if err != nil {
+			t.Fatalf("%s %s: could not decode %s: %v", method, target, recorder.Body, err)
+		}
+	}
+	return recorder.Code
+}
+
+func TestChromaCollections(t *testing.T) {
+	embedders.EmbedderRegister["mock-embedder"] = mockEmbed
+	db := database.MakeDatabase()
+	handler := MakeChromaServer(db, ChromaOptions{})
+
+	heartbeat := map[string]int64{}
+	status := chromaCall(t, handler, "GET", "/api/v1/heartbeat", "", &heartbeat)
+	if status != http.StatusOK || heartbeat["nanosecond heartbeat"] == 0 {
+		t.Errorf("Unexpected heartbeat %d %v", status, heartbeat)
+	}
+	tenant := map[string]string{}
+	chromaCall(t, handler, "GET", "/api/v1/tenants/default_tenant", "", &tenant)
+	if tenant["name"] != "default_tenant" {
+		t.Errorf("Unexpected tenant %v", tenant)
+	}
+
+	created := chromaCollection{}
+	status = chromaCall(t, handler, "POST", "/api/v1/collections?tenant=default_tenant&database=default_database", `{"name": "docs", "metadata": null, "get_or_create": false}`, &created)
+	if status != http.StatusOK || created.Name != "docs" || created.Id != chromaId("docs") || created.Metadata["embedder"] != embedders.ClientEmbedder {
+		t.Fatalf("Unexpected collection %d %+v", status, created)
+	}
+	chromaCall(t, handler, "POST", "/api/v1/collections", `{"name": "mocked", "metadata": {"embedder": "mock-embedder"}}`, nil)
+	errorBody := map[string]string{}
+	status = chromaCall(t, handler, "POST", "/api/v1/collections", `{"name": "docs"}`, &errorBody)
+	if status != http.StatusConflict || errorBody["error"] != "UniqueConstraintError" {
+		t.Errorf("Expected a UniqueConstraintError, got %d %v", status, errorBody)
+	}
+	status = chromaCall(t, handler, "POST", "/api/v1/collections", `{"name": "docs", "get_or_create": true}`, &created)
+	if status != http.StatusOK || created.Id != chromaId("docs") {
+		t.Errorf("Expected get_or_create to return the existing collection, got %d %+v", status, created)
+	}
+
+	got := chromaCollection{}
+	chromaCall(t, handler, "GET", "/api/v1/collections/docs", "", &got)
+	if !reflect.DeepEqual(got, created) {
+		t.Errorf("Not equal (expected %+v, got %+v)", created, got)
+	}
+	listed := []chromaCollection{}
+	chromaCall(t, handler, "GET", "/api/v1/collections?limit=1&offset=1", "", &listed)
+	if len(listed) != 1 || listed[0].Name != "mocked" {
+		t.Errorf("Unexpected collections %+v", listed)
+	}
+	count := 0
+	chromaCall(t, handler, "GET", "/api/v1/count_collections", "", &count)
+	if count != 2 {
+		t.Errorf("Expected 2 collections, got %d", count)
+	}
+
+	status = chromaCall(t, handler, "DELETE", "/api/v1/collections/mocked", "", nil)
+	if status != http.StatusOK {
+		t.Errorf("Could not delete collection: %d", status)
+	}
+	status = chromaCall(t, handler, "GET", "/api/v1/collections/mocked", "", &errorBody)
+	if status != http.StatusNotFound || errorBody["error"] != "NotFoundError" {
+		t.Errorf("Expected a NotFoundError, got %d %v", status, errorBody)
+	}
+}
+
+func TestChromaRecords(t *testing.T) {
+	embedders.EmbedderRegister["mock-embedder"] = mockEmbed
+	db := database.MakeDatabase()
+	handler := MakeChromaServer(db, ChromaOptions{})
+	chromaCall(t, handler, "POST", "/api/v1/collections", `{"name": "docs", "metadata": {"embedder": "mock-embedder"}}`, nil)
+	base := "/api/v1/collections/" + chromaId("docs")
+
+	status := chromaCall(t, handler, "POST", base+"/add", `{
+		"ids": ["a", "b", "ab"],
+		"embeddings": [[1, 0, 1], [0, 1, 1], null],
+		"metadatas": [{"lang": "en", "page": 1}, {"lang": "fr", "draft": true}, null],
+		"documents": ["aa", "bb", "ab"],
+		"uris": null
+	}`, nil)
+	if status != http.StatusCreated {
+		t.Fatalf("Could not add records: %d", status)
+	}
+	// adding an existing ID is skipped, the way Chroma does it
+	status = chromaCall(t, handler, "POST", base+"/add", `{"ids": ["a"], "documents": ["changed"]}`, nil)
+	if status != http.StatusCreated {
+		t.Errorf("Expected adding an existing ID to be skipped, got %d", status)
+	}
+	record, _ := db.GetRecord("docs", "ab")
+	if record == nil || !reflect.DeepEqual(record.Embedding, []float64{1, 1, 1}) {
+		t.Errorf("Expected the document without an embedding to be embedded, got %v", record)
+	}
+	count := 0
+	chromaCall(t, handler, "GET", base+"/count", "", &count)
+	if count != 3 {
+		t.Errorf("Expected 3 records, got %d", count)
+	}
+
+	result := chromaResult{}
+	chromaCall(t, handler, "POST", base+"/get", `{"ids": ["b", "a", "missing"], "include": ["metadatas", "documents", "embeddings"]}`, &result)
+	expected := chromaResult{
+		Ids:        []string{"b", "a"},
+		Embeddings: [][]float64{{0, 1, 1}, {1, 0, 1}},
+		Metadatas:  []map[string]any{{"lang": "fr", "draft": "true"}, {"lang": "en", "page": "1"}},
+		Documents:  []string{"bb", "aa"},
+		Included:   []string{"metadatas", "documents", "embeddings"},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Not equal (expected %+v, got %+v)", expected, result)
+	}
+	result = chromaResult{}
+	chromaCall(t, handler, "POST", base+"/get", `{"where": {"$and": [{"lang": {"$eq": "en"}}, {"page": 1}]}}`, &result)
+	if !reflect.DeepEqual(result.Ids, []string{"a"}) || result.Embeddings != nil || len(result.Documents) != 1 {
+		t.Errorf("Unexpected filtered get %+v", result)
+	}
+	result = chromaResult{}
+	chromaCall(t, handler, "POST", base+"/get", `{"limit": 1, "offset": 1, "include": []}`, &result)
+	if !reflect.DeepEqual(result.Ids, []string{"ab"}) || result.Metadatas != nil || result.Documents != nil {
+		t.Errorf("Unexpected paged get %+v", result)
+	}
+
+	queried := chromaQueryResult{}
+	status = chromaCall(t, handler, "POST", base+"/query", `{"query_embeddings": [[1, 0, 1], [0, 1, 1]], "n_results": 2, "include": ["distances", "documents"]}`, &queried)
+	if status != http.StatusOK {
+		t.Fatalf("Could not query: %d", status)
+	}
+	if !reflect.DeepEqual(queried.Ids, [][]string{{"a", "ab"}, {"b", "ab"}}) || queried.Metadatas != nil {
+		t.Errorf("Unexpected query results %+v", queried)
+	}
+	if len(queried.Distances) != 2 || queried.Distances[0][0] > 1e-9 || queried.Distances[0][1] <= queried.Distances[0][0] {
+		t.Errorf("Expected ascending cosine distances, got %v", queried.Distances)
+	}
+	errorBody := map[string]string{}
+	status = chromaCall(t, handler, "POST", base+"/query", `{"query_embeddings": [[1, 0, 1]], "where": {"page": {"$gt": 0}}}`, &errorBody)
+	if status != http.StatusBadRequest || errorBody["error"] != "InvalidArgumentError" {
+		t.Errorf("Expected unsupported filters to be rejected, got %d %v", status, errorBody)
+	}
+
+	status = chromaCall(t, handler, "POST", base+"/upsert", `{"ids": ["a", "c"], "embeddings": [[2, 0, 1], [0, 0, 1]], "documents": ["aa", "c"]}`, nil)
+	if status != http.StatusCreated {
+		t.Fatalf("Could not upsert records: %d", status)
+	}
+	record, _ = db.GetRecord("docs", "a")
+	if record == nil || record.Embedding[0] != 2 || record.UpdatedAt.IsZero() {
+		t.Errorf("Expected the upsert to replace record a, got %v", record)
+	}
+
+	deleted := []string{}
+	chromaCall(t, handler, "POST", base+"/delete", `{"where": {"lang": "fr"}}`, &deleted)
+	if !reflect.DeepEqual(deleted, []string{"b"}) {
+		t.Errorf("Unexpected deleted IDs %v", deleted)
+	}
+	chromaCall(t, handler, "POST", base+"/delete", `{"ids": ["c", "missing"]}`, &deleted)
+	if !reflect.DeepEqual(deleted, []string{"c"}) {
+		t.Errorf("Unexpected deleted IDs %v", deleted)
+	}
+	chromaCall(t, handler, "GET", base+"/count", "", &count)
+	if count != 2 {
+		t.Errorf("Expected 2 records after deleting, got %d", count)
+	}
+}
+
+func TestChromaClientEmbedder(t *testing.T) {
+	handler := MakeChromaServer(database.MakeDatabase(), ChromaOptions{})
+	chromaCall(t, handler, "POST", "/api/v1/collections", `{"name": "docs"}`, nil)
+	errorBody := map[string]string{}
+	status := chromaCall(t, handler, "POST", "/api/v1/collections/docs/add", `{"ids": ["a"], "documents": ["needs embedding"]}`, &errorBody)
+	if status != http.StatusBadRequest {
+		t.Errorf("Expected documents without embeddings to be rejected, got %d %v", status, errorBody)
+	}
+	status = chromaCall(t, handler, "POST", "/api/v1/collections/docs/add", `{"ids": ["a", "b"], "embeddings": [[1, 2]]}`, &errorBody)
+	if status != http.StatusBadRequest {
+		t.Errorf("Expected mismatched columns to be rejected, got %d %v", status, errorBody)
+	}
+}
+
+func TestChromaErrors(t *testing.T) {
+	for code := range codeStatus {
+		if chromaErrorNames[code] == "" {
+			t.Errorf("Expected %s to have a Chroma error name", code)
+		}
+	}
+
+	// an embedder that can't be reached is worth retrying, not a bad request
+	embedders.EmbedderRegister["unreachable-embedder"] = func(blob []byte) ([]float64, error) {
+		return nil, fmt.Errorf("%w: connection refused", embedders.ErrEmbedderUnavailable)
+	}
+	handler := MakeChromaServer(database.MakeDatabase(), ChromaOptions{})
+	chromaCall(t, handler, "POST", "/api/v1/collections", `{"name": "docs", "metadata": {"embedder": "unreachable-embedder"}}`, nil)
+	errorBody := map[string]string{}
+	status := chromaCall(t, handler, "POST", "/api/v1/collections/docs/add", `{"ids": ["a"], "documents": ["needs embedding"]}`, &errorBody)
+	if status != http.StatusServiceUnavailable || errorBody["error"] != "ChromaError" {
+		t.Errorf("Expected an unavailable embedder to be a 503, got %d %v", status, errorBody)
+	}
+}
@@ -0,0 +1,438 @@
+// Package server serves a SimpleDataBase over HTTP with JSON bodies. The
+// client package talks to it.
+//
+//	GET    /collections                           list collections
+//	POST   /collections                           add a collection
+//	GET    /collections/{id}                      get a collection (without its records)
+//	DELETE /collections/{id}                      delete a collection
+//	POST   /collections/{id}/records              add a record
+//	GET    /collections/{id}/records              list records
+//	GET    /collections/{id}/records/{recordId}   get a record
+//	PUT    /collections/{id}/records/{recordId}   upsert a record
+//	DELETE /collections/{id}/records/{recordId}   delete a record
+//	POST   /collections/{id}/query                query a collection
+//	GET    /changes                               stream changes as Server-Sent Events
+//
+// TenantServer serves a tenant.Registry, with this API for each database.
+// Failed requests get an ErrorResponse body with one of the Code constants
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	collection "go-simple-embedding-database/collection"
+	database "go-simple-embedding-database/database"
+	embedders "go-simple-embedding-database/embedders"
+	records "go-simple-embedding-database/records"
+	storage "go-simple-embedding-database/storage"
+	tenant "go-simple-embedding-database/tenant"
+	utils "go-simple-embedding-database/utils"
+)
+
+// Error codes, along with the HTTP status they're sent with
+const (
+	CodeInvalidArgument  = "invalid_argument"  // 400
+	CodeUnauthenticated  = "unauthenticated"   // 401
+	CodeReadOnly         = "read_only"         // 403
+	CodePermissionDenied = "permission_denied" // 403
+	CodeNotFound         = "not_found"         // 404
+	CodeAlreadyExists    = "already_exists"    // 409
+	CodeGone             = "gone"              // 410
+	CodeQuotaExceeded    = "quota_exceeded"    // 429
+	CodeInternal         = "internal"          // 500
+	CodeUnavailable      = "unavailable"       // 503
+)
+
+var codeStatus = map[string]int{
+	CodeInvalidArgument:  http.StatusBadRequest,
+	CodeUnauthenticated:  http.StatusUnauthorized,
+	CodeReadOnly:         http.StatusForbidden,
+	CodePermissionDenied: http.StatusForbidden,
+	CodeNotFound:         http.StatusNotFound,
+	CodeAlreadyExists:    http.StatusConflict,
+	CodeGone:             http.StatusGone,
+	CodeQuotaExceeded:    http.StatusTooManyRequests,
+	CodeInternal:         http.StatusInternalServerError,
+	CodeUnavailable:      http.StatusServiceUnavailable,
+}
+
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+type ErrorBody struct {
+	Code string `json:"code"`
+	// names the error the database wrapped its error around, if it's one
+	// the server knows (see ReasonError)
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message"`
+}
+
+// QueryRequest is the body of a query. Set either Query, which is embedded
+// with the collection's embedder, or Vector
+type QueryRequest struct {
+	Query         string            `json:"query,omitempty"`
+	Vector        []float64         `json:"vector,omitempty"`
+	NGreatest     int               `json:"nGreatest,omitempty"`
+	MinSimilarity *float64          `json:"minSimilarity,omitempty"`
+	MaxDistance   *float64          `json:"maxDistance,omitempty"`
+	Where         map[string]string `json:"where,omitempty"`
+	MMR           *MMRRequest       `json:"mmr,omitempty"`
+}
+
+type MMRRequest struct {
+	Lambda float64 `json:"lambda"`
+	FetchK int     `json:"fetchK,omitempty"`
+}
+
+func MakeQueryRequest(query []byte, options collection.QueryOptions) QueryRequest {
+	request := QueryRequest{Query: string(query), NGreatest: options.NGreatest, MinSimilarity: options.MinSimilarity, MaxDistance: options.MaxDistance, Where: options.Where}
+	if options.MMR != nil {
+		request.MMR = &MMRRequest{Lambda: options.MMR.Lambda, FetchK: options.MMR.FetchK}
+	}
+	return request
+}
+
+func (request QueryRequest) Options() collection.QueryOptions {
+	options := collection.QueryOptions{NGreatest: request.NGreatest, MinSimilarity: request.MinSimilarity, MaxDistance: request.MaxDistance, Where: request.Where}
+	if request.MMR != nil {
+		options.MMR = &collection.MMROptions{Lambda: request.MMR.Lambda, FetchK: request.MMR.FetchK}
+	}
+	return options
+}
+
+// ListQuery encodes list options as the query string of a list request.
+// Where pairs are sent as where=key=value
+func ListQuery(options collection.ListOptions) url.Values {
+	values := url.Values{}
+	values.Set("order", options.OrderBy.String())
+	if options.Cursor != "" {
+		values.Set("cursor", options.Cursor)
+	}
+	if options.Limit != 0 {
+		values.Set("limit", strconv.Itoa(options.Limit))
+	}
+	for key, value := range options.Where {
+		values.Add("where", key+"="+value)
+	}
+	if options.ExcludeEmbeddings {
+		values.Set("excludeEmbeddings", "true")
+	}
+	if options.ExcludeBlobs {
+		values.Set("excludeBlobs", "true")
+	}
+	return values
+}
+
+func parseListQuery(values url.Values) (collection.ListOptions, error) {
+	options := collection.ListOptions{Cursor: values.Get("cursor")}
+	var err error
+	if values.Has("order") {
+		options.OrderBy, err = collection.ParseListOrder(values.Get("order"))
+		if err != nil {
+			return options, err
+		}
+	}
+	if values.Has("limit") {
+		options.Limit, err = strconv.Atoi(values.Get("limit"))
+		if err != nil {
+			return options, errors.New(fmt.Sprintf("Invalid limit %s", values.Get("limit")))
+		}
+	}
+	for _, pair := range values["where"] {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return options, errors.New(fmt.Sprintf("Invalid where %s (expected key=value)", pair))
+		}
+		if options.Where == nil {
+			options.Where = make(map[string]string)
+		}
+		options.Where[key] = value
+	}
+	for name, flag := range map[string]*bool{"excludeEmbeddings": &options.ExcludeEmbeddings, "excludeBlobs": &options.ExcludeBlobs} {
+		if values.Has(name) {
+			*flag, err = strconv.ParseBool(values.Get(name))
+			if err != nil {
+				return options, errors.New(fmt.Sprintf("Invalid %s %s", name, values.Get(name)))
+			}
+		}
+	}
+	return options, nil
+}
+
+// Server is an http.Handler for a database
+type Server struct {
+	db  *database.SimpleDataBase
+	mux *http.ServeMux
+}
+
+func MakeServer(db *database.SimpleDataBase) *Server {
+	server := &Server{db: db, mux: http.NewServeMux()}
+	server.mux.HandleFunc("GET /collections", server.listCollections)
+	server.mux.HandleFunc("POST /collections", server.addCollection)
+	server.mux.HandleFunc("GET /collections/{id}", server.getCollection)
+	server.mux.HandleFunc("DELETE /collections/{id}", server.deleteCollection)
+	server.mux.HandleFunc("POST /collections/{id}/records", server.addRecord)
+	server.mux.HandleFunc("GET /collections/{id}/records", server.listRecords)
+	server.mux.HandleFunc("GET /collections/{id}/records/{recordId}", server.getRecord)
+	server.mux.HandleFunc("PUT /collections/{id}/records/{recordId}", server.upsertRecord)
+	server.mux.HandleFunc("DELETE /collections/{id}/records/{recordId}", server.deleteRecord)
+	server.mux.HandleFunc("POST /collections/{id}/query", server.query)
+	server.mux.HandleFunc("GET /changes", server.changes)
+	return server
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mux.ServeHTTP(w, r)
+}
+
+// invalidArgument marks an error as the caller's fault
+type invalidArgument struct {
+	err error
+}
+
+func (e invalidArgument) Error() string {
+	return e.err.Error()
+}
+
+func (e invalidArgument) Unwrap() error {
+	return e.err
+}
+
+// errorCodes maps the errors the database and the packages under it wrap
+// their errors around to codes, and to reasons naming each of them
+var errorCodes = []struct {
+	target error
+	code   string
+	reason string
+}{
+	{database.ErrReadOnly, CodeReadOnly, "read_only"},
+	{database.ErrChangesGone, CodeGone, "changes_gone"},
+	{database.ErrQuotaExceeded, CodeQuotaExceeded, "quota_exceeded"},
+	{collection.ErrCollectionNotFound, CodeNotFound, "collection_not_found"},
+	{collection.ErrRecordNotFound, CodeNotFound, "record_not_found"},
+	{database.ErrChangeFeedNotEnabled, CodeNotFound, "change_feed_not_enabled"},
+	{database.ErrBackupsNotEnabled, CodeNotFound, "backups_not_enabled"},
+	{database.ErrSnapshotNotFound, CodeNotFound, "snapshot_not_found"},
+	{tenant.ErrTenantNotFound, CodeNotFound, "tenant_not_found"},
+	{tenant.ErrDatabaseNotFound, CodeNotFound, "database_not_found"},
+	{collection.ErrCollectionExists, CodeAlreadyExists, "collection_exists"},
+	{collection.ErrRecordExists, CodeAlreadyExists, "record_exists"},
+	{tenant.ErrTenantExists, CodeAlreadyExists, "tenant_exists"},
+	{tenant.ErrDatabaseExists, CodeAlreadyExists, "database_exists"},
+	{collection.ErrEmbedderMismatch, CodeInvalidArgument, "embedder_mismatch"},
+	{collection.ErrMissingEmbedding, CodeInvalidArgument, "missing_embedding"},
+	{collection.ErrMissingRecordId, CodeInvalidArgument, "missing_record_id"},
+	{collection.ErrInvalidOptions, CodeInvalidArgument, "invalid_options"},
+	{collection.ErrInvalidCursor, CodeInvalidArgument, "invalid_cursor"},
+	{utils.ErrDimensionMismatch, CodeInvalidArgument, "dimension_mismatch"},
+	{embedders.ErrUnknownEmbedder, CodeInvalidArgument, "unknown_embedder"},
+	{embedders.ErrClientEmbedder, CodeInvalidArgument, "client_embedder"},
+	{database.ErrFutureChange, CodeInvalidArgument, "future_change"},
+	{database.ErrInvalidSchedule, CodeInvalidArgument, "invalid_schedule"},
+	{tenant.ErrInvalidName, CodeInvalidArgument, "invalid_name"},
+	{embedders.ErrEmbedderUnavailable, CodeUnavailable, "embedder_unavailable"},
+}
+
+// ReasonError returns the error an ErrorBody's Reason names, or nil if
+// there isn't one, so clients can map errors back to it
+func ReasonError(reason string) error {
+	for _, match := range errorCodes {
+		if match.reason == reason {
+			return match.target
+		}
+	}
+	return nil
+}
+
+// errorCode works out the code for an error coming back from the database
+func errorCode(err error) string {
+	code, _ := errorReason(err)
+	return code
+}
+
+// errorReason works out the code for an error coming back from the
+// database, and the reason naming the error it wraps
+func errorReason(err error) (code string, reason string) {
+	code = CodeInternal
+	for _, match := range errorCodes {
+		if errors.Is(err, match.target) {
+			code, reason = match.code, match.reason
+			break
+		}
+	}
+	// the request was at fault, whatever the error it wraps
+	if errors.As(err, &invalidArgument{}) && code != CodeInvalidArgument {
+		code, reason = CodeInvalidArgument, ""
+	}
+	return code, reason
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code, reason := errorReason(err)
+	writeJSON(w, codeStatus[code], ErrorResponse{Error: ErrorBody{Code: code, Reason: reason, Message: strings.TrimSpace(err.Error())}})
+}
+
+func readJSON(r *http.Request, value any) error {
+	err := json.NewDecoder(io.LimitReader(r.Body, maxBodySize)).Decode(value)
+	if err != nil {
+		return invalidArgument{fmt.Errorf("Could not decode request body: %w", err)}
+	}
+	return nil
+}
+
+// the largest request body the server will read, 64 MiB
+const maxBodySize = 64 << 20
+
+func (server *Server) listCollections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, server.db.ListCollections())
+}
+
+func (server *Server) addCollection(w http.ResponseWriter, r *http.Request) {
+	coll := collection.Collection{}
+	err := readJSON(r, &coll)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if coll.Id == "" {
+		writeError(w, invalidArgument{errors.New("Collection ID must not be empty")})
+		return
+	}
+	_, err = embedders.GetEmbedderFunc(coll.EmbedderId)
+	if err != nil {
+		writeError(w, invalidArgument{err})
+		return
+	}
+	if coll.Records == nil {
+		coll.Records = make(map[string]records.Record)
+	}
+	err = server.db.AddCollection(&coll)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, storage.Info(coll))
+}
+
+func (server *Server) getCollection(w http.ResponseWriter, r *http.Request) {
+	coll, err := server.db.GetCollection(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, storage.Info(*coll))
+}
+
+func (server *Server) deleteCollection(w http.ResponseWriter, r *http.Request) {
+	err := server.db.DeleteCollection(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// addRecord and upsertRecord send back the record as stored, so the caller
+// can see the times the collection gave it
+func (server *Server) addRecord(w http.ResponseWriter, r *http.Request) {
+	record := records.Record{}
+	err := readJSON(r, &record)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	err = server.db.AddRecord(r.PathValue("id"), &record)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, record)
+}
+
+func (server *Server) upsertRecord(w http.ResponseWriter, r *http.Request) {
+	record := records.Record{}
+	err := readJSON(r, &record)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if record.Id != r.PathValue("recordId") {
+		writeError(w, invalidArgument{errors.New(fmt.Sprintf("Record ID %s doesn't match the URL (%s)", record.Id, r.PathValue("recordId")))})
+		return
+	}
+	err = server.db.UpsertRecord(r.PathValue("id"), &record)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, record)
+}
+
+func (server *Server) getRecord(w http.ResponseWriter, r *http.Request) {
+	record, err := server.db.GetRecord(r.PathValue("id"), r.PathValue("recordId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, record)
+}
+
+func (server *Server) deleteRecord(w http.ResponseWriter, r *http.Request) {
+	err := server.db.DeleteRecord(r.PathValue("id"), r.PathValue("recordId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) listRecords(w http.ResponseWriter, r *http.Request) {
+	options, err := parseListQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, invalidArgument{err})
+		return
+	}
+	page, err := server.db.ListRecords(r.PathValue("id"), options)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (server *Server) query(w http.ResponseWriter, r *http.Request) {
+	request := QueryRequest{}
+	err := readJSON(r, &request)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var results []collection.QueryResult
+	if request.Vector != nil {
+		results, err = server.db.QueryVector(r.PathValue("id"), request.Vector, request.Options())
+	} else {
+		results, err = server.db.QueryWithOptions(r.PathValue("id"), []byte(request.Query), request.Options())
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if results == nil {
+		results = []collection.QueryResult{}
+	}
+	writeJSON(w, http.StatusOK, results)
+}
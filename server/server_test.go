@@ -0,0 +1,292 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	collection "go-simple-embedding-database/collection"
+	database "go-simple-embedding-database/database"
+	embedders "go-simple-embedding-database/embedders"
+	records "go-simple-embedding-database/records"
+	tenant "go-simple-embedding-database/tenant"
+)
+
+func mockEmbed(blob []byte) ([]float64, error) {
+	return []float64{float64(bytes.Count(blob, []byte("a"))), float64(bytes.Count(blob, []byte("b"))), 1}, nil
+}
+
+func makeTestDatabase(t *testing.T) *database.SimpleDataBase {
+	t.Helper()
+	embedders.EmbedderRegister["mock-embedder"] = mockEmbed
+	db := database.MakeDatabase()
+	coll, _ := collection.MakeCollection("docs", "mock-embedder")
+	err := db.AddCollection(coll)
+	if err != nil {
+		t.Fatalf("Could not add collection: %v", err)
+	}
+	for _, blob := range []string{"aaa", "bbb", "ab"} {
+		record, _ := records.MakeRecord("mock-embedder", []byte(blob), blob)
+		err = db.AddRecord("docs", record)
+		if err != nil {
+			t.Fatalf("Could not add record: %v", err)
+		}
+	}
+	return db
+}
+
+func request(t *testing.T, handler http.Handler, method string, target string, body string) (int, ErrorResponse) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, target, strings.NewReader(body)))
+	errorResponse := ErrorResponse{}
+	if recorder.Code >= 300 {
+		err := json.Unmarshal(recorder.Body.Bytes(), &errorResponse)
+		if err != nil {
+			t.Errorf("Could not decode error response %s: %v", recorder.Body, err)
+		}
+	}
+	return recorder.Code, errorResponse
+}
+
+func TestErrorCodes(t *testing.T) {
+	handler := MakeServer(makeTestDatabase(t))
+	embedders.EmbedderRegister["down-embedder"] = func(blob []byte) ([]float64, error) {
+		return nil, fmt.Errorf("%w: try again later", embedders.ErrEmbedderUnavailable)
+	}
+	defer delete(embedders.EmbedderRegister, "down-embedder")
+	for _, test := range []struct {
+		method string
+		target string
+		body   string
+		status int
+		code   string
+	}{
+		{"GET", "/collections/docs/records/aaa", "", http.StatusOK, ""},
+		{"GET", "/collections/missing", "", http.StatusNotFound, CodeNotFound},
+		{"GET", "/collections/docs/records/missing", "", http.StatusNotFound, CodeNotFound},
+		{"DELETE", "/collections/docs/records/missing", "", http.StatusNotFound, CodeNotFound},
+		{"POST", "/collections", `{"id": "docs", "embedderId": "mock-embedder"}`, http.StatusConflict, CodeAlreadyExists},
+		{"POST", "/collections", `{"id": "other", "embedderId": "no-such-embedder"}`, http.StatusBadRequest, CodeInvalidArgument},
+		{"POST", "/collections", `{"id": ""}`, http.StatusBadRequest, CodeInvalidArgument},
+		{"POST", "/collections/docs/records", `{"id": "aaa", "embedderId": "mock-embedder", "embedding": [1, 0, 1]}`, http.StatusConflict, CodeAlreadyExists},
+		{"POST", "/collections/docs/records", `{"id": "c", "embedderId": "mock-embedder"}`, http.StatusBadRequest, CodeInvalidArgument},
+		{"POST", "/collections/docs/records", `{"id": `, http.StatusBadRequest, CodeInvalidArgument},
+		{"PUT", "/collections/docs/records/c", `{"id": "d", "embedderId": "mock-embedder", "embedding": [1, 0, 1]}`, http.StatusBadRequest, CodeInvalidArgument},
+		{"GET", "/collections/docs/records?limit=-1", "", http.StatusBadRequest, CodeInvalidArgument},
+		{"GET", "/collections/docs/records?order=random", "", http.StatusBadRequest, CodeInvalidArgument},
+		{"GET", "/collections/docs/records?cursor=nonsense", "", http.StatusBadRequest, CodeInvalidArgument},
+		{"POST", "/collections/docs/query", `{"query": "a", "nGreatest": -1}`, http.StatusBadRequest, CodeInvalidArgument},
+		{"POST", "/collections/missing/query", `{"query": "a"}`, http.StatusNotFound, CodeNotFound},
+		{"POST", "/collections/docs/query", `{"vector": [1, 0]}`, http.StatusBadRequest, CodeInvalidArgument},
+		{"POST", "/collections", `{"id": "down", "embedderId": "down-embedder"}`, http.StatusCreated, ""},
+		{"POST", "/collections/down/query", `{"query": "a"}`, http.StatusServiceUnavailable, CodeUnavailable},
+	} {
+		status, errorResponse := request(t, handler, test.method, test.target, test.body)
+		if status != test.status || errorResponse.Error.Code != test.code {
+			t.Errorf("%s %s: expected %d %s, got %d %+v", test.method, test.target, test.status, test.code, status, errorResponse)
+		}
+	}
+}
+
+func TestReadOnlyErrors(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "db.bin")
+	err := makeTestDatabase(t).ToBinaryFile(fileName)
+	if err != nil {
+		t.Fatalf("Could not write binary file: %v", err)
+	}
+	db, err := database.OpenMapped(fileName)
+	if err != nil {
+		t.Fatalf("Could not open binary file: %v", err)
+	}
+	defer db.Close()
+	handler := MakeServer(db)
+	status, _ := request(t, handler, "POST", "/collections/docs/query", `{"vector": [1, 0, 1], "nGreatest": 1}`)
+	if status != http.StatusOK {
+		t.Errorf("Expected queries to work on a read-only database, got %d", status)
+	}
+	status, errorResponse := request(t, handler, "DELETE", "/collections/docs/records/aaa", "")
+	if status != http.StatusForbidden || errorResponse.Error.Code != CodeReadOnly || ReasonError(errorResponse.Error.Reason) != database.ErrReadOnly {
+		t.Errorf("Expected a read_only error, got %d %+v", status, errorResponse)
+	}
+}
+
+func TestListQuery(t *testing.T) {
+	for _, options := range []collection.ListOptions{
+		{},
+		{OrderBy: collection.OrderByInsertion, Cursor: "abc", Limit: 5},
+		{Where: map[string]string{"tag": "a=b", "lang": "en"}, ExcludeEmbeddings: true, ExcludeBlobs: true},
+	} {
+		parsed, err := parseListQuery(ListQuery(options))
+		if err != nil {
+			t.Errorf("Could not parse %v: %v", ListQuery(options), err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, options) {
+			t.Errorf("Not equal (expected %+v, got %+v)", options, parsed)
+		}
+	}
+}
+
+type event struct {
+	id   string
+	name string
+	data string
+}
+
+// readEvent reads the next Server-Sent Event, skipping comments
+func readEvent(t *testing.T, reader *bufio.Reader) event {
+	t.Helper()
+	e := event{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Could not read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if e.name != "" {
+				return e
+			}
+			continue
+		}
+		field, value, _ := strings.Cut(line, ": ")
+		switch field {
+		case "id":
+			e.id = value
+		case "event":
+			e.name = value
+		case "data":
+			e.data = value
+		}
+	}
+}
+
+func TestChangeStream(t *testing.T) {
+	db := makeTestDatabase(t)
+	status, errorResponse := request(t, MakeServer(db), "GET", "/changes", "")
+	if status != http.StatusNotFound {
+		t.Errorf("Expected a 404 before the change feed is enabled, got %d %+v", status, errorResponse)
+	}
+	db.EnableChangeFeed(database.ChangeFeedOptions{History: 1})
+	httpServer := httptest.NewServer(MakeServer(db))
+	defer httpServer.Close()
+
+	for _, test := range []struct {
+		target string
+		status int
+		code   string
+	}{
+		{"/changes?type=renamed", http.StatusBadRequest, CodeInvalidArgument},
+		{"/changes?after=x", http.StatusBadRequest, CodeInvalidArgument},
+		{"/changes?after=5", http.StatusBadRequest, CodeInvalidArgument},
+	} {
+		status, errorResponse := request(t, MakeServer(db), "GET", test.target, "")
+		if status != test.status || errorResponse.Error.Code != test.code {
+			t.Errorf("GET %s: expected %d %s, got %d %+v", test.target, test.status, test.code, status, errorResponse)
+		}
+	}
+
+	resp, err := http.Get(httpServer.URL + "/changes?collection=docs&type=record_added&type=record_deleted")
+	if err != nil {
+		t.Fatalf("Could not subscribe: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Expected an event stream, got %s", resp.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(resp.Body)
+	// the upsert replaces a record, which is filtered out
+	record, _ := records.MakeRecord("mock-embedder", []byte("aaa"), "aaa")
+	db.UpsertRecord("docs", record)
+	record, _ = records.MakeRecord("mock-embedder", []byte("abab"), "abab")
+	db.AddRecord("docs", record)
+	db.DeleteRecord("docs", "bbb")
+
+	added := readEvent(t, reader)
+	change := database.Change{}
+	json.Unmarshal([]byte(added.data), &change)
+	if added.id != "2" || added.name != "record_added" || change.RecordId != "abab" || string(change.Record.Blob) != "abab" {
+		t.Errorf("Unexpected event %+v", added)
+	}
+	deleted := readEvent(t, reader)
+	if deleted.id != "3" || deleted.name != "record_deleted" {
+		t.Errorf("Unexpected event %+v", deleted)
+	}
+
+	// reconnecting picks up after the last event seen, as long as it's
+	// still in the history
+	req, _ := http.NewRequest("GET", httpServer.URL+"/changes", nil)
+	req.Header.Set("Last-Event-ID", "2")
+	resumed, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not resume: %v", err)
+	}
+	defer resumed.Body.Close()
+	if e := readEvent(t, bufio.NewReader(resumed.Body)); e.id != "3" {
+		t.Errorf("Expected to resume from event 3, got %+v", e)
+	}
+	status, errorResponse = request(t, MakeServer(db), "GET", "/changes?after=1", "")
+	if status != http.StatusGone || errorResponse.Error.Code != CodeGone {
+		t.Errorf("Expected a gone error resuming from a change that's left the history, got %d %+v", status, errorResponse)
+	}
+}
+
+func TestTenantServer(t *testing.T) {
+	embedders.EmbedderRegister["mock-embedder"] = mockEmbed
+	registry := tenant.MakeRegistry()
+	defer registry.Close()
+	handler := MakeTenantServer(registry)
+	for _, test := range []struct {
+		method string
+		target string
+		body   string
+		status int
+		code   string
+	}{
+		{"POST", "/tenants", `{"name": "acme", "quota": {"maxRecords": 2}}`, http.StatusCreated, ""},
+		{"POST", "/tenants", `{"name": "globex"}`, http.StatusCreated, ""},
+		{"POST", "/tenants", `{"name": "acme"}`, http.StatusConflict, CodeAlreadyExists},
+		{"POST", "/tenants", `{"name": "../etc"}`, http.StatusBadRequest, CodeInvalidArgument},
+		{"POST", "/tenants/acme/databases", `{"name": "prod"}`, http.StatusCreated, ""},
+		{"POST", "/tenants/globex/databases", `{"name": "prod"}`, http.StatusCreated, ""},
+		{"POST", "/tenants/missing/databases", `{"name": "prod"}`, http.StatusNotFound, CodeNotFound},
+		// each database gets the whole API, and the same collection ID in
+		// both tenants
+		{"POST", "/tenants/acme/databases/prod/collections", `{"id": "docs", "embedderId": "mock-embedder"}`, http.StatusCreated, ""},
+		{"POST", "/tenants/globex/databases/prod/collections", `{"id": "docs", "embedderId": "mock-embedder"}`, http.StatusCreated, ""},
+		{"POST", "/tenants/acme/databases/prod/collections/docs/records", `{"id": "a", "embedderId": "mock-embedder", "embedding": [1, 0, 1]}`, http.StatusCreated, ""},
+		{"POST", "/tenants/acme/databases/prod/collections/docs/records", `{"id": "b", "embedderId": "mock-embedder", "embedding": [0, 1, 1]}`, http.StatusCreated, ""},
+		{"POST", "/tenants/acme/databases/prod/collections/docs/records", `{"id": "c", "embedderId": "mock-embedder", "embedding": [1, 1, 1]}`, http.StatusTooManyRequests, CodeQuotaExceeded},
+		{"GET", "/tenants/acme/databases/prod/collections/docs/records/a", "", http.StatusOK, ""},
+		{"GET", "/tenants/globex/databases/prod/collections/docs/records/a", "", http.StatusNotFound, CodeNotFound},
+		{"GET", "/tenants/globex/databases/test/collections", "", http.StatusNotFound, CodeNotFound},
+		{"PUT", "/tenants/acme/quota", `{"maxRecords": 3}`, http.StatusOK, ""},
+		{"POST", "/tenants/acme/databases/prod/collections/docs/records", `{"id": "c", "embedderId": "mock-embedder", "embedding": [1, 1, 1]}`, http.StatusCreated, ""},
+		{"DELETE", "/tenants/globex/databases/prod", "", http.StatusNoContent, ""},
+		{"GET", "/tenants/globex/databases/prod/collections", "", http.StatusNotFound, CodeNotFound},
+		{"DELETE", "/tenants/globex", "", http.StatusNoContent, ""},
+		{"GET", "/tenants/globex", "", http.StatusNotFound, CodeNotFound},
+	} {
+		status, errorResponse := request(t, handler, test.method, test.target, test.body)
+		if status != test.status || errorResponse.Error.Code != test.code {
+			t.Errorf("%s %s: expected %d %s, got %d %+v", test.method, test.target, test.status, test.code, status, errorResponse)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/tenants/acme", nil))
+	info := TenantInfo{}
+	json.Unmarshal(recorder.Body.Bytes(), &info)
+	expected := TenantInfo{Name: "acme", Quota: database.Quota{MaxRecords: 3}, Usage: database.Usage{Records: 3, Bytes: info.Usage.Bytes}, Databases: []string{"prod"}}
+	if !reflect.DeepEqual(info, expected) || info.Usage.Bytes == 0 {
+		t.Errorf("Expected %+v, got %+v", expected, info)
+	}
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+
+	database "go-simple-embedding-database/database"
+	tenant "go-simple-embedding-database/tenant"
+)
+
+// TenantServer is an http.Handler for a tenant.Registry. Each database is
+// served with the same API as Server, under its tenant and database:
+//
+//	GET    /tenants                                      list tenants
+//	POST   /tenants                                      add a tenant
+//	GET    /tenants/{tenant}                             get a tenant's quota, usage and databases
+//	PUT    /tenants/{tenant}/quota                       change a tenant's quota
+//	DELETE /tenants/{tenant}                             delete a tenant and all its databases
+//	GET    /tenants/{tenant}/databases                   list a tenant's databases
+//	POST   /tenants/{tenant}/databases                   add a database
+//	DELETE /tenants/{tenant}/databases/{database}        delete a database
+//	       /tenants/{tenant}/databases/{database}/...    Server's API for the database
+//
+// so a client.Client made with a database's URL as its base URL works as it
+// would against a Server. Writes over the tenant's quota fail with
+// CodeQuotaExceeded
+type TenantServer struct {
+	registry *tenant.Registry
+	mux      *http.ServeMux
+
+	mutex *sync.Mutex
+	// a Server for each database that's been used, made the first time it's
+	// needed
+	servers map[*database.SimpleDataBase]*Server
+}
+
+// TenantInfo is what GET /tenants/{tenant} returns
+type TenantInfo struct {
+	Name      string         `json:"name"`
+	Quota     database.Quota `json:"quota"`
+	Usage     database.Usage `json:"usage"`
+	Databases []string       `json:"databases"`
+}
+
+type CreateTenantRequest struct {
+	Name  string         `json:"name"`
+	Quota database.Quota `json:"quota"`
+}
+
+type CreateDatabaseRequest struct {
+	Name string `json:"name"`
+}
+
+func MakeTenantServer(registry *tenant.Registry) *TenantServer {
+	server := &TenantServer{registry: registry, mux: http.NewServeMux(), mutex: &sync.Mutex{}, servers: make(map[*database.SimpleDataBase]*Server)}
+	server.mux.HandleFunc("GET /tenants", server.listTenants)
+	server.mux.HandleFunc("POST /tenants", server.addTenant)
+	server.mux.HandleFunc("GET /tenants/{tenant}", server.getTenant)
+	server.mux.HandleFunc("PUT /tenants/{tenant}/quota", server.setQuota)
+	server.mux.HandleFunc("DELETE /tenants/{tenant}", server.deleteTenant)
+	server.mux.HandleFunc("GET /tenants/{tenant}/databases", server.listDatabases)
+	server.mux.HandleFunc("POST /tenants/{tenant}/databases", server.addDatabase)
+	server.mux.HandleFunc("DELETE /tenants/{tenant}/databases/{database}", server.deleteDatabase)
+	server.mux.HandleFunc("/tenants/{tenant}/databases/{database}/", server.serveDatabase)
+	return server
+}
+
+func (server *TenantServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mux.ServeHTTP(w, r)
+}
+
+func tenantInfo(t *tenant.Tenant) TenantInfo {
+	return TenantInfo{Name: t.Name(), Quota: t.Quota(), Usage: t.Usage(), Databases: t.ListDatabases()}
+}
+
+func (server *TenantServer) listTenants(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, server.registry.ListTenants())
+}
+
+func (server *TenantServer) addTenant(w http.ResponseWriter, r *http.Request) {
+	request := CreateTenantRequest{}
+	err := readJSON(r, &request)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	t, err := server.registry.CreateTenant(request.Name, request.Quota)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, tenantInfo(t))
+}
+
+func (server *TenantServer) getTenant(w http.ResponseWriter, r *http.Request) {
+	t, err := server.registry.Tenant(r.PathValue("tenant"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, tenantInfo(t))
+}
+
+func (server *TenantServer) setQuota(w http.ResponseWriter, r *http.Request) {
+	quota := database.Quota{}
+	err := readJSON(r, &quota)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	t, err := server.registry.Tenant(r.PathValue("tenant"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	err = t.SetQuota(quota)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, tenantInfo(t))
+}
+
+func (server *TenantServer) deleteTenant(w http.ResponseWriter, r *http.Request) {
+	t, err := server.registry.Tenant(r.PathValue("tenant"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	databases := make([]*database.SimpleDataBase, 0)
+	for _, name := range t.ListDatabases() {
+		db, err := t.Database(name)
+		if err == nil {
+			databases = append(databases, db)
+		}
+	}
+	err = server.registry.DeleteTenant(t.Name())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	server.forget(databases...)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *TenantServer) listDatabases(w http.ResponseWriter, r *http.Request) {
+	t, err := server.registry.Tenant(r.PathValue("tenant"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, t.ListDatabases())
+}
+
+func (server *TenantServer) addDatabase(w http.ResponseWriter, r *http.Request) {
+	request := CreateDatabaseRequest{}
+	err := readJSON(r, &request)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	t, err := server.registry.Tenant(r.PathValue("tenant"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	_, err = t.CreateDatabase(request.Name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, request)
+}
+
+func (server *TenantServer) deleteDatabase(w http.ResponseWriter, r *http.Request) {
+	t, err := server.registry.Tenant(r.PathValue("tenant"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	db, err := t.Database(r.PathValue("database"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	err = t.DeleteDatabase(r.PathValue("database"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	server.forget(db)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveDatabase hands the request to the database's Server, with the path
+// it would have had without the tenant and database in front
+func (server *TenantServer) serveDatabase(w http.ResponseWriter, r *http.Request) {
+	t, err := server.registry.Tenant(r.PathValue("tenant"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	db, err := t.Database(r.PathValue("database"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	prefix := "/tenants/" + t.Name() + "/databases/" + r.PathValue("database")
+	http.StripPrefix(prefix, server.databaseServer(db)).ServeHTTP(w, r)
+}
+
+func (server *TenantServer) databaseServer(db *database.SimpleDataBase) *Server {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	dbServer, ok := server.servers[db]
+	if !ok {
+		dbServer = MakeServer(db)
+		server.servers[db] = dbServer
+	}
+	return dbServer
+}
+
+func (server *TenantServer) forget(databases ...*database.SimpleDataBase) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for _, db := range databases {
+		delete(server.servers, db)
+	}
+}
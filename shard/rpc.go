@@ -0,0 +1,360 @@
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+
+	collection "go-simple-embedding-database/collection"
+	records "go-simple-embedding-database/records"
+	utils "go-simple-embedding-database/utils"
+)
+
+// Shards on other machines are served by a Node and reached through a
+// RemoteShard, over net/rpc (gob over TCP). Every call names the shard it's
+// for, so one Node can serve the shards of several sharded collections
+
+var (
+	ErrShardExists   = errors.New("Shard already exists")
+	ErrShardNotFound = errors.New("Shard does not exist")
+)
+
+// net/rpc only sends an error's message, so a Node puts the name of the
+// error it wraps in front of the message, and RemoteShard turns it back
+// into an error wrapping the same error
+var remoteErrors = []struct {
+	name   string
+	target error
+}{
+	{"shard_not_found", ErrShardNotFound},
+	{"record_not_found", collection.ErrRecordNotFound},
+	{"record_exists", collection.ErrRecordExists},
+	{"embedder_mismatch", collection.ErrEmbedderMismatch},
+	{"missing_embedding", collection.ErrMissingEmbedding},
+	{"missing_record_id", collection.ErrMissingRecordId},
+	{"invalid_options", collection.ErrInvalidOptions},
+	{"invalid_cursor", collection.ErrInvalidCursor},
+	{"dimension_mismatch", utils.ErrDimensionMismatch},
+}
+
+// sendError names the error err wraps, if it's one of remoteErrors
+func sendError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, remote := range remoteErrors {
+		if errors.Is(err, remote.target) {
+			return errors.New(remote.name + ": " + err.Error())
+		}
+	}
+	return err
+}
+
+// remoteError is an error sent by sendError
+type remoteError struct {
+	target  error
+	message string
+}
+
+func (e remoteError) Error() string {
+	return e.message
+}
+
+func (e remoteError) Unwrap() error {
+	return e.target
+}
+
+// receivedError turns an error sent by sendError back into one wrapping
+// the error it names. Other errors are left as they are
+func receivedError(err error) error {
+	serverErr := rpc.ServerError("")
+	if !errors.As(err, &serverErr) {
+		return err
+	}
+	name, message, ok := strings.Cut(string(serverErr), ": ")
+	if !ok {
+		return err
+	}
+	for _, remote := range remoteErrors {
+		if remote.name == name {
+			return remoteError{target: remote.target, message: message}
+		}
+	}
+	return err
+}
+
+// the RPC argument and reply types have to be exported for net/rpc
+
+type RecordArgs struct {
+	Shard  string
+	Record records.Record
+}
+
+type UpsertReply struct {
+	Record   records.Record
+	Replaced bool
+}
+
+type IdArgs struct {
+	Shard    string
+	RecordId string
+}
+
+type QueryArgs struct {
+	Shard          string
+	QueryEmbedding []float64
+	Options        collection.QueryOptions
+}
+
+type ListArgs struct {
+	Shard   string
+	Options collection.ListOptions
+}
+
+type NameArgs struct {
+	Shard string
+}
+
+type Empty struct{}
+
+// Node serves shards to RemoteShards
+type Node struct {
+	mutex  *sync.RWMutex
+	shards map[string]Shard
+	server *rpc.Server
+}
+
+func MakeNode() *Node {
+	node := &Node{mutex: &sync.RWMutex{}, shards: make(map[string]Shard), server: rpc.NewServer()}
+	// RegisterName only fails for a service with no suitable methods
+	err := node.server.RegisterName("Shard", &nodeService{node: node})
+	if err != nil {
+		panic(err)
+	}
+	return node
+}
+
+// AddShard serves shard as name. net/rpc handles calls concurrently, so the
+// shard is locked (see LockShard) if it isn't already
+func (node *Node) AddShard(name string, shard Shard) error {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	_, exists := node.shards[name]
+	if exists {
+		return fmt.Errorf("%w: %s", ErrShardExists, name)
+	}
+	node.shards[name] = LockShard(shard)
+	return nil
+}
+
+func (node *Node) RemoveShard(name string) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	delete(node.shards, name)
+}
+
+func (node *Node) shard(name string) (Shard, error) {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	shard, exists := node.shards[name]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrShardNotFound, name)
+	}
+	return shard, nil
+}
+
+// Serve serves connections accepted on listener until it's closed, then
+// returns the error from Accept
+func (node *Node) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go node.server.ServeConn(conn)
+	}
+}
+
+// nodeService holds the methods net/rpc serves, so they don't clutter Node
+type nodeService struct {
+	node *Node
+}
+
+func (service *nodeService) AddRecord(args RecordArgs, reply *records.Record) error {
+	shard, err := service.node.shard(args.Shard)
+	if err != nil {
+		return sendError(err)
+	}
+	err = shard.AddRecord(&args.Record)
+	*reply = args.Record
+	return sendError(err)
+}
+
+func (service *nodeService) UpsertRecord(args RecordArgs, reply *UpsertReply) error {
+	shard, err := service.node.shard(args.Shard)
+	if err != nil {
+		return sendError(err)
+	}
+	replaced, err := shard.UpsertRecord(&args.Record)
+	*reply = UpsertReply{Record: args.Record, Replaced: replaced}
+	return sendError(err)
+}
+
+func (service *nodeService) PutRecord(args RecordArgs, reply *Empty) error {
+	shard, err := service.node.shard(args.Shard)
+	if err != nil {
+		return sendError(err)
+	}
+	return sendError(shard.PutRecord(args.Record))
+}
+
+func (service *nodeService) GetRecord(args IdArgs, reply *records.Record) error {
+	shard, err := service.node.shard(args.Shard)
+	if err != nil {
+		return sendError(err)
+	}
+	record, err := shard.GetRecord(args.RecordId)
+	if err != nil {
+		return sendError(err)
+	}
+	*reply = *record
+	return nil
+}
+
+func (service *nodeService) DeleteRecord(args IdArgs, reply *Empty) error {
+	shard, err := service.node.shard(args.Shard)
+	if err != nil {
+		return sendError(err)
+	}
+	return sendError(shard.DeleteRecord(args.RecordId))
+}
+
+func (service *nodeService) QueryVector(args QueryArgs, reply *[]collection.QueryResult) error {
+	shard, err := service.node.shard(args.Shard)
+	if err != nil {
+		return sendError(err)
+	}
+	results, err := shard.QueryVector(args.QueryEmbedding, args.Options)
+	if err != nil {
+		return sendError(err)
+	}
+	*reply = results
+	return nil
+}
+
+func (service *nodeService) ListRecords(args ListArgs, reply *collection.RecordPage) error {
+	shard, err := service.node.shard(args.Shard)
+	if err != nil {
+		return sendError(err)
+	}
+	page, err := shard.ListRecords(args.Options)
+	if err != nil {
+		return sendError(err)
+	}
+	*reply = page
+	return nil
+}
+
+func (service *nodeService) Count(args NameArgs, reply *int) error {
+	shard, err := service.node.shard(args.Shard)
+	if err != nil {
+		return sendError(err)
+	}
+	count, err := shard.Count()
+	if err != nil {
+		return sendError(err)
+	}
+	*reply = count
+	return nil
+}
+
+// RemoteShard is a shard served by a Node. Errors from the shard that wrap
+// one of remoteErrors (records that don't exist, invalid options and the
+// like) wrap it again on this side, so errors.Is works on them. Others come
+// back as rpc.ServerError, carrying the original error's message
+type RemoteShard struct {
+	name   string
+	client *rpc.Client
+}
+
+var _ Shard = &RemoteShard{}
+
+// DialShard connects to the shard called name on the Node at addr
+func DialShard(addr string, name string) (*RemoteShard, error) {
+	client, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteShard{name: name, client: client}, nil
+}
+
+func (shard *RemoteShard) call(method string, args any, reply any) error {
+	return receivedError(shard.client.Call(method, args, reply))
+}
+
+func (shard *RemoteShard) Close() error {
+	return shard.client.Close()
+}
+
+// AddRecord and UpsertRecord copy the record as stored (with its timestamps
+// set) back into record, as a local shard would
+func (shard *RemoteShard) AddRecord(record *records.Record) error {
+	stored := records.Record{}
+	err := shard.call("Shard.AddRecord", RecordArgs{Shard: shard.name, Record: *record}, &stored)
+	if err != nil {
+		return err
+	}
+	*record = stored
+	return nil
+}
+
+func (shard *RemoteShard) UpsertRecord(record *records.Record) (bool, error) {
+	reply := UpsertReply{}
+	err := shard.call("Shard.UpsertRecord", RecordArgs{Shard: shard.name, Record: *record}, &reply)
+	if err != nil {
+		return false, err
+	}
+	*record = reply.Record
+	return reply.Replaced, nil
+}
+
+func (shard *RemoteShard) PutRecord(record records.Record) error {
+	return shard.call("Shard.PutRecord", RecordArgs{Shard: shard.name, Record: record}, &Empty{})
+}
+
+func (shard *RemoteShard) GetRecord(recordId string) (*records.Record, error) {
+	record := records.Record{}
+	err := shard.call("Shard.GetRecord", IdArgs{Shard: shard.name, RecordId: recordId}, &record)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (shard *RemoteShard) DeleteRecord(recordId string) error {
+	return shard.call("Shard.DeleteRecord", IdArgs{Shard: shard.name, RecordId: recordId}, &Empty{})
+}
+
+func (shard *RemoteShard) QueryVector(queryEmbedding []float64, options collection.QueryOptions) ([]collection.QueryResult, error) {
+	results := make([]collection.QueryResult, 0)
+	err := shard.call("Shard.QueryVector", QueryArgs{Shard: shard.name, QueryEmbedding: queryEmbedding, Options: options}, &results)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (shard *RemoteShard) ListRecords(options collection.ListOptions) (collection.RecordPage, error) {
+	page := collection.RecordPage{}
+	err := shard.call("Shard.ListRecords", ListArgs{Shard: shard.name, Options: options}, &page)
+	return page, err
+}
+
+func (shard *RemoteShard) Count() (int, error) {
+	count := 0
+	err := shard.call("Shard.Count", NameArgs{Shard: shard.name}, &count)
+	return count, err
+}
@@ -0,0 +1,371 @@
+// Package shard splits a collection's records across several shards by
+// hashing their IDs. Shards can be collections in this process or on other
+// machines (see Node and RemoteShard). Queries go to every shard at once and
+// the shards' results are merged
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	collection "go-simple-embedding-database/collection"
+	embedders "go-simple-embedding-database/embedders"
+	records "go-simple-embedding-database/records"
+)
+
+// Shard holds some of a sharded collection's records. A collection.Collection
+// is a Shard, and so is a RemoteShard. A ShardedCollection calls its shards
+// from several goroutines at once, so a collection.Collection has to be
+// wrapped with LockShard first
+type Shard interface {
+	AddRecord(record *records.Record) error
+	// UpsertRecord returns whether it replaced a record
+	UpsertRecord(record *records.Record) (bool, error)
+	// PutRecord stores the record as it is, for moving records between
+	// shards
+	PutRecord(record records.Record) error
+	GetRecord(recordId string) (*records.Record, error)
+	DeleteRecord(recordId string) error
+	QueryVector(queryEmbedding []float64, options collection.QueryOptions) ([]collection.QueryResult, error)
+	ListRecords(options collection.ListOptions) (collection.RecordPage, error)
+	Count() (int, error)
+}
+
+var _ Shard = collection.Collection{}
+
+type Options struct {
+	// How long a query waits for each shard. Shards that take longer are
+	// left out and the results are marked Partial. 0 waits as long as it
+	// takes
+	ShardTimeout time.Duration
+	// Fail queries that any shard fails to answer, instead of returning
+	// partial results
+	RequireAllShards bool
+}
+
+// ShardedCollection is a collection whose records are split across shards.
+// Each record lives on the shard its ID hashes to
+type ShardedCollection struct {
+	Id         string
+	EmbedderId string
+
+	options Options
+	// held for writing while the shards are being resized
+	mutex  *sync.RWMutex
+	shards []Shard
+}
+
+// MakeShardedCollection splits a collection across shards. Each shard is
+// locked with LockShard, since queries run against every shard at once
+func MakeShardedCollection(id string, embedderId string, shards []Shard, options Options) (*ShardedCollection, error) {
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("%w: sharded collection %s needs at least one shard", collection.ErrInvalidOptions, id)
+	}
+	_, err := embedders.GetEmbedderFunc(embedderId)
+	if err != nil {
+		return nil, err
+	}
+	return &ShardedCollection{Id: id, EmbedderId: embedderId, options: options, mutex: &sync.RWMutex{}, shards: lockShards(shards)}, nil
+}
+
+// MakeLocalShards makes n in-process shards for a sharded collection. Each
+// is locked (see LockShard), so writes to a shard don't race queries
+func MakeLocalShards(id string, embedderId string, n int) ([]Shard, error) {
+	shards := make([]Shard, n)
+	for i := range shards {
+		coll, err := collection.MakeCollection(fmt.Sprintf("%s-%d", id, i), embedderId)
+		if err != nil {
+			return nil, err
+		}
+		shards[i] = LockShard(coll)
+	}
+	return shards, nil
+}
+
+// lockShards is LockShard for each of shards, in a new slice
+func lockShards(shards []Shard) []Shard {
+	locked := make([]Shard, len(shards))
+	for i, shard := range shards {
+		locked[i] = LockShard(shard)
+	}
+	return locked
+}
+
+// lockedShard guards a shard that isn't safe to use from several goroutines
+// at once, like a collection.Collection, with a mutex
+type lockedShard struct {
+	mutex *sync.RWMutex
+	shard Shard
+}
+
+// LockShard wraps shard so that writes hold a lock that keeps out every
+// other call, and reads share it. A shard that's already locked is returned
+// as it is
+func LockShard(shard Shard) Shard {
+	_, locked := shard.(*lockedShard)
+	if locked {
+		return shard
+	}
+	return &lockedShard{mutex: &sync.RWMutex{}, shard: shard}
+}
+
+func (locked *lockedShard) AddRecord(record *records.Record) error {
+	locked.mutex.Lock()
+	defer locked.mutex.Unlock()
+	return locked.shard.AddRecord(record)
+}
+
+func (locked *lockedShard) UpsertRecord(record *records.Record) (bool, error) {
+	locked.mutex.Lock()
+	defer locked.mutex.Unlock()
+	return locked.shard.UpsertRecord(record)
+}
+
+func (locked *lockedShard) PutRecord(record records.Record) error {
+	locked.mutex.Lock()
+	defer locked.mutex.Unlock()
+	return locked.shard.PutRecord(record)
+}
+
+func (locked *lockedShard) GetRecord(recordId string) (*records.Record, error) {
+	locked.mutex.RLock()
+	defer locked.mutex.RUnlock()
+	return locked.shard.GetRecord(recordId)
+}
+
+func (locked *lockedShard) DeleteRecord(recordId string) error {
+	locked.mutex.Lock()
+	defer locked.mutex.Unlock()
+	return locked.shard.DeleteRecord(recordId)
+}
+
+func (locked *lockedShard) QueryVector(queryEmbedding []float64, options collection.QueryOptions) ([]collection.QueryResult, error) {
+	locked.mutex.RLock()
+	defer locked.mutex.RUnlock()
+	return locked.shard.QueryVector(queryEmbedding, options)
+}
+
+func (locked *lockedShard) ListRecords(options collection.ListOptions) (collection.RecordPage, error) {
+	locked.mutex.RLock()
+	defer locked.mutex.RUnlock()
+	return locked.shard.ListRecords(options)
+}
+
+func (locked *lockedShard) Count() (int, error) {
+	locked.mutex.RLock()
+	defer locked.mutex.RUnlock()
+	return locked.shard.Count()
+}
+
+// ShardIndex is the index of the shard a record ID belongs on, out of n
+func ShardIndex(recordId string, n int) int {
+	hash := fnv.New64a()
+	hash.Write([]byte(recordId))
+	return int(hash.Sum64() % uint64(n))
+}
+
+func (coll *ShardedCollection) shardFor(recordId string) Shard {
+	return coll.shards[ShardIndex(recordId, len(coll.shards))]
+}
+
+func (coll *ShardedCollection) Shards() []Shard {
+	coll.mutex.RLock()
+	defer coll.mutex.RUnlock()
+	return append([]Shard(nil), coll.shards...)
+}
+
+func (coll *ShardedCollection) AddRecord(record *records.Record) error {
+	coll.mutex.RLock()
+	defer coll.mutex.RUnlock()
+	return coll.shardFor(record.Id).AddRecord(record)
+}
+
+func (coll *ShardedCollection) UpsertRecord(record *records.Record) (bool, error) {
+	coll.mutex.RLock()
+	defer coll.mutex.RUnlock()
+	return coll.shardFor(record.Id).UpsertRecord(record)
+}
+
+func (coll *ShardedCollection) GetRecord(recordId string) (*records.Record, error) {
+	coll.mutex.RLock()
+	defer coll.mutex.RUnlock()
+	return coll.shardFor(recordId).GetRecord(recordId)
+}
+
+func (coll *ShardedCollection) DeleteRecord(recordId string) error {
+	coll.mutex.RLock()
+	defer coll.mutex.RUnlock()
+	return coll.shardFor(recordId).DeleteRecord(recordId)
+}
+
+// Count adds up the shards' counts
+func (coll *ShardedCollection) Count() (int, error) {
+	coll.mutex.RLock()
+	defer coll.mutex.RUnlock()
+	total := 0
+	for i, shard := range coll.shards {
+		count, err := shard.Count()
+		if err != nil {
+			return 0, fmt.Errorf("Could not count shard %d: %w", i, err)
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// ShardError is a shard that couldn't answer a query
+type ShardError struct {
+	Shard int
+	Err   error
+}
+
+func (e ShardError) Error() string {
+	return fmt.Sprintf("Shard %d: %v", e.Shard, e.Err)
+}
+
+func (e ShardError) Unwrap() error {
+	return e.Err
+}
+
+type QueryResults struct {
+	Results []collection.QueryResult
+	// Set if any shards are missing from the results, in which case Failed
+	// says which and why
+	Partial bool
+	Failed  []ShardError
+}
+
+var errShardTimeout = errors.New("Timed out")
+
+func (coll *ShardedCollection) QueryWithOptions(query []byte, options collection.QueryOptions) (QueryResults, error) {
+	embed, err := embedders.GetEmbedderFunc(coll.EmbedderId)
+	if err != nil {
+		return QueryResults{}, err
+	}
+	queryEmbedding, err := embed(query)
+	if err != nil {
+		return QueryResults{}, err
+	}
+	return coll.QueryVector(queryEmbedding, options)
+}
+
+// QueryVector sends the query to every shard at once and merges what they
+// send back. A query returns an error if every shard fails (or any shard
+// does, with RequireAllShards); otherwise the results come from the shards
+// that answered
+func (coll *ShardedCollection) QueryVector(queryEmbedding []float64, options collection.QueryOptions) (QueryResults, error) {
+	coll.mutex.RLock()
+	shards := coll.shards
+	coll.mutex.RUnlock()
+
+	type answer struct {
+		shard   int
+		results []collection.QueryResult
+		err     error
+	}
+	// buffered, so shards that answer after the timeout don't block
+	answers := make(chan answer, len(shards))
+	shardOptions := options.CandidateOptions()
+	for i, shard := range shards {
+		go func() {
+			results, err := shard.QueryVector(queryEmbedding, shardOptions)
+			answers <- answer{shard: i, results: results, err: err}
+		}()
+	}
+	var timeout <-chan time.Time
+	if coll.options.ShardTimeout > 0 {
+		timer := time.NewTimer(coll.options.ShardTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	answered := make([]bool, len(shards))
+	resultSets := make([][]collection.QueryResult, 0, len(shards))
+	failed := make([]ShardError, 0)
+	for waiting := len(shards); waiting > 0; waiting-- {
+		select {
+		case a := <-answers:
+			answered[a.shard] = true
+			if a.err != nil {
+				failed = append(failed, ShardError{Shard: a.shard, Err: a.err})
+				continue
+			}
+			resultSets = append(resultSets, a.results)
+		case <-timeout:
+			for i := range shards {
+				if !answered[i] {
+					failed = append(failed, ShardError{Shard: i, Err: errShardTimeout})
+				}
+			}
+			waiting = 0
+		}
+	}
+
+	if len(failed) == len(shards) || (len(failed) > 0 && coll.options.RequireAllShards) {
+		shardErrors := make([]error, len(failed))
+		for i, shardErr := range failed {
+			shardErrors[i] = shardErr
+		}
+		return QueryResults{Failed: failed}, errors.Join(shardErrors...)
+	}
+	merged, err := collection.MergeResults(resultSets, options)
+	if err != nil {
+		return QueryResults{}, err
+	}
+	return QueryResults{Results: merged, Partial: len(failed) > 0, Failed: failed}, nil
+}
+
+// how many records Resize moves at a time
+const resizeBatch = 1000
+
+// Resize moves the collection onto a different number of shards, moving
+// every record whose shard changes, and returns how many records moved.
+// The first min(old, new) of the new shards have to be the shards already
+// at those positions; shards past the end of the new shards are emptied
+// and can be thrown away afterwards. The collection can't be used while
+// it's being resized. If Resize fails part way, every record is still on
+// one of the old or new shards, some maybe on both. The new shards are
+// locked like MakeShardedCollection's
+func (coll *ShardedCollection) Resize(shards []Shard) (int, error) {
+	if len(shards) == 0 {
+		return 0, fmt.Errorf("%w: sharded collection %s needs at least one shard", collection.ErrInvalidOptions, coll.Id)
+	}
+	shards = lockShards(shards)
+	coll.mutex.Lock()
+	defer coll.mutex.Unlock()
+
+	moved := 0
+	for i, shard := range coll.shards {
+		options := collection.ListOptions{OrderBy: collection.OrderById, Limit: resizeBatch}
+		for {
+			page, err := shard.ListRecords(options)
+			if err != nil {
+				return moved, fmt.Errorf("Could not list shard %d: %w", i, err)
+			}
+			for _, record := range page.Records {
+				target := ShardIndex(record.Id, len(shards))
+				if target == i {
+					continue
+				}
+				err = shards[target].PutRecord(record)
+				if err != nil {
+					return moved, fmt.Errorf("Could not move record %s to shard %d: %w", record.Id, target, err)
+				}
+				err = shard.DeleteRecord(record.Id)
+				if err != nil {
+					return moved, fmt.Errorf("Could not delete record %s from shard %d: %w", record.Id, i, err)
+				}
+				moved++
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			options.Cursor = page.NextCursor
+		}
+	}
+	coll.shards = shards
+	return moved, nil
+}
@@ -0,0 +1,470 @@
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	collection "go-simple-embedding-database/collection"
+	embedders "go-simple-embedding-database/embedders"
+	records "go-simple-embedding-database/records"
+)
+
+// VectorEmbed treats the blob as a comma separated list of floats
+func VectorEmbed(blob []byte) ([]float64, error) {
+	vector := make([]float64, 0)
+	for _, field := range strings.Split(string(blob), ",") {
+		value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, err
+		}
+		vector = append(vector, value)
+	}
+	return vector, nil
+}
+
+func testRecord(t *testing.T, i int) *records.Record {
+	blob := fmt.Sprintf("%d,%d,%d", i%13+1, i%7, i%5)
+	record, err := records.MakeRecord("vector-embedder", []byte(blob), fmt.Sprintf("record-%03d", i))
+	if err != nil {
+		t.Fatalf("Could not create record %d: %v", i, err)
+	}
+	record.Metadata = map[string]string{"parity": strconv.Itoa(i % 2)}
+	return record
+}
+
+// makeTestCollections makes a sharded collection and a plain collection
+// with the same n records
+func makeTestCollections(t *testing.T, shards []Shard, n int) (*ShardedCollection, *collection.Collection) {
+	embedders.EmbedderRegister["vector-embedder"] = VectorEmbed
+	sharded, err := MakeShardedCollection("test-sharded", "vector-embedder", shards, Options{})
+	if err != nil {
+		t.Fatalf("Could not make sharded collection: %v", err)
+	}
+	single, err := collection.MakeCollection("test-single", "vector-embedder")
+	if err != nil {
+		t.Fatalf("Could not make collection: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		err = sharded.AddRecord(testRecord(t, i))
+		if err != nil {
+			t.Fatalf("Could not add record %d to sharded collection: %v", i, err)
+		}
+		err = single.AddRecord(testRecord(t, i))
+		if err != nil {
+			t.Fatalf("Could not add record %d to collection: %v", i, err)
+		}
+	}
+	return sharded, single
+}
+
+func resultIds(results []collection.QueryResult) []string {
+	ids := make([]string, len(results))
+	for i, result := range results {
+		ids[i] = result.Record.Id
+	}
+	return ids
+}
+
+var equivalenceQueries = map[string]collection.QueryOptions{
+	"top 10":    {NGreatest: 10},
+	"no limit":  {},
+	"where":     {NGreatest: 7, Where: map[string]string{"parity": "1"}},
+	"mmr":       {NGreatest: 5, MMR: &collection.MMROptions{Lambda: 0.5}},
+	"mmr fetch": {NGreatest: 5, MMR: &collection.MMROptions{Lambda: 0.3, FetchK: 12}},
+}
+
+// checkEquivalent checks that queries against the sharded collection get the
+// same results as against the plain one
+func checkEquivalent(t *testing.T, sharded *ShardedCollection, single *collection.Collection) {
+	t.Helper()
+	for name, options := range equivalenceQueries {
+		expected, err := single.QueryWithOptions([]byte("3,2,1"), options)
+		if err != nil {
+			t.Fatalf("%s: query failed: %v", name, err)
+		}
+		got, err := sharded.QueryWithOptions([]byte("3,2,1"), options)
+		if err != nil {
+			t.Fatalf("%s: sharded query failed: %v", name, err)
+		}
+		if got.Partial {
+			t.Errorf("%s: expected complete results, got failures %v", name, got.Failed)
+		}
+		if !reflect.DeepEqual(resultIds(got.Results), resultIds(expected)) {
+			t.Errorf("%s: expected %v, got %v", name, resultIds(expected), resultIds(got.Results))
+		}
+	}
+}
+
+func TestShardedCollection(t *testing.T) {
+	embedders.EmbedderRegister["vector-embedder"] = VectorEmbed
+	shards, err := MakeLocalShards("test-sharded", "vector-embedder", 4)
+	if err != nil {
+		t.Fatalf("Could not make shards: %v", err)
+	}
+	sharded, single := makeTestCollections(t, shards, 100)
+	checkEquivalent(t, sharded, single)
+
+	count, err := sharded.Count()
+	if err != nil || count != 100 {
+		t.Errorf("Expected 100 records, got %d (%v)", count, err)
+	}
+	for i, shard := range shards {
+		count, _ := shard.Count()
+		if count == 0 || count == 100 {
+			t.Errorf("Expected shard %d to hold some of the records, it has %d", i, count)
+		}
+	}
+
+	record, err := sharded.GetRecord("record-042")
+	if err != nil || record.Id != "record-042" {
+		t.Errorf("Could not get record-042: %v", err)
+	}
+	if _, err := shards[ShardIndex("record-042", 4)].GetRecord("record-042"); err != nil {
+		t.Errorf("Expected record-042 to be on shard %d: %v", ShardIndex("record-042", 4), err)
+	}
+	err = sharded.AddRecord(testRecord(t, 42))
+	if err == nil {
+		t.Errorf("Should not have been able to add record-042 twice")
+	}
+	err = sharded.DeleteRecord("record-042")
+	if err != nil {
+		t.Errorf("Could not delete record-042: %v", err)
+	}
+	if _, err := sharded.GetRecord("record-042"); err == nil {
+		t.Errorf("record-042 should have been deleted")
+	}
+
+	_, err = MakeShardedCollection("test-no-shards", "vector-embedder", nil, Options{})
+	if !errors.Is(err, collection.ErrInvalidOptions) {
+		t.Errorf("Should not have been able to make a sharded collection without shards")
+	}
+}
+
+// slowShard takes delay to answer queries, or fails them with err
+type slowShard struct {
+	Shard
+	delay time.Duration
+	err   error
+}
+
+func (shard slowShard) QueryVector(queryEmbedding []float64, options collection.QueryOptions) ([]collection.QueryResult, error) {
+	time.Sleep(shard.delay)
+	if shard.err != nil {
+		return nil, shard.err
+	}
+	return shard.Shard.QueryVector(queryEmbedding, options)
+}
+
+func TestPartialResults(t *testing.T) {
+	embedders.EmbedderRegister["vector-embedder"] = VectorEmbed
+	shards, err := MakeLocalShards("test-sharded", "vector-embedder", 3)
+	if err != nil {
+		t.Fatalf("Could not make shards: %v", err)
+	}
+	sharded, _ := makeTestCollections(t, shards, 60)
+
+	sharded.shards[1] = slowShard{Shard: shards[1], delay: time.Second}
+	sharded.options.ShardTimeout = 50 * time.Millisecond
+	start := time.Now()
+	results, err := sharded.QueryWithOptions([]byte("3,2,1"), collection.QueryOptions{})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Expected the query not to wait for the slow shard")
+	}
+	if !results.Partial || len(results.Failed) != 1 || results.Failed[0].Shard != 1 {
+		t.Errorf("Expected results without shard 1, got failures %v", results.Failed)
+	}
+	countWithout, _ := shards[1].Count()
+	if len(results.Results) != 60-countWithout {
+		t.Errorf("Expected %d results from the other shards, got %d", 60-countWithout, len(results.Results))
+	}
+	for _, result := range results.Results {
+		if ShardIndex(result.Record.Id, 3) == 1 {
+			t.Errorf("Did not expect %s from the slow shard", result.Record.Id)
+		}
+	}
+
+	sharded.options.RequireAllShards = true
+	_, err = sharded.QueryWithOptions([]byte("3,2,1"), collection.QueryOptions{})
+	if err == nil {
+		t.Errorf("Expected the query to fail when a shard doesn't answer and all are required")
+	}
+
+	sharded.options = Options{}
+	broken := errors.New("broken")
+	for i := range sharded.shards {
+		sharded.shards[i] = slowShard{Shard: shards[i], err: broken}
+	}
+	results, err = sharded.QueryWithOptions([]byte("3,2,1"), collection.QueryOptions{})
+	if !errors.Is(err, broken) || len(results.Failed) != 3 {
+		t.Errorf("Expected the query to fail when every shard fails, got %v", err)
+	}
+}
+
+func TestResize(t *testing.T) {
+	embedders.EmbedderRegister["vector-embedder"] = VectorEmbed
+	shards, err := MakeLocalShards("test-sharded", "vector-embedder", 6)
+	if err != nil {
+		t.Fatalf("Could not make shards: %v", err)
+	}
+	sharded, single := makeTestCollections(t, shards[:4], 200)
+
+	for _, n := range []int{6, 2, 1, 3} {
+		before := make(map[string]int)
+		for i := 0; i < 200; i++ {
+			id := fmt.Sprintf("record-%03d", i)
+			before[id] = ShardIndex(id, len(sharded.Shards()))
+		}
+		expectedMoves := 0
+		for id, index := range before {
+			if ShardIndex(id, n) != index {
+				expectedMoves++
+			}
+		}
+
+		moved, err := sharded.Resize(shards[:n])
+		if err != nil {
+			t.Fatalf("Could not resize to %d shards: %v", n, err)
+		}
+		if moved != expectedMoves {
+			t.Errorf("Expected resizing to %d shards to move %d records, moved %d", n, expectedMoves, moved)
+		}
+		total := 0
+		for i, shard := range shards {
+			page, err := shard.ListRecords(collection.ListOptions{})
+			if err != nil {
+				t.Fatalf("Could not list shard %d: %v", i, err)
+			}
+			for _, record := range page.Records {
+				if i >= n || ShardIndex(record.Id, n) != i {
+					t.Errorf("Record %s is on shard %d after resizing to %d shards", record.Id, i, n)
+				}
+			}
+			total += len(page.Records)
+		}
+		if total != 200 {
+			t.Errorf("Expected 200 records after resizing to %d shards, got %d", n, total)
+		}
+		checkEquivalent(t, sharded, single)
+	}
+
+	_, err = sharded.Resize(nil)
+	if !errors.Is(err, collection.ErrInvalidOptions) {
+		t.Errorf("Should not have been able to resize to no shards")
+	}
+}
+
+func TestRemoteShards(t *testing.T) {
+	embedders.EmbedderRegister["vector-embedder"] = VectorEmbed
+	node := MakeNode()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer listener.Close()
+	go node.Serve(listener)
+
+	local, err := MakeLocalShards("test-remote", "vector-embedder", 3)
+	if err != nil {
+		t.Fatalf("Could not make shards: %v", err)
+	}
+	shards := make([]Shard, 3)
+	for i, shard := range local {
+		name := fmt.Sprintf("test-remote-%d", i)
+		err = node.AddShard(name, shard)
+		if err != nil {
+			t.Fatalf("Could not add shard %s: %v", name, err)
+		}
+		remote, err := DialShard(listener.Addr().String(), name)
+		if err != nil {
+			t.Fatalf("Could not dial shard %s: %v", name, err)
+		}
+		defer remote.Close()
+		shards[i] = remote
+	}
+	if !errors.Is(node.AddShard("test-remote-0", local[0]), ErrShardExists) {
+		t.Errorf("Should not have been able to add test-remote-0 twice")
+	}
+
+	sharded, single := makeTestCollections(t, shards, 100)
+	checkEquivalent(t, sharded, single)
+
+	record := testRecord(t, 7)
+	record.Id = "upserted"
+	replaced, err := sharded.UpsertRecord(record)
+	if err != nil || replaced {
+		t.Fatalf("Could not upsert: %v", err)
+	}
+	if record.CreatedAt.IsZero() {
+		t.Errorf("Expected the stored record to be copied back from the remote shard")
+	}
+	got, err := sharded.GetRecord("upserted")
+	if err != nil || !got.CreatedAt.Equal(record.CreatedAt) {
+		t.Errorf("Could not get the upserted record back: %v", err)
+	}
+	replaced, err = sharded.UpsertRecord(record)
+	if err != nil || !replaced || record.UpdatedAt.IsZero() {
+		t.Errorf("Expected upserting again to replace the record, got %v (%v)", replaced, err)
+	}
+	count, err := sharded.Count()
+	if err != nil || count != 101 {
+		t.Errorf("Expected 101 records, got %d (%v)", count, err)
+	}
+
+	// errors from the shard come back over the connection
+	_, err = sharded.GetRecord("missing")
+	if !errors.Is(err, collection.ErrRecordNotFound) || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("Expected a record not found error getting a missing record, got %v", err)
+	}
+	missing, err := DialShard(listener.Addr().String(), "no-such-shard")
+	if err != nil {
+		t.Fatalf("Could not dial: %v", err)
+	}
+	defer missing.Close()
+	_, err = missing.Count()
+	if !errors.Is(err, ErrShardNotFound) || !strings.Contains(err.Error(), "no-such-shard") {
+		t.Errorf("Expected a shard not found error from a shard that doesn't exist, got %v", err)
+	}
+
+	// resizing moves records between remote shards too
+	moved, err := sharded.Resize(shards[:2])
+	if err != nil || moved == 0 {
+		t.Fatalf("Could not resize: moved %d (%v)", moved, err)
+	}
+	if count, _ := local[2].Count(); count != 0 {
+		t.Errorf("Expected the removed shard to be empty, it has %d records", count)
+	}
+	err = sharded.DeleteRecord("upserted")
+	if err != nil {
+		t.Errorf("Could not delete: %v", err)
+	}
+	checkEquivalent(t, sharded, single)
+}
+
+// checkConcurrent writes to sharded while querying it, for the race detector
+func checkConcurrent(t *testing.T, sharded *ShardedCollection) {
+	t.Helper()
+	var wait sync.WaitGroup
+	errs := make(chan error, 4)
+	for writer := 0; writer < 2; writer++ {
+		// made here, since t.Fatalf can't be called from other goroutines
+		batch := make([]*records.Record, 50)
+		for i := range batch {
+			batch[i] = testRecord(t, i)
+			batch[i].Id = fmt.Sprintf("concurrent-%d-%d", writer, i)
+		}
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for i, record := range batch {
+				err := sharded.AddRecord(record)
+				if err == nil {
+					_, err = sharded.UpsertRecord(record)
+				}
+				if err == nil && i%2 == 0 {
+					err = sharded.DeleteRecord(record.Id)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	for reader := 0; reader < 2; reader++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for i := 0; i < 50; i++ {
+				_, err := sharded.QueryWithOptions([]byte("3,2,1"), collection.QueryOptions{NGreatest: 5})
+				if err == nil {
+					_, err = sharded.Count()
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wait.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Concurrent call failed: %v", err)
+	}
+	count, err := sharded.Count()
+	if err != nil || count != 150 {
+		t.Errorf("Expected 150 records after the concurrent writes, got %d (%v)", count, err)
+	}
+}
+
+func TestConcurrentLocalShards(t *testing.T) {
+	embedders.EmbedderRegister["vector-embedder"] = VectorEmbed
+	shards, err := MakeLocalShards("test-concurrent", "vector-embedder", 3)
+	if err != nil {
+		t.Fatalf("Could not make shards: %v", err)
+	}
+	sharded, _ := makeTestCollections(t, shards, 100)
+	checkConcurrent(t, sharded)
+}
+
+func TestConcurrentBareShards(t *testing.T) {
+	embedders.EmbedderRegister["vector-embedder"] = VectorEmbed
+	shards := make([]Shard, 3)
+	for i := range shards {
+		// bare collections: the sharded collection has to lock them
+		coll, err := collection.MakeCollection(fmt.Sprintf("test-bare-%d", i), "vector-embedder")
+		if err != nil {
+			t.Fatalf("Could not make collection: %v", err)
+		}
+		shards[i] = coll
+	}
+	sharded, _ := makeTestCollections(t, shards[:2], 100)
+	_, err := sharded.Resize(shards)
+	if err != nil {
+		t.Fatalf("Could not resize: %v", err)
+	}
+	checkConcurrent(t, sharded)
+}
+
+func TestConcurrentNode(t *testing.T) {
+	embedders.EmbedderRegister["vector-embedder"] = VectorEmbed
+	node := MakeNode()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer listener.Close()
+	go node.Serve(listener)
+
+	shards := make([]Shard, 3)
+	for i := range shards {
+		name := fmt.Sprintf("test-concurrent-%d", i)
+		// a bare collection: the node has to lock it
+		coll, err := collection.MakeCollection(name, "vector-embedder")
+		if err != nil {
+			t.Fatalf("Could not make collection: %v", err)
+		}
+		err = node.AddShard(name, coll)
+		if err != nil {
+			t.Fatalf("Could not add shard %s: %v", name, err)
+		}
+		remote, err := DialShard(listener.Addr().String(), name)
+		if err != nil {
+			t.Fatalf("Could not dial shard %s: %v", name, err)
+		}
+		defer remote.Close()
+		shards[i] = remote
+	}
+	sharded, _ := makeTestCollections(t, shards, 100)
+	checkConcurrent(t, sharded)
+}
@@ -0,0 +1,345 @@
+// Package shell is an interactive prompt over a SimpleDataBase, for poking
+// around a database file without writing any Go
+package shell
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	collection "go-simple-embedding-database/collection"
+	database "go-simple-embedding-database/database"
+)
+
+const help = `commands:
+  collections            list the collections in the database
+  use <collection>       run the following commands against a collection
+  query <text> [k]       show the k (default 5) records most similar to text
+  show <recordId>        show a record
+  peek [n]               show the first n (default 5) records added
+  delete <recordId>      delete a record
+  save [file]            write the database back to its file (or another one)
+  help                   show this message
+  exit                   leave the shell
+
+Tab completes commands, collection IDs and record IDs.
+`
+
+var commands = []string{"collections", "use", "query", "show", "peek", "delete", "save", "help", "exit", "quit"}
+
+const defaultK = 5
+
+type Shell struct {
+	db   *database.SimpleDataBase
+	path string
+	out  io.Writer
+
+	collectionId string
+	// set when the database has changes that haven't been saved yet
+	dirty bool
+	// set after exit was refused because of unsaved changes
+	warnedExit bool
+}
+
+func MakeShell(db *database.SimpleDataBase, path string, out io.Writer) *Shell {
+	return &Shell{db: db, path: path, out: out}
+}
+
+// Open loads a database file written by SimpleDataBase.ToFile or
+// SimpleDataBase.ToBinaryFile
+func Open(path string, out io.Writer) (*Shell, error) {
+	db, err := database.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return MakeShell(db, path, out), nil
+}
+
+func (s *Shell) Prompt() string {
+	if s.collectionId == "" {
+		return "sedb> "
+	}
+	return fmt.Sprintf("sedb:%s> ", s.collectionId)
+}
+
+// Execute runs one line of input. quit is true once the user has asked to
+// leave the shell
+func (s *Shell) Execute(line string) (quit bool, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false, nil
+	}
+	command, args := fields[0], fields[1:]
+	if command != "exit" && command != "quit" {
+		s.warnedExit = false
+	}
+
+	switch command {
+	case "help":
+		fmt.Fprint(s.out, help)
+	case "collections":
+		return false, s.listCollections()
+	case "use":
+		return false, s.use(args)
+	case "query":
+		return false, s.query(args)
+	case "show":
+		return false, s.show(args)
+	case "peek":
+		return false, s.peek(args)
+	case "delete":
+		return false, s.delete(args)
+	case "save":
+		return false, s.save(args)
+	case "exit", "quit":
+		if s.dirty && !s.warnedExit {
+			s.warnedExit = true
+			return false, errors.New("there are unsaved changes - run save, or exit again to throw them away")
+		}
+		return true, nil
+	default:
+		return false, errors.New(fmt.Sprintf("unknown command %q (try help)", command))
+	}
+	return false, nil
+}
+
+func (s *Shell) currentCollection() (string, error) {
+	if s.collectionId == "" {
+		return "", errors.New("no collection selected - run use <collection> first")
+	}
+	return s.collectionId, nil
+}
+
+func (s *Shell) collectionIds() []string {
+	ids := make([]string, 0)
+	for id := range s.db.GetCollections() {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func (s *Shell) recordIds() []string {
+	if s.collectionId == "" {
+		return nil
+	}
+	page, err := s.db.ListRecords(s.collectionId, collection.ListOptions{ExcludeEmbeddings: true, ExcludeBlobs: true})
+	if err != nil {
+		return nil
+	}
+	ids := make([]string, len(page.Records))
+	for i, record := range page.Records {
+		ids[i] = record.Id
+	}
+	return ids
+}
+
+func (s *Shell) listCollections() error {
+	for _, id := range s.collectionIds() {
+		count, err := s.db.Count(id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(s.out, "%s (%d records)\n", id, count)
+	}
+	return nil
+}
+
+func (s *Shell) use(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: use <collection>")
+	}
+	_, err := s.db.GetCollection(args[0])
+	if err != nil {
+		return err
+	}
+	s.collectionId = args[0]
+	return nil
+}
+
+func (s *Shell) query(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: query <text> [k]")
+	}
+	collectionId, err := s.currentCollection()
+	if err != nil {
+		return err
+	}
+	k := defaultK
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[len(args)-1])
+		if err == nil {
+			k = n
+			args = args[:len(args)-1]
+		}
+	}
+	if k < 1 {
+		return errors.New(fmt.Sprintf("k must be at least 1 (got %d)", k))
+	}
+
+	results, err := s.db.QueryWithOptions(collectionId, []byte(strings.Join(args, " ")), collection.QueryOptions{NGreatest: k})
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		fmt.Fprintln(s.out, "no results")
+	}
+	for i, result := range results {
+		fmt.Fprintf(s.out, "%d. (%.4f) %s\n", i+1, result.Similarity, result.Record)
+	}
+	return nil
+}
+
+func (s *Shell) show(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: show <recordId>")
+	}
+	collectionId, err := s.currentCollection()
+	if err != nil {
+		return err
+	}
+	record, err := s.db.GetRecord(collectionId, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(s.out, record)
+	return nil
+}
+
+func (s *Shell) peek(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: peek [n]")
+	}
+	collectionId, err := s.currentCollection()
+	if err != nil {
+		return err
+	}
+	n := defaultK
+	if len(args) == 1 {
+		n, err = strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return errors.New(fmt.Sprintf("n must be a positive number (got %q)", args[0]))
+		}
+	}
+	peeked, err := s.db.Peek(collectionId, n)
+	if err != nil {
+		return err
+	}
+	if len(peeked) == 0 {
+		fmt.Fprintln(s.out, "collection is empty")
+	}
+	for _, record := range peeked {
+		fmt.Fprintln(s.out, record)
+	}
+	return nil
+}
+
+func (s *Shell) delete(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: delete <recordId>")
+	}
+	collectionId, err := s.currentCollection()
+	if err != nil {
+		return err
+	}
+	err = s.db.DeleteRecord(collectionId, args[0])
+	if err != nil {
+		return err
+	}
+	s.dirty = true
+	fmt.Fprintf(s.out, "deleted %s\n", args[0])
+	return nil
+}
+
+func (s *Shell) save(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: save [file]")
+	}
+	path := s.path
+	if len(args) == 1 {
+		path = args[0]
+	}
+	if path == "" {
+		return errors.New("no file to save to - run save <file>")
+	}
+	err := s.db.ToFile(path)
+	if err != nil {
+		return err
+	}
+	if path == s.path {
+		s.dirty = false
+	}
+	fmt.Fprintf(s.out, "saved to %s\n", path)
+	return nil
+}
+
+// Complete returns the possible completions for the last word of line
+func (s *Shell) Complete(line string) []string {
+	fields := strings.Fields(line)
+	startingWord := len(fields) == 0 || strings.HasSuffix(line, " ")
+	prefix := ""
+	if !startingWord {
+		prefix = fields[len(fields)-1]
+		fields = fields[:len(fields)-1]
+	}
+
+	var candidates []string
+	switch {
+	case len(fields) == 0:
+		candidates = commands
+	case len(fields) == 1 && fields[0] == "use":
+		candidates = s.collectionIds()
+	case len(fields) == 1 && (fields[0] == "show" || fields[0] == "delete"):
+		candidates = s.recordIds()
+	}
+
+	matches := make([]string, 0)
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, prefix) {
+			matches = append(matches, candidate)
+		}
+	}
+	return matches
+}
+
+// completeLine replaces the last word of line with the longest prefix
+// shared by all of its completions
+func (s *Shell) completeLine(line string) (string, bool) {
+	matches := s.Complete(line)
+	if len(matches) == 0 {
+		return line, false
+	}
+	common := matches[0]
+	for _, match := range matches[1:] {
+		for !strings.HasPrefix(match, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	start := strings.LastIndexAny(line, " \t") + 1
+	completed := line[:start] + common
+	if len(matches) == 1 {
+		completed += " "
+	}
+	return completed, completed != line
+}
+
+// Run reads commands from in until it runs out of input or the user exits.
+// It's meant for scripted input; interactive sessions should use RunTerminal
+func (s *Shell) Run(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		quit, err := s.Execute(scanner.Text())
+		if err != nil {
+			fmt.Fprintf(s.out, "error: %v\n", err)
+		}
+		if quit {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,168 @@
+package shell
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	collection "go-simple-embedding-database/collection"
+	database "go-simple-embedding-database/database"
+	embedders "go-simple-embedding-database/embedders"
+	records "go-simple-embedding-database/records"
+)
+
+func VectorEmbed(blob []byte) ([]float64, error) {
+	vector := make([]float64, 0)
+	for _, field := range strings.Split(string(blob), ",") {
+		value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, err
+		}
+		vector = append(vector, value)
+	}
+	return vector, nil
+}
+
+func makeTestFile(t *testing.T) string {
+	embedders.EmbedderRegister["vector-embedder"] = VectorEmbed
+	db := database.MakeDatabase()
+	for _, id := range []string{"docs", "drafts"} {
+		coll, err := collection.MakeCollection(id, "vector-embedder")
+		if err != nil {
+			t.Fatalf("Could not create collection: %v", err)
+		}
+		err = db.AddCollection(coll)
+		if err != nil {
+			t.Fatalf("Could not add collection: %v", err)
+		}
+	}
+	for id, vector := range map[string]string{"page-1": "1,0", "page-2": "0,1", "index": "1,1"} {
+		record, err := records.MakeRecord("vector-embedder", []byte(vector), id)
+		if err != nil {
+			t.Fatalf("Could not create record: %v", err)
+		}
+		err = db.AddRecord("docs", record)
+		if err != nil {
+			t.Fatalf("Could not add record: %v", err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "db.json")
+	err := db.ToFile(path)
+	if err != nil {
+		t.Fatalf("Could not write database: %v", err)
+	}
+	return path
+}
+
+func runScript(t *testing.T, sh *Shell, out *bytes.Buffer, script string) string {
+	out.Reset()
+	err := sh.Run(strings.NewReader(script))
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	return out.String()
+}
+
+func TestCommands(t *testing.T) {
+	path := makeTestFile(t)
+	out := &bytes.Buffer{}
+	sh, err := Open(path, out)
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+
+	output := runScript(t, sh, out, "collections\n")
+	if output != "docs (3 records)\ndrafts (0 records)\n" {
+		t.Errorf("Unexpected collections output %q", output)
+	}
+
+	output = runScript(t, sh, out, "query 1,0\n")
+	if !strings.Contains(output, "no collection selected") {
+		t.Errorf("Expected query without a collection to fail, got %q", output)
+	}
+
+	output = runScript(t, sh, out, "use docs\nquery 1,0.1 2\n")
+	expected := "1. (0.9950) Embedding{Embedding: [1.00, 0.00], EmbedderId: vector-embedder, Blob: 1,0, Id: page-1}\n" +
+		"2. (0.7740) Embedding{Embedding: [1.00, 1.00], EmbedderId: vector-embedder, Blob: 1,1, Id: index}\n"
+	if output != expected {
+		t.Errorf("Unexpected query output:\n%s\nexpected:\n%s", output, expected)
+	}
+	if sh.Prompt() != "sedb:docs> " {
+		t.Errorf("Unexpected prompt %q", sh.Prompt())
+	}
+
+	output = runScript(t, sh, out, "show page-2\n")
+	if !strings.Contains(output, "Id: page-2") {
+		t.Errorf("Unexpected show output %q", output)
+	}
+	output = runScript(t, sh, out, "peek 2\n")
+	if strings.Count(output, "\n") != 2 {
+		t.Errorf("Expected peek to show 2 records, got %q", output)
+	}
+
+	// deleting makes exit ask for confirmation
+	output = runScript(t, sh, out, "delete page-2\nexit\n")
+	if !strings.Contains(output, "deleted page-2") || !strings.Contains(output, "unsaved changes") {
+		t.Errorf("Unexpected delete output %q", output)
+	}
+	output = runScript(t, sh, out, "save\nexit\nhelp\n")
+	if !strings.Contains(output, "saved to") || strings.Contains(output, "commands:") {
+		t.Errorf("Expected save then exit to stop the shell, got %q", output)
+	}
+
+	reopened, err := Open(path, out)
+	if err != nil {
+		t.Fatalf("Could not reopen database: %v", err)
+	}
+	output = runScript(t, reopened, out, "use docs\nshow page-2\n")
+	if !strings.Contains(output, "error:") {
+		t.Errorf("Expected the deleted record to be gone after saving, got %q", output)
+	}
+
+	output = runScript(t, sh, out, "frobnicate\n")
+	if !strings.Contains(output, "unknown command") {
+		t.Errorf("Unexpected output for unknown command %q", output)
+	}
+}
+
+func TestComplete(t *testing.T) {
+	path := makeTestFile(t)
+	sh, err := Open(path, &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+
+	cases := []struct {
+		line     string
+		expected []string
+	}{
+		{"", commands},
+		{"qu", []string{"query", "quit"}},
+		{"use ", []string{"docs", "drafts"}},
+		{"use dr", []string{"drafts"}},
+		{"show ", []string{}},
+	}
+	for _, c := range cases {
+		matches := sh.Complete(c.line)
+		if !reflect.DeepEqual(matches, c.expected) {
+			t.Errorf("Complete(%q): expected %v, got %v", c.line, c.expected, matches)
+		}
+	}
+
+	sh.Execute("use docs")
+	matches := sh.Complete("show pa")
+	if !reflect.DeepEqual(matches, []string{"page-1", "page-2"}) {
+		t.Errorf("Expected record IDs to complete, got %v", matches)
+	}
+	line, ok := sh.completeLine("show pa")
+	if !ok || line != "show page-" {
+		t.Errorf("Expected completion up to the common prefix, got %q", line)
+	}
+	line, ok = sh.completeLine("delete in")
+	if !ok || line != "delete index " {
+		t.Errorf("Expected a unique completion, got %q", line)
+	}
+}
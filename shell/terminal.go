@@ -0,0 +1,53 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/term"
+)
+
+// RunTerminal runs an interactive session on a terminal, with line editing,
+// history (up and down arrows) and tab completion
+func (s *Shell) RunTerminal(in io.Reader, out io.Writer, fd int) error {
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, oldState)
+
+	terminal := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{in, out}, s.Prompt())
+	terminal.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' || pos != len(line) {
+			return "", 0, false
+		}
+		completed, ok := s.completeLine(line)
+		return completed, len(completed), ok
+	}
+
+	// output has to go through the terminal while it's in raw mode so that
+	// newlines get translated
+	s.out = terminal
+	fmt.Fprintln(terminal, "type help for a list of commands")
+	for {
+		terminal.SetPrompt(s.Prompt())
+		line, err := terminal.ReadLine()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		quit, err := s.Execute(line)
+		if err != nil {
+			fmt.Fprintf(terminal, "error: %v\n", err)
+		}
+		if quit {
+			return nil
+		}
+	}
+}
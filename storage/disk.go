@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	collection "go-simple-embedding-database/collection"
+	records "go-simple-embedding-database/records"
+)
+
+// DiskEngine keeps collections in a bbolt file. The file has two buckets:
+// collections, which maps each collection ID to its CollectionInfo as JSON,
+// and records, which has a bucket per collection mapping record IDs to
+// encoded records (see encodeRecord)
+type DiskEngine struct {
+	db *bolt.DB
+}
+
+var (
+	collectionsBucket = []byte("collections")
+	recordsBucket     = []byte("records")
+)
+
+// OpenDiskEngine opens the bbolt file at path, creating it if it doesn't
+// exist. Only one process can have the file open at a time
+func OpenDiskEngine(path string) (*DiskEngine, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Could not open %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(collectionsBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(recordsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DiskEngine{db: db}, nil
+}
+
+func (engine DiskEngine) Path() string {
+	return engine.db.Path()
+}
+
+func (engine DiskEngine) Close() error {
+	return engine.db.Close()
+}
+
+func noCollection(collectionId string) error {
+	return fmt.Errorf("%w: %s", collection.ErrCollectionNotFound, collectionId)
+}
+
+func collectionExists(collectionId string) error {
+	return fmt.Errorf("%w: %s", collection.ErrCollectionExists, collectionId)
+}
+
+// recordBucket returns the bucket holding a collection's records
+func recordBucket(tx *bolt.Tx, collectionId string) (*bolt.Bucket, error) {
+	bucket := tx.Bucket(recordsBucket).Bucket([]byte(collectionId))
+	if bucket == nil {
+		return nil, noCollection(collectionId)
+	}
+	return bucket, nil
+}
+
+func (engine DiskEngine) CreateCollection(info CollectionInfo) error {
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return engine.db.Update(func(tx *bolt.Tx) error {
+		collections := tx.Bucket(collectionsBucket)
+		if collections.Get([]byte(info.Id)) != nil {
+			return collectionExists(info.Id)
+		}
+		_, err := tx.Bucket(recordsBucket).CreateBucket([]byte(info.Id))
+		if err != nil {
+			return err
+		}
+		return collections.Put([]byte(info.Id), encoded)
+	})
+}
+
+func (engine DiskEngine) UpdateCollection(info CollectionInfo) error {
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return engine.db.Update(func(tx *bolt.Tx) error {
+		collections := tx.Bucket(collectionsBucket)
+		if collections.Get([]byte(info.Id)) == nil {
+			return noCollection(info.Id)
+		}
+		return collections.Put([]byte(info.Id), encoded)
+	})
+}
+
+func (engine DiskEngine) DeleteCollection(collectionId string) error {
+	return engine.db.Update(func(tx *bolt.Tx) error {
+		collections := tx.Bucket(collectionsBucket)
+		if collections.Get([]byte(collectionId)) == nil {
+			return noCollection(collectionId)
+		}
+		err := tx.Bucket(recordsBucket).DeleteBucket([]byte(collectionId))
+		if err != nil {
+			return err
+		}
+		return collections.Delete([]byte(collectionId))
+	})
+}
+
+func (engine DiskEngine) ListCollections() ([]CollectionInfo, error) {
+	infos := make([]CollectionInfo, 0)
+	err := engine.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(collectionsBucket).ForEach(func(key, value []byte) error {
+			info := CollectionInfo{}
+			err := json.Unmarshal(value, &info)
+			if err != nil {
+				return fmt.Errorf("%w: could not decode collection %s: %w", ErrCorrupt, key, err)
+			}
+			infos = append(infos, info)
+			return nil
+		})
+	})
+	return infos, err
+}
+
+func (engine DiskEngine) GetRecord(collectionId string, recordId string) (records.Record, bool, error) {
+	record := records.Record{}
+	found := false
+	err := engine.db.View(func(tx *bolt.Tx) error {
+		bucket, err := recordBucket(tx, collectionId)
+		if err != nil {
+			return err
+		}
+		value := bucket.Get([]byte(recordId))
+		if value == nil {
+			return nil
+		}
+		found = true
+		record, err = decodeRecord(value)
+		return err
+	})
+	return record, found, err
+}
+
+func (engine DiskEngine) PutRecord(collectionId string, record records.Record) error {
+	encoded, err := encodeRecord(record)
+	if err != nil {
+		return err
+	}
+	return engine.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := recordBucket(tx, collectionId)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(record.Id), encoded)
+	})
+}
+
+func (engine DiskEngine) DeleteRecord(collectionId string, recordId string) (bool, error) {
+	found := false
+	err := engine.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := recordBucket(tx, collectionId)
+		if err != nil {
+			return err
+		}
+		found = bucket.Get([]byte(recordId)) != nil
+		return bucket.Delete([]byte(recordId))
+	})
+	return found, err
+}
+
+// ScanRecords runs inside a read transaction. bbolt keys are sorted bytewise,
+// which is the same order Go sorts strings in
+func (engine DiskEngine) ScanRecords(collectionId string, fn func(record records.Record) bool) error {
+	return engine.ScanRecordsAfter(collectionId, "", fn)
+}
+
+// ScanRecordsAfter seeks straight to afterId rather than reading the records
+// before it
+func (engine DiskEngine) ScanRecordsAfter(collectionId string, afterId string, fn func(record records.Record) bool) error {
+	return engine.db.View(func(tx *bolt.Tx) error {
+		bucket, err := recordBucket(tx, collectionId)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		key, value := cursor.Seek([]byte(afterId))
+		if key != nil && string(key) == afterId {
+			key, value = cursor.Next()
+		}
+		for ; key != nil; key, value = cursor.Next() {
+			record, err := decodeRecord(value)
+			if err != nil {
+				return fmt.Errorf("%w: could not decode record %s: %w", ErrCorrupt, key, err)
+			}
+			if !fn(record) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// Records are stored as the length of their JSON (a little endian uint32),
+// the record as JSON minus its embedding, then the embedding as little
+// endian float64s. Keeping the embedding out of the JSON makes decoding it
+// during a scan cheap
+func encodeRecord(record records.Record) ([]byte, error) {
+	embedding := record.Embedding
+	record.Embedding = nil
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	if len(encoded) > math.MaxUint32 {
+		return nil, fmt.Errorf("%w: %s", ErrRecordTooLarge, record.Id)
+	}
+	value := make([]byte, 4, 4+len(encoded)+8*len(embedding))
+	binary.LittleEndian.PutUint32(value, uint32(len(encoded)))
+	value = append(value, encoded...)
+	for _, x := range embedding {
+		value = binary.LittleEndian.AppendUint64(value, math.Float64bits(x))
+	}
+	return value, nil
+}
+
+// decodeRecord copies everything out of value, which bbolt only keeps valid
+// until the transaction ends
+func decodeRecord(value []byte) (records.Record, error) {
+	record := records.Record{}
+	if len(value) < 4 {
+		return record, fmt.Errorf("%w: stored record is truncated", ErrCorrupt)
+	}
+	length := int(binary.LittleEndian.Uint32(value))
+	if length > len(value)-4 || (len(value)-4-length)%8 != 0 {
+		return record, fmt.Errorf("%w: stored record is truncated", ErrCorrupt)
+	}
+	err := json.Unmarshal(value[4:4+length], &record)
+	if err != nil {
+		return record, err
+	}
+	vector := value[4+length:]
+	record.Embedding = make([]float64, len(vector)/8)
+	for i := range record.Embedding {
+		record.Embedding[i] = math.Float64frombits(binary.LittleEndian.Uint64(vector[i*8:]))
+	}
+	return record, nil
+}
@@ -0,0 +1,93 @@
+// Package storage has the engines a SimpleDataBase can keep its collections
+// in. MemoryEngine holds everything in maps, the same way a database made
+// with MakeDatabase does, and DiskEngine keeps everything in a bbolt file so
+// databases can outgrow memory and survive restarts
+package storage
+
+import (
+	"errors"
+	"time"
+
+	collection "go-simple-embedding-database/collection"
+	records "go-simple-embedding-database/records"
+)
+
+// ErrCorrupt is returned for stored collections or records that can't be
+// decoded
+var ErrCorrupt = errors.New("Stored data is corrupt")
+
+// ErrRecordTooLarge is returned for records too large for an engine to store
+var ErrRecordTooLarge = errors.New("Record is too large to store")
+
+// CollectionInfo is everything about a collection apart from its records
+type CollectionInfo struct {
+	Id         string        `json:"id"`
+	EmbedderId string        `json:"embedderId"`
+	TTL        time.Duration `json:"ttl,omitempty"`
+}
+
+func Info(coll collection.Collection) CollectionInfo {
+	return CollectionInfo{Id: coll.Id, EmbedderId: coll.EmbedderId, TTL: coll.TTL}
+}
+
+// Engine stores collections and their records. Engines are safe to use from
+// several goroutines at once. The record methods return an error if the
+// collection doesn't exist
+type Engine interface {
+	// CreateCollection returns an error if the collection already exists
+	CreateCollection(info CollectionInfo) error
+	// UpdateCollection changes an existing collection's info
+	UpdateCollection(info CollectionInfo) error
+	// DeleteCollection deletes the collection along with its records
+	DeleteCollection(collectionId string) error
+	// ListCollections returns every collection in ID order
+	ListCollections() ([]CollectionInfo, error)
+
+	// GetRecord returns false if there's no record with the ID
+	GetRecord(collectionId string, recordId string) (records.Record, bool, error)
+	// PutRecord adds the record, replacing any with the same ID
+	PutRecord(collectionId string, record records.Record) error
+	// DeleteRecord returns false if there was no record with the ID
+	DeleteRecord(collectionId string, recordId string) (bool, error)
+	// ScanRecords calls fn with every record in the collection, in ID order,
+	// until fn returns false. This is what queries are answered from. fn
+	// must not change the engine
+	ScanRecords(collectionId string, fn func(record records.Record) bool) error
+	// ScanRecordsAfter is ScanRecords starting after the record with ID
+	// afterId, which doesn't have to exist. Listing pages by ID uses it to
+	// pick up where the last page left off
+	ScanRecordsAfter(collectionId string, afterId string, fn func(record records.Record) bool) error
+
+	Close() error
+}
+
+type collectionStore struct {
+	engine       Engine
+	collectionId string
+}
+
+// Store gives a collection's records in the engine the shape
+// collection.Collection expects
+func Store(engine Engine, collectionId string) collection.RecordStore {
+	return collectionStore{engine: engine, collectionId: collectionId}
+}
+
+func (s collectionStore) GetRecord(recordId string) (records.Record, bool, error) {
+	return s.engine.GetRecord(s.collectionId, recordId)
+}
+
+func (s collectionStore) PutRecord(record records.Record) error {
+	return s.engine.PutRecord(s.collectionId, record)
+}
+
+func (s collectionStore) DeleteRecord(recordId string) (bool, error) {
+	return s.engine.DeleteRecord(s.collectionId, recordId)
+}
+
+func (s collectionStore) ScanRecords(fn func(record records.Record) bool) error {
+	return s.engine.ScanRecords(s.collectionId, fn)
+}
+
+func (s collectionStore) ScanRecordsAfter(afterId string, fn func(record records.Record) bool) error {
+	return s.engine.ScanRecordsAfter(s.collectionId, afterId, fn)
+}
@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	collection "go-simple-embedding-database/collection"
+	records "go-simple-embedding-database/records"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// every engine has to pass testEngine
+var engines = map[string]func(t *testing.T) Engine{
+	"memory": func(t *testing.T) Engine {
+		return MakeMemoryEngine()
+	},
+	"disk": func(t *testing.T) Engine {
+		engine, err := OpenDiskEngine(filepath.Join(t.TempDir(), "engine.db"))
+		if err != nil {
+			t.Fatalf("Could not open disk engine: %v", err)
+		}
+		return engine
+	},
+}
+
+func TestEngines(t *testing.T) {
+	for name, makeEngine := range engines {
+		t.Run(name, func(t *testing.T) {
+			engine := makeEngine(t)
+			defer engine.Close()
+			testEngine(t, engine)
+		})
+	}
+}
+
+func makeTestRecord(id string, embedding ...float64) records.Record {
+	return records.Record{
+		Id:         id,
+		EmbedderId: "test-embedder",
+		Blob:       []byte("blob " + id),
+		Embedding:  embedding,
+		Metadata:   map[string]string{"id": id},
+		CreatedAt:  time.Date(2024, time.March, 13, 15, 42, 10, 123456789, time.UTC),
+	}
+}
+
+func scanIds(t *testing.T, engine Engine, collectionId string) []string {
+	t.Helper()
+	ids := make([]string, 0)
+	err := engine.ScanRecords(collectionId, func(record records.Record) bool {
+		ids = append(ids, record.Id)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Could not scan %s: %v", collectionId, err)
+	}
+	return ids
+}
+
+func testEngine(t *testing.T, engine Engine) {
+	docs := CollectionInfo{Id: "docs", EmbedderId: "test-embedder"}
+	news := CollectionInfo{Id: "news", EmbedderId: "test-embedder", TTL: time.Hour}
+	for _, info := range []CollectionInfo{news, docs} {
+		err := engine.CreateCollection(info)
+		if err != nil {
+			t.Fatalf("Could not create collection %s: %v", info.Id, err)
+		}
+	}
+	err := engine.CreateCollection(docs)
+	if err == nil {
+		t.Errorf("Should not have been able to create a collection twice")
+	}
+	infos, err := engine.ListCollections()
+	if err != nil {
+		t.Fatalf("Could not list collections: %v", err)
+	}
+	if !reflect.DeepEqual(infos, []CollectionInfo{docs, news}) {
+		t.Errorf("Unexpected collections %v", infos)
+	}
+	docs.TTL = time.Minute
+	err = engine.UpdateCollection(docs)
+	if err != nil {
+		t.Fatalf("Could not update collection: %v", err)
+	}
+	infos, _ = engine.ListCollections()
+	if infos[0].TTL != time.Minute {
+		t.Errorf("Expected the collection update to stick, got %v", infos[0])
+	}
+	err = engine.UpdateCollection(CollectionInfo{Id: "missing"})
+	if err == nil {
+		t.Errorf("Should not have been able to update a missing collection")
+	}
+
+	// records
+	for _, record := range []records.Record{makeTestRecord("b", 0, 1), makeTestRecord("a", 1, 0), makeTestRecord("c", 1, 1)} {
+		err = engine.PutRecord("docs", record)
+		if err != nil {
+			t.Fatalf("Could not put record %s: %v", record.Id, err)
+		}
+	}
+	record, ok, err := engine.GetRecord("docs", "a")
+	if err != nil || !ok {
+		t.Fatalf("Could not get record: %v", err)
+	}
+	if !reflect.DeepEqual(record, makeTestRecord("a", 1, 0)) {
+		t.Errorf("Not equal (expected %v, got %v)", makeTestRecord("a", 1, 0), record)
+	}
+	_, ok, err = engine.GetRecord("docs", "missing")
+	if err != nil || ok {
+		t.Errorf("Expected a missing record not to be found, got %v, %v", ok, err)
+	}
+	_, _, err = engine.GetRecord("missing", "a")
+	if err == nil {
+		t.Errorf("Should not have been able to get a record from a missing collection")
+	}
+	err = engine.PutRecord("missing", makeTestRecord("a", 1))
+	if err == nil {
+		t.Errorf("Should not have been able to put a record in a missing collection")
+	}
+
+	replaced := makeTestRecord("a", 0.5, 0.5)
+	replaced.UpdatedAt = time.Date(2024, time.March, 14, 0, 0, 0, 0, time.UTC)
+	err = engine.PutRecord("docs", replaced)
+	if err != nil {
+		t.Fatalf("Could not replace record: %v", err)
+	}
+	record, _, _ = engine.GetRecord("docs", "a")
+	if !reflect.DeepEqual(record, replaced) {
+		t.Errorf("Not equal (expected %v, got %v)", replaced, record)
+	}
+
+	// scans come back in ID order and stop when asked to
+	if !reflect.DeepEqual(scanIds(t, engine, "docs"), []string{"a", "b", "c"}) {
+		t.Errorf("Expected a scan in ID order, got %v", scanIds(t, engine, "docs"))
+	}
+	if len(scanIds(t, engine, "news")) != 0 {
+		t.Errorf("Expected an empty collection to scan nothing")
+	}
+	scanned := 0
+	err = engine.ScanRecords("docs", func(record records.Record) bool {
+		scanned += 1
+		return false
+	})
+	if err != nil || scanned != 1 {
+		t.Errorf("Expected the scan to stop after 1 record, scanned %d (%v)", scanned, err)
+	}
+	err = engine.ScanRecords("missing", func(record records.Record) bool { return true })
+	if err == nil {
+		t.Errorf("Should not have been able to scan a missing collection")
+	}
+	// scans can start part way through, after an ID that may not exist
+	for afterId, expected := range map[string][]string{"a": {"b", "c"}, "ab": {"b", "c"}, "c": {}, "": {"a", "b", "c"}} {
+		scannedIds := make([]string, 0)
+		err = engine.ScanRecordsAfter("docs", afterId, func(record records.Record) bool {
+			scannedIds = append(scannedIds, record.Id)
+			return true
+		})
+		if err != nil || !reflect.DeepEqual(scannedIds, expected) {
+			t.Errorf("Expected a scan after %q to get %v, got %v (%v)", afterId, expected, scannedIds, err)
+		}
+	}
+
+	deleted, err := engine.DeleteRecord("docs", "b")
+	if err != nil || !deleted {
+		t.Errorf("Expected the record to be deleted, got %v, %v", deleted, err)
+	}
+	deleted, err = engine.DeleteRecord("docs", "b")
+	if err != nil || deleted {
+		t.Errorf("Expected deleting a missing record to report false, got %v, %v", deleted, err)
+	}
+
+	// a collection store works the same as the engine underneath it
+	coll := collection.Collection{Id: "docs", EmbedderId: "test-embedder", Store: Store(engine, "docs")}
+	count, err := coll.Count()
+	if err != nil || count != 2 {
+		t.Errorf("Expected 2 records through the collection, got %d (%v)", count, err)
+	}
+	results, err := coll.QueryVector([]float64{1, 0.1}, collection.QueryOptions{NGreatest: 1})
+	if err != nil {
+		t.Fatalf("Could not query through the collection: %v", err)
+	}
+	if len(results) != 1 || results[0].Record.Id != "a" {
+		t.Errorf("Unexpected query results %v", results)
+	}
+
+	// deleting a collection takes its records with it
+	err = engine.DeleteCollection("docs")
+	if err != nil {
+		t.Fatalf("Could not delete collection: %v", err)
+	}
+	err = engine.DeleteCollection("docs")
+	if err == nil {
+		t.Errorf("Should not have been able to delete a collection twice")
+	}
+	err = engine.CreateCollection(docs)
+	if err != nil {
+		t.Fatalf("Could not recreate collection: %v", err)
+	}
+	if len(scanIds(t, engine, "docs")) != 0 {
+		t.Errorf("Expected a recreated collection to start empty")
+	}
+}
+
+func TestDiskEnginePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "engine.db")
+	engine, err := OpenDiskEngine(path)
+	if err != nil {
+		t.Fatalf("Could not open disk engine: %v", err)
+	}
+	info := CollectionInfo{Id: "docs", EmbedderId: "test-embedder", TTL: time.Hour}
+	engine.CreateCollection(info)
+	engine.PutRecord("docs", makeTestRecord("a", 1, 2, 3))
+	err = engine.Close()
+	if err != nil {
+		t.Fatalf("Could not close disk engine: %v", err)
+	}
+
+	engine, err = OpenDiskEngine(path)
+	if err != nil {
+		t.Fatalf("Could not reopen disk engine: %v", err)
+	}
+	defer engine.Close()
+	infos, _ := engine.ListCollections()
+	if !reflect.DeepEqual(infos, []CollectionInfo{info}) {
+		t.Errorf("Unexpected collections after reopening %v", infos)
+	}
+	record, ok, err := engine.GetRecord("docs", "a")
+	if err != nil || !ok || !reflect.DeepEqual(record, makeTestRecord("a", 1, 2, 3)) {
+		t.Errorf("Unexpected record after reopening %v (%v)", record, err)
+	}
+
+	_, err = decodeRecord([]byte{1, 2})
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected a truncated record to fail to decode with ErrCorrupt, got %v", err)
+	}
+	err = engine.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(recordsBucket).Bucket([]byte("docs")).Put([]byte("b"), []byte{1, 2})
+	})
+	if err != nil {
+		t.Fatalf("Could not write a truncated record: %v", err)
+	}
+	err = engine.ScanRecords("docs", func(record records.Record) bool { return true })
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected scanning a truncated record to fail with ErrCorrupt, got %v", err)
+	}
+}
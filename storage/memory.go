@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"slices"
+	"strings"
+	"sync"
+
+	records "go-simple-embedding-database/records"
+)
+
+type memoryCollection struct {
+	info    CollectionInfo
+	records map[string]records.Record
+}
+
+// MemoryEngine keeps everything in maps. Nothing survives the process
+type MemoryEngine struct {
+	mutex       *sync.RWMutex
+	collections map[string]*memoryCollection
+}
+
+func MakeMemoryEngine() *MemoryEngine {
+	return &MemoryEngine{mutex: &sync.RWMutex{}, collections: make(map[string]*memoryCollection)}
+}
+
+// getCollection expects the caller to hold the lock
+func (engine MemoryEngine) getCollection(collectionId string) (*memoryCollection, error) {
+	coll, ok := engine.collections[collectionId]
+	if !ok {
+		return nil, noCollection(collectionId)
+	}
+	return coll, nil
+}
+
+func (engine MemoryEngine) CreateCollection(info CollectionInfo) error {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	_, ok := engine.collections[info.Id]
+	if ok {
+		return collectionExists(info.Id)
+	}
+	engine.collections[info.Id] = &memoryCollection{info: info, records: make(map[string]records.Record)}
+	return nil
+}
+
+func (engine MemoryEngine) UpdateCollection(info CollectionInfo) error {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	coll, err := engine.getCollection(info.Id)
+	if err != nil {
+		return err
+	}
+	coll.info = info
+	return nil
+}
+
+func (engine MemoryEngine) DeleteCollection(collectionId string) error {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	_, err := engine.getCollection(collectionId)
+	if err != nil {
+		return err
+	}
+	delete(engine.collections, collectionId)
+	return nil
+}
+
+func (engine MemoryEngine) ListCollections() ([]CollectionInfo, error) {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	infos := make([]CollectionInfo, 0, len(engine.collections))
+	for _, coll := range engine.collections {
+		infos = append(infos, coll.info)
+	}
+	slices.SortFunc(infos, func(a, b CollectionInfo) int {
+		return strings.Compare(a.Id, b.Id)
+	})
+	return infos, nil
+}
+
+func (engine MemoryEngine) GetRecord(collectionId string, recordId string) (records.Record, bool, error) {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	coll, err := engine.getCollection(collectionId)
+	if err != nil {
+		return records.Record{}, false, err
+	}
+	record, ok := coll.records[recordId]
+	return record, ok, nil
+}
+
+func (engine MemoryEngine) PutRecord(collectionId string, record records.Record) error {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	coll, err := engine.getCollection(collectionId)
+	if err != nil {
+		return err
+	}
+	coll.records[record.Id] = record
+	return nil
+}
+
+func (engine MemoryEngine) DeleteRecord(collectionId string, recordId string) (bool, error) {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	coll, err := engine.getCollection(collectionId)
+	if err != nil {
+		return false, err
+	}
+	_, ok := coll.records[recordId]
+	delete(coll.records, recordId)
+	return ok, nil
+}
+
+// ScanRecords copies the records out under the lock and calls fn after
+// letting go of it, so fn is free to read from the engine
+func (engine MemoryEngine) ScanRecords(collectionId string, fn func(record records.Record) bool) error {
+	return engine.ScanRecordsAfter(collectionId, "", fn)
+}
+
+func (engine MemoryEngine) ScanRecordsAfter(collectionId string, afterId string, fn func(record records.Record) bool) error {
+	engine.mutex.RLock()
+	coll, err := engine.getCollection(collectionId)
+	if err != nil {
+		engine.mutex.RUnlock()
+		return err
+	}
+	scanned := make([]records.Record, 0, len(coll.records))
+	for recordId, record := range coll.records {
+		if recordId > afterId {
+			scanned = append(scanned, record)
+		}
+	}
+	engine.mutex.RUnlock()
+
+	slices.SortFunc(scanned, func(a, b records.Record) int {
+		return strings.Compare(a.Id, b.Id)
+	})
+	for _, record := range scanned {
+		if !fn(record) {
+			break
+		}
+	}
+	return nil
+}
+
+func (engine MemoryEngine) Close() error {
+	return nil
+}
@@ -0,0 +1,396 @@
+// Package tenant keeps many customers' databases apart. A Registry holds
+// tenants, a tenant holds databases, and a database holds collections, so
+// collection IDs only have to be unique within their database.
+//
+// The only way to reach a database is through its tenant's Tenant, which
+// only knows about its own databases, so there's no way to name another
+// tenant's collections. On disk every tenant gets its own directory, with a
+// bbolt file per database:
+//
+//	<dir>/<tenant>/tenant.json       the tenant's quota
+//	<dir>/<tenant>/<database>.db     a database's collections
+//
+// A tenant's quota covers all of its databases together
+package tenant
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	database "go-simple-embedding-database/database"
+	storage "go-simple-embedding-database/storage"
+)
+
+const (
+	tenantFile        = "tenant.json"
+	databaseExtension = ".db"
+)
+
+// names end up in file names, so they're kept to characters that are safe
+// there. They can't start with a dot, which rules out . and ..
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+func checkName(kind string, name string) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("%w: %s %q (names are 1-63 letters, digits, _, . and -, and can't start with _, . or -)", ErrInvalidName, kind, name)
+	}
+	return nil
+}
+
+var (
+	// a tenant or database name that isn't allowed
+	ErrInvalidName      = errors.New("Invalid name")
+	ErrTenantNotFound   = errors.New("Tenant does not exist")
+	ErrTenantExists     = errors.New("Tenant already exists")
+	ErrDatabaseNotFound = errors.New("Database does not exist")
+	ErrDatabaseExists   = errors.New("Database already exists")
+)
+
+var errRegistryClosed = errors.New("The tenant registry is closed")
+
+// Registry holds tenants, either in memory or in a directory
+type Registry struct {
+	// empty for a registry in memory
+	dir     string
+	mutex   *sync.Mutex
+	tenants map[string]*Tenant
+	closed  bool
+}
+
+// MakeRegistry makes a registry that keeps everything in memory
+func MakeRegistry() *Registry {
+	return &Registry{mutex: &sync.Mutex{}, tenants: make(map[string]*Tenant)}
+}
+
+// OpenRegistry opens the registry in dir, creating dir if it doesn't exist
+// and opening every tenant and database already there. Close closes them
+func OpenRegistry(dir string) (*Registry, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	registry := MakeRegistry()
+	registry.dir = dir
+	for _, entry := range entries {
+		if !entry.IsDir() || checkName("tenant", entry.Name()) != nil {
+			continue
+		}
+		tenant, err := openTenant(filepath.Join(dir, entry.Name()), entry.Name())
+		if err != nil {
+			registry.Close()
+			return nil, fmt.Errorf("Could not open tenant %s: %w", entry.Name(), err)
+		}
+		registry.tenants[tenant.name] = tenant
+	}
+	return registry, nil
+}
+
+func (registry *Registry) CreateTenant(name string, quota database.Quota) (*Tenant, error) {
+	err := checkName("tenant", name)
+	if err != nil {
+		return nil, err
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if registry.closed {
+		return nil, errRegistryClosed
+	}
+	_, exists := registry.tenants[name]
+	if exists {
+		return nil, fmt.Errorf("%w: %s", ErrTenantExists, name)
+	}
+	tenant := makeTenant(name, quota)
+	if registry.dir != "" {
+		tenant.dir = filepath.Join(registry.dir, name)
+		err = os.Mkdir(tenant.dir, 0700)
+		if err != nil {
+			return nil, err
+		}
+		err = tenant.saveQuota(quota)
+		if err != nil {
+			os.RemoveAll(tenant.dir)
+			return nil, err
+		}
+	}
+	registry.tenants[name] = tenant
+	return tenant, nil
+}
+
+func (registry *Registry) Tenant(name string) (*Tenant, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	tenant, exists := registry.tenants[name]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrTenantNotFound, name)
+	}
+	return tenant, nil
+}
+
+// DeleteTenant deletes the tenant and all of its databases, files and all.
+// The tenant's Tenant stops working, and so do its databases if they're on
+// disk
+func (registry *Registry) DeleteTenant(name string) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	tenant, exists := registry.tenants[name]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrTenantNotFound, name)
+	}
+	delete(registry.tenants, name)
+	err := tenant.close()
+	if err != nil {
+		return err
+	}
+	if tenant.dir != "" {
+		return os.RemoveAll(tenant.dir)
+	}
+	return nil
+}
+
+// ListTenants returns the tenants' names in order
+func (registry *Registry) ListTenants() []string {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	names := make([]string, 0, len(registry.tenants))
+	for name := range registry.tenants {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Close closes every tenant's databases. The registry can't be used after
+func (registry *Registry) Close() error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.closed = true
+	errs := make([]error, 0)
+	for _, tenant := range registry.tenants {
+		err := tenant.close()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Tenant is one tenant's databases
+type Tenant struct {
+	name string
+	// empty for a tenant in memory
+	dir       string
+	quota     *database.QuotaTracker
+	mutex     *sync.Mutex
+	databases map[string]*database.SimpleDataBase
+	closed    bool
+}
+
+func makeTenant(name string, quota database.Quota) *Tenant {
+	return &Tenant{name: name, quota: database.MakeQuotaTracker(quota), mutex: &sync.Mutex{}, databases: make(map[string]*database.SimpleDataBase)}
+}
+
+func openTenant(dir string, name string) (*Tenant, error) {
+	encoded, err := os.ReadFile(filepath.Join(dir, tenantFile))
+	if err != nil {
+		return nil, err
+	}
+	quota := database.Quota{}
+	err = json.Unmarshal(encoded, &quota)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read %s: %w", tenantFile, err)
+	}
+	tenant := makeTenant(name, quota)
+	tenant.dir = dir
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		databaseName, ok := strings.CutSuffix(entry.Name(), databaseExtension)
+		if entry.IsDir() || !ok || checkName("database", databaseName) != nil {
+			continue
+		}
+		db, err := tenant.openDatabase(databaseName)
+		if err != nil {
+			tenant.close()
+			return nil, err
+		}
+		tenant.databases[databaseName] = db
+	}
+	return tenant, nil
+}
+
+func (tenant *Tenant) Name() string {
+	return tenant.name
+}
+
+func (tenant *Tenant) Quota() database.Quota {
+	return tenant.quota.Quota()
+}
+
+// Usage is what all of the tenant's databases hold between them
+func (tenant *Tenant) Usage() database.Usage {
+	return tenant.quota.Usage()
+}
+
+// SetQuota changes the tenant's quota. If the tenant is already over the
+// new quota, what it has is kept but nothing more can be added
+func (tenant *Tenant) SetQuota(quota database.Quota) error {
+	tenant.mutex.Lock()
+	defer tenant.mutex.Unlock()
+	if tenant.closed {
+		return tenant.closedError()
+	}
+	err := tenant.saveQuota(quota)
+	if err != nil {
+		return err
+	}
+	tenant.quota.SetQuota(quota)
+	return nil
+}
+
+func (tenant *Tenant) saveQuota(quota database.Quota) error {
+	if tenant.dir == "" {
+		return nil
+	}
+	encoded, err := json.Marshal(quota)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(tenant.dir, tenantFile), encoded, 0600)
+}
+
+func (tenant *Tenant) closedError() error {
+	return fmt.Errorf("%w: %s has been closed or deleted", ErrTenantNotFound, tenant.name)
+}
+
+// openDatabase opens (or creates) the database's file, or makes it in memory
+// for a tenant in memory
+func (tenant *Tenant) openDatabase(name string) (*database.SimpleDataBase, error) {
+	var db *database.SimpleDataBase
+	if tenant.dir == "" {
+		db = database.MakeDatabase()
+	} else {
+		engine, err := storage.OpenDiskEngine(filepath.Join(tenant.dir, name+databaseExtension))
+		if err != nil {
+			return nil, err
+		}
+		db, err = database.OpenDatabase(engine)
+		if err != nil {
+			engine.Close()
+			return nil, err
+		}
+	}
+	err := db.SetQuotaTracker(tenant.quota)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (tenant *Tenant) CreateDatabase(name string) (*database.SimpleDataBase, error) {
+	err := checkName("database", name)
+	if err != nil {
+		return nil, err
+	}
+	tenant.mutex.Lock()
+	defer tenant.mutex.Unlock()
+	if tenant.closed {
+		return nil, tenant.closedError()
+	}
+	_, exists := tenant.databases[name]
+	if exists {
+		return nil, fmt.Errorf("%w: %s in tenant %s", ErrDatabaseExists, name, tenant.name)
+	}
+	db, err := tenant.openDatabase(name)
+	if err != nil {
+		return nil, err
+	}
+	tenant.databases[name] = db
+	return db, nil
+}
+
+// Database returns one of the tenant's databases. Writes to it count
+// against the tenant's quota, and fail with database.ErrQuotaExceeded when
+// they'd go over
+func (tenant *Tenant) Database(name string) (*database.SimpleDataBase, error) {
+	tenant.mutex.Lock()
+	defer tenant.mutex.Unlock()
+	if tenant.closed {
+		return nil, tenant.closedError()
+	}
+	db, exists := tenant.databases[name]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s in tenant %s", ErrDatabaseNotFound, name, tenant.name)
+	}
+	return db, nil
+}
+
+// DeleteDatabase deletes the database and its file, releasing what it held
+// from the tenant's quota
+func (tenant *Tenant) DeleteDatabase(name string) error {
+	tenant.mutex.Lock()
+	defer tenant.mutex.Unlock()
+	if tenant.closed {
+		return tenant.closedError()
+	}
+	db, exists := tenant.databases[name]
+	if !exists {
+		return fmt.Errorf("%w: %s in tenant %s", ErrDatabaseNotFound, name, tenant.name)
+	}
+	// deleting the collections one at a time releases them from the quota
+	// under the database's lock, in step with anything still writing to it
+	for _, info := range db.ListCollections() {
+		err := db.DeleteCollection(info.Id)
+		if err != nil {
+			return err
+		}
+	}
+	delete(tenant.databases, name)
+	err := db.Close()
+	if err != nil {
+		return err
+	}
+	if tenant.dir != "" {
+		return os.Remove(filepath.Join(tenant.dir, name+databaseExtension))
+	}
+	return nil
+}
+
+// ListDatabases returns the names of the tenant's databases in order
+func (tenant *Tenant) ListDatabases() []string {
+	tenant.mutex.Lock()
+	defer tenant.mutex.Unlock()
+	names := make([]string, 0, len(tenant.databases))
+	for name := range tenant.databases {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (tenant *Tenant) close() error {
+	tenant.mutex.Lock()
+	defer tenant.mutex.Unlock()
+	if tenant.closed {
+		return nil
+	}
+	tenant.closed = true
+	errs := make([]error, 0)
+	for _, db := range tenant.databases {
+		errs = append(errs, db.Close())
+	}
+	return errors.Join(errs...)
+}
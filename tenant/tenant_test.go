@@ -0,0 +1,178 @@
+package tenant
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	collection "go-simple-embedding-database/collection"
+	database "go-simple-embedding-database/database"
+	embedders "go-simple-embedding-database/embedders"
+	records "go-simple-embedding-database/records"
+)
+
+func MockEmbed(blob []byte) ([]float64, error) {
+	return []float64{1.0, 2.0, 3.0}, nil
+}
+
+func addDocs(t *testing.T, db *database.SimpleDataBase, ids ...string) error {
+	t.Helper()
+	embedders.EmbedderRegister["mock-embedder"] = MockEmbed
+	if _, err := db.GetCollection("docs"); err != nil {
+		coll, _ := collection.MakeCollection("docs", "mock-embedder")
+		err = db.AddCollection(coll)
+		if err != nil {
+			t.Fatalf("Could not add collection: %v", err)
+		}
+	}
+	for _, id := range ids {
+		record, err := records.MakeRecord("mock-embedder", []byte(id), id)
+		if err != nil {
+			t.Fatalf("Could not make record: %v", err)
+		}
+		err = db.AddRecord("docs", record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestTenants(t *testing.T) {
+	dir := t.TempDir()
+	registry, err := OpenRegistry(dir)
+	if err != nil {
+		t.Fatalf("Could not open registry: %v", err)
+	}
+	acme, err := registry.CreateTenant("acme", database.Quota{MaxRecords: 3})
+	if err != nil {
+		t.Fatalf("Could not create tenant: %v", err)
+	}
+	globex, err := registry.CreateTenant("globex", database.Quota{})
+	if err != nil {
+		t.Fatalf("Could not create tenant: %v", err)
+	}
+	if _, err := registry.CreateTenant("acme", database.Quota{}); !errors.Is(err, ErrTenantExists) {
+		t.Errorf("Should not have been able to create acme twice")
+	}
+	for _, name := range []string{"", "..", ".hidden", "a/b", "-flag"} {
+		if _, err := registry.CreateTenant(name, database.Quota{}); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Should not have been able to create a tenant called %q", name)
+		}
+	}
+
+	// the same collection ID in different tenants (or databases) doesn't clash
+	acmeProd, _ := acme.CreateDatabase("prod")
+	acmeTest, _ := acme.CreateDatabase("test")
+	globexProd, _ := globex.CreateDatabase("prod")
+	if err := addDocs(t, acmeProd, "a", "b"); err != nil {
+		t.Fatalf("Could not add records: %v", err)
+	}
+	if err := addDocs(t, globexProd, "x", "y", "z", "w"); err != nil {
+		t.Fatalf("Could not add records: %v", err)
+	}
+	if _, err := acmeProd.GetRecord("docs", "x"); err == nil {
+		t.Errorf("acme should not see globex's records")
+	}
+	if count, _ := globexProd.Count("docs"); count != 4 {
+		t.Errorf("Expected globex to have 4 records, got %d", count)
+	}
+	if _, err := acme.Database("missing"); !errors.Is(err, ErrDatabaseNotFound) {
+		t.Errorf("Should not have been able to get a database that doesn't exist")
+	}
+
+	// the quota covers all of a tenant's databases
+	if err := addDocs(t, acmeTest, "c"); err != nil {
+		t.Fatalf("Could not add record: %v", err)
+	}
+	if err := addDocs(t, acmeTest, "d"); !errors.Is(err, database.ErrQuotaExceeded) {
+		t.Errorf("Expected acme to be over its quota, got %v", err)
+	}
+	if usage := acme.Usage(); usage.Records != 3 {
+		t.Errorf("Expected acme to have 3 records, got %+v", usage)
+	}
+
+	// everything is still there after reopening, in its own files
+	err = registry.Close()
+	if err != nil {
+		t.Fatalf("Could not close registry: %v", err)
+	}
+	if _, err := acme.Database("prod"); err == nil {
+		t.Errorf("Should not be able to use a closed tenant")
+	}
+	for _, file := range []string{"acme/tenant.json", "acme/prod.db", "acme/test.db", "globex/prod.db"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+			t.Errorf("Expected %s to exist: %v", file, err)
+		}
+	}
+	registry, err = OpenRegistry(dir)
+	if err != nil {
+		t.Fatalf("Could not reopen registry: %v", err)
+	}
+	defer registry.Close()
+	if !reflect.DeepEqual(registry.ListTenants(), []string{"acme", "globex"}) {
+		t.Errorf("Expected acme and globex, got %v", registry.ListTenants())
+	}
+	acme, err = registry.Tenant("acme")
+	if err != nil {
+		t.Fatalf("Could not get acme: %v", err)
+	}
+	if acme.Quota() != (database.Quota{MaxRecords: 3}) || acme.Usage().Records != 3 {
+		t.Errorf("Expected acme's quota and usage to survive reopening, got %+v %+v", acme.Quota(), acme.Usage())
+	}
+	if !reflect.DeepEqual(acme.ListDatabases(), []string{"prod", "test"}) {
+		t.Errorf("Expected prod and test, got %v", acme.ListDatabases())
+	}
+
+	// deleting a database makes room
+	err = acme.DeleteDatabase("test")
+	if err != nil {
+		t.Fatalf("Could not delete database: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "acme", "test.db")); !os.IsNotExist(err) {
+		t.Errorf("Expected test.db to be deleted, got %v", err)
+	}
+	acmeProd, _ = acme.Database("prod")
+	if err := addDocs(t, acmeProd, "c"); err != nil {
+		t.Errorf("Expected room for another record, got %v", err)
+	}
+	err = acme.SetQuota(database.Quota{MaxRecords: 10})
+	if err != nil {
+		t.Fatalf("Could not set quota: %v", err)
+	}
+	if err := addDocs(t, acmeProd, "d", "e"); err != nil {
+		t.Errorf("Expected the bigger quota to make room, got %v", err)
+	}
+
+	err = registry.DeleteTenant("globex")
+	if err != nil {
+		t.Fatalf("Could not delete tenant: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "globex")); !os.IsNotExist(err) {
+		t.Errorf("Expected globex's directory to be deleted, got %v", err)
+	}
+	if _, err := registry.Tenant("globex"); !errors.Is(err, ErrTenantNotFound) {
+		t.Errorf("globex should have been deleted")
+	}
+}
+
+func TestMemoryRegistry(t *testing.T) {
+	registry := MakeRegistry()
+	defer registry.Close()
+	tenant, err := registry.CreateTenant("acme", database.Quota{MaxRecords: 1})
+	if err != nil {
+		t.Fatalf("Could not create tenant: %v", err)
+	}
+	db, err := tenant.CreateDatabase("prod")
+	if err != nil {
+		t.Fatalf("Could not create database: %v", err)
+	}
+	if _, err := tenant.CreateDatabase("prod"); !errors.Is(err, ErrDatabaseExists) {
+		t.Errorf("Should not have been able to create prod twice")
+	}
+	if err := addDocs(t, db, "a", "b"); !errors.Is(err, database.ErrQuotaExceeded) {
+		t.Errorf("Expected the second record to go over the quota, got %v", err)
+	}
+}
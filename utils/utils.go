@@ -6,10 +6,14 @@ import (
 	"math"
 )
 
+// ErrDimensionMismatch is returned when vectors of different lengths are
+// compared, usually because they came from different embedders
+var ErrDimensionMismatch = errors.New("Cannot compare vectors of unequal length")
+
 func CosineSimilarity(x, y []float64) (float64, error) {
 	var sum, s1, s2 float64
 	if len(x) != len(y) {
-		return 0.0, errors.New(fmt.Sprintf("Cannot compare vectors of unequal length (len(x) = %d, len(y) = %d)", len(x), len(y)))
+		return 0.0, fmt.Errorf("%w (len(x) = %d, len(y) = %d)", ErrDimensionMismatch, len(x), len(y))
 	}
 	for i := 0; i < len(x); i++ {
 		sum += x[i] * y[i]